@@ -1,65 +1,225 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"waffle-app/internal/auth"
+	"waffle-app/internal/config"
 	"waffle-app/internal/conversations"
 	"waffle-app/internal/storage"
 	"waffle-app/internal/videos"
 )
 
-const (
-	addr      = ":8080"
-	dbPath    = "./waffle.db"
-	videosDir = "./videos"
-)
-
 func main() {
-	// Structured JSON logging
-	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
-		Level: slog.LevelDebug,
-	}))
-	slog.SetDefault(logger)
+	cfg, err := config.Load(os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid configuration:", err)
+		os.Exit(2)
+	}
+
+	// Structured logging
+	slog.SetDefault(cfg.NewLogger(os.Stdout))
 
-	slog.Info("starting waffle server", "addr", addr)
+	if len(cfg.Args) > 0 {
+		var err error
+		switch cfg.Args[0] {
+		case "migrate":
+			err = runMigrate(cfg.DBPath, cfg.Args[1:])
+		case "retention":
+			err = runRetention(cfg, cfg.Args[1:])
+		default:
+			fmt.Fprintf(os.Stderr, "unknown command %q\n", cfg.Args[0])
+			os.Exit(2)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	slog.Info("starting waffle server", "addr", cfg.Addr)
+
+	// Stop on SIGINT or SIGTERM. Everything below shuts down when ctx is
+	// cancelled.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	// Create videos directory
-	if err := os.MkdirAll(videosDir, 0755); err != nil {
+	if err := os.MkdirAll(cfg.VideosDir, 0755); err != nil {
 		slog.Error("failed to create videos directory", "error", err)
 		os.Exit(1)
 	}
 
 	// Initialize database
-	db, err := storage.New(dbPath)
+	db, err := storage.New(cfg.DBPath)
 	if err != nil {
 		slog.Error("failed to initialize database", "error", err)
 		os.Exit(1)
 	}
-	defer db.Close()
+
+	// Load transcoding profiles
+	profiles := videos.DefaultProfiles
+	if _, err := os.Stat(cfg.ProfilesPath); err == nil {
+		profiles, err = videos.LoadProfiles(cfg.ProfilesPath)
+		if err != nil {
+			slog.Error("failed to load transcoding profiles", "error", err, "path", cfg.ProfilesPath)
+			os.Exit(1)
+		}
+		slog.Info("loaded transcoding profiles", "path", cfg.ProfilesPath, "profiles", profiles.Names(), "default", profiles.Default)
+	}
 
 	// Initialize session store
-	sessions := auth.NewStore()
+	sessions := auth.NewDBStore(db, auth.Timeouts{
+		Absolute: cfg.SessionAbsoluteTimeout,
+		Idle:     cfg.SessionIdleTimeout,
+	})
+	var background sync.WaitGroup
+	background.Go(func() { auth.RunSweeper(ctx, sessions, cfg.SessionSweepInterval) })
 
 	// Initialize handlers
+	authHandler := auth.NewHandler(db, sessions)
+	authHandler.RelyingParty = cfg.RelyingParty()
+	authHandler.Mailer = cfg.NewMailer()
+	authHandler.MagicLinkExpiry = cfg.MagicLinkExpiry
 	convHandler := conversations.NewHandler(db, sessions)
-	videoHandler := videos.NewHandler(db, sessions, videosDir)
+	convHandler.Profiles = profiles.Names()
+	convHandler.ConversationQuota = cfg.ConversationQuota
+	convHandler.UserQuota = cfg.UserQuota
+	blobs := cfg.NewBlobStore()
+	videoHandler := videos.NewHandler(db, sessions, cfg.VideosDir, &videos.FFmpeg{})
+	videoHandler.Blobs = blobs
+	videoHandler.SignedURLExpiry = cfg.SignedURLExpiry
+	videoHandler.Profiles = profiles
+	videoHandler.MaxUploadSize = cfg.MaxUploadSize
+	videoHandler.ConversationQuota = cfg.ConversationQuota
+	videoHandler.UserQuota = cfg.UserQuota
+	videoHandler.UploadExpiry = cfg.UploadExpiry
+	videoHandler.Retry = videos.RetryPolicy{MaxAttempts: cfg.RetryMaxAttempts, Backoff: cfg.RetryBackoff}
+	videoHandler.DrainTimeout = cfg.ShutdownTimeout
+	if cfg.EnableHLS {
+		videoHandler.HLS = &videos.FFmpeg{}
+	}
+	// Deleting a conversation removes its videos' files too
+	convHandler.Deleter = videoHandler
+
+	// Start transcoding workers, resuming any jobs interrupted by a restart.
+	// On shutdown they finish or requeue their running jobs.
+	var failed atomic.Bool
+	background.Go(func() {
+		if err := videoHandler.RunWorkers(ctx, cfg.TranscodeWorkers); err != nil {
+			slog.Error("transcoding workers failed", "error", err)
+			failed.Store(true)
+			stop()
+		}
+	})
+
+	// Discard resumable uploads that clients have abandoned
+	background.Go(func() { videoHandler.RunUploadJanitor(ctx, cfg.UploadSweepInterval) })
+
+	// Expire videos past their conversation's retention policy
+	background.Go(func() { videoHandler.RunRetentionJanitor(ctx, cfg.RetentionSweepInterval) })
 
 	// Routes
 	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/auth/register", authHandler.Register)
+	mux.HandleFunc("POST /api/auth/login", authHandler.Login)
+	mux.HandleFunc("GET /api/auth/me", authHandler.Me)
+	mux.HandleFunc("PUT /api/auth/passphrase", authHandler.SetPassphrase)
+	mux.HandleFunc("POST /api/auth/magic", authHandler.RequestMagicLink)
+	mux.HandleFunc("GET /api/auth/magic", authHandler.MagicLink)
+	mux.HandleFunc("POST /api/auth/magic/confirm", authHandler.ConfirmMagicLink)
+	mux.HandleFunc("PUT /api/auth/email", authHandler.SetEmail)
+	mux.HandleFunc("POST /api/auth/passkeys/register/begin", authHandler.BeginPasskeyRegistration)
+	mux.HandleFunc("POST /api/auth/passkeys/register/finish", authHandler.FinishPasskeyRegistration)
+	mux.HandleFunc("POST /api/auth/passkeys/login/begin", authHandler.BeginPasskeyLogin)
+	mux.HandleFunc("POST /api/auth/passkeys/login/finish", authHandler.FinishPasskeyLogin)
+	mux.HandleFunc("POST /api/auth/logout", authHandler.Logout)
+	mux.HandleFunc("POST /api/auth/logout-all", authHandler.LogoutAll)
 	mux.HandleFunc("POST /api/conversations/join", convHandler.Join)
 	mux.HandleFunc("POST /api/conversations", convHandler.Create)
 	mux.HandleFunc("GET /api/conversations", convHandler.List)
+	mux.HandleFunc("PATCH /api/conversations/{id}", convHandler.Update)
+	mux.HandleFunc("DELETE /api/conversations/{id}", convHandler.Delete)
+	mux.HandleFunc("GET /api/conversations/{id}/usage", convHandler.Usage)
+	mux.HandleFunc("GET /api/conversations/{id}/members", convHandler.Members)
+	mux.HandleFunc("PUT /api/conversations/{id}/members/{username}/role", convHandler.SetRole)
+	mux.HandleFunc("DELETE /api/conversations/{id}/members/{username}", convHandler.RemoveMember)
+	mux.HandleFunc("POST /api/conversations/{id}/invites", convHandler.CreateInvite)
+	mux.HandleFunc("GET /api/conversations/{id}/invites", convHandler.ListInvites)
+	mux.HandleFunc("DELETE /api/conversations/{id}/invites/{code}", convHandler.RevokeInvite)
 	mux.HandleFunc("POST /api/upload", videoHandler.Upload)
+	mux.HandleFunc("OPTIONS /api/uploads", videoHandler.UploadOptions)
+	mux.HandleFunc("POST /api/uploads", videoHandler.CreateUpload)
+	mux.HandleFunc("HEAD /api/uploads/{id}", videoHandler.UploadStatus)
+	mux.HandleFunc("PATCH /api/uploads/{id}", videoHandler.UploadChunk)
+	mux.HandleFunc("DELETE /api/uploads/{id}", videoHandler.TerminateUpload)
 	mux.HandleFunc("GET /api/videos", videoHandler.List)
+	mux.HandleFunc("DELETE /api/videos/{id}", videoHandler.Delete)
+	mux.HandleFunc("GET /api/videos/{id}/stream", videoHandler.Stream)
+	mux.HandleFunc("GET /api/videos/{id}/thumbnail", videoHandler.Thumbnail)
+	mux.HandleFunc("GET /api/videos/{id}/hls/{path...}", videoHandler.HLSFile)
+	if local, ok := blobs.(*storage.LocalBlobStore); ok {
+		// Signed URLs for files on disk are served by the store itself
+		mux.Handle("GET "+videos.BlobURLPrefix+"/", local)
+	}
 
 	// Serve static files
 	mux.Handle("/", http.FileServer(http.Dir("web")))
 
-	slog.Info("server listening", "addr", addr)
-	if err := http.ListenAndServe(addr, mux); err != nil {
+	// No read or write timeouts: uploads and video streams may legitimately
+	// take longer than any fixed limit.
+	server := &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           mux,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+	serverErr := make(chan error, 1)
+	go func() {
+		slog.Info("server listening", "addr", cfg.Addr)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case <-ctx.Done():
+		slog.Info("shutting down", "timeout", cfg.ShutdownTimeout)
+	case err := <-serverErr:
 		slog.Error("server error", "error", err)
+		failed.Store(true)
+	}
+	stop()
+
+	// Let in-flight requests, including uploads, finish. Connections still
+	// open at the deadline are closed.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("requests did not finish in time, closing connections", "error", err)
+		server.Close()
+	}
+
+	// Wait for the transcoding workers and sweepers before closing the
+	// database they use.
+	background.Wait()
+	authHandler.WaitForMail()
+	if err := db.Close(); err != nil {
+		slog.Error("failed to close database", "error", err)
+	}
+	slog.Info("server stopped")
+	if failed.Load() {
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"waffle-app/internal/storage"
+)
+
+const migrateUsage = `usage: waffle [flags] migrate <command>
+
+Commands:
+  status     list migrations and whether they are applied
+  up [n]     apply the next n pending migrations, or all of them
+  down [n]   revert the last n applied migrations (default 1)`
+
+// runMigrate implements the migrate subcommand against the database at
+// dbPath.
+func runMigrate(dbPath string, args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return errors.New(migrateUsage)
+	}
+	switch args[0] {
+	case "status":
+		if len(args) > 1 {
+			return errors.New(migrateUsage)
+		}
+	case "up", "down":
+	default:
+		return fmt.Errorf("unknown migrate command %q\n%s", args[0], migrateUsage)
+	}
+	n := 0
+	if args[0] == "down" {
+		n = 1
+	}
+	if len(args) == 2 {
+		var err error
+		n, err = strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid migration count %q\n%s", args[1], migrateUsage)
+		}
+	}
+
+	db, err := storage.Open(dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch args[0] {
+	case "status":
+		status, err := db.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED")
+		for _, m := range status {
+			applied := "pending"
+			if !m.AppliedAt.IsZero() {
+				applied = m.AppliedAt.Local().Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\n", m.Version, m.Name, applied)
+		}
+		return tw.Flush()
+	case "up":
+		applied, err := db.MigrateUp(n)
+		fmt.Printf("applied %d migration(s)\n", applied)
+		return err
+	default: // down
+		reverted, err := db.MigrateDown(n)
+		fmt.Printf("reverted %d migration(s)\n", reverted)
+		return err
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+	"waffle-app/internal/config"
+	"waffle-app/internal/storage"
+	"waffle-app/internal/videos"
+)
+
+const retentionUsage = `usage: waffle [flags] retention <command>
+
+Commands:
+  report   list the videos past their conversation's retention policy
+  apply    delete the videos past their conversation's retention policy`
+
+// runRetention implements the retention subcommand.
+func runRetention(cfg *config.Config, args []string) error {
+	if len(args) != 1 {
+		return errors.New(retentionUsage)
+	}
+	var dryRun bool
+	switch args[0] {
+	case "report":
+		dryRun = true
+	case "apply":
+	default:
+		return fmt.Errorf("unknown retention command %q\n%s", args[0], retentionUsage)
+	}
+
+	db, err := storage.New(cfg.DBPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	h := videos.NewHandler(db, nil, cfg.VideosDir, nil)
+	h.Blobs = cfg.NewBlobStore()
+	expired, err := h.ApplyRetention(time.Now(), dryRun)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "VIDEO\tCONVERSATION\tUPLOADER\tUPLOADED\tBYTES\tREASON")
+	var total int64
+	for _, e := range expired {
+		total += e.Bytes
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n", e.VideoID, e.ConversationID, e.Uploader,
+			e.UploadedAt.Local().Format("2006-01-02 15:04:05"), e.Bytes, e.Reason)
+	}
+	if ferr := tw.Flush(); err == nil {
+		err = ferr
+	}
+	if dryRun {
+		fmt.Printf("%d video(s), %d bytes would be deleted\n", len(expired), total)
+	} else {
+		fmt.Printf("deleted %d video(s), %d bytes\n", len(expired), total)
+	}
+	return err
+}
@@ -0,0 +1,281 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+	"waffle-app/internal/storage"
+)
+
+const maxUsernameLength = 32
+
+// POST /api/auth/register
+// Body: { "username": "alice", "passphrase": "..." }
+// Response: { "id": "...", "username": "alice", "email": "", "has_passphrase": true }
+// Creates an account and signs in to it. Responds 409 if the username is
+// taken. An account carried over from before accounts existed is claimed
+// by the first to register its name instead, as anyone could use it by
+// typing the name before, unless its owner has secured it with an email
+// address or a passkey. Claiming signs out everyone else using it.
+func (h *Handler) Register(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Username   string `json:"username"`
+		Passphrase string `json:"passphrase"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Username == "" || body.Passphrase == "" {
+		http.Error(w, "invalid body: 'username' and 'passphrase' are required", http.StatusBadRequest)
+		return
+	}
+	if err := validUsername(body.Username); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validPassphrase(body.Passphrase); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hash, err := hashPassphrase(body.Passphrase)
+	if err != nil {
+		slog.Error("failed to hash passphrase", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	id, err := generateUserID()
+	if err != nil {
+		slog.Error("failed to generate user id", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	user := &storage.User{ID: id, Username: body.Username, PassphraseHash: hash}
+	err = h.DB.CreateUser(user)
+	if err == nil {
+		slog.Info("user registered", "username", user.Username, "user_id", user.ID)
+		h.signIn(w, user, http.StatusCreated)
+		return
+	}
+	if !errors.Is(err, storage.ErrUsernameTaken) {
+		slog.Error("failed to create user", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	claimed, err := h.DB.ClaimUser(body.Username, hash)
+	if err != nil {
+		slog.Error("failed to claim user", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if claimed == nil {
+		http.Error(w, "username taken", http.StatusConflict)
+		return
+	}
+	if !h.revokeOthers(w, claimed) {
+		return
+	}
+	slog.Info("user claimed by registering", "username", claimed.Username, "user_id", claimed.ID)
+	h.signIn(w, claimed, http.StatusOK)
+}
+
+// POST /api/auth/login
+// Body: { "username": "alice", "passphrase": "..." }
+// Response: { "id": "...", "username": "alice", "email": "", "has_passphrase": true }
+func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Username   string `json:"username"`
+		Passphrase string `json:"passphrase"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Username == "" || body.Passphrase == "" {
+		http.Error(w, "invalid body: 'username' and 'passphrase' are required", http.StatusBadRequest)
+		return
+	}
+	if len(body.Passphrase) > maxPassphraseLength {
+		http.Error(w, "invalid username or passphrase", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := h.DB.GetUserByUsername(body.Username)
+	if err != nil {
+		slog.Error("failed to look up user", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	// Unknown users are checked against a dummy hash, so that response
+	// times don't reveal which usernames exist.
+	hash := dummyPassphraseHash()
+	if user != nil && user.PassphraseHash != "" {
+		hash = user.PassphraseHash
+	}
+	if !checkPassphrase(hash, body.Passphrase) || user == nil || user.PassphraseHash == "" {
+		slog.Warn("failed login", "username", body.Username)
+		http.Error(w, "invalid username or passphrase", http.StatusUnauthorized)
+		return
+	}
+
+	slog.Info("user logged in", "username", user.Username)
+	h.signIn(w, user, http.StatusOK)
+}
+
+// GET /api/auth/me
+// Response: { "id": "...", "username": "alice", "email": "", "has_passphrase": true }
+func (h *Handler) Me(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+	writeUser(w, user, http.StatusOK)
+}
+
+// PUT /api/auth/passphrase
+// Body: { "passphrase": "...", "current_passphrase": "..." }
+// Sets the signed-in user's passphrase. current_passphrase is required to
+// change an existing one, and omitted when claiming an account that has
+// none. Claiming signs out every other session, as anyone could have
+// signed in under the name before.
+func (h *Handler) SetPassphrase(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Passphrase        string `json:"passphrase"`
+		CurrentPassphrase string `json:"current_passphrase"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Passphrase == "" {
+		http.Error(w, "invalid body: 'passphrase' is required", http.StatusBadRequest)
+		return
+	}
+	if err := validPassphrase(body.Passphrase); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if user.PassphraseHash != "" && !checkPassphrase(user.PassphraseHash, body.CurrentPassphrase) {
+		http.Error(w, "current passphrase is incorrect", http.StatusForbidden)
+		return
+	}
+
+	hash, err := hashPassphrase(body.Passphrase)
+	if err != nil {
+		slog.Error("failed to hash passphrase", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if err := h.DB.SetUserPassphrase(user.ID, hash); err != nil {
+		slog.Error("failed to set passphrase", "error", err, "username", user.Username)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	claimed := user.PassphraseHash == ""
+	if claimed {
+		if !h.revokeOthers(w, user) {
+			return
+		}
+		session, err := h.Sessions.Create(user.Username)
+		if err != nil {
+			slog.Error("failed to create session", "error", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		SetCookie(w, session)
+	}
+
+	slog.Info("passphrase set", "username", user.Username, "claimed", claimed)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokeOthers ends every session of a claimed account, writing an error
+// response if that fails. Whoever claimed it is then signed in afresh.
+func (h *Handler) revokeOthers(w http.ResponseWriter, user *storage.User) bool {
+	n, err := h.Sessions.RevokeAll(user.Username)
+	if err != nil {
+		slog.Error("failed to revoke sessions", "error", err, "username", user.Username)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return false
+	}
+	slog.Info("sessions of claimed account revoked", "username", user.Username, "count", n)
+	return true
+}
+
+// requireUser resolves the signed-in user's account, writing the
+// appropriate error response if there is none.
+func (h *Handler) requireUser(w http.ResponseWriter, r *http.Request) (*storage.User, bool) {
+	session, ok := RequireSession(w, r, h.Sessions)
+	if !ok {
+		return nil, false
+	}
+	user, err := h.DB.GetUserByUsername(session.Username)
+	if err != nil {
+		slog.Error("failed to look up user", "error", err, "username", session.Username)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return nil, false
+	}
+	if user == nil {
+		http.Error(w, "account not found", http.StatusNotFound)
+		return nil, false
+	}
+	return user, true
+}
+
+// signIn starts a session for the user and responds with their account.
+func (h *Handler) signIn(w http.ResponseWriter, user *storage.User, status int) {
+	session, err := h.Sessions.Create(user.Username)
+	if err != nil {
+		slog.Error("failed to create session", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	SetCookie(w, session)
+	writeUser(w, user, status)
+}
+
+func writeUser(w http.ResponseWriter, user *storage.User, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"id":             user.ID,
+		"username":       user.Username,
+		"email":          user.Email,
+		"has_passphrase": user.PassphraseHash != "",
+	})
+}
+
+// validUsername allows names people would type for themselves: up to
+// maxUsernameLength letters, digits, spaces and punctuation, without
+// surrounding spaces.
+func validUsername(username string) error {
+	if strings.TrimSpace(username) != username {
+		return errors.New("username must not start or end with a space")
+	}
+	if utf8.RuneCountInString(username) > maxUsernameLength {
+		return fmt.Errorf("username must be at most %d characters", maxUsernameLength)
+	}
+	for _, r := range username {
+		if !unicode.IsPrint(r) {
+			return errors.New("username must not contain control characters")
+		}
+	}
+	return nil
+}
+
+var dummyPassphraseHash = sync.OnceValue(func() string {
+	hash, _ := hashPassphrase("not anyone's passphrase")
+	return hash
+})
+
+func generateUserID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate user id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,212 @@
+package auth_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"waffle-app/internal/auth"
+	"waffle-app/internal/storage"
+)
+
+func newAccountsHandler(t *testing.T) (*auth.Handler, *storage.DB) {
+	t.Helper()
+	db := newTestDB(t, tempDBPath(t))
+	t.Cleanup(func() { db.Close() })
+	return auth.NewHandler(db, auth.NewStore(auth.DefaultTimeouts)), db
+}
+
+// call calls handler with a JSON body, signed in as the session with the
+// given token if it isn't empty.
+func call(handler http.HandlerFunc, method, path, token, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.AddCookie(&http.Cookie{Name: "waffle_session", Value: token})
+	}
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+	return rr
+}
+
+// sessionCookie returns the session cookie the response sets last, which
+// is the one a browser would keep.
+func sessionCookie(t *testing.T, rr *httptest.ResponseRecorder) string {
+	t.Helper()
+	token := ""
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == "waffle_session" && c.Value != "" {
+			token = c.Value
+		}
+	}
+	if token == "" {
+		t.Fatal("expected a session cookie")
+	}
+	return token
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	h, db := newAccountsHandler(t)
+
+	rr := call(h.Register, "POST", "/api/auth/register", "", `{"username":"alice","passphrase":"correct horse"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("register: expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var registered struct {
+		ID       string `json:"id"`
+		Username string `json:"username"`
+	}
+	json.NewDecoder(rr.Body).Decode(&registered)
+	if registered.ID == "" || registered.Username != "alice" {
+		t.Errorf("unexpected response %+v", registered)
+	}
+	if session, ok := h.Sessions.Get(sessionCookie(t, rr)); !ok || session.Username != "alice" {
+		t.Errorf("expected to be signed in as alice, got %+v", session)
+	}
+	user, err := db.GetUserByUsername("alice")
+	if err != nil || user == nil || user.ID != registered.ID {
+		t.Fatalf("GetUserByUsername: %+v, %v", user, err)
+	}
+	if strings.Contains(user.PassphraseHash, "correct horse") {
+		t.Error("expected the passphrase to be hashed")
+	}
+
+	rr = call(h.Register, "POST", "/api/auth/register", "", `{"username":"alice","passphrase":"another one"}`)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("duplicate register: expected 409, got %d", rr.Code)
+	}
+
+	rr = call(h.Login, "POST", "/api/auth/login", "", `{"username":"alice","passphrase":"wrong horse"}`)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("wrong passphrase: expected 401, got %d", rr.Code)
+	}
+	rr = call(h.Login, "POST", "/api/auth/login", "", `{"username":"nobody","passphrase":"correct horse"}`)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("unknown user: expected 401, got %d", rr.Code)
+	}
+
+	rr = call(h.Login, "POST", "/api/auth/login", "", `{"username":"alice","passphrase":"correct horse"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("login: expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	token := sessionCookie(t, rr)
+
+	rr = call(h.Me, "GET", "/api/auth/me", token, "")
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"id":"`+registered.ID+`"`) {
+		t.Errorf("me: got %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestRegister_Validation(t *testing.T) {
+	h, _ := newAccountsHandler(t)
+
+	for _, body := range []string{
+		`{"username":"alice"}`,
+		`{"username":"alice","passphrase":"short"}`,
+		`{"username":" alice","passphrase":"correct horse"}`,
+		`{"username":"a\nb","passphrase":"correct horse"}`,
+		`{"username":"` + strings.Repeat("a", 33) + `","passphrase":"correct horse"}`,
+	} {
+		if rr := call(h.Register, "POST", "/api/auth/register", "", body); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, rr.Code)
+		}
+	}
+}
+
+func TestSetPassphrase_ClaimsAccount(t *testing.T) {
+	h, db := newAccountsHandler(t)
+
+	// An account carried over from before accounts existed, whose owner is
+	// still signed in on some device
+	if err := db.CreateUser(&storage.User{ID: "id-alice", Username: "alice"}); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	session, _ := h.Sessions.Create("alice")
+	other, _ := h.Sessions.Create("alice")
+
+	rr := call(h.Login, "POST", "/api/auth/login", "", `{"username":"alice","passphrase":"correct horse"}`)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("unclaimed login: expected 401, got %d", rr.Code)
+	}
+	rr = call(h.Me, "GET", "/api/auth/me", session.Token, "")
+	if !strings.Contains(rr.Body.String(), `"has_passphrase":false`) {
+		t.Errorf("me: expected no passphrase, got %s", rr.Body.String())
+	}
+
+	rr = call(h.SetPassphrase, "PUT", "/api/auth/passphrase", "", `{"passphrase":"correct horse"}`)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("signed out: expected 401, got %d", rr.Code)
+	}
+	rr = call(h.SetPassphrase, "PUT", "/api/auth/passphrase", session.Token, `{"passphrase":"correct horse"}`)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("claim: expected 204, got %d: %s", rr.Code, rr.Body.String())
+	}
+	// Anyone else who signed in under the name is signed out, and the
+	// claimer gets a new session
+	for _, token := range []string{session.Token, other.Token} {
+		if _, ok := h.Sessions.Get(token); ok {
+			t.Errorf("expected session %s to be revoked", token)
+		}
+	}
+	token := sessionCookie(t, rr)
+
+	rr = call(h.Login, "POST", "/api/auth/login", "", `{"username":"alice","passphrase":"correct horse"}`)
+	if rr.Code != http.StatusOK {
+		t.Errorf("login after claiming: expected 200, got %d", rr.Code)
+	}
+
+	// Changing it now requires the current passphrase
+	rr = call(h.SetPassphrase, "PUT", "/api/auth/passphrase", token, `{"passphrase":"battery staple"}`)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("change without current: expected 403, got %d", rr.Code)
+	}
+	rr = call(h.SetPassphrase, "PUT", "/api/auth/passphrase", token,
+		`{"passphrase":"battery staple","current_passphrase":"correct horse"}`)
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("change: expected 204, got %d", rr.Code)
+	}
+	rr = call(h.Login, "POST", "/api/auth/login", "", `{"username":"alice","passphrase":"battery staple"}`)
+	if rr.Code != http.StatusOK {
+		t.Errorf("login with new passphrase: expected 200, got %d", rr.Code)
+	}
+}
+
+func TestRegister_ClaimsAccount(t *testing.T) {
+	h, db := newAccountsHandler(t)
+	for _, username := range []string{"alice", "bob"} {
+		if err := db.CreateUser(&storage.User{ID: "id-" + username, Username: username}); err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+	}
+	stale, _ := h.Sessions.Create("alice")
+
+	rr := call(h.Register, "POST", "/api/auth/register", "", `{"username":"alice","passphrase":"correct horse"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("claim: expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if !strings.Contains(rr.Body.String(), `"id":"id-alice"`) {
+		t.Errorf("expected the existing account, got %s", rr.Body.String())
+	}
+	if session, ok := h.Sessions.Get(sessionCookie(t, rr)); !ok || session.Username != "alice" {
+		t.Errorf("expected to be signed in as alice, got %+v", session)
+	}
+	if _, ok := h.Sessions.Get(stale.Token); ok {
+		t.Error("expected the old session to be revoked")
+	}
+	rr = call(h.Register, "POST", "/api/auth/register", "", `{"username":"alice","passphrase":"another one"}`)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("claimed account: expected 409, got %d", rr.Code)
+	}
+
+	// An account secured with an email address is left to its owner
+	if err := db.SetUserEmail("id-bob", "bob@example.com"); err != nil {
+		t.Fatalf("SetUserEmail: %v", err)
+	}
+	rr = call(h.Register, "POST", "/api/auth/register", "", `{"username":"bob","passphrase":"correct horse"}`)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("secured account: expected 409, got %d", rr.Code)
+	}
+	if user, _ := db.GetUser("id-bob"); user.PassphraseHash != "" {
+		t.Error("expected bob's account to stay unclaimed")
+	}
+}
@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+)
+
+// maxCBORDepth bounds how deeply arrays and maps may nest, so that a
+// malicious attestation can't exhaust the stack.
+const maxCBORDepth = 8
+
+var errCBORTruncated = errors.New("cbor: unexpected end of data")
+
+// decodeCBOR decodes the first CBOR data item in data, returning it and the
+// bytes after it. It supports the subset WebAuthn uses: definite-length
+// integers, byte and text strings, arrays, maps and the simple values
+// false, true and null. Integers decode as int64, arrays as []any and maps
+// as map[any]any keyed by int64 or string.
+func decodeCBOR(data []byte) (any, []byte, error) {
+	return decodeCBORItem(data, 0)
+}
+
+func decodeCBORItem(data []byte, depth int) (any, []byte, error) {
+	if depth > maxCBORDepth {
+		return nil, nil, errors.New("cbor: nested too deeply")
+	}
+	if len(data) == 0 {
+		return nil, nil, errCBORTruncated
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22:
+			return nil, data, nil
+		}
+		return nil, nil, fmt.Errorf("cbor: unsupported simple value %d", info)
+	}
+
+	var n uint64
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(data) < size {
+			return nil, nil, errCBORTruncated
+		}
+		for _, b := range data[:size] {
+			n = n<<8 | uint64(b)
+		}
+		data = data[size:]
+	default:
+		return nil, nil, fmt.Errorf("cbor: unsupported additional information %d", info)
+	}
+
+	switch major {
+	case 0, 1:
+		if n > 1<<63-1 {
+			return nil, nil, errors.New("cbor: integer overflows int64")
+		}
+		if major == 1 {
+			return -1 - int64(n), data, nil
+		}
+		return int64(n), data, nil
+	case 2, 3:
+		if n > uint64(len(data)) {
+			return nil, nil, errCBORTruncated
+		}
+		if major == 3 {
+			return string(data[:n]), data[n:], nil
+		}
+		return data[:n:n], data[n:], nil
+	case 4:
+		// Each item takes at least a byte, which bounds the allocation
+		if n > uint64(len(data)) {
+			return nil, nil, errCBORTruncated
+		}
+		items := make([]any, 0, n)
+		for range n {
+			item, rest, err := decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+			data = rest
+		}
+		return items, data, nil
+	case 5:
+		if n > uint64(len(data)) {
+			return nil, nil, errCBORTruncated
+		}
+		m := make(map[any]any, n)
+		for range n {
+			key, rest, err := decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("cbor: unsupported map key %T", key)
+			}
+			value, rest, err := decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[key] = value
+			data = rest
+		}
+		return m, data, nil
+	}
+	return nil, nil, fmt.Errorf("cbor: unsupported major type %d", major)
+}
@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"time"
+	"waffle-app/internal/storage"
+)
+
+// renewInterval limits how often Get writes the last-seen time back to the
+// database, so that every request does not turn into a write.
+const renewInterval = time.Minute
+
+// DBStore is a session store persisted in SQLite, so sessions survive
+// server restarts. Only a SHA-256 hash of each token is stored.
+type DBStore struct {
+	DB       *storage.DB
+	Timeouts Timeouts
+}
+
+var _ SessionStore = (*DBStore)(nil)
+
+func NewDBStore(db *storage.DB, timeouts Timeouts) *DBStore {
+	return &DBStore{DB: db, Timeouts: timeouts}
+}
+
+// Create generates a new session token and persists its hash.
+func (s *DBStore) Create(username string) (*Session, error) {
+	token, err := generateToken()
+	if err != nil {
+		return nil, fmt.Errorf("generate session token: %w", err)
+	}
+	now := time.Now()
+	if err := s.DB.CreateSession(hashToken(token), username, now); err != nil {
+		return nil, err
+	}
+	slog.Info("session created", "username", username)
+	return &Session{Token: token, Username: username, ExpiresAt: s.Timeouts.expiresAt(now, now)}, nil
+}
+
+// Get retrieves the session associated with the token and renews it.
+func (s *DBStore) Get(token string) (*Session, bool) {
+	hash := hashToken(token)
+	stored, err := s.DB.GetSession(hash)
+	if err != nil {
+		slog.Error("failed to look up session", "error", err)
+		return nil, false
+	}
+	if stored == nil {
+		return nil, false
+	}
+
+	now := time.Now()
+	if s.Timeouts.expired(stored.CreatedAt, stored.LastSeenAt, now) {
+		if err := s.DB.DeleteSession(hash); err != nil {
+			slog.Error("failed to delete expired session", "error", err)
+		}
+		return nil, false
+	}
+
+	lastSeen := stored.LastSeenAt
+	if now.Sub(lastSeen) >= renewInterval {
+		if err := s.DB.TouchSession(hash, now); err != nil {
+			slog.Error("failed to renew session", "error", err)
+		} else {
+			lastSeen = now
+		}
+	}
+	return &Session{Token: token, Username: stored.Username, ExpiresAt: s.Timeouts.expiresAt(stored.CreatedAt, lastSeen)}, true
+}
+
+// Revoke deletes the session for the token.
+func (s *DBStore) Revoke(token string) error {
+	return s.DB.DeleteSession(hashToken(token))
+}
+
+// RevokeAll deletes every session belonging to the user.
+func (s *DBStore) RevokeAll(username string) (int, error) {
+	n, err := s.DB.DeleteSessionsByUsername(username)
+	return int(n), err
+}
+
+// DeleteExpired deletes sessions past their absolute or idle timeout.
+func (s *DBStore) DeleteExpired() (int, error) {
+	now := time.Now()
+	var createdBefore, lastSeenBefore time.Time
+	if s.Timeouts.Absolute > 0 {
+		createdBefore = now.Add(-s.Timeouts.Absolute)
+	}
+	if s.Timeouts.Idle > 0 {
+		lastSeenBefore = now.Add(-s.Timeouts.Idle)
+	}
+	n, err := s.DB.DeleteExpiredSessions(createdBefore, lastSeenBefore)
+	return int(n), err
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
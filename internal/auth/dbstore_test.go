@@ -0,0 +1,148 @@
+package auth_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+	"waffle-app/internal/auth"
+	"waffle-app/internal/storage"
+)
+
+func newTestDB(t *testing.T, path string) *storage.DB {
+	t.Helper()
+	db, err := storage.New(path)
+	if err != nil {
+		t.Fatalf("open test db: %v", err)
+	}
+	return db
+}
+
+func tempDBPath(t *testing.T) string {
+	t.Helper()
+	// A directory rather than a file, so that the WAL files are removed too
+	return filepath.Join(t.TempDir(), "waffle.db")
+}
+
+func TestDBStore_CreateAndGet(t *testing.T) {
+	db := newTestDB(t, tempDBPath(t))
+	defer db.Close()
+	store := auth.NewDBStore(db, auth.DefaultTimeouts)
+
+	created, err := store.Create("alice")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	session, ok := store.Get(created.Token)
+	if !ok {
+		t.Fatal("expected session to exist")
+	}
+	if session.Username != "alice" {
+		t.Errorf("expected username 'alice', got %q", session.Username)
+	}
+
+	if _, ok := store.Get("invalid-token"); ok {
+		t.Error("expected no session for invalid token")
+	}
+}
+
+func TestDBStore_SurvivesReopen(t *testing.T) {
+	path := tempDBPath(t)
+
+	db := newTestDB(t, path)
+	created, err := auth.NewDBStore(db, auth.DefaultTimeouts).Create("alice")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	db.Close()
+
+	db = newTestDB(t, path)
+	defer db.Close()
+
+	session, ok := auth.NewDBStore(db, auth.DefaultTimeouts).Get(created.Token)
+	if !ok {
+		t.Fatal("expected session to survive reopening the database")
+	}
+	if session.Username != "alice" {
+		t.Errorf("expected username 'alice', got %q", session.Username)
+	}
+}
+
+func TestDBStore_StoresHashedTokens(t *testing.T) {
+	db := newTestDB(t, tempDBPath(t))
+	defer db.Close()
+
+	created, err := auth.NewDBStore(db, auth.DefaultTimeouts).Create("alice")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	stored, err := db.GetSession(created.Token)
+	if err != nil {
+		t.Fatalf("GetSession: %v", err)
+	}
+	if stored != nil {
+		t.Error("raw token should not be stored in the database")
+	}
+}
+
+func TestDBStore_ExpiryAndRevocation(t *testing.T) {
+	db := newTestDB(t, tempDBPath(t))
+	defer db.Close()
+	store := auth.NewDBStore(db, auth.Timeouts{Absolute: 50 * time.Millisecond})
+
+	expiring, err := store.Create("alice")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := store.Get(expiring.Token); ok {
+		t.Error("expected session past its absolute timeout to be rejected")
+	}
+
+	store.Timeouts = auth.DefaultTimeouts
+	phone, _ := store.Create("alice")
+	laptop, _ := store.Create("alice")
+
+	if err := store.Revoke(phone.Token); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+	if _, ok := store.Get(phone.Token); ok {
+		t.Error("expected revoked session to be rejected")
+	}
+
+	n, err := store.RevokeAll("alice")
+	if err != nil {
+		t.Fatalf("RevokeAll: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 remaining session revoked, got %d", n)
+	}
+	if _, ok := store.Get(laptop.Token); ok {
+		t.Error("expected all sessions to be revoked")
+	}
+}
+
+func TestDBStore_DeleteExpired(t *testing.T) {
+	db := newTestDB(t, tempDBPath(t))
+	defer db.Close()
+	store := auth.NewDBStore(db, auth.Timeouts{Idle: 30 * time.Millisecond})
+
+	stale, _ := store.Create("alice")
+	time.Sleep(40 * time.Millisecond)
+	fresh, _ := store.Create("bob")
+
+	n, err := store.DeleteExpired()
+	if err != nil {
+		t.Fatalf("DeleteExpired: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 expired session deleted, got %d", n)
+	}
+	if _, ok := store.Get(stale.Token); ok {
+		t.Error("stale session should be gone")
+	}
+	if _, ok := store.Get(fresh.Token); !ok {
+		t.Error("fresh session should remain")
+	}
+}
@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+	"waffle-app/internal/email"
+	"waffle-app/internal/storage"
+)
+
+type Handler struct {
+	DB       *storage.DB
+	Sessions SessionStore
+	// RelyingParty is the site passkeys are registered with. Emailed
+	// sign-in links point at its origin.
+	RelyingParty RelyingParty
+	// Mailer sends sign-in links, which expire after MagicLinkExpiry.
+	// Signing in by email is unavailable if it is nil.
+	Mailer          email.Mailer
+	MagicLinkExpiry time.Duration
+
+	ceremonies *ceremonies
+	mail       sync.WaitGroup // sign-in links being sent
+}
+
+func NewHandler(db *storage.DB, sessions SessionStore) *Handler {
+	return &Handler{
+		DB:              db,
+		Sessions:        sessions,
+		RelyingParty:    DefaultRelyingParty,
+		MagicLinkExpiry: DefaultMagicLinkExpiry,
+		ceremonies:      newCeremonies(),
+	}
+}
+
+// POST /api/auth/logout
+// Revokes the current session and clears the cookie.
+func (h *Handler) Logout(w http.ResponseWriter, r *http.Request) {
+	if token, ok := FromRequest(r); ok {
+		if err := h.Sessions.Revoke(token); err != nil {
+			slog.Error("failed to revoke session", "error", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+	}
+	ClearCookie(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /api/auth/logout-all
+// Revokes every session belonging to the current user, on all devices.
+// Response: { "revoked": 3 }
+func (h *Handler) LogoutAll(w http.ResponseWriter, r *http.Request) {
+	session, ok := RequireSession(w, r, h.Sessions)
+	if !ok {
+		return
+	}
+
+	n, err := h.Sessions.RevokeAll(session.Username)
+	if err != nil {
+		slog.Error("failed to revoke sessions", "error", err, "username", session.Username)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("all sessions revoked", "username", session.Username, "count", n)
+	ClearCookie(w)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"revoked": n})
+}
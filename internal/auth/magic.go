@@ -0,0 +1,283 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+	"waffle-app/internal/email"
+	"waffle-app/internal/storage"
+)
+
+// DefaultMagicLinkExpiry is how long an emailed sign-in link works.
+const DefaultMagicLinkExpiry = 15 * time.Minute
+
+// POST /api/auth/magic
+// Body: { "email": "alice@example.com" }
+// Emails a sign-in link to the account with this confirmed address, if
+// there is one. Responds 202 either way, so that the response doesn't
+// reveal which addresses have accounts.
+func (h *Handler) RequestMagicLink(w http.ResponseWriter, r *http.Request) {
+	if h.Mailer == nil {
+		http.Error(w, "email sign-in is not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	address, ok := decodeEmail(w, r)
+	if !ok {
+		return
+	}
+
+	// Looking up the account and sending the email both happen after
+	// responding, so that how long the response takes doesn't reveal
+	// whether the address has an account either.
+	ctx := context.WithoutCancel(r.Context())
+	h.mail.Go(func() { h.sendMagicLink(ctx, address) })
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// sendMagicLink emails a sign-in link to the account with the address, if
+// there is one. Failures are only logged, as nobody is waiting to hear.
+func (h *Handler) sendMagicLink(ctx context.Context, address string) {
+	user, err := h.DB.GetUserByEmail(address)
+	if err != nil {
+		slog.Error("failed to look up user by email", "error", err)
+		return
+	}
+	if user == nil {
+		slog.Debug("sign-in link requested for unknown email")
+		return
+	}
+	if err := h.sendLink(ctx, user, address, false); err != nil {
+		slog.Error("failed to send sign-in link", "error", err, "username", user.Username)
+		return
+	}
+	slog.Info("sign-in link sent", "username", user.Username)
+}
+
+// WaitForMail waits for sign-in links that are still being sent, so that
+// the database can be closed after them.
+func (h *Handler) WaitForMail() {
+	h.mail.Wait()
+}
+
+// PUT /api/auth/email
+// Body: { "email": "alice@example.com" }
+// Emails a link confirming the address to the signed-in user. Following it
+// sets the address on the account, and signs in. Responds 202.
+func (h *Handler) SetEmail(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+	if h.Mailer == nil {
+		http.Error(w, "email sign-in is not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	address, ok := decodeEmail(w, r)
+	if !ok {
+		return
+	}
+	owner, err := h.DB.GetUserByEmail(address)
+	if err != nil {
+		slog.Error("failed to look up user by email", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if owner != nil && owner.ID != user.ID {
+		http.Error(w, "email taken", http.StatusConflict)
+		return
+	}
+
+	if err := h.sendLink(r.Context(), user, address, true); err != nil {
+		slog.Error("failed to send confirmation link", "error", err, "username", user.Username)
+		http.Error(w, "failed to send email", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("email confirmation sent", "username", user.Username)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// magicLinkPage asks the user to confirm signing in. Link scanners and
+// previews in mail clients fetch links before the user follows them, so the
+// link itself must not use up the token.
+var magicLinkPage = template.Must(template.New("magic").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Sign in to {{.Site}}</title>
+</head>
+<body>
+<form method="post" action="/api/auth/magic/confirm">
+<input type="hidden" name="token" value="{{.Token}}">
+<input type="hidden" name="nonce" value="{{.Nonce}}">
+<button type="submit">Sign in to {{.Site}}</button>
+</form>
+</body>
+</html>
+`))
+
+// magicNonceCookieName holds a nonce that the sign-in page's form must
+// repeat. Other sites can't read or send it, so they can't confirm a link
+// of their own to sign someone into the wrong account.
+const magicNonceCookieName = "waffle_magic_nonce"
+
+// GET /api/auth/magic?token=...
+// The link in the email. Serves a page whose button confirms signing in,
+// without using up the link.
+func (h *Handler) MagicLink(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "missing token", http.StatusBadRequest)
+		return
+	}
+	nonce, err := generateToken()
+	if err != nil {
+		slog.Error("failed to generate nonce", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     magicNonceCookieName,
+		Value:    nonce,
+		Path:     "/api/auth/magic",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	// The page holds the token, so keep it out of caches and referrers
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	err = magicLinkPage.Execute(w, struct{ Site, Token, Nonce string }{h.RelyingParty.Name, token, nonce})
+	if err != nil {
+		slog.Error("failed to render sign-in page", "error", err)
+	}
+}
+
+// POST /api/auth/magic/confirm
+// Form: token=...&nonce=...
+// Signs in with an emailed link and redirects to the app. Each link works
+// once. Only the page served for the link can confirm it: the nonce must
+// match the cookie set with the page.
+func (h *Handler) ConfirmMagicLink(w http.ResponseWriter, r *http.Request) {
+	token := r.PostFormValue("token")
+	if token == "" {
+		http.Error(w, "missing token", http.StatusBadRequest)
+		return
+	}
+	cookie, err := r.Cookie(magicNonceCookieName)
+	nonce := r.PostFormValue("nonce")
+	if err != nil || nonce == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(nonce)) != 1 {
+		http.Error(w, "open the link from your email to sign in", http.StatusForbidden)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: magicNonceCookieName, Path: "/api/auth/magic", MaxAge: -1})
+
+	login, err := h.DB.ConsumeLoginToken(hashToken(token), time.Now())
+	if err != nil {
+		slog.Error("failed to consume login token", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if login == nil {
+		http.Error(w, "invalid or expired link", http.StatusUnauthorized)
+		return
+	}
+	user, err := h.DB.GetUser(login.UserID)
+	if err != nil || user == nil {
+		slog.Error("failed to look up link owner", "error", err, "user_id", login.UserID)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	if login.Email != "" {
+		if err := h.DB.SetUserEmail(user.ID, login.Email); err != nil {
+			if errors.Is(err, storage.ErrEmailTaken) {
+				http.Error(w, "email taken", http.StatusConflict)
+				return
+			}
+			slog.Error("failed to set email", "error", err, "username", user.Username)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("email confirmed", "username", user.Username)
+	}
+
+	session, err := h.Sessions.Create(user.Username)
+	if err != nil {
+		slog.Error("failed to create session", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	SetCookie(w, session)
+	slog.Info("user logged in with emailed link", "username", user.Username)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// sendLink emails the user a single-use sign-in link. If confirm is set,
+// following the link also sets the address on their account.
+func (h *Handler) sendLink(ctx context.Context, user *storage.User, address string, confirm bool) error {
+	token, err := generateToken()
+	if err != nil {
+		return fmt.Errorf("generate token: %w", err)
+	}
+	login := &storage.LoginToken{UserID: user.ID, ExpiresAt: time.Now().Add(h.MagicLinkExpiry)}
+	if confirm {
+		login.Email = address
+	}
+	if err := h.DB.CreateLoginToken(hashToken(token), login); err != nil {
+		return err
+	}
+
+	site := h.RelyingParty.Name
+	link := h.RelyingParty.Origin + "/api/auth/magic?token=" + token
+	msg := email.Message{
+		To:      address,
+		Subject: "Sign in to " + site,
+		Body: fmt.Sprintf("Hi %s,\n\nFollow this link to sign in to %s:\n\n%s\n\n"+
+			"It works once, within %s. If you didn't ask to sign in, you can ignore this email.\n",
+			user.Username, site, link, formatExpiry(h.MagicLinkExpiry)),
+	}
+	if confirm {
+		msg.Subject = "Confirm your email for " + site
+		msg.Body = fmt.Sprintf("Hi %s,\n\nFollow this link to use this address to sign in to %s:\n\n%s\n\n"+
+			"It works once, within %s. If you didn't ask for this, you can ignore this email.\n",
+			user.Username, site, link, formatExpiry(h.MagicLinkExpiry))
+	}
+	return h.Mailer.Send(ctx, msg)
+}
+
+// decodeEmail reads the address from a request body, normalized to lower
+// case, writing a 400 response if it is invalid.
+func decodeEmail(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var body struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Email == "" {
+		http.Error(w, "invalid body: 'email' is required", http.StatusBadRequest)
+		return "", false
+	}
+	address := strings.ToLower(strings.TrimSpace(body.Email))
+	if !email.ValidAddress(address) {
+		http.Error(w, "invalid email address", http.StatusBadRequest)
+		return "", false
+	}
+	return address, true
+}
+
+// formatExpiry describes a link's lifetime for people, e.g. "15 minutes".
+func formatExpiry(d time.Duration) string {
+	if d >= time.Hour && d%time.Hour == 0 {
+		return fmt.Sprintf("%d hours", d/time.Hour)
+	}
+	return fmt.Sprintf("%d minutes", max(d/time.Minute, 1))
+}
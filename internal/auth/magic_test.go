@@ -0,0 +1,299 @@
+package auth_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime/quotedprintable"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+	"waffle-app/internal/auth"
+	"waffle-app/internal/email"
+)
+
+// withMailer makes the handler write emails to a directory, returned.
+func withMailer(t *testing.T, h *auth.Handler) string {
+	t.Helper()
+	dir := t.TempDir()
+	h.Mailer = &email.FileMailer{Dir: dir, From: "waffle@localhost"}
+	return dir
+}
+
+var linkPattern = regexp.MustCompile(`/api/auth/magic\?token=[0-9a-f]+`)
+
+// lastLink returns the path of the sign-in link in the newest email.
+func lastLink(t *testing.T, dir string) string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) == 0 {
+		t.Fatalf("expected an email, got %v, %v", entries, err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, entries[len(entries)-1].Name()))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	_, encoded, _ := strings.Cut(string(data), "\r\n\r\n")
+	body, err := io.ReadAll(quotedprintable.NewReader(strings.NewReader(encoded)))
+	if err != nil {
+		t.Fatalf("decode email: %v", err)
+	}
+	link := linkPattern.FindString(string(body))
+	if link == "" {
+		t.Fatalf("no sign-in link in %s", data)
+	}
+	return link
+}
+
+// follow opens a sign-in link and confirms it from the page it serves.
+func follow(t *testing.T, h *auth.Handler, link string) *httptest.ResponseRecorder {
+	t.Helper()
+	rr := call(h.MagicLink, "GET", link, "", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("open link: expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	token := strings.TrimPrefix(linkPattern.FindString(link), "/api/auth/magic?token=")
+	if !strings.Contains(rr.Body.String(), `value="`+token+`"`) {
+		t.Fatalf("expected the page to hold the token, got %s", rr.Body.String())
+	}
+	var nonce *http.Cookie
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == "waffle_magic_nonce" {
+			nonce = c
+		}
+	}
+	if nonce == nil || !strings.Contains(rr.Body.String(), `value="`+nonce.Value+`"`) {
+		t.Fatalf("expected the page to set a nonce cookie and hold it, got %v", rr.Result().Cookies())
+	}
+
+	return confirm(h, url.Values{"token": {token}, "nonce": {nonce.Value}}, nonce)
+}
+
+// confirm posts the sign-in page's form, with the nonce cookie if it isn't
+// nil.
+func confirm(h *auth.Handler, form url.Values, nonce *http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/api/auth/magic/confirm", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if nonce != nil {
+		req.AddCookie(&http.Cookie{Name: nonce.Name, Value: nonce.Value})
+	}
+	rr := httptest.NewRecorder()
+	h.ConfirmMagicLink(rr, req)
+	return rr
+}
+
+func TestMagicLink_ConfirmEmailAndSignIn(t *testing.T) {
+	h, db := newAccountsHandler(t)
+	dir := withMailer(t, h)
+	token := signedIn(t, h, db, "alice")
+
+	rr := call(h.SetEmail, "PUT", "/api/auth/email", token, `{"email":"Alice@Example.com"}`)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("set email: expected 202, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if user, _ := db.GetUser("id-alice"); user.Email != "" {
+		t.Errorf("expected the address to wait for confirmation, got %q", user.Email)
+	}
+	link := lastLink(t, dir)
+	rr = follow(t, h, link)
+	if rr.Code != http.StatusSeeOther {
+		t.Fatalf("confirm: expected 303, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if user, _ := db.GetUser("id-alice"); user.Email != "alice@example.com" {
+		t.Errorf("expected the address to be confirmed, got %q", user.Email)
+	}
+
+	// Later, on a device that isn't signed in
+	rr = call(h.RequestMagicLink, "POST", "/api/auth/magic", "", `{"email":"alice@example.com"}`)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("request link: expected 202, got %d", rr.Code)
+	}
+	h.WaitForMail()
+	link = lastLink(t, dir)
+	rr = follow(t, h, link)
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/" {
+		t.Fatalf("sign in: expected a redirect to the app, got %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+	if session, ok := h.Sessions.Get(sessionCookie(t, rr)); !ok || session.Username != "alice" {
+		t.Errorf("expected to be signed in as alice, got %+v", session)
+	}
+
+	rr = follow(t, h, link)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("reused link: expected 401, got %d", rr.Code)
+	}
+}
+
+func TestMagicLink_UnknownEmail(t *testing.T) {
+	h, _ := newAccountsHandler(t)
+	dir := withMailer(t, h)
+
+	rr := call(h.RequestMagicLink, "POST", "/api/auth/magic", "", `{"email":"nobody@example.com"}`)
+	if rr.Code != http.StatusAccepted {
+		t.Errorf("expected 202, got %d", rr.Code)
+	}
+	h.WaitForMail()
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("expected no email to be sent, got %v", entries)
+	}
+
+	rr = call(h.RequestMagicLink, "POST", "/api/auth/magic", "", `{"email":"Nobody <nobody@example.com>"}`)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid address: expected 400, got %d", rr.Code)
+	}
+}
+
+func TestMagicLink_Expired(t *testing.T) {
+	h, db := newAccountsHandler(t)
+	dir := withMailer(t, h)
+	h.MagicLinkExpiry = -time.Minute
+
+	rr := call(h.SetEmail, "PUT", "/api/auth/email", signedIn(t, h, db, "alice"), `{"email":"alice@example.com"}`)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("set email: expected 202, got %d", rr.Code)
+	}
+	link := lastLink(t, dir)
+	if rr := follow(t, h, link); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", rr.Code)
+	}
+}
+
+func TestSetEmail_Taken(t *testing.T) {
+	h, db := newAccountsHandler(t)
+	withMailer(t, h)
+	signedIn(t, h, db, "alice")
+	if err := db.SetUserEmail("id-alice", "alice@example.com"); err != nil {
+		t.Fatalf("SetUserEmail: %v", err)
+	}
+
+	rr := call(h.SetEmail, "PUT", "/api/auth/email", signedIn(t, h, db, "bob"), `{"email":"alice@example.com"}`)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("expected 409, got %d", rr.Code)
+	}
+}
+
+func TestMagicLink_OpeningDoesNotUseLink(t *testing.T) {
+	h, db := newAccountsHandler(t)
+	dir := withMailer(t, h)
+
+	rr := call(h.SetEmail, "PUT", "/api/auth/email", signedIn(t, h, db, "alice"), `{"email":"alice@example.com"}`)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("set email: expected 202, got %d", rr.Code)
+	}
+	link := lastLink(t, dir)
+
+	// As a mail client's link scanner would
+	rr = call(h.MagicLink, "GET", link, "", "")
+	if rr.Code != http.StatusOK || strings.Contains(strings.Join(rr.Header().Values("Set-Cookie"), "\n"), "waffle_session") {
+		t.Fatalf("expected a page without signing in, got %d with %v", rr.Code, rr.Result().Cookies())
+	}
+	if rr.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("expected the page not to be cached, got %q", rr.Header().Get("Cache-Control"))
+	}
+	if rr := follow(t, h, link); rr.Code != http.StatusSeeOther {
+		t.Errorf("confirm: expected 303, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestMagicLink_ConfirmRequiresPage(t *testing.T) {
+	h, db := newAccountsHandler(t)
+	dir := withMailer(t, h)
+
+	rr := call(h.SetEmail, "PUT", "/api/auth/email", signedIn(t, h, db, "alice"), `{"email":"alice@example.com"}`)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("set email: expected 202, got %d", rr.Code)
+	}
+	link := lastLink(t, dir)
+	token := strings.TrimPrefix(link, "/api/auth/magic?token=")
+
+	// As another site's form would, posting the token it was sent without
+	// the page's cookie, or with a nonce of its own
+	if rr := confirm(h, url.Values{"token": {token}}, nil); rr.Code != http.StatusForbidden {
+		t.Errorf("without a nonce: expected 403, got %d", rr.Code)
+	}
+	forged := &http.Cookie{Name: "waffle_magic_nonce", Value: "mine"}
+	if rr := confirm(h, url.Values{"token": {token}, "nonce": {"theirs"}}, forged); rr.Code != http.StatusForbidden {
+		t.Errorf("with the wrong nonce: expected 403, got %d", rr.Code)
+	}
+	if rr := follow(t, h, link); rr.Code != http.StatusSeeOther {
+		t.Errorf("expected the link to still work, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+// failingMailer fails to send every message.
+type failingMailer struct{}
+
+func (failingMailer) Send(context.Context, email.Message) error {
+	return errors.New("connection refused")
+}
+
+func TestRequestMagicLink_SendFailureIsHidden(t *testing.T) {
+	h, db := newAccountsHandler(t)
+	signedIn(t, h, db, "alice")
+	if err := db.SetUserEmail("id-alice", "alice@example.com"); err != nil {
+		t.Fatalf("SetUserEmail: %v", err)
+	}
+	h.Mailer = failingMailer{}
+
+	rr := call(h.RequestMagicLink, "POST", "/api/auth/magic", "", `{"email":"alice@example.com"}`)
+	if rr.Code != http.StatusAccepted {
+		t.Errorf("expected 202, got %d", rr.Code)
+	}
+	h.WaitForMail()
+}
+
+// blockingMailer sends messages only once released.
+type blockingMailer struct {
+	release chan struct{}
+	sent    chan email.Message
+}
+
+func (m *blockingMailer) Send(ctx context.Context, msg email.Message) error {
+	<-m.release
+	m.sent <- msg
+	return nil
+}
+
+func TestRequestMagicLink_RespondsBeforeLookingUp(t *testing.T) {
+	h, db := newAccountsHandler(t)
+	signedIn(t, h, db, "alice")
+	if err := db.SetUserEmail("id-alice", "alice@example.com"); err != nil {
+		t.Fatalf("SetUserEmail: %v", err)
+	}
+	mailer := &blockingMailer{release: make(chan struct{}), sent: make(chan email.Message, 2)}
+	h.Mailer = mailer
+
+	// Neither response waits for the email, which would take longer for
+	// addresses with accounts
+	for _, address := range []string{"alice@example.com", "nobody@example.com"} {
+		rr := call(h.RequestMagicLink, "POST", "/api/auth/magic", "", `{"email":"`+address+`"}`)
+		if rr.Code != http.StatusAccepted {
+			t.Errorf("%s: expected 202, got %d", address, rr.Code)
+		}
+	}
+	close(mailer.release)
+	h.WaitForMail()
+	if len(mailer.sent) != 1 {
+		t.Fatalf("expected one email, got %d", len(mailer.sent))
+	}
+	if msg := <-mailer.sent; msg.To != "alice@example.com" {
+		t.Errorf("expected the email to go to alice, got %q", msg.To)
+	}
+
+	// Nor do they wait for the lookup: with the database gone, unknown and
+	// known addresses alike are accepted
+	db.Close()
+	for _, address := range []string{"alice@example.com", "nobody@example.com"} {
+		rr := call(h.RequestMagicLink, "POST", "/api/auth/magic", "", `{"email":"`+address+`"}`)
+		if rr.Code != http.StatusAccepted {
+			t.Errorf("%s without a database: expected 202, got %d", address, rr.Code)
+		}
+	}
+	h.WaitForMail()
+}
@@ -0,0 +1,255 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"waffle-app/internal/storage"
+)
+
+// POST /api/auth/passkeys/register/begin
+// Response: creation options for navigator.credentials.create, in the form
+// PublicKeyCredential.parseCreationOptionsFromJSON takes.
+// Starts adding a passkey to the signed-in user's account.
+func (h *Handler) BeginPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	passkeys, err := h.DB.GetPasskeysByUser(user.ID)
+	if err != nil {
+		slog.Error("failed to list passkeys", "error", err, "username", user.Username)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	challenge, err := h.ceremonies.begin("webauthn.create", user.ID)
+	if err != nil {
+		slog.Error("failed to start passkey registration", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	type param struct {
+		Type string `json:"type"`
+		Alg  int    `json:"alg"`
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"challenge": challenge,
+		"rp":        map[string]string{"id": h.RelyingParty.ID, "name": h.RelyingParty.Name},
+		"user": map[string]any{
+			"id":          base64URL(user.ID),
+			"name":        user.Username,
+			"displayName": user.Username,
+		},
+		"pubKeyCredParams":   []param{{"public-key", algES256}, {"public-key", algRS256}},
+		"timeout":            ceremonyTimeout.Milliseconds(),
+		"excludeCredentials": describePasskeys(passkeys),
+		// Discoverable credentials let users sign in without typing their name
+		"authenticatorSelection": map[string]string{"residentKey": "required", "userVerification": "preferred"},
+		"attestation":            "none",
+	})
+}
+
+// POST /api/auth/passkeys/register/finish
+// Body: the credential from navigator.credentials.create, in its toJSON form
+// Response: { "id": "..." }
+func (h *Handler) FinishPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	var credential credentialResponse
+	if err := json.NewDecoder(r.Body).Decode(&credential); err != nil || credential.Type != "public-key" {
+		http.Error(w, "invalid body: expected a public-key credential", http.StatusBadRequest)
+		return
+	}
+	passkey, err := h.verifyRegistration(&credential, user)
+	if err != nil {
+		slog.Warn("passkey registration rejected", "error", err, "username", user.Username)
+		http.Error(w, "passkey verification failed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.DB.CreatePasskey(passkey); err != nil {
+		if errors.Is(err, storage.ErrPasskeyExists) {
+			http.Error(w, "passkey already registered", http.StatusConflict)
+			return
+		}
+		slog.Error("failed to store passkey", "error", err, "username", user.Username)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("passkey registered", "username", user.Username)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{"id": base64URL(passkey.ID)})
+}
+
+func (h *Handler) verifyRegistration(credential *credentialResponse, user *storage.User) (*storage.Passkey, error) {
+	pending, err := h.verifyClientData(credential.Response.ClientDataJSON, "webauthn.create")
+	if err != nil {
+		return nil, err
+	}
+	if pending.userID != user.ID {
+		return nil, errors.New("challenge was issued to another user")
+	}
+	raw, err := parseAttestation(credential.Response.AttestationObject)
+	if err != nil {
+		return nil, err
+	}
+	authData, err := h.parseAuthenticatorData(raw)
+	if err != nil {
+		return nil, err
+	}
+	if authData.credentialID == nil {
+		return nil, errors.New("no credential in authenticator data")
+	}
+	if !bytes.Equal(authData.credentialID, credential.RawID) {
+		return nil, errors.New("credential ID does not match authenticator data")
+	}
+	publicKey, alg, err := parsePublicKey(authData.publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &storage.Passkey{
+		ID:        authData.credentialID,
+		UserID:    user.ID,
+		PublicKey: publicKey,
+		Algorithm: alg,
+		SignCount: authData.signCount,
+	}, nil
+}
+
+// POST /api/auth/passkeys/login/begin
+// Body (optional): { "username": "alice" }
+// Response: request options for navigator.credentials.get, in the form
+// PublicKeyCredential.parseRequestOptionsFromJSON takes.
+// Without a username, the browser offers any passkey it has for the site.
+func (h *Handler) BeginPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		http.Error(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+
+	var userID string
+	var passkeys []storage.Passkey
+	if body.Username != "" {
+		user, err := h.DB.GetUserByUsername(body.Username)
+		if err != nil {
+			slog.Error("failed to look up user", "error", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if user != nil {
+			userID = user.ID
+			if passkeys, err = h.DB.GetPasskeysByUser(user.ID); err != nil {
+				slog.Error("failed to list passkeys", "error", err, "username", user.Username)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	challenge, err := h.ceremonies.begin("webauthn.get", userID)
+	if err != nil {
+		slog.Error("failed to start passkey login", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"challenge":        challenge,
+		"rpId":             h.RelyingParty.ID,
+		"timeout":          ceremonyTimeout.Milliseconds(),
+		"allowCredentials": describePasskeys(passkeys),
+		"userVerification": "preferred",
+	})
+}
+
+// POST /api/auth/passkeys/login/finish
+// Body: the credential from navigator.credentials.get, in its toJSON form
+// Response: { "id": "...", "username": "alice", "email": "", "has_passphrase": true }
+func (h *Handler) FinishPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	var credential credentialResponse
+	if err := json.NewDecoder(r.Body).Decode(&credential); err != nil || credential.Type != "public-key" {
+		http.Error(w, "invalid body: expected a public-key credential", http.StatusBadRequest)
+		return
+	}
+	passkey, err := h.verifyAssertion(&credential)
+	if err != nil {
+		slog.Warn("passkey login rejected", "error", err)
+		http.Error(w, "passkey verification failed", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := h.DB.GetUser(passkey.UserID)
+	if err != nil || user == nil {
+		slog.Error("failed to look up passkey owner", "error", err, "user_id", passkey.UserID)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("user logged in with passkey", "username", user.Username)
+	h.signIn(w, user, http.StatusOK)
+}
+
+// verifyAssertion checks a sign-in with a passkey and records its use,
+// returning the passkey.
+func (h *Handler) verifyAssertion(credential *credentialResponse) (*storage.Passkey, error) {
+	pending, err := h.verifyClientData(credential.Response.ClientDataJSON, "webauthn.get")
+	if err != nil {
+		return nil, err
+	}
+	passkey, err := h.DB.GetPasskey(credential.RawID)
+	if err != nil {
+		return nil, err
+	}
+	if passkey == nil {
+		return nil, errors.New("unknown passkey")
+	}
+	if pending.userID != "" && pending.userID != passkey.UserID {
+		return nil, errors.New("passkey belongs to another user")
+	}
+	if handle := credential.Response.UserHandle; len(handle) > 0 && string(handle) != passkey.UserID {
+		return nil, errors.New("user handle does not match passkey")
+	}
+
+	authData, err := h.parseAuthenticatorData(credential.Response.AuthenticatorData)
+	if err != nil {
+		return nil, err
+	}
+	err = verifySignature(passkey.PublicKey, passkey.Algorithm, authData.raw,
+		credential.Response.ClientDataJSON, credential.Response.Signature)
+	if err != nil {
+		return nil, err
+	}
+	// Authenticators that count signatures report a higher count each
+	// time; one that doesn't may have been cloned. Synced passkeys always
+	// report zero.
+	if (authData.signCount != 0 || passkey.SignCount != 0) && authData.signCount <= passkey.SignCount {
+		return nil, errors.New("signature counter did not increase")
+	}
+
+	if err := h.DB.UsePasskey(passkey.ID, authData.signCount); err != nil {
+		return nil, err
+	}
+	return passkey, nil
+}
+
+func describePasskeys(passkeys []storage.Passkey) []credentialDescriptor {
+	descriptors := make([]credentialDescriptor, 0, len(passkeys))
+	for _, p := range passkeys {
+		descriptors = append(descriptors, credentialDescriptor{Type: "public-key", ID: p.ID})
+	}
+	return descriptors
+}
@@ -0,0 +1,172 @@
+package auth_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"waffle-app/internal/auth"
+	"waffle-app/internal/auth/webauthntest"
+	"waffle-app/internal/storage"
+)
+
+// signedIn creates an account and returns a session token for it.
+func signedIn(t *testing.T, h *auth.Handler, db *storage.DB, username string) string {
+	t.Helper()
+	if err := db.CreateUser(&storage.User{ID: "id-" + username, Username: username}); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	session, err := h.Sessions.Create(username)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	return session.Token
+}
+
+// registerPasskey adds a passkey from authenticator to the account.
+func registerPasskey(t *testing.T, h *auth.Handler, authenticator *webauthntest.Authenticator, token string) {
+	t.Helper()
+	rr := call(h.BeginPasskeyRegistration, "POST", "/api/auth/passkeys/register/begin", token, "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("register begin: expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	credential := authenticator.Create(rr.Body.Bytes())
+	rr = call(h.FinishPasskeyRegistration, "POST", "/api/auth/passkeys/register/finish", token, string(credential))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("register finish: expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+// beginLogin returns request options for signing in, as username if it
+// isn't empty.
+func beginLogin(t *testing.T, h *auth.Handler, username string) []byte {
+	t.Helper()
+	body := ""
+	if username != "" {
+		body = `{"username":"` + username + `"}`
+	}
+	rr := call(h.BeginPasskeyLogin, "POST", "/api/auth/passkeys/login/begin", "", body)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("login begin: expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	return rr.Body.Bytes()
+}
+
+func TestPasskeys_RegisterAndLogin(t *testing.T) {
+	h, db := newAccountsHandler(t)
+	authenticator := webauthntest.New(t, auth.DefaultRelyingParty.Origin)
+	registerPasskey(t, h, authenticator, signedIn(t, h, db, "alice"))
+
+	// A new device that only has the synced passkey, without a username
+	rr := call(h.FinishPasskeyLogin, "POST", "/api/auth/passkeys/login/finish", "", string(authenticator.Get(beginLogin(t, h, ""))))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("login finish: expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if session, ok := h.Sessions.Get(sessionCookie(t, rr)); !ok || session.Username != "alice" {
+		t.Errorf("expected to be signed in as alice, got %+v", session)
+	}
+
+	// And with the username, which limits the browser to alice's passkeys
+	options := beginLogin(t, h, "alice")
+	if !strings.Contains(string(options), `"allowCredentials":[{`) {
+		t.Errorf("expected alice's passkeys to be allowed, got %s", options)
+	}
+	rr = call(h.FinishPasskeyLogin, "POST", "/api/auth/passkeys/login/finish", "", string(authenticator.Get(options)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("login with username: expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	passkeys, err := db.GetPasskeysByUser("id-alice")
+	if err != nil || len(passkeys) != 1 {
+		t.Fatalf("GetPasskeysByUser: %+v, %v", passkeys, err)
+	}
+	if passkeys[0].LastUsedAt.IsZero() {
+		t.Error("expected the passkey's last use to be recorded")
+	}
+}
+
+func TestPasskeys_RequiresSession(t *testing.T) {
+	h, _ := newAccountsHandler(t)
+
+	rr := call(h.BeginPasskeyRegistration, "POST", "/api/auth/passkeys/register/begin", "", "")
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", rr.Code)
+	}
+}
+
+func TestPasskeys_RejectsReplay(t *testing.T) {
+	h, db := newAccountsHandler(t)
+	authenticator := webauthntest.New(t, auth.DefaultRelyingParty.Origin)
+	registerPasskey(t, h, authenticator, signedIn(t, h, db, "alice"))
+
+	assertion := string(authenticator.Get(beginLogin(t, h, "")))
+	if rr := call(h.FinishPasskeyLogin, "POST", "/api/auth/passkeys/login/finish", "", assertion); rr.Code != http.StatusOK {
+		t.Fatalf("first use: expected 200, got %d", rr.Code)
+	}
+	if rr := call(h.FinishPasskeyLogin, "POST", "/api/auth/passkeys/login/finish", "", assertion); rr.Code != http.StatusUnauthorized {
+		t.Errorf("replay: expected 401, got %d", rr.Code)
+	}
+}
+
+func TestPasskeys_RejectsOtherOrigin(t *testing.T) {
+	h, db := newAccountsHandler(t)
+	token := signedIn(t, h, db, "alice")
+	authenticator := webauthntest.New(t, "https://phishing.example")
+
+	rr := call(h.BeginPasskeyRegistration, "POST", "/api/auth/passkeys/register/begin", token, "")
+	credential := authenticator.Create(rr.Body.Bytes())
+	rr = call(h.FinishPasskeyRegistration, "POST", "/api/auth/passkeys/register/finish", token, string(credential))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("registration: expected 400, got %d", rr.Code)
+	}
+
+	authenticator.Origin = auth.DefaultRelyingParty.Origin
+	registerPasskey(t, h, authenticator, token)
+	authenticator.Origin = "https://phishing.example"
+	rr = call(h.FinishPasskeyLogin, "POST", "/api/auth/passkeys/login/finish", "", string(authenticator.Get(beginLogin(t, h, ""))))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("login: expected 401, got %d", rr.Code)
+	}
+}
+
+func TestPasskeys_RejectsOtherUsersPasskey(t *testing.T) {
+	h, db := newAccountsHandler(t)
+	authenticator := webauthntest.New(t, auth.DefaultRelyingParty.Origin)
+	signedIn(t, h, db, "alice")
+	registerPasskey(t, h, authenticator, signedIn(t, h, db, "bob"))
+
+	// Bob answers a challenge issued for signing in as alice
+	options := beginLogin(t, h, "alice")
+	var challenge struct {
+		Challenge string `json:"challenge"`
+	}
+	if err := json.Unmarshal(options, &challenge); err != nil {
+		t.Fatalf("parse options: %v", err)
+	}
+	assertion := authenticator.Sign(authenticator.Credentials()[0], challenge.Challenge)
+	rr := call(h.FinishPasskeyLogin, "POST", "/api/auth/passkeys/login/finish", "", string(assertion))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", rr.Code)
+	}
+}
+
+func TestPasskeys_RejectsClonedAuthenticator(t *testing.T) {
+	h, db := newAccountsHandler(t)
+	authenticator := webauthntest.New(t, auth.DefaultRelyingParty.Origin)
+	authenticator.CountSignatures = true
+	registerPasskey(t, h, authenticator, signedIn(t, h, db, "alice"))
+
+	for range 2 {
+		rr := call(h.FinishPasskeyLogin, "POST", "/api/auth/passkeys/login/finish", "", string(authenticator.Get(beginLogin(t, h, ""))))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("login: expected 200, got %d", rr.Code)
+		}
+	}
+
+	// A copy of the key made before it was first used
+	authenticator.Credentials()[0].SignCount = 0
+	rr := call(h.FinishPasskeyLogin, "POST", "/api/auth/passkeys/login/finish", "", string(authenticator.Get(beginLogin(t, h, ""))))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Passphrases are stored as "pbkdf2-sha256$<iterations>$<salt>$<key>" with
+// the salt and key base64 encoded, so the cost can be raised later without
+// invalidating existing hashes.
+const (
+	passphraseScheme     = "pbkdf2-sha256"
+	passphraseIterations = 600_000 // OWASP's recommendation for PBKDF2-HMAC-SHA256
+	passphraseSaltLen    = 16
+	passphraseKeyLen     = 32
+
+	MinPassphraseLength = 8
+	maxPassphraseLength = 1024 // bounds the work a single login can cause
+)
+
+func hashPassphrase(passphrase string) (string, error) {
+	salt := make([]byte, passphraseSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("generate salt: %w", err)
+	}
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, passphraseIterations, passphraseKeyLen)
+	if err != nil {
+		return "", fmt.Errorf("hash passphrase: %w", err)
+	}
+	return fmt.Sprintf("%s$%d$%s$%s", passphraseScheme, passphraseIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// checkPassphrase reports whether passphrase matches a hash made by
+// hashPassphrase. An empty or malformed hash matches nothing.
+func checkPassphrase(hash, passphrase string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != passphraseScheme {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	got, err := pbkdf2.Key(sha256.New, passphrase, salt, iterations, len(want))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+func validPassphrase(passphrase string) error {
+	switch {
+	case utf8.RuneCountInString(passphrase) < MinPassphraseLength:
+		return fmt.Errorf("passphrase must be at least %d characters", MinPassphraseLength)
+	case len(passphrase) > maxPassphraseLength:
+		return fmt.Errorf("passphrase must be at most %d bytes", maxPassphraseLength)
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package auth
+
+import (
+	"log/slog"
+	"net/http"
+	"waffle-app/internal/storage"
+)
+
+// RequireRole checks that the session's user has at least the given role in
+// a conversation, and returns the role they have. It writes a 403 response
+// and returns false if they don't, including when they aren't a member.
+func RequireRole(w http.ResponseWriter, db *storage.DB, session *Session, conversationID, role string) (string, bool) {
+	actual, err := db.GetMemberRole(conversationID, session.Username)
+	if err != nil {
+		slog.Error("failed to check membership", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return "", false
+	}
+	if !storage.RoleAtLeast(actual, role) {
+		slog.Warn("conversation access denied", "username", session.Username,
+			"conversation_id", conversationID, "role", actual, "required", role)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return "", false
+	}
+	return actual, true
+}
@@ -0,0 +1,50 @@
+package auth_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"waffle-app/internal/auth"
+	"waffle-app/internal/storage"
+)
+
+func TestRequireRole(t *testing.T) {
+	_, db := newAccountsHandler(t)
+	if err := db.CreateConversation("conv-1", "invite-abc", "Test Group", ""); err != nil {
+		t.Fatalf("CreateConversation: %v", err)
+	}
+	for _, username := range []string{"alice", "bob", "mallory"} {
+		if err := db.CreateUser(&storage.User{ID: "id-" + username, Username: username}); err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+	}
+	for _, username := range []string{"alice", "bob"} {
+		if err := db.AddMember("conv-1", username); err != nil {
+			t.Fatalf("AddMember: %v", err)
+		}
+	}
+	if err := db.SetMemberRole("conv-1", "alice", storage.RoleAdmin); err != nil {
+		t.Fatalf("SetMemberRole: %v", err)
+	}
+
+	tests := []struct {
+		username, role string
+		want           int
+	}{
+		{"alice", storage.RoleAdmin, http.StatusOK},
+		{"alice", storage.RoleOwner, http.StatusForbidden},
+		{"bob", storage.RoleMember, http.StatusOK},
+		{"bob", storage.RoleAdmin, http.StatusForbidden},
+		{"mallory", storage.RoleMember, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		role, ok := auth.RequireRole(rr, db, &auth.Session{Username: tt.username}, "conv-1", tt.role)
+		if ok != (tt.want == http.StatusOK) || rr.Code != tt.want {
+			t.Errorf("%s as %s: expected %d, got %v with %d", tt.username, tt.role, tt.want, ok, rr.Code)
+		}
+		if ok && !storage.RoleAtLeast(role, tt.role) {
+			t.Errorf("%s as %s: returned role %q", tt.username, tt.role, role)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
@@ -15,56 +16,218 @@ const sessionCookieName = "waffle_session"
 
 // Session holds the authenticated user's data for the duration of a request.
 type Session struct {
-	Username string
+	Token     string
+	Username  string
+	ExpiresAt time.Time // zero if the session never expires
 }
 
-// Store is an in-memory session store.
+// Timeouts controls how long sessions stay valid. A zero duration disables
+// that timeout.
+type Timeouts struct {
+	// Absolute is the maximum lifetime of a session, regardless of activity.
+	Absolute time.Duration
+	// Idle is how long a session may go unused before it expires. Every
+	// authenticated request renews it.
+	Idle time.Duration
+}
+
+var DefaultTimeouts = Timeouts{
+	Absolute: 30 * 24 * time.Hour,
+	Idle:     7 * 24 * time.Hour,
+}
+
+// expiresAt returns when a session created at createdAt and last used at
+// lastSeen expires, or the zero time if it never does.
+func (t Timeouts) expiresAt(createdAt, lastSeen time.Time) time.Time {
+	var exp time.Time
+	if t.Absolute > 0 {
+		exp = createdAt.Add(t.Absolute)
+	}
+	if t.Idle > 0 {
+		if idle := lastSeen.Add(t.Idle); exp.IsZero() || idle.Before(exp) {
+			exp = idle
+		}
+	}
+	return exp
+}
+
+func (t Timeouts) expired(createdAt, lastSeen, now time.Time) bool {
+	exp := t.expiresAt(createdAt, lastSeen)
+	return !exp.IsZero() && !now.Before(exp)
+}
+
+// SessionStore creates and resolves session tokens. Handlers depend on this
+// interface so the backing store can be swapped between memory and SQLite.
+type SessionStore interface {
+	// Create generates a new session for the user.
+	Create(username string) (*Session, error)
+	// Get returns the session for the token, or false if it does not exist
+	// or has expired. A successful Get renews the idle timeout.
+	Get(token string) (*Session, bool)
+	// Revoke ends the session for the token.
+	Revoke(token string) error
+	// RevokeAll ends every session belonging to the user and returns how
+	// many were revoked.
+	RevokeAll(username string) (int, error)
+	// DeleteExpired evicts expired sessions and returns how many were removed.
+	DeleteExpired() (int, error)
+}
+
+// Store is an in-memory session store. Sessions are lost on restart, so it
+// is intended for tests; use DBStore in production.
 type Store struct {
 	mu       sync.RWMutex
 	sessions map[string]sessionEntry
+	timeouts Timeouts
 }
 
+var _ SessionStore = (*Store)(nil)
+
 type sessionEntry struct {
 	username  string
 	createdAt time.Time
+	lastSeen  time.Time
 }
 
-func NewStore() *Store {
-	return &Store{sessions: make(map[string]sessionEntry)}
+func NewStore(timeouts Timeouts) *Store {
+	return &Store{sessions: make(map[string]sessionEntry), timeouts: timeouts}
 }
 
 // Create generates a new session token and stores it.
-func (s *Store) Create(username string) (string, error) {
+func (s *Store) Create(username string) (*Session, error) {
 	token, err := generateToken()
 	if err != nil {
-		return "", fmt.Errorf("generate session token: %w", err)
+		return nil, fmt.Errorf("generate session token: %w", err)
 	}
+	now := time.Now()
 	s.mu.Lock()
-	s.sessions[token] = sessionEntry{username: username, createdAt: time.Now()}
+	s.sessions[token] = sessionEntry{username: username, createdAt: now, lastSeen: now}
 	s.mu.Unlock()
 	slog.Info("session created", "username", username)
-	return token, nil
+	return &Session{Token: token, Username: username, ExpiresAt: s.timeouts.expiresAt(now, now)}, nil
 }
 
-// Get retrieves the session associated with the token.
+// Get retrieves the session associated with the token and renews it.
 func (s *Store) Get(token string) (*Session, bool) {
-	s.mu.RLock()
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	entry, ok := s.sessions[token]
-	s.mu.RUnlock()
 	if !ok {
 		return nil, false
 	}
-	return &Session{Username: entry.username}, true
+	if s.timeouts.expired(entry.createdAt, entry.lastSeen, now) {
+		delete(s.sessions, token)
+		return nil, false
+	}
+	entry.lastSeen = now
+	s.sessions[token] = entry
+	return &Session{Token: token, Username: entry.username, ExpiresAt: s.timeouts.expiresAt(entry.createdAt, now)}, true
+}
+
+// Revoke removes the session for the token.
+func (s *Store) Revoke(token string) error {
+	s.mu.Lock()
+	delete(s.sessions, token)
+	s.mu.Unlock()
+	return nil
+}
+
+// RevokeAll removes every session belonging to the user.
+func (s *Store) RevokeAll(username string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for token, entry := range s.sessions {
+		if entry.username == username {
+			delete(s.sessions, token)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// DeleteExpired removes all expired sessions.
+func (s *Store) DeleteExpired() (int, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for token, entry := range s.sessions {
+		if s.timeouts.expired(entry.createdAt, entry.lastSeen, now) {
+			delete(s.sessions, token)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// RunSweeper periodically evicts expired sessions until ctx is cancelled.
+func RunSweeper(ctx context.Context, store SessionStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := store.DeleteExpired()
+			if err != nil {
+				slog.Error("failed to sweep expired sessions", "error", err)
+				continue
+			}
+			if n > 0 {
+				slog.Info("swept expired sessions", "count", n)
+			}
+		}
+	}
+}
+
+// RequireSession resolves the session from the request cookie and refreshes
+// the cookie's expiry. It writes a 401 response and returns false if there
+// is no valid session.
+func RequireSession(w http.ResponseWriter, r *http.Request, store SessionStore) (*Session, bool) {
+	token, ok := FromRequest(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	session, ok := store.Get(token)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	SetCookie(w, session)
+	return session, true
+}
+
+// SetCookie writes the session cookie to the response. The cookie expires
+// together with the session.
+func SetCookie(w http.ResponseWriter, session *Session) {
+	cookie := &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    session.Token,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if !session.ExpiresAt.IsZero() {
+		cookie.Expires = session.ExpiresAt.UTC()
+		cookie.MaxAge = max(int(time.Until(session.ExpiresAt).Seconds()), 1)
+	}
+	http.SetCookie(w, cookie)
 }
 
-// SetCookie writes the session cookie to the response.
-func SetCookie(w http.ResponseWriter, token string) {
+// ClearCookie instructs the browser to delete the session cookie.
+func ClearCookie(w http.ResponseWriter) {
 	http.SetCookie(w, &http.Cookie{
 		Name:     sessionCookieName,
-		Value:    token,
+		Value:    "",
 		Path:     "/",
 		HttpOnly: true,
 		SameSite: http.SameSiteLaxMode,
+		MaxAge:   -1,
+		Expires:  time.Unix(0, 0),
 	})
 }
 
@@ -1,22 +1,25 @@
 package auth_test
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 	"waffle-app/internal/auth"
 )
 
 func TestCreateAndGetSession(t *testing.T) {
-	store := auth.NewStore()
+	store := auth.NewStore(auth.DefaultTimeouts)
 
-	token, err := store.Create("alice")
+	created, err := store.Create("alice")
 	if err != nil {
 		t.Fatalf("Create: %v", err)
 	}
-	if token == "" {
+	if created.Token == "" {
 		t.Fatal("expected non-empty token")
 	}
 
-	session, ok := store.Get(token)
+	session, ok := store.Get(created.Token)
 	if !ok {
 		t.Fatal("expected session to exist")
 	}
@@ -26,7 +29,7 @@ func TestCreateAndGetSession(t *testing.T) {
 }
 
 func TestGetSession_InvalidToken(t *testing.T) {
-	store := auth.NewStore()
+	store := auth.NewStore(auth.DefaultTimeouts)
 
 	_, ok := store.Get("invalid-token")
 	if ok {
@@ -35,18 +38,185 @@ func TestGetSession_InvalidToken(t *testing.T) {
 }
 
 func TestSessionTokensAreUnique(t *testing.T) {
-	store := auth.NewStore()
+	store := auth.NewStore(auth.DefaultTimeouts)
 
-	token1, err := store.Create("alice")
+	session1, err := store.Create("alice")
 	if err != nil {
 		t.Fatalf("Create token1: %v", err)
 	}
-	token2, err := store.Create("bob")
+	session2, err := store.Create("bob")
 	if err != nil {
 		t.Fatalf("Create token2: %v", err)
 	}
 
-	if token1 == token2 {
+	if session1.Token == session2.Token {
 		t.Error("tokens should be unique")
 	}
 }
+
+func TestSession_IdleTimeout(t *testing.T) {
+	store := auth.NewStore(auth.Timeouts{Idle: 50 * time.Millisecond})
+
+	session, err := store.Create("alice")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	// Activity within the idle window keeps the session alive.
+	for range 3 {
+		time.Sleep(30 * time.Millisecond)
+		if _, ok := store.Get(session.Token); !ok {
+			t.Fatal("expected session to be renewed by activity")
+		}
+	}
+
+	time.Sleep(80 * time.Millisecond)
+	if _, ok := store.Get(session.Token); ok {
+		t.Fatal("expected session to expire after idle timeout")
+	}
+}
+
+func TestSession_AbsoluteTimeout(t *testing.T) {
+	store := auth.NewStore(auth.Timeouts{Absolute: 50 * time.Millisecond, Idle: time.Hour})
+
+	session, err := store.Create("alice")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if time.Until(session.ExpiresAt) > 50*time.Millisecond {
+		t.Errorf("expected expiry bounded by absolute timeout, got %v", session.ExpiresAt)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := store.Get(session.Token); !ok {
+		t.Fatal("expected session to be valid")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := store.Get(session.Token); ok {
+		t.Fatal("expected session to expire after absolute timeout despite activity")
+	}
+}
+
+func TestDeleteExpired(t *testing.T) {
+	store := auth.NewStore(auth.Timeouts{Idle: 20 * time.Millisecond})
+
+	if _, err := store.Create("alice"); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, err := store.Create("bob"); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	n, err := store.DeleteExpired()
+	if err != nil {
+		t.Fatalf("DeleteExpired: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 expired session, got %d", n)
+	}
+}
+
+func TestRevokeAll(t *testing.T) {
+	store := auth.NewStore(auth.DefaultTimeouts)
+
+	phone, _ := store.Create("alice")
+	laptop, _ := store.Create("alice")
+	other, _ := store.Create("bob")
+
+	n, err := store.RevokeAll("alice")
+	if err != nil {
+		t.Fatalf("RevokeAll: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 sessions revoked, got %d", n)
+	}
+	for _, token := range []string{phone.Token, laptop.Token} {
+		if _, ok := store.Get(token); ok {
+			t.Error("expected alice's sessions to be revoked")
+		}
+	}
+	if _, ok := store.Get(other.Token); !ok {
+		t.Error("expected bob's session to remain")
+	}
+}
+
+func TestSetCookie_Expiry(t *testing.T) {
+	store := auth.NewStore(auth.Timeouts{Idle: time.Hour})
+	session, err := store.Create("alice")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	auth.SetCookie(rr, session)
+
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected 1 cookie, got %d", len(cookies))
+	}
+	c := cookies[0]
+	if c.Name != "waffle_session" || c.Value != session.Token {
+		t.Errorf("unexpected cookie %s=%s", c.Name, c.Value)
+	}
+	if c.MaxAge < 3590 || c.MaxAge > 3600 {
+		t.Errorf("expected Max-Age of about one hour, got %d", c.MaxAge)
+	}
+	if c.Expires.IsZero() {
+		t.Error("expected Expires to be set")
+	}
+}
+
+func TestLogout(t *testing.T) {
+	store := auth.NewStore(auth.DefaultTimeouts)
+	session, err := store.Create("alice")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	req, _ := http.NewRequest("POST", "/api/auth/logout", nil)
+	req.AddCookie(&http.Cookie{Name: "waffle_session", Value: session.Token})
+	rr := httptest.NewRecorder()
+	auth.NewHandler(nil, store).Logout(rr, req)
+
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rr.Code)
+	}
+	if _, ok := store.Get(session.Token); ok {
+		t.Error("expected session to be revoked")
+	}
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+		t.Errorf("expected cookie to be cleared, got %+v", cookies)
+	}
+}
+
+func TestLogoutAll(t *testing.T) {
+	store := auth.NewStore(auth.DefaultTimeouts)
+	phone, _ := store.Create("alice")
+	laptop, _ := store.Create("alice")
+
+	req, _ := http.NewRequest("POST", "/api/auth/logout-all", nil)
+	req.AddCookie(&http.Cookie{Name: "waffle_session", Value: phone.Token})
+	rr := httptest.NewRecorder()
+	auth.NewHandler(nil, store).LogoutAll(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	if _, ok := store.Get(laptop.Token); ok {
+		t.Error("expected sessions on other devices to be revoked")
+	}
+}
+
+func TestLogoutAll_Unauthenticated(t *testing.T) {
+	store := auth.NewStore(auth.DefaultTimeouts)
+
+	req, _ := http.NewRequest("POST", "/api/auth/logout-all", nil)
+	rr := httptest.NewRecorder()
+	auth.NewHandler(nil, store).LogoutAll(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", rr.Code)
+	}
+}
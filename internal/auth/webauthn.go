@@ -0,0 +1,306 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RelyingParty identifies the site passkeys are registered with. Browsers
+// only offer a passkey to pages on the domain it was registered for.
+type RelyingParty struct {
+	ID     string // the site's domain, e.g. "waffle.example.com"
+	Name   string // shown by the browser when creating a passkey
+	Origin string // the URL pages are served from, e.g. "https://waffle.example.com"
+}
+
+// DefaultRelyingParty suits a server run locally on the default port.
+var DefaultRelyingParty = RelyingParty{
+	ID:     "localhost",
+	Name:   "Wednesday Waffle",
+	Origin: "http://localhost:8080",
+}
+
+// COSE algorithm identifiers for the signature algorithms passkeys may use.
+const (
+	algES256 = -7
+	algRS256 = -257
+)
+
+// ceremonyTimeout is how long the browser has to complete a registration
+// or sign-in once it has been given a challenge.
+const ceremonyTimeout = 5 * time.Minute
+
+// Authenticator data flags.
+const (
+	flagUserPresent  = 0x01
+	flagAttestedData = 0x40
+)
+
+// ceremony is a registration or sign-in waiting for the browser's response.
+type ceremony struct {
+	kind    string // "webauthn.create" or "webauthn.get", as in client data
+	userID  string // the user registering, or signing in if they said who they are
+	expires time.Time
+}
+
+// ceremonies holds the challenges handed out to browsers, each good for
+// one response.
+type ceremonies struct {
+	mu      sync.Mutex
+	pending map[string]ceremony
+}
+
+func newCeremonies() *ceremonies {
+	return &ceremonies{pending: make(map[string]ceremony)}
+}
+
+// begin returns a new challenge for a ceremony of the given kind.
+func (c *ceremonies) begin(kind, userID string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate challenge: %w", err)
+	}
+	challenge := base64.RawURLEncoding.EncodeToString(b)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for k, pending := range c.pending {
+		if now.After(pending.expires) {
+			delete(c.pending, k)
+		}
+	}
+	c.pending[challenge] = ceremony{kind: kind, userID: userID, expires: now.Add(ceremonyTimeout)}
+	return challenge, nil
+}
+
+// finish consumes the challenge, reporting the ceremony it was issued for
+// if it is still pending.
+func (c *ceremonies) finish(challenge string) (ceremony, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pending, ok := c.pending[challenge]
+	delete(c.pending, challenge)
+	if !ok || time.Now().After(pending.expires) {
+		return ceremony{}, false
+	}
+	return pending, true
+}
+
+// base64URL is binary data in JSON, encoded as the browser's
+// PublicKeyCredential.toJSON encodes it: base64url without padding.
+type base64URL []byte
+
+func (b base64URL) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *base64URL) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+// credentialDescriptor names a passkey in creation and request options.
+type credentialDescriptor struct {
+	Type string    `json:"type"`
+	ID   base64URL `json:"id"`
+}
+
+// credentialResponse is a PublicKeyCredential returned by
+// navigator.credentials.create or get, in its toJSON form. Which response
+// fields are set depends on the ceremony.
+type credentialResponse struct {
+	RawID    base64URL `json:"rawId"`
+	Type     string    `json:"type"`
+	Response struct {
+		ClientDataJSON    base64URL `json:"clientDataJSON"`
+		AttestationObject base64URL `json:"attestationObject"`
+		AuthenticatorData base64URL `json:"authenticatorData"`
+		Signature         base64URL `json:"signature"`
+		UserHandle        base64URL `json:"userHandle"`
+	} `json:"response"`
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// verifyClientData checks that the browser signed what we asked, from our
+// origin, and returns the ceremony it answers.
+func (h *Handler) verifyClientData(raw []byte, kind string) (ceremony, error) {
+	var data clientData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return ceremony{}, fmt.Errorf("parse client data: %w", err)
+	}
+	if data.Type != kind {
+		return ceremony{}, fmt.Errorf("client data type is %q, want %q", data.Type, kind)
+	}
+	pending, ok := h.ceremonies.finish(data.Challenge)
+	if !ok || pending.kind != kind {
+		return ceremony{}, errors.New("unknown or expired challenge")
+	}
+	if data.Origin != h.RelyingParty.Origin {
+		return ceremony{}, fmt.Errorf("origin is %q, want %q", data.Origin, h.RelyingParty.Origin)
+	}
+	return pending, nil
+}
+
+// authenticatorData is the authenticator's signed statement about a
+// ceremony. The credential fields are only set when registering.
+type authenticatorData struct {
+	raw          []byte
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte // COSE_Key
+}
+
+func (h *Handler) parseAuthenticatorData(raw []byte) (*authenticatorData, error) {
+	if len(raw) < 37 {
+		return nil, errors.New("authenticator data too short")
+	}
+	rpIDHash := sha256.Sum256([]byte(h.RelyingParty.ID))
+	if !bytes.Equal(raw[:32], rpIDHash[:]) {
+		return nil, errors.New("authenticator data is for another relying party")
+	}
+	ad := &authenticatorData{raw: raw, flags: raw[32], signCount: binary.BigEndian.Uint32(raw[33:37])}
+	if ad.flags&flagUserPresent == 0 {
+		return nil, errors.New("user was not present")
+	}
+	if ad.flags&flagAttestedData == 0 {
+		return ad, nil
+	}
+
+	// Attested credential data: AAGUID, credential ID length and ID, then
+	// the public key
+	rest := raw[37:]
+	if len(rest) < 18 {
+		return nil, errors.New("attested credential data too short")
+	}
+	n := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < n {
+		return nil, errors.New("credential ID truncated")
+	}
+	ad.credentialID = rest[:n]
+	rest = rest[n:]
+	_, after, err := decodeCBOR(rest)
+	if err != nil {
+		return nil, fmt.Errorf("parse credential public key: %w", err)
+	}
+	ad.publicKey = rest[:len(rest)-len(after)]
+	return ad, nil
+}
+
+// parseAttestation returns the authenticator data from an attestation
+// object. Registration asks for no attestation, so the statement itself
+// is not checked: passkeys are trusted on first use, by a signed-in user.
+func parseAttestation(raw []byte) ([]byte, error) {
+	decoded, _, err := decodeCBOR(raw)
+	if err != nil {
+		return nil, fmt.Errorf("parse attestation object: %w", err)
+	}
+	object, ok := decoded.(map[any]any)
+	if !ok {
+		return nil, errors.New("attestation object is not a map")
+	}
+	authData, ok := object["authData"].([]byte)
+	if !ok {
+		return nil, errors.New("attestation object has no authenticator data")
+	}
+	return authData, nil
+}
+
+// parsePublicKey converts a COSE_Key to a public key in PKIX form, and
+// returns its algorithm. Only ES256 and RS256 keys are supported, which
+// between them cover the authenticators in use.
+func parsePublicKey(coseKey []byte) ([]byte, int, error) {
+	decoded, _, err := decodeCBOR(coseKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	key, ok := decoded.(map[any]any)
+	if !ok {
+		return nil, 0, errors.New("public key is not a map")
+	}
+	alg, _ := key[int64(3)].(int64)
+
+	var pub crypto.PublicKey
+	switch alg {
+	case algES256:
+		crv, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		y, _ := key[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, errors.New("ES256 key is not on P-256")
+		}
+		point := append(append([]byte{4}, x...), y...)
+		if pub, err = ecdsa.ParseUncompressedPublicKey(elliptic.P256(), point); err != nil {
+			return nil, 0, err
+		}
+	case algRS256:
+		n, _ := key[int64(-1)].([]byte)
+		e, _ := key[int64(-2)].([]byte)
+		if len(n) < 2048/8 || len(e) == 0 || len(e) > 4 {
+			return nil, 0, errors.New("RS256 key is too small or malformed")
+		}
+		exponent := new(big.Int).SetBytes(e)
+		pub = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}
+	default:
+		return nil, 0, fmt.Errorf("unsupported algorithm %d", alg)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, 0, err
+	}
+	return der, int(alg), nil
+}
+
+// verifySignature checks a sign-in assertion's signature, made over the
+// authenticator data followed by the hash of the client data.
+func verifySignature(publicKey []byte, alg int, authData, clientDataJSON, signature []byte) error {
+	pub, err := x509.ParsePKIXPublicKey(publicKey)
+	if err != nil {
+		return fmt.Errorf("parse stored public key: %w", err)
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(bytes.Clone(authData), clientDataHash[:]...))
+
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		if alg == algES256 && ecdsa.VerifyASN1(pub, digest[:], signature) {
+			return nil
+		}
+	case *rsa.PublicKey:
+		if alg == algRS256 && rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature) == nil {
+			return nil
+		}
+	}
+	return errors.New("invalid signature")
+}
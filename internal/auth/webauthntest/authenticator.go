@@ -0,0 +1,243 @@
+// Package webauthntest provides a software WebAuthn authenticator for
+// tests, standing in for the browser and the passkey provider together. It
+// creates ES256 passkeys with "none" attestation and signs sign-in
+// challenges with them, exchanging the JSON forms of the options and
+// credentials that browsers use.
+package webauthntest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// Authenticator holds passkeys in memory.
+type Authenticator struct {
+	// Origin is reported in client data as the page's origin.
+	Origin string
+	// CountSignatures makes the authenticator report an increasing
+	// signature counter, as security keys do. Otherwise it reports zero,
+	// as synced passkeys do.
+	CountSignatures bool
+
+	t           testing.TB
+	credentials []*Credential
+}
+
+// Credential is a passkey the authenticator created.
+type Credential struct {
+	ID         []byte
+	RPID       string
+	UserHandle []byte
+	SignCount  uint32
+	key        *ecdsa.PrivateKey
+}
+
+// New returns an authenticator with no passkeys that fails t on errors.
+func New(t testing.TB, origin string) *Authenticator {
+	return &Authenticator{Origin: origin, t: t}
+}
+
+// Credentials returns the passkeys created so far, oldest first.
+func (a *Authenticator) Credentials() []*Credential {
+	return a.credentials
+}
+
+// Create answers creation options as navigator.credentials.create would,
+// creating a passkey and returning it in its toJSON form.
+func (a *Authenticator) Create(options []byte) []byte {
+	a.t.Helper()
+	var opts struct {
+		Challenge string `json:"challenge"`
+		RP        struct {
+			ID string `json:"id"`
+		} `json:"rp"`
+		User struct {
+			ID string `json:"id"`
+		} `json:"user"`
+	}
+	if err := json.Unmarshal(options, &opts); err != nil {
+		a.t.Fatalf("webauthntest: parse creation options: %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		a.t.Fatalf("webauthntest: generate key: %v", err)
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	c := &Credential{ID: id, RPID: opts.RP.ID, UserHandle: decode(a.t, opts.User.ID), key: key}
+	a.credentials = append(a.credentials, c)
+
+	point, err := key.PublicKey.Bytes()
+	if err != nil {
+		a.t.Fatalf("webauthntest: encode public key: %v", err)
+	}
+	coseKey := encodeMap(
+		1, 2, // kty: EC2
+		3, -7, // alg: ES256
+		-1, 1, // crv: P-256
+		-2, point[1:33],
+		-3, point[33:],
+	)
+	attested := make([]byte, 18, 18+len(id)+len(coseKey))
+	binary.BigEndian.PutUint16(attested[16:], uint16(len(id)))
+	attested = append(append(attested, id...), coseKey...)
+	authData := append(a.authenticatorData(c, 0x40), attested...)
+
+	clientData := a.clientData("webauthn.create", opts.Challenge)
+	return a.marshal(c, map[string]any{
+		"clientDataJSON":    encode(clientData),
+		"attestationObject": encode(encodeMap("fmt", "none", "attStmt", encodeMap(), "authData", authData)),
+	})
+}
+
+// Get answers request options as navigator.credentials.get would, signing
+// the challenge with a passkey for the relying party. If the options allow
+// particular credentials, the first of those it holds is used; otherwise
+// the newest passkey for the relying party.
+func (a *Authenticator) Get(options []byte) []byte {
+	a.t.Helper()
+	var opts struct {
+		Challenge        string `json:"challenge"`
+		RPID             string `json:"rpId"`
+		AllowCredentials []struct {
+			ID string `json:"id"`
+		} `json:"allowCredentials"`
+	}
+	if err := json.Unmarshal(options, &opts); err != nil {
+		a.t.Fatalf("webauthntest: parse request options: %v", err)
+	}
+
+	var c *Credential
+	for _, candidate := range a.credentials {
+		if candidate.RPID != opts.RPID {
+			continue
+		}
+		if len(opts.AllowCredentials) == 0 {
+			c = candidate
+			continue
+		}
+		for _, allowed := range opts.AllowCredentials {
+			if allowed.ID == encode(candidate.ID) && c == nil {
+				c = candidate
+			}
+		}
+	}
+	if c == nil {
+		a.t.Fatalf("webauthntest: no passkey for %q", opts.RPID)
+	}
+	return a.Sign(c, opts.Challenge)
+}
+
+// Sign answers a sign-in challenge with the given passkey, regardless of
+// which passkeys the relying party asked for.
+func (a *Authenticator) Sign(c *Credential, challenge string) []byte {
+	a.t.Helper()
+	if a.CountSignatures {
+		c.SignCount++
+	}
+	authData := a.authenticatorData(c, 0)
+	clientData := a.clientData("webauthn.get", challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, c.key, digest[:])
+	if err != nil {
+		a.t.Fatalf("webauthntest: sign: %v", err)
+	}
+	return a.marshal(c, map[string]any{
+		"clientDataJSON":    encode(clientData),
+		"authenticatorData": encode(authData),
+		"signature":         encode(signature),
+		"userHandle":        encode(c.UserHandle),
+	})
+}
+
+// authenticatorData returns the fixed-length part of authenticator data,
+// with the user present and verified flags and any extra flags set.
+func (a *Authenticator) authenticatorData(c *Credential, flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(c.RPID))
+	data := append(rpIDHash[:], 0x01|0x04|flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], c.SignCount)
+	return data
+}
+
+func (a *Authenticator) clientData(kind, challenge string) []byte {
+	data, _ := json.Marshal(map[string]any{
+		"type":        kind,
+		"challenge":   challenge,
+		"origin":      a.Origin,
+		"crossOrigin": false,
+	})
+	return data
+}
+
+func (a *Authenticator) marshal(c *Credential, response map[string]any) []byte {
+	data, _ := json.Marshal(map[string]any{
+		"id":       encode(c.ID),
+		"rawId":    encode(c.ID),
+		"type":     "public-key",
+		"response": response,
+	})
+	return data
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decode(t testing.TB, s string) []byte {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatalf("webauthntest: decode %q: %v", s, err)
+	}
+	return b
+}
+
+// encodeMap encodes alternating keys and values as a CBOR map. Keys and
+// values may be ints, strings, byte strings or previously encoded maps.
+func encodeMap(pairs ...any) cborValue {
+	out := cborHead(5, uint64(len(pairs)/2))
+	for _, v := range pairs {
+		out = append(out, encodeCBOR(v)...)
+	}
+	return out
+}
+
+// cborValue is already encoded CBOR, as opposed to a byte string.
+type cborValue []byte
+
+func encodeCBOR(v any) []byte {
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return cborHead(1, uint64(-1-v))
+		}
+		return cborHead(0, uint64(v))
+	case string:
+		return append(cborHead(3, uint64(len(v))), v...)
+	case []byte:
+		return append(cborHead(2, uint64(len(v))), v...)
+	case cborValue:
+		return v
+	}
+	panic(fmt.Sprintf("webauthntest: cannot encode %T", v))
+}
+
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n <= 0xff:
+		return []byte{major<<5 | 24, byte(n)}
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+	}
+	return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+}
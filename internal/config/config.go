@@ -0,0 +1,401 @@
+// Package config loads the server's settings. Each setting can come from
+// a JSON config file, a WAFFLE_* environment variable or a command-line
+// flag. Flags take precedence over the environment, which takes precedence
+// over the file, which takes precedence over the built-in defaults.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/mail"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+	"waffle-app/internal/auth"
+	"waffle-app/internal/email"
+	"waffle-app/internal/storage"
+	"waffle-app/internal/videos"
+)
+
+// envPrefix is prepended to a setting's name, upper-cased with dashes
+// replaced by underscores, to form its environment variable.
+const envPrefix = "WAFFLE_"
+
+type Config struct {
+	Addr      string
+	LogLevel  string // debug, info, warn or error
+	LogFormat string // text or json
+	// PublicURL is where users open the app. Passkeys are registered for
+	// its host name and only accepted from pages at this origin.
+	PublicURL string
+
+	ReadHeaderTimeout time.Duration
+	IdleTimeout       time.Duration
+	// ShutdownTimeout bounds how long in-flight requests and transcoding
+	// jobs may take to finish once the server is asked to stop.
+	ShutdownTimeout time.Duration
+
+	DBPath       string
+	VideosDir    string
+	ProfilesPath string // optional; the built-in profiles are used if the file doesn't exist
+
+	// BlobStore is where video files are kept: "local" for VideosDir, or
+	// "s3" for the S3-compatible bucket described by the S3 settings.
+	BlobStore   string
+	S3Endpoint  string
+	S3Region    string
+	S3Bucket    string
+	S3AccessKey string
+	S3SecretKey string
+	S3PathStyle bool
+	// SignedURLExpiry, if set, redirects video and thumbnail requests to
+	// signed blob store URLs valid this long instead of proxying them.
+	SignedURLExpiry time.Duration
+
+	MaxUploadSize       int64 // bytes
+	ConversationQuota   int64 // bytes stored per conversation, 0 for no limit
+	UserQuota           int64 // bytes stored per uploader, 0 for no limit
+	UploadExpiry        time.Duration
+	UploadSweepInterval time.Duration
+	// RetentionSweepInterval is how often conversations' retention policies
+	// are applied.
+	RetentionSweepInterval time.Duration
+
+	TranscodeWorkers int
+	RetryMaxAttempts int
+	RetryBackoff     time.Duration
+	EnableHLS        bool
+
+	SessionAbsoluteTimeout time.Duration // 0 disables
+	SessionIdleTimeout     time.Duration // 0 disables
+	SessionSweepInterval   time.Duration
+
+	// Mailer sends sign-in links: "file" writes them to MailDir for
+	// development, and "smtp" sends them through the SMTP relay.
+	Mailer          string
+	MailDir         string
+	MailFrom        string
+	SMTPAddr        string
+	SMTPUsername    string
+	SMTPPassword    string
+	MagicLinkExpiry time.Duration
+
+	// Args are the arguments left after the flags, naming a subcommand such
+	// as "migrate status". Empty when running the server.
+	Args []string
+}
+
+// Default returns the settings used when nothing is configured.
+func Default() *Config {
+	return &Config{
+		Addr:      ":8080",
+		LogLevel:  "debug",
+		LogFormat: "text",
+		PublicURL: "http://localhost:8080",
+
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+		ShutdownTimeout:   videos.DefaultDrainTimeout,
+
+		DBPath:       "./waffle.db",
+		VideosDir:    "./videos",
+		ProfilesPath: "./profiles.json",
+
+		BlobStore:   "local",
+		S3Region:    "us-east-1",
+		S3PathStyle: true,
+
+		MaxUploadSize:       videos.DefaultMaxUploadSize,
+		UploadExpiry:        videos.DefaultUploadExpiry,
+		UploadSweepInterval: 15 * time.Minute,
+
+		RetentionSweepInterval: time.Hour,
+
+		TranscodeWorkers: 2,
+		RetryMaxAttempts: videos.DefaultRetryPolicy.MaxAttempts,
+		RetryBackoff:     videos.DefaultRetryPolicy.Backoff,
+		EnableHLS:        true,
+
+		SessionAbsoluteTimeout: auth.DefaultTimeouts.Absolute,
+		SessionIdleTimeout:     auth.DefaultTimeouts.Idle,
+		SessionSweepInterval:   time.Hour,
+
+		Mailer:          "file",
+		MailDir:         "./mail",
+		MailFrom:        "Wednesday Waffle <waffle@localhost>",
+		MagicLinkExpiry: auth.DefaultMagicLinkExpiry,
+	}
+}
+
+// register binds every setting to a flag of the same name.
+func (c *Config) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.Addr, "addr", c.Addr, "address to listen on")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "log level: debug, info, warn or error")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "log format: text or json")
+	fs.StringVar(&c.PublicURL, "public-url", c.PublicURL, "URL users open the app at, e.g. https://waffle.example.com")
+
+	fs.DurationVar(&c.ReadHeaderTimeout, "read-header-timeout", c.ReadHeaderTimeout, "how long a client may take to send request headers")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", c.IdleTimeout, "how long an idle keep-alive connection is kept open")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "how long requests and transcodes may take to finish on shutdown")
+
+	fs.StringVar(&c.DBPath, "db-path", c.DBPath, "SQLite database file")
+	fs.StringVar(&c.VideosDir, "videos-dir", c.VideosDir, "directory for uploaded and transcoded videos")
+	fs.StringVar(&c.ProfilesPath, "profiles-path", c.ProfilesPath, "JSON file of transcoding profiles, used if it exists")
+
+	fs.StringVar(&c.BlobStore, "blob-store", c.BlobStore, "where video files are stored: local or s3")
+	fs.StringVar(&c.S3Endpoint, "s3-endpoint", c.S3Endpoint, "S3-compatible endpoint URL, e.g. http://localhost:9000")
+	fs.StringVar(&c.S3Region, "s3-region", c.S3Region, "S3 region")
+	fs.StringVar(&c.S3Bucket, "s3-bucket", c.S3Bucket, "S3 bucket holding video files")
+	fs.StringVar(&c.S3AccessKey, "s3-access-key", c.S3AccessKey, "S3 access key id")
+	fs.StringVar(&c.S3SecretKey, "s3-secret-key", c.S3SecretKey, "S3 secret access key")
+	fs.BoolVar(&c.S3PathStyle, "s3-path-style", c.S3PathStyle, "address the bucket in the URL path rather than the host name")
+	fs.DurationVar(&c.SignedURLExpiry, "signed-url-expiry", c.SignedURLExpiry, "redirect to signed blob URLs valid this long, 0 to proxy files")
+
+	fs.Int64Var(&c.MaxUploadSize, "max-upload-size", c.MaxUploadSize, "largest accepted upload in bytes")
+	fs.Int64Var(&c.ConversationQuota, "conversation-quota", c.ConversationQuota, "bytes of videos a conversation may store, 0 for no limit")
+	fs.Int64Var(&c.UserQuota, "user-quota", c.UserQuota, "bytes of videos a user may store across conversations, 0 for no limit")
+	fs.DurationVar(&c.UploadExpiry, "upload-expiry", c.UploadExpiry, "how long an idle resumable upload is kept")
+	fs.DurationVar(&c.UploadSweepInterval, "upload-sweep-interval", c.UploadSweepInterval, "how often expired resumable uploads are removed")
+	fs.DurationVar(&c.RetentionSweepInterval, "retention-sweep-interval", c.RetentionSweepInterval, "how often videos past their conversation's retention policy are removed")
+
+	fs.IntVar(&c.TranscodeWorkers, "transcode-workers", c.TranscodeWorkers, "number of concurrent transcoding workers")
+	fs.IntVar(&c.RetryMaxAttempts, "retry-max-attempts", c.RetryMaxAttempts, "transcoding attempts per video before giving up")
+	fs.DurationVar(&c.RetryBackoff, "retry-backoff", c.RetryBackoff, "delay before the first transcoding retry, doubled for each later one")
+	fs.BoolVar(&c.EnableHLS, "enable-hls", c.EnableHLS, "also package videos for adaptive HLS streaming")
+
+	fs.DurationVar(&c.SessionAbsoluteTimeout, "session-absolute-timeout", c.SessionAbsoluteTimeout, "session lifetime from login, 0 for no limit")
+	fs.DurationVar(&c.SessionIdleTimeout, "session-idle-timeout", c.SessionIdleTimeout, "session lifetime without activity, 0 for no limit")
+	fs.DurationVar(&c.SessionSweepInterval, "session-sweep-interval", c.SessionSweepInterval, "how often expired sessions are removed")
+
+	fs.StringVar(&c.Mailer, "mailer", c.Mailer, "how emails are sent: file or smtp")
+	fs.StringVar(&c.MailDir, "mail-dir", c.MailDir, "directory emails are written to when mailer is file")
+	fs.StringVar(&c.MailFrom, "mail-from", c.MailFrom, "sender of emails, e.g. \"Wednesday Waffle <waffle@example.com>\"")
+	fs.StringVar(&c.SMTPAddr, "smtp-addr", c.SMTPAddr, "SMTP relay host:port, e.g. smtp.example.com:587")
+	fs.StringVar(&c.SMTPUsername, "smtp-username", c.SMTPUsername, "SMTP username, if the relay requires authentication")
+	fs.StringVar(&c.SMTPPassword, "smtp-password", c.SMTPPassword, "SMTP password")
+	fs.DurationVar(&c.MagicLinkExpiry, "magic-link-expiry", c.MagicLinkExpiry, "how long an emailed sign-in link works")
+}
+
+// Load builds the configuration from the defaults, the config file named
+// by -config or WAFFLE_CONFIG, the environment and the command-line
+// arguments (without the program name), then validates it. Arguments after
+// the flags are returned in Args.
+func Load(args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	c := Default()
+	fs := flag.NewFlagSet("waffle", flag.ContinueOnError)
+	c.register(fs)
+	configEnv, _ := lookupEnv(EnvName("config"))
+	configPath := fs.String("config", configEnv, "JSON config file")
+
+	// Flags are parsed first so that the file and environment can skip the
+	// settings they override.
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	c.Args = fs.Args()
+	fromFlags := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { fromFlags[f.Name] = true })
+	fromFlags["config"] = true
+
+	if *configPath != "" {
+		values, err := readFile(*configPath)
+		if err != nil {
+			return nil, err
+		}
+		for name, value := range values {
+			if fs.Lookup(name) == nil || name == "config" {
+				return nil, fmt.Errorf("%s: unknown setting %q", *configPath, name)
+			}
+			if fromFlags[name] {
+				continue
+			}
+			if err := fs.Set(name, value); err != nil {
+				return nil, fmt.Errorf("%s: invalid %s: %w", *configPath, name, err)
+			}
+		}
+	}
+
+	var envErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		if fromFlags[f.Name] || envErr != nil {
+			return
+		}
+		if value, ok := lookupEnv(EnvName(f.Name)); ok {
+			if err := fs.Set(f.Name, value); err != nil {
+				envErr = fmt.Errorf("invalid %s: %w", EnvName(f.Name), err)
+			}
+		}
+	})
+	if envErr != nil {
+		return nil, envErr
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// EnvName returns the environment variable for a setting.
+func EnvName(setting string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(setting, "-", "_"))
+}
+
+// readFile reads a JSON object of setting names to values. Values are
+// returned in the same string form a flag would take.
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+
+	var raw map[string]any
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("parse config %s: %w", path, err)
+	}
+
+	values := make(map[string]string, len(raw))
+	for name, v := range raw {
+		switch v := v.(type) {
+		case string:
+			values[name] = v
+		case json.Number:
+			values[name] = v.String()
+		case bool:
+			values[name] = fmt.Sprint(v)
+		default:
+			return nil, fmt.Errorf("%s: %s must be a string, number or boolean", path, name)
+		}
+	}
+	return values, nil
+}
+
+// Validate reports the first setting with an unusable value.
+func (c *Config) Validate() error {
+	var level slog.Level
+	switch {
+	case c.Addr == "":
+		return errors.New("addr is required")
+	case level.UnmarshalText([]byte(c.LogLevel)) != nil:
+		return fmt.Errorf("log-level must be debug, info, warn or error, got %q", c.LogLevel)
+	case c.LogFormat != "text" && c.LogFormat != "json":
+		return fmt.Errorf("log-format must be text or json, got %q", c.LogFormat)
+	case !validPublicURL(c.PublicURL):
+		return fmt.Errorf("public-url must be an http or https URL without a path, got %q", c.PublicURL)
+	case c.ReadHeaderTimeout <= 0 || c.IdleTimeout <= 0:
+		return errors.New("read-header-timeout and idle-timeout must be positive")
+	case c.ShutdownTimeout < 0:
+		return errors.New("shutdown-timeout must not be negative")
+	case c.DBPath == "":
+		return errors.New("db-path is required")
+	case c.VideosDir == "":
+		return errors.New("videos-dir is required")
+	case c.BlobStore != "local" && c.BlobStore != "s3":
+		return fmt.Errorf("blob-store must be local or s3, got %q", c.BlobStore)
+	case c.BlobStore == "s3" && (c.S3Endpoint == "" || c.S3Bucket == "" || c.S3AccessKey == "" || c.S3SecretKey == ""):
+		return errors.New("blob-store s3 requires s3-endpoint, s3-bucket, s3-access-key and s3-secret-key")
+	case c.SignedURLExpiry < 0:
+		return errors.New("signed-url-expiry must not be negative")
+	case c.MaxUploadSize <= 0:
+		return errors.New("max-upload-size must be positive")
+	case c.ConversationQuota < 0 || c.UserQuota < 0:
+		return errors.New("conversation-quota and user-quota must not be negative")
+	case c.UploadExpiry <= 0:
+		return errors.New("upload-expiry must be positive")
+	case c.UploadSweepInterval <= 0:
+		return errors.New("upload-sweep-interval must be positive")
+	case c.RetentionSweepInterval <= 0:
+		return errors.New("retention-sweep-interval must be positive")
+	case c.TranscodeWorkers < 1:
+		return errors.New("transcode-workers must be at least 1")
+	case c.RetryMaxAttempts < 1:
+		return errors.New("retry-max-attempts must be at least 1")
+	case c.RetryBackoff < 0:
+		return errors.New("retry-backoff must not be negative")
+	case c.SessionAbsoluteTimeout < 0 || c.SessionIdleTimeout < 0:
+		return errors.New("session timeouts must not be negative")
+	case c.SessionSweepInterval <= 0:
+		return errors.New("session-sweep-interval must be positive")
+	case c.Mailer != "file" && c.Mailer != "smtp":
+		return fmt.Errorf("mailer must be file or smtp, got %q", c.Mailer)
+	case c.Mailer == "file" && c.MailDir == "":
+		return errors.New("mailer file requires mail-dir")
+	case c.Mailer == "smtp" && c.SMTPAddr == "":
+		return errors.New("mailer smtp requires smtp-addr")
+	case !validSender(c.MailFrom):
+		return fmt.Errorf("mail-from must be an email address, got %q", c.MailFrom)
+	case c.MagicLinkExpiry <= 0:
+		return errors.New("magic-link-expiry must be positive")
+	}
+	return nil
+}
+
+// NewLogger returns a logger writing to w at the configured level and in
+// the configured format.
+func (c *Config) NewLogger(w io.Writer) *slog.Logger {
+	var level slog.Level
+	level.UnmarshalText([]byte(c.LogLevel))
+	opts := &slog.HandlerOptions{Level: level}
+	if c.LogFormat == "json" {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// RelyingParty returns the site passkeys are registered with, as given by
+// PublicURL.
+func (c *Config) RelyingParty() auth.RelyingParty {
+	u, _ := url.Parse(c.PublicURL)
+	return auth.RelyingParty{
+		ID:     u.Hostname(),
+		Name:   auth.DefaultRelyingParty.Name,
+		Origin: u.Scheme + "://" + u.Host,
+	}
+}
+
+func validPublicURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" &&
+		(u.Path == "" || u.Path == "/") && u.RawQuery == "" && u.Fragment == ""
+}
+
+func validSender(s string) bool {
+	_, err := mail.ParseAddress(s)
+	return err == nil
+}
+
+// NewMailer returns the configured way of sending emails.
+func (c *Config) NewMailer() email.Mailer {
+	if c.Mailer == "smtp" {
+		return &email.SMTPMailer{
+			Addr:     c.SMTPAddr,
+			Username: c.SMTPUsername,
+			Password: c.SMTPPassword,
+			From:     c.MailFrom,
+		}
+	}
+	return &email.FileMailer{Dir: c.MailDir, From: c.MailFrom}
+}
+
+// NewBlobStore returns the configured store for video files.
+func (c *Config) NewBlobStore() storage.BlobStore {
+	if c.BlobStore == "s3" {
+		return &storage.S3BlobStore{
+			Endpoint:  c.S3Endpoint,
+			Region:    c.S3Region,
+			Bucket:    c.S3Bucket,
+			AccessKey: c.S3AccessKey,
+			SecretKey: c.S3SecretKey,
+			PathStyle: c.S3PathStyle,
+		}
+	}
+	return storage.NewLocalBlobStore(c.VideosDir, videos.BlobURLPrefix)
+}
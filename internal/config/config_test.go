@@ -0,0 +1,147 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"waffle-app/internal/config"
+)
+
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+}
+
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "waffle.json")
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	return path
+}
+
+func TestLoad_Defaults(t *testing.T) {
+	cfg, err := config.Load(nil, env(nil))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !reflect.DeepEqual(cfg, config.Default()) {
+		t.Errorf("expected defaults, got %+v", cfg)
+	}
+}
+
+func TestLoad_Precedence(t *testing.T) {
+	path := writeConfig(t, `{
+		"addr": ":7000",
+		"db-path": "/data/file.db",
+		"videos-dir": "/data/videos",
+		"max-upload-size": 1073741824,
+		"enable-hls": false,
+		"session-idle-timeout": "48h"
+	}`)
+
+	cfg, err := config.Load(
+		[]string{"-config", path, "-addr", ":9000"},
+		env(map[string]string{
+			"WAFFLE_ADDR":       ":8000",
+			"WAFFLE_DB_PATH":    "/env/waffle.db",
+			"WAFFLE_LOG_FORMAT": "json",
+		}),
+	)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	if cfg.Addr != ":9000" {
+		t.Errorf("expected flag to win, got addr %q", cfg.Addr)
+	}
+	if cfg.DBPath != "/env/waffle.db" {
+		t.Errorf("expected environment to override file, got db-path %q", cfg.DBPath)
+	}
+	if cfg.LogFormat != "json" {
+		t.Errorf("expected environment to override default, got log-format %q", cfg.LogFormat)
+	}
+	if cfg.VideosDir != "/data/videos" || cfg.MaxUploadSize != 1<<30 || cfg.EnableHLS || cfg.SessionIdleTimeout != 48*time.Hour {
+		t.Errorf("expected file values to override defaults, got %+v", cfg)
+	}
+	if cfg.TranscodeWorkers != config.Default().TranscodeWorkers {
+		t.Errorf("expected unset values to keep their default, got %d workers", cfg.TranscodeWorkers)
+	}
+}
+
+func TestLoad_ConfigPathFromEnvironment(t *testing.T) {
+	path := writeConfig(t, `{"transcode-workers": 4}`)
+
+	cfg, err := config.Load(nil, env(map[string]string{"WAFFLE_CONFIG": path}))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.TranscodeWorkers != 4 {
+		t.Errorf("expected 4 workers from file, got %d", cfg.TranscodeWorkers)
+	}
+}
+
+func TestLoad_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		args []string
+		env  map[string]string
+		want string
+	}{
+		{name: "unknown file setting", file: `{"adress": ":80"}`, want: `unknown setting "adress"`},
+		{name: "bad file value", file: `{"upload-expiry": "tomorrow"}`, want: "invalid upload-expiry"},
+		{name: "nested file value", file: `{"addr": {"port": 80}}`, want: "must be a string, number or boolean"},
+		{name: "bad env value", env: map[string]string{"WAFFLE_TRANSCODE_WORKERS": "many"}, want: "invalid WAFFLE_TRANSCODE_WORKERS"},
+		{name: "unknown flag", args: []string{"-verbose"}, want: "flag provided but not defined"},
+		{name: "log level", args: []string{"-log-level", "loud"}, want: "log-level"},
+		{name: "log format", env: map[string]string{"WAFFLE_LOG_FORMAT": "xml"}, want: "log-format"},
+		{name: "workers", args: []string{"-transcode-workers", "0"}, want: "transcode-workers"},
+		{name: "upload size", args: []string{"-max-upload-size", "-1"}, want: "max-upload-size"},
+		{name: "negative quota", env: map[string]string{"WAFFLE_USER_QUOTA": "-1"}, want: "user-quota"},
+		{name: "blob store", args: []string{"-blob-store", "gcs"}, want: "blob-store"},
+		{name: "s3 without bucket", args: []string{"-blob-store", "s3", "-s3-endpoint", "http://localhost:9000"}, want: "s3-bucket"},
+		{name: "smtp without address", args: []string{"-mailer", "smtp"}, want: "smtp-addr"},
+		{name: "public url with path", args: []string{"-public-url", "https://waffle.example.com/app"}, want: "public-url"},
+		{name: "negative timeout", args: []string{"-session-idle-timeout", "-1h"}, want: "session timeouts"},
+		{name: "idle timeout", args: []string{"-idle-timeout", "0s"}, want: "idle-timeout"},
+		{name: "empty path", args: []string{"-db-path", ""}, want: "db-path"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"-config", writeConfig(t, tt.file)}, args...)
+			}
+			_, err := config.Load(args, env(tt.env))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestLoad_Args(t *testing.T) {
+	cfg, err := config.Load([]string{"-db-path", "/data/waffle.db", "migrate", "down", "2"}, env(nil))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.DBPath != "/data/waffle.db" {
+		t.Errorf("expected db-path from flag, got %q", cfg.DBPath)
+	}
+	if !reflect.DeepEqual(cfg.Args, []string{"migrate", "down", "2"}) {
+		t.Errorf("expected subcommand arguments, got %q", cfg.Args)
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	if got := config.EnvName("session-idle-timeout"); got != "WAFFLE_SESSION_IDLE_TIMEOUT" {
+		t.Errorf("unexpected env name %q", got)
+	}
+}
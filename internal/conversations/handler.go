@@ -4,20 +4,38 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"slices"
+	"strings"
+	"time"
 	"waffle-app/internal/auth"
 	"waffle-app/internal/storage"
 )
 
+// Deleter deletes a conversation and everything in it.
+type Deleter interface {
+	DeleteConversation(id string) error
+}
+
 type Handler struct {
 	DB       *storage.DB
-	Sessions *auth.Store
+	Sessions auth.SessionStore
+	// Deleter deletes conversations. It defaults to DB, which leaves the
+	// videos' files behind; the videos handler removes them too.
+	Deleter Deleter
+	// Profiles are the transcoding profile names a conversation may choose.
+	Profiles []string
+	// ConversationQuota and UserQuota are the storage quotas reported by
+	// Usage, in bytes. Zero means no limit.
+	ConversationQuota int64
+	UserQuota         int64
 }
 
-func NewHandler(db *storage.DB, sessions *auth.Store) *Handler {
-	return &Handler{DB: db, Sessions: sessions}
+func NewHandler(db *storage.DB, sessions auth.SessionStore) *Handler {
+	return &Handler{DB: db, Sessions: sessions, Deleter: db}
 }
 
 // POST /api/conversations
@@ -51,19 +69,13 @@ func (h *Handler) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.DB.CreateConversation(id, inviteCode, body.Name); err != nil {
+	// Creator automatically joins the conversation as its owner
+	if err := h.DB.CreateConversation(id, inviteCode, body.Name, session.Username); err != nil {
 		slog.Error("failed to create conversation", "error", err)
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
 
-	// Creator automatically joins the conversation
-	if err := h.DB.AddMember(id, session.Username); err != nil {
-		slog.Error("failed to add creator as member", "error", err)
-		http.Error(w, "internal error", http.StatusInternalServerError)
-		return
-	}
-
 	slog.Info("conversation created", "id", id, "name", body.Name, "creator", session.Username)
 
 	w.Header().Set("Content-Type", "application/json")
@@ -76,7 +88,7 @@ func (h *Handler) Create(w http.ResponseWriter, r *http.Request) {
 }
 
 // GET /api/conversations
-// Response: [{ "id": "...", "invite_code": "...", "name": "..." }, ...]
+// Response: [{ "id": "...", "name": "...", "retention": {...} }, ...]
 func (h *Handler) List(w http.ResponseWriter, r *http.Request) {
 	session, ok := h.requireSession(w, r)
 	if !ok {
@@ -93,78 +105,244 @@ func (h *Handler) List(w http.ResponseWriter, r *http.Request) {
 	slog.Debug("listed conversations", "username", session.Username, "count", len(conversations))
 
 	type response struct {
-		ID         string `json:"id"`
-		InviteCode string `json:"invite_code"`
-		Name       string `json:"name"`
+		ID        string             `json:"id"`
+		Name      string             `json:"name"`
+		Profile   string             `json:"profile,omitempty"`
+		Retention *retentionResponse `json:"retention,omitempty"`
 	}
 	result := make([]response, 0, len(conversations))
 	for _, c := range conversations {
-		result = append(result, response{ID: c.ID, InviteCode: c.InviteCode, Name: c.Name})
+		resp := response{ID: c.ID, Name: c.Name, Profile: c.Profile}
+		if !c.Retention.Unlimited() {
+			retention := retentionResponse(c.Retention)
+			resp.Retention = &retention
+		}
+		result = append(result, resp)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(result)
 }
 
-// POST /api/conversations/join
-// Body: { "invite_code": "...", "username": "..." }
-func (h *Handler) Join(w http.ResponseWriter, r *http.Request) {
+// PATCH /api/conversations/{id}
+// Body: { "name": "Book Club", "profile": "1080p", "retention": { "weeks": 4, "videos": 0, "bytes": 0 } }
+// Any field may be omitted. Only the conversation's owner and admins may
+// rename it or change its profile, which sets the transcoding profile for
+// new uploads; "" restores the server default. The retention policy limits
+// which videos the conversation keeps, zero meaning unlimited, and only the
+// owner may change it. The fields given change together or not at all.
+func (h *Handler) Update(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireSession(w, r)
+	if !ok {
+		return
+	}
+
+	conversationID := r.PathValue("id")
+	role, ok := auth.RequireRole(w, h.DB, session, conversationID, storage.RoleMember)
+	if !ok {
+		return
+	}
+
 	var body struct {
-		InviteCode string `json:"invite_code"`
-		Username   string `json:"username"`
+		Name      *string            `json:"name"`
+		Profile   *string            `json:"profile"`
+		Retention *retentionResponse `json:"retention"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.InviteCode == "" || body.Username == "" {
-		http.Error(w, "invalid body: 'invite_code' and 'username' are required", http.StatusBadRequest)
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || (body.Name == nil && body.Profile == nil && body.Retention == nil) {
+		http.Error(w, "invalid body: 'name', 'profile' or 'retention' is required", http.StatusBadRequest)
 		return
 	}
+	if body.Name != nil {
+		if strings.TrimSpace(*body.Name) == "" {
+			http.Error(w, "invalid body: 'name' must not be empty", http.StatusBadRequest)
+			return
+		}
+		if !storage.RoleAtLeast(role, storage.RoleAdmin) {
+			http.Error(w, "only the conversation owner and admins can rename it", http.StatusForbidden)
+			return
+		}
+	}
+	if body.Profile != nil {
+		if *body.Profile != "" && !slices.Contains(h.Profiles, *body.Profile) {
+			http.Error(w, fmt.Sprintf("unknown profile %q", *body.Profile), http.StatusBadRequest)
+			return
+		}
+		if !storage.RoleAtLeast(role, storage.RoleAdmin) {
+			http.Error(w, "only the conversation owner and admins can change the profile", http.StatusForbidden)
+			return
+		}
+	}
+	if body.Retention != nil {
+		if body.Retention.Weeks < 0 || body.Retention.Videos < 0 || body.Retention.Bytes < 0 {
+			http.Error(w, "invalid body: retention limits must not be negative", http.StatusBadRequest)
+			return
+		}
+		if role != storage.RoleOwner {
+			http.Error(w, "only the conversation owner can change retention", http.StatusForbidden)
+			return
+		}
+	}
 
-	conversation, err := h.DB.GetConversationByInviteCode(body.InviteCode)
-	if err != nil {
-		slog.Error("failed to look up invite code", "error", err)
+	update := storage.ConversationUpdate{Name: body.Name, Profile: body.Profile}
+	if body.Retention != nil {
+		policy := storage.Retention(*body.Retention)
+		update.Retention = &policy
+	}
+	if err := h.DB.UpdateConversation(conversationID, update); err != nil {
+		slog.Error("failed to update conversation", "error", err, "conversation_id", conversationID)
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
-	if conversation == nil {
-		slog.Warn("invalid invite code used", "invite_code", body.InviteCode, "username", body.Username)
-		http.Error(w, "invalid invite code", http.StatusUnauthorized)
+	if body.Name != nil {
+		slog.Info("conversation renamed", "conversation_id", conversationID, "name", *body.Name, "username", session.Username)
+	}
+	if body.Profile != nil {
+		slog.Info("conversation profile changed", "conversation_id", conversationID, "profile", *body.Profile, "username", session.Username)
+	}
+	if p := update.Retention; p != nil {
+		slog.Info("conversation retention changed", "conversation_id", conversationID,
+			"weeks", p.Weeks, "videos", p.Videos, "bytes", p.Bytes, "username", session.Username)
+	}
+
+	conversation, err := h.DB.GetConversation(conversationID)
+	if err != nil || conversation == nil {
+		slog.Error("failed to reload conversation", "error", err, "conversation_id", conversationID)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"id":        conversationID,
+		"name":      conversation.Name,
+		"profile":   conversation.Profile,
+		"retention": retentionResponse(conversation.Retention),
+	})
+}
+
+// DELETE /api/conversations/{id}
+// Deletes the conversation with all of its videos. Only its owner may.
+func (h *Handler) Delete(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireSession(w, r)
+	if !ok {
+		return
+	}
+
+	conversationID := r.PathValue("id")
+	if _, ok := auth.RequireRole(w, h.DB, session, conversationID, storage.RoleOwner); !ok {
+		return
+	}
+
+	if err := h.Deleter.DeleteConversation(conversationID); err != nil {
+		slog.Error("failed to delete conversation", "error", err, "conversation_id", conversationID)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("conversation deleted", "conversation_id", conversationID, "username", session.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// retentionResponse is the JSON form of a storage.Retention.
+type retentionResponse struct {
+	Weeks  int   `json:"weeks"`
+	Videos int   `json:"videos"`
+	Bytes  int64 `json:"bytes"`
+}
+
+// GET /api/conversations/{id}/usage
+// Response: { "conversation": { "used_bytes": ..., "quota_bytes": ... }, "user": { ... }, "uploaders": { "alice": ..., ... } }
+// Reports the bytes stored for the conversation, for the requesting user
+// across every conversation, and for each uploader in the conversation.
+// quota_bytes is omitted when there is no limit.
+func (h *Handler) Usage(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireSession(w, r)
+	if !ok {
 		return
 	}
 
-	if err := h.DB.AddMember(conversation.ID, body.Username); err != nil {
-		slog.Error("failed to add member", "error", err)
+	conversationID := r.PathValue("id")
+	if _, ok := auth.RequireRole(w, h.DB, session, conversationID, storage.RoleMember); !ok {
+		return
+	}
+
+	conversationUsed, byUploader, err := h.DB.GetConversationUsage(conversationID)
+	if err != nil {
+		slog.Error("failed to get conversation usage", "error", err, "conversation_id", conversationID)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	userUsed, err := h.DB.GetUploaderUsage(session.Username)
+	if err != nil {
+		slog.Error("failed to get user usage", "error", err, "username", session.Username)
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
 
-	token, err := h.Sessions.Create(body.Username)
+	type usage struct {
+		UsedBytes  int64 `json:"used_bytes"`
+		QuotaBytes int64 `json:"quota_bytes,omitempty"`
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Conversation usage            `json:"conversation"`
+		User         usage            `json:"user"`
+		Uploaders    map[string]int64 `json:"uploaders"`
+	}{
+		Conversation: usage{UsedBytes: conversationUsed, QuotaBytes: h.ConversationQuota},
+		User:         usage{UsedBytes: userUsed, QuotaBytes: h.UserQuota},
+		Uploaders:    byUploader,
+	})
+}
+
+// POST /api/conversations/join
+// Body: { "invite_code": "..." }
+// Response: { "conversation_id": "...", "username": "alice" }
+// Adds the signed-in user to the conversation the invite code belongs to,
+// if the code hasn't been revoked, expired or been used up.
+func (h *Handler) Join(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireSession(w, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		InviteCode string `json:"invite_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.InviteCode == "" {
+		http.Error(w, "invalid body: 'invite_code' is required", http.StatusBadRequest)
+		return
+	}
+
+	conversationID, err := h.DB.RedeemInvite(body.InviteCode, session.Username, time.Now())
+	if errors.Is(err, storage.ErrInviteUnusable) {
+		slog.Warn("unusable invite code used", "invite_code", body.InviteCode, "username", session.Username)
+		http.Error(w, "invite code revoked, expired or used up", http.StatusGone)
+		return
+	}
 	if err != nil {
-		slog.Error("failed to create session", "error", err)
+		slog.Error("failed to redeem invite code", "error", err)
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
+	if conversationID == "" {
+		slog.Warn("invalid invite code used", "invite_code", body.InviteCode, "username", session.Username)
+		http.Error(w, "invalid invite code", http.StatusUnauthorized)
+		return
+	}
 
-	auth.SetCookie(w, token)
-	slog.Info("user joined conversation", "username", body.Username, "conversation_id", conversation.ID)
+	slog.Info("user joined conversation", "username", session.Username, "conversation_id", conversationID)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
-		"conversation_id": conversation.ID,
-		"username":        body.Username,
+		"conversation_id": conversationID,
+		"username":        session.Username,
 	})
 }
 
 func (h *Handler) requireSession(w http.ResponseWriter, r *http.Request) (*auth.Session, bool) {
-	token, ok := auth.FromRequest(r)
-	if !ok {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
-		return nil, false
-	}
-	session, ok := h.Sessions.Get(token)
-	if !ok {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
-		return nil, false
-	}
-	return session, true
+	return auth.RequireSession(w, r, h.Sessions)
 }
 
 func generateID() (string, error) {
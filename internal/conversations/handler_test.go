@@ -0,0 +1,124 @@
+package conversations_test
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"testing"
+	"waffle-app/internal/storage"
+)
+
+func TestUpdate_Profile(t *testing.T) {
+	s := setupTest(t)
+
+	tests := []struct {
+		actor, body string
+		want        int
+	}{
+		{"mallory", `{"profile":"480p"}`, http.StatusForbidden},
+		{"alice", `{"profile":"480p"}`, http.StatusForbidden},
+		{"dave", `{"profile":"720p"}`, http.StatusOK},
+		{"carol", `{"profile":"480p"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		rr := s.do(t, tt.actor, "PATCH", "/api/conversations/conv-1", tt.body)
+		if rr.Code != tt.want {
+			t.Errorf("%s %s: expected %d, got %d: %s", tt.actor, tt.body, tt.want, rr.Code, rr.Body.String())
+		}
+	}
+
+	if c, _ := s.db.GetConversation("conv-1"); c.Profile != "480p" {
+		t.Errorf("expected profile %q, got %q", "480p", c.Profile)
+	}
+}
+
+func TestUpdate_UnknownProfile(t *testing.T) {
+	s := setupTest(t)
+
+	if rr := s.do(t, "carol", "PATCH", "/api/conversations/conv-1", `{"profile":"8k"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rr.Code)
+	}
+	if rr := s.do(t, "carol", "PATCH", "/api/conversations/conv-1", `{"profile":""}`); rr.Code != http.StatusOK {
+		t.Errorf("server default: expected 200, got %d", rr.Code)
+	}
+}
+
+func TestUpdate_Retention(t *testing.T) {
+	s := setupTest(t)
+
+	tests := []struct {
+		actor, body string
+		want        int
+	}{
+		{"carol", `{"retention":{"weeks":-1}}`, http.StatusBadRequest},
+		{"carol", `{"retention":{"bytes":-1}}`, http.StatusBadRequest},
+		{"dave", `{"retention":{"weeks":4}}`, http.StatusForbidden},
+		{"alice", `{"retention":{"weeks":4}}`, http.StatusForbidden},
+		{"carol", `{"retention":{"weeks":4,"videos":50}}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		rr := s.do(t, tt.actor, "PATCH", "/api/conversations/conv-1", tt.body)
+		if rr.Code != tt.want {
+			t.Errorf("%s %s: expected %d, got %d: %s", tt.actor, tt.body, tt.want, rr.Code, rr.Body.String())
+		}
+	}
+
+	want := storage.Retention{Weeks: 4, Videos: 50}
+	if c, _ := s.db.GetConversation("conv-1"); c.Retention != want {
+		t.Errorf("expected retention %+v, got %+v", want, c.Retention)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	s := setupTest(t)
+	s.h.ConversationQuota = 1000
+	if err := s.db.CreateConversation("conv-2", "invite-def", "Other", "alice"); err != nil {
+		t.Fatalf("CreateConversation: %v", err)
+	}
+	for _, v := range []struct {
+		id, conversationID, uploader string
+		bytes                        int64
+	}{
+		{"vid-1", "conv-1", "alice", 100},
+		{"vid-2", "conv-1", "alice", 50},
+		{"vid-3", "conv-1", "bob", 200},
+		{"vid-4", "conv-2", "alice", 400},
+	} {
+		if err := s.db.CreateVideo(&storage.Video{ID: v.id, ConversationID: v.conversationID, Uploader: v.uploader, Filename: v.id + ".mp4"}); err != nil {
+			t.Fatalf("CreateVideo: %v", err)
+		}
+		if err := s.db.SetVideoStoredBytes(v.id, v.bytes); err != nil {
+			t.Fatalf("SetVideoStoredBytes: %v", err)
+		}
+	}
+
+	rr := s.do(t, "alice", "GET", "/api/conversations/conv-1/usage", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(rr.Body.Bytes(), &raw); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if string(raw["user"]) != `{"used_bytes":550}` {
+		t.Errorf("expected user usage across conversations without a quota, got %s", raw["user"])
+	}
+	var usage struct {
+		Conversation struct {
+			UsedBytes  int64 `json:"used_bytes"`
+			QuotaBytes int64 `json:"quota_bytes"`
+		} `json:"conversation"`
+		Uploaders map[string]int64 `json:"uploaders"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &usage)
+	if usage.Conversation.UsedBytes != 350 || usage.Conversation.QuotaBytes != 1000 {
+		t.Errorf("unexpected conversation usage %+v", usage.Conversation)
+	}
+	if want := map[string]int64{"alice": 150, "bob": 200}; !maps.Equal(usage.Uploaders, want) {
+		t.Errorf("expected uploaders %v, got %v", want, usage.Uploaders)
+	}
+
+	if rr := s.do(t, "mallory", "GET", "/api/conversations/conv-1/usage", ""); rr.Code != http.StatusForbidden {
+		t.Errorf("non-member: expected 403, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,159 @@
+package conversations
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+	"waffle-app/internal/auth"
+	"waffle-app/internal/storage"
+)
+
+// inviteResponse is the JSON form of a storage.Invite.
+type inviteResponse struct {
+	Code      string     `json:"code"`
+	MaxUses   int        `json:"max_uses"`
+	Uses      int        `json:"uses"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	Active    bool       `json:"active"`
+}
+
+func newInviteResponse(i *storage.Invite, now time.Time) inviteResponse {
+	resp := inviteResponse{
+		Code:      i.Code,
+		MaxUses:   i.MaxUses,
+		Uses:      i.Uses,
+		CreatedAt: i.CreatedAt,
+		Active:    i.Usable(now),
+	}
+	if !i.ExpiresAt.IsZero() {
+		resp.ExpiresAt = &i.ExpiresAt
+	}
+	if !i.RevokedAt.IsZero() {
+		resp.RevokedAt = &i.RevokedAt
+	}
+	return resp
+}
+
+// POST /api/conversations/{id}/invites
+// Body (optional): { "expires_at": "2024-06-01T00:00:00Z", "max_uses": 10 }
+// Response: { "code": "...", "max_uses": 10, "uses": 0, "expires_at": "...", "created_at": "...", "active": true }
+// Creates an invite code. Without an expiry or a limit on its uses, it works
+// until revoked. Only the conversation's owner may.
+func (h *Handler) CreateInvite(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireSession(w, r)
+	if !ok {
+		return
+	}
+
+	conversationID := r.PathValue("id")
+	if _, ok := auth.RequireRole(w, h.DB, session, conversationID, storage.RoleOwner); !ok {
+		return
+	}
+
+	var body struct {
+		ExpiresAt *time.Time `json:"expires_at"`
+		MaxUses   int        `json:"max_uses"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		http.Error(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	if body.MaxUses < 0 {
+		http.Error(w, "invalid body: 'max_uses' must not be negative", http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	invite := &storage.Invite{ConversationID: conversationID, MaxUses: body.MaxUses, CreatedAt: now}
+	if body.ExpiresAt != nil {
+		if !body.ExpiresAt.After(now) {
+			http.Error(w, "invalid body: 'expires_at' must be in the future", http.StatusBadRequest)
+			return
+		}
+		invite.ExpiresAt = *body.ExpiresAt
+	}
+
+	code, err := generateInviteCode()
+	if err != nil {
+		slog.Error("failed to generate invite code", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	invite.Code = code
+	if err := h.DB.CreateInvite(invite); err != nil {
+		slog.Error("failed to create invite", "error", err, "conversation_id", conversationID)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("invite created", "conversation_id", conversationID, "username", session.Username,
+		"max_uses", invite.MaxUses, "expires_at", invite.ExpiresAt)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newInviteResponse(invite, now))
+}
+
+// GET /api/conversations/{id}/invites
+// Response: [{ "code": "...", "max_uses": 0, "uses": 3, "created_at": "...", "active": true }, ...]
+// Lists every invite code, newest first, including revoked and expired
+// ones. Only the conversation's owner may.
+func (h *Handler) ListInvites(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireSession(w, r)
+	if !ok {
+		return
+	}
+
+	conversationID := r.PathValue("id")
+	if _, ok := auth.RequireRole(w, h.DB, session, conversationID, storage.RoleOwner); !ok {
+		return
+	}
+
+	invites, err := h.DB.GetInvitesByConversation(conversationID)
+	if err != nil {
+		slog.Error("failed to list invites", "error", err, "conversation_id", conversationID)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	result := make([]inviteResponse, 0, len(invites))
+	for i := range invites {
+		result = append(result, newInviteResponse(&invites[i], now))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// DELETE /api/conversations/{id}/invites/{code}
+// Revokes an invite code, so that nobody else can join with it. People who
+// already joined stay. Only the conversation's owner may.
+func (h *Handler) RevokeInvite(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireSession(w, r)
+	if !ok {
+		return
+	}
+
+	conversationID, code := r.PathValue("id"), r.PathValue("code")
+	if _, ok := auth.RequireRole(w, h.DB, session, conversationID, storage.RoleOwner); !ok {
+		return
+	}
+
+	found, err := h.DB.RevokeInvite(conversationID, code, time.Now())
+	if err != nil {
+		slog.Error("failed to revoke invite", "error", err, "conversation_id", conversationID)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "invite not found", http.StatusNotFound)
+		return
+	}
+
+	slog.Info("invite revoked", "conversation_id", conversationID, "invite_code", code, "username", session.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
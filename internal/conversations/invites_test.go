@@ -0,0 +1,144 @@
+package conversations_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+	"waffle-app/internal/storage"
+)
+
+func TestInvites_OwnerOnly(t *testing.T) {
+	s := setupTest(t)
+
+	for _, username := range []string{"mallory", "alice", "dave"} {
+		if rr := s.do(t, username, "POST", "/api/conversations/conv-1/invites", ""); rr.Code != http.StatusForbidden {
+			t.Errorf("%s create: expected 403, got %d", username, rr.Code)
+		}
+		if rr := s.do(t, username, "GET", "/api/conversations/conv-1/invites", ""); rr.Code != http.StatusForbidden {
+			t.Errorf("%s list: expected 403, got %d", username, rr.Code)
+		}
+		if rr := s.do(t, username, "DELETE", "/api/conversations/conv-1/invites/invite-abc", ""); rr.Code != http.StatusForbidden {
+			t.Errorf("%s revoke: expected 403, got %d", username, rr.Code)
+		}
+	}
+	if invite, _ := s.db.GetInvite("invite-abc"); !invite.RevokedAt.IsZero() {
+		t.Error("expected the invite not to be revoked")
+	}
+}
+
+func TestInvites_CreateListRevoke(t *testing.T) {
+	s := setupTest(t)
+
+	expiresAt := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	body := fmt.Sprintf(`{"expires_at":%q,"max_uses":5}`, expiresAt.Format(time.RFC3339))
+	rr := s.do(t, "carol", "POST", "/api/conversations/conv-1/invites", body)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create: expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var created struct {
+		Code      string    `json:"code"`
+		MaxUses   int       `json:"max_uses"`
+		ExpiresAt time.Time `json:"expires_at"`
+		CreatedAt time.Time `json:"created_at"`
+		Active    bool      `json:"active"`
+	}
+	json.NewDecoder(rr.Body).Decode(&created)
+	if created.Code == "" || created.MaxUses != 5 || !created.ExpiresAt.Equal(expiresAt) || !created.Active {
+		t.Errorf("unexpected invite %+v", created)
+	}
+
+	for _, body := range []string{`{"max_uses":-1}`, `{"expires_at":"2001-01-01T00:00:00Z"}`} {
+		if rr := s.do(t, "carol", "POST", "/api/conversations/conv-1/invites", body); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, rr.Code)
+		}
+	}
+
+	rr = s.do(t, "carol", "DELETE", "/api/conversations/conv-1/invites/invite-abc", "")
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("revoke: expected 204, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := s.do(t, "carol", "DELETE", "/api/conversations/conv-1/invites/nonexistent", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("revoke unknown: expected 404, got %d", rr.Code)
+	}
+
+	rr = s.do(t, "carol", "GET", "/api/conversations/conv-1/invites", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("list: expected 200, got %d", rr.Code)
+	}
+	var invites []struct {
+		Code      string     `json:"code"`
+		RevokedAt *time.Time `json:"revoked_at"`
+		CreatedAt time.Time  `json:"created_at"`
+		Active    bool       `json:"active"`
+	}
+	json.NewDecoder(rr.Body).Decode(&invites)
+	if len(invites) != 2 || invites[0].Code != created.Code || !invites[0].Active {
+		t.Fatalf("expected the new invite first, got %+v", invites)
+	}
+	if !invites[0].CreatedAt.Equal(created.CreatedAt) {
+		t.Errorf("expected the creation time %v reported on create, got %v", created.CreatedAt, invites[0].CreatedAt)
+	}
+	if invites[1].Code != "invite-abc" || invites[1].Active || invites[1].RevokedAt == nil {
+		t.Errorf("expected the first invite to be revoked, got %+v", invites[1])
+	}
+}
+
+func TestJoin(t *testing.T) {
+	s := setupTest(t)
+	now := time.Now()
+	for _, invite := range []*storage.Invite{
+		{Code: "once", ConversationID: "conv-1", MaxUses: 1},
+		{Code: "expired", ConversationID: "conv-1", ExpiresAt: now.Add(-time.Minute)},
+		{Code: "revoked", ConversationID: "conv-1"},
+	} {
+		if err := s.db.CreateInvite(invite); err != nil {
+			t.Fatalf("CreateInvite: %v", err)
+		}
+	}
+	if _, err := s.db.RevokeInvite("conv-1", "revoked", now); err != nil {
+		t.Fatalf("RevokeInvite: %v", err)
+	}
+	if err := s.db.CreateUser(&storage.User{ID: "id-erin", Username: "erin"}); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+
+	join := func(username, code string) int {
+		return s.do(t, username, "POST", "/api/conversations/join", `{"invite_code":"`+code+`"}`).Code
+	}
+	if code := join("mallory", "once"); code != http.StatusOK {
+		t.Fatalf("join: expected 200, got %d", code)
+	}
+	if role := s.role(t, "mallory"); role != storage.RoleMember {
+		t.Errorf("expected mallory to join as a member, got %q", role)
+	}
+	// A member joining again doesn't use up the invite
+	if code := join("alice", "once"); code != http.StatusOK {
+		t.Errorf("existing member: expected 200, got %d", code)
+	}
+	if code := join("mallory", "once"); code != http.StatusOK {
+		t.Errorf("repeat join: expected 200, got %d", code)
+	}
+	if invite, _ := s.db.GetInvite("once"); invite.Uses != 1 {
+		t.Errorf("expected one use, got %d", invite.Uses)
+	}
+
+	tests := []struct {
+		code string
+		want int
+	}{
+		{"once", http.StatusGone},
+		{"expired", http.StatusGone},
+		{"revoked", http.StatusGone},
+		{"nonexistent", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if got := join("erin", tt.code); got != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.code, tt.want, got)
+		}
+	}
+	if role := s.role(t, "erin"); role != "" {
+		t.Errorf("expected erin not to join, got %q", role)
+	}
+}
@@ -0,0 +1,157 @@
+package conversations
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+	"waffle-app/internal/auth"
+	"waffle-app/internal/storage"
+)
+
+// GET /api/conversations/{id}/members
+// Response: [{ "username": "alice", "role": "owner", "joined_at": "..." }, ...]
+// Lists the members, owner and admins first.
+func (h *Handler) Members(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireSession(w, r)
+	if !ok {
+		return
+	}
+
+	conversationID := r.PathValue("id")
+	if _, ok := auth.RequireRole(w, h.DB, session, conversationID, storage.RoleMember); !ok {
+		return
+	}
+
+	members, err := h.DB.GetMembers(conversationID)
+	if err != nil {
+		slog.Error("failed to list members", "error", err, "conversation_id", conversationID)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	type response struct {
+		Username string    `json:"username"`
+		Role     string    `json:"role"`
+		JoinedAt time.Time `json:"joined_at"`
+	}
+	result := make([]response, 0, len(members))
+	for _, m := range members {
+		result = append(result, response(m))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// PUT /api/conversations/{id}/members/{username}/role
+// Body: { "role": "admin" }
+// Response: { "username": "bob", "role": "admin" }
+// Promotes a member to admin, or demotes an admin to member. Only the
+// conversation's owner may, and their own role can't be changed.
+func (h *Handler) SetRole(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireSession(w, r)
+	if !ok {
+		return
+	}
+
+	conversationID, username := r.PathValue("id"), r.PathValue("username")
+	if _, ok := auth.RequireRole(w, h.DB, session, conversationID, storage.RoleOwner); !ok {
+		return
+	}
+
+	var body struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || (body.Role != storage.RoleAdmin && body.Role != storage.RoleMember) {
+		http.Error(w, `invalid body: 'role' must be "admin" or "member"`, http.StatusBadRequest)
+		return
+	}
+
+	current, ok := h.requireMember(w, conversationID, username)
+	if !ok {
+		return
+	}
+	if current == storage.RoleOwner {
+		http.Error(w, "the owner's role can't be changed", http.StatusForbidden)
+		return
+	}
+
+	if err := h.DB.SetMemberRole(conversationID, username, body.Role); err != nil {
+		slog.Error("failed to set member role", "error", err, "conversation_id", conversationID)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("member role changed", "conversation_id", conversationID, "member", username,
+		"from", current, "to", body.Role, "username", session.Username)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"username": username,
+		"role":     body.Role,
+	})
+}
+
+// DELETE /api/conversations/{id}/members/{username}
+// Removes a member from the conversation; their videos stay. Members may
+// leave, except the owner, who deletes the conversation instead. The owner
+// may remove anyone else, and admins may remove members.
+func (h *Handler) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireSession(w, r)
+	if !ok {
+		return
+	}
+
+	conversationID, username := r.PathValue("id"), r.PathValue("username")
+	if username == session.Username {
+		role, ok := auth.RequireRole(w, h.DB, session, conversationID, storage.RoleMember)
+		if !ok {
+			return
+		}
+		if role == storage.RoleOwner {
+			http.Error(w, "the owner can't leave the conversation, only delete it", http.StatusConflict)
+			return
+		}
+	} else {
+		role, ok := auth.RequireRole(w, h.DB, session, conversationID, storage.RoleAdmin)
+		if !ok {
+			return
+		}
+		current, ok := h.requireMember(w, conversationID, username)
+		if !ok {
+			return
+		}
+		if current == role || !storage.RoleAtLeast(role, current) {
+			slog.Warn("member removal attempted without outranking them", "username", session.Username,
+				"conversation_id", conversationID, "member", username)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+	}
+
+	if err := h.DB.RemoveMember(conversationID, username); err != nil {
+		slog.Error("failed to remove member", "error", err, "conversation_id", conversationID)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("member removed", "conversation_id", conversationID, "member", username, "username", session.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requireMember returns the role of the member a request acts on, writing a
+// 404 response if they aren't one.
+func (h *Handler) requireMember(w http.ResponseWriter, conversationID, username string) (string, bool) {
+	role, err := h.DB.GetMemberRole(conversationID, username)
+	if err != nil {
+		slog.Error("failed to get member role", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return "", false
+	}
+	if role == "" {
+		http.Error(w, "member not found", http.StatusNotFound)
+		return "", false
+	}
+	return role, true
+}
@@ -0,0 +1,233 @@
+package conversations_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"waffle-app/internal/auth"
+	"waffle-app/internal/conversations"
+	"waffle-app/internal/storage"
+)
+
+// server routes requests to a conversations handler as cmd/server does, so
+// that path values are set.
+type server struct {
+	*http.ServeMux
+	h        *conversations.Handler
+	db       *storage.DB
+	sessions *auth.Store
+}
+
+// setupTest creates conv-1, owned by carol, with dave as an admin and alice
+// and bob as members. mallory has an account but isn't a member.
+func setupTest(t *testing.T) *server {
+	t.Helper()
+	db, err := storage.New(filepath.Join(t.TempDir(), "waffle.db"))
+	if err != nil {
+		t.Fatalf("open test db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	for _, username := range []string{"carol", "dave", "alice", "bob", "mallory"} {
+		if err := db.CreateUser(&storage.User{ID: "id-" + username, Username: username}); err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+	}
+	if err := db.CreateConversation("conv-1", "invite-abc", "Test Group", "carol"); err != nil {
+		t.Fatalf("CreateConversation: %v", err)
+	}
+	for _, username := range []string{"dave", "alice", "bob"} {
+		if err := db.AddMember("conv-1", username); err != nil {
+			t.Fatalf("AddMember: %v", err)
+		}
+	}
+	if err := db.SetMemberRole("conv-1", "dave", storage.RoleAdmin); err != nil {
+		t.Fatalf("SetMemberRole: %v", err)
+	}
+
+	sessions := auth.NewStore(auth.DefaultTimeouts)
+	h := conversations.NewHandler(db, sessions)
+	h.Profiles = []string{"480p", "720p"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/conversations/join", h.Join)
+	mux.HandleFunc("POST /api/conversations", h.Create)
+	mux.HandleFunc("PATCH /api/conversations/{id}", h.Update)
+	mux.HandleFunc("DELETE /api/conversations/{id}", h.Delete)
+	mux.HandleFunc("GET /api/conversations/{id}/usage", h.Usage)
+	mux.HandleFunc("GET /api/conversations/{id}/members", h.Members)
+	mux.HandleFunc("PUT /api/conversations/{id}/members/{username}/role", h.SetRole)
+	mux.HandleFunc("DELETE /api/conversations/{id}/members/{username}", h.RemoveMember)
+	mux.HandleFunc("POST /api/conversations/{id}/invites", h.CreateInvite)
+	mux.HandleFunc("GET /api/conversations/{id}/invites", h.ListInvites)
+	mux.HandleFunc("DELETE /api/conversations/{id}/invites/{code}", h.RevokeInvite)
+	return &server{ServeMux: mux, h: h, db: db, sessions: sessions}
+}
+
+// do sends a request with a JSON body, signed in as username.
+func (s *server) do(t *testing.T, username, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	session, err := s.sessions.Create(username)
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	req.AddCookie(&http.Cookie{Name: "waffle_session", Value: session.Token})
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+	return rr
+}
+
+func (s *server) role(t *testing.T, username string) string {
+	t.Helper()
+	role, err := s.db.GetMemberRole("conv-1", username)
+	if err != nil {
+		t.Fatalf("GetMemberRole: %v", err)
+	}
+	return role
+}
+
+func TestMembers(t *testing.T) {
+	s := setupTest(t)
+
+	rr := s.do(t, "alice", "GET", "/api/conversations/conv-1/members", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var members []struct {
+		Username string `json:"username"`
+		Role     string `json:"role"`
+	}
+	json.NewDecoder(rr.Body).Decode(&members)
+	if len(members) != 4 || members[0].Username != "carol" || members[0].Role != storage.RoleOwner ||
+		members[1].Username != "dave" || members[1].Role != storage.RoleAdmin {
+		t.Errorf("expected owner and admin first, got %+v", members)
+	}
+
+	if rr := s.do(t, "mallory", "GET", "/api/conversations/conv-1/members", ""); rr.Code != http.StatusForbidden {
+		t.Errorf("non-member: expected 403, got %d", rr.Code)
+	}
+}
+
+func TestSetRole(t *testing.T) {
+	s := setupTest(t)
+
+	tests := []struct {
+		name, actor, target, body string
+		want                      int
+	}{
+		{"non-member", "mallory", "bob", `{"role":"admin"}`, http.StatusForbidden},
+		{"member", "alice", "bob", `{"role":"admin"}`, http.StatusForbidden},
+		{"admin", "dave", "bob", `{"role":"admin"}`, http.StatusForbidden},
+		{"owner's own role", "carol", "carol", `{"role":"member"}`, http.StatusForbidden},
+		{"transfer ownership", "carol", "bob", `{"role":"owner"}`, http.StatusBadRequest},
+		{"not a member", "carol", "mallory", `{"role":"admin"}`, http.StatusNotFound},
+		{"promote", "carol", "bob", `{"role":"admin"}`, http.StatusOK},
+		{"demote", "carol", "dave", `{"role":"member"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		rr := s.do(t, tt.actor, "PUT", "/api/conversations/conv-1/members/"+tt.target+"/role", tt.body)
+		if rr.Code != tt.want {
+			t.Errorf("%s: expected %d, got %d: %s", tt.name, tt.want, rr.Code, rr.Body.String())
+		}
+	}
+
+	for username, want := range map[string]string{
+		"carol": storage.RoleOwner, "bob": storage.RoleAdmin, "dave": storage.RoleMember, "mallory": "",
+	} {
+		if got := s.role(t, username); got != want {
+			t.Errorf("%s: expected role %q, got %q", username, want, got)
+		}
+	}
+}
+
+func TestRemoveMember(t *testing.T) {
+	s := setupTest(t)
+	if err := s.db.AddMember("conv-1", "mallory"); err != nil {
+		t.Fatalf("AddMember: %v", err)
+	}
+	if err := s.db.SetMemberRole("conv-1", "mallory", storage.RoleAdmin); err != nil {
+		t.Fatalf("SetMemberRole: %v", err)
+	}
+
+	tests := []struct {
+		name, actor, target string
+		want                int
+	}{
+		{"member removes member", "alice", "bob", http.StatusForbidden},
+		{"member removes admin", "alice", "dave", http.StatusForbidden},
+		{"admin removes admin", "dave", "mallory", http.StatusForbidden},
+		{"admin removes owner", "dave", "carol", http.StatusForbidden},
+		{"owner leaves", "carol", "carol", http.StatusConflict},
+		{"admin removes member", "dave", "bob", http.StatusNoContent},
+		{"owner removes admin", "carol", "mallory", http.StatusNoContent},
+		{"member leaves", "alice", "alice", http.StatusNoContent},
+		{"not a member", "carol", "alice", http.StatusNotFound},
+		{"non-member leaves", "alice", "alice", http.StatusForbidden},
+		{"non-member removes member", "bob", "dave", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		rr := s.do(t, tt.actor, "DELETE", "/api/conversations/conv-1/members/"+tt.target, "")
+		if rr.Code != tt.want {
+			t.Errorf("%s: expected %d, got %d: %s", tt.name, tt.want, rr.Code, rr.Body.String())
+		}
+	}
+
+	for username, want := range map[string]string{
+		"carol": storage.RoleOwner, "dave": storage.RoleAdmin, "alice": "", "bob": "", "mallory": "",
+	} {
+		if got := s.role(t, username); got != want {
+			t.Errorf("%s: expected role %q, got %q", username, want, got)
+		}
+	}
+}
+
+func TestUpdate_Rename(t *testing.T) {
+	s := setupTest(t)
+
+	tests := []struct {
+		actor, body string
+		want        int
+	}{
+		{"mallory", `{"name":"Mallory's"}`, http.StatusForbidden},
+		{"alice", `{"name":"Alice's"}`, http.StatusForbidden},
+		{"dave", `{"name":"  "}`, http.StatusBadRequest},
+		{"dave", `{"name":"Book Club"}`, http.StatusOK},
+		{"carol", `{"name":"Wednesday Waffle"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		rr := s.do(t, tt.actor, "PATCH", "/api/conversations/conv-1", tt.body)
+		if rr.Code != tt.want {
+			t.Errorf("%s %s: expected %d, got %d: %s", tt.actor, tt.body, tt.want, rr.Code, rr.Body.String())
+		}
+	}
+
+	if c, _ := s.db.GetConversation("conv-1"); c.Name != "Wednesday Waffle" {
+		t.Errorf("expected the owner's name to stick, got %q", c.Name)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	s := setupTest(t)
+
+	for _, username := range []string{"mallory", "alice", "dave"} {
+		if rr := s.do(t, username, "DELETE", "/api/conversations/conv-1", ""); rr.Code != http.StatusForbidden {
+			t.Errorf("%s: expected 403, got %d", username, rr.Code)
+		}
+	}
+	if c, _ := s.db.GetConversation("conv-1"); c == nil {
+		t.Fatal("expected the conversation to survive")
+	}
+
+	if rr := s.do(t, "carol", "DELETE", "/api/conversations/conv-1", ""); rr.Code != http.StatusNoContent {
+		t.Fatalf("owner: expected 204, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if c, _ := s.db.GetConversation("conv-1"); c != nil {
+		t.Errorf("expected the conversation to be deleted, got %+v", c)
+	}
+	if role := s.role(t, "alice"); role != "" {
+		t.Errorf("expected members to be removed, got %q", role)
+	}
+}
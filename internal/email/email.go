@@ -0,0 +1,95 @@
+// Package email sends the server's emails, such as sign-in links, through
+// a pluggable Mailer: SMTP in production, or files on disk for development
+// and tests.
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Message is a plain-text email to a single recipient.
+type Message struct {
+	To      string // a bare address, e.g. "alice@example.com"
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// ValidAddress reports whether s is a bare email address, without a
+// display name or angle brackets.
+func ValidAddress(s string) bool {
+	addr, err := mail.ParseAddress(s)
+	return err == nil && addr.Name == "" && addr.Address == s
+}
+
+// format renders the message with its headers, ready to be sent.
+func (m Message) format(from string, now time.Time) ([]byte, error) {
+	if !ValidAddress(m.To) {
+		return nil, fmt.Errorf("invalid recipient %q", m.To)
+	}
+	if strings.ContainsAny(m.Subject, "\r\n") {
+		return nil, errors.New("subject contains a line break")
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", m.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	w := quotedprintable.NewWriter(&b)
+	w.Write([]byte(strings.ReplaceAll(m.Body, "\n", "\r\n")))
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// FileMailer writes each message to a file in Dir instead of sending it,
+// and logs where. It is meant for development and tests, where following
+// a sign-in link means opening the file.
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+func (m *FileMailer) Send(ctx context.Context, msg Message) error {
+	data, err := msg.format(m.From, time.Now())
+	if err != nil {
+		return fmt.Errorf("format email: %w", err)
+	}
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return fmt.Errorf("create mail dir: %w", err)
+	}
+
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), hex.EncodeToString(suffix))
+	path := filepath.Join(m.Dir, name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return fmt.Errorf("write email: %w", err)
+	}
+
+	slog.Info("email written to file", "to", msg.To, "subject", msg.Subject, "path", path)
+	return nil
+}
@@ -0,0 +1,137 @@
+package email_test
+
+import (
+	"bufio"
+	"io"
+	"mime/quotedprintable"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"waffle-app/internal/email"
+)
+
+var message = email.Message{
+	To:      "alice@example.com",
+	Subject: "Sign in to Wednesday Waffle",
+	Body:    "Follow this link to sign in:\nhttp://localhost:8080/api/auth/magic?token=" + strings.Repeat("ab", 32) + "\n",
+}
+
+// body decodes the body of a formatted message.
+func body(t *testing.T, raw string) string {
+	t.Helper()
+	_, encoded, ok := strings.Cut(raw, "\r\n\r\n")
+	if !ok {
+		t.Fatalf("no body in %q", raw)
+	}
+	decoded, err := io.ReadAll(quotedprintable.NewReader(strings.NewReader(encoded)))
+	if err != nil {
+		t.Fatalf("decode body: %v", err)
+	}
+	return strings.ReplaceAll(string(decoded), "\r\n", "\n")
+}
+
+func TestFileMailer(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	mailer := &email.FileMailer{Dir: dir, From: "Waffle <waffle@localhost>"}
+
+	if err := mailer.Send(t.Context(), message); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected one file, got %v, %v", entries, err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, entries[0].Name()))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	for _, header := range []string{"From: Waffle <waffle@localhost>\r\n", "To: alice@example.com\r\n", "Subject: Sign in to Wednesday Waffle\r\n"} {
+		if !strings.Contains(string(data), header) {
+			t.Errorf("expected %q in %q", header, data)
+		}
+	}
+	if got := body(t, string(data)); got != message.Body {
+		t.Errorf("expected body %q, got %q", message.Body, got)
+	}
+}
+
+func TestFileMailer_RejectsHeaderInjection(t *testing.T) {
+	mailer := &email.FileMailer{Dir: t.TempDir(), From: "waffle@localhost"}
+
+	for _, msg := range []email.Message{
+		{To: "alice@example.com\r\nBcc: mallory@example.com", Subject: "Hi"},
+		{To: "Alice <alice@example.com>", Subject: "Hi"},
+		{To: "alice@example.com", Subject: "Hi\r\nBcc: mallory@example.com"},
+	} {
+		if err := mailer.Send(t.Context(), msg); err == nil {
+			t.Errorf("expected %+v to be rejected", msg)
+		}
+	}
+}
+
+func TestSMTPMailer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	// A minimal SMTP server accepting a single message
+	received := make(chan string, 1)
+	var recipients []string
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+		reply("220 localhost ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			command := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(command, "EHLO"):
+				reply("250 localhost")
+			case strings.HasPrefix(command, "RCPT TO:"):
+				recipients = append(recipients, strings.TrimSpace(line[len("RCPT TO:"):]))
+				reply("250 OK")
+			case command == "DATA":
+				reply("354 go ahead")
+				var data strings.Builder
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+					data.WriteString(line)
+				}
+				received <- data.String()
+				reply("250 OK")
+			case command == "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+	}()
+
+	mailer := &email.SMTPMailer{Addr: ln.Addr().String(), From: "Waffle <waffle@localhost>"}
+	if err := mailer.Send(t.Context(), message); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	data := <-received
+	if len(recipients) != 1 || recipients[0] != "<alice@example.com>" {
+		t.Errorf("expected one recipient, got %v", recipients)
+	}
+	if got := body(t, data); got != message.Body {
+		t.Errorf("expected body %q, got %q", message.Body, got)
+	}
+}
@@ -0,0 +1,286 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BlobStore holds video files as objects addressed by slash-separated keys
+// such as "<conversation id>/<video id>.mp4". Methods that look up a
+// missing object return an error matching fs.ErrNotExist.
+type BlobStore interface {
+	// Put stores size bytes read from r under key, replacing any existing
+	// object.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Get returns length bytes of the object starting at offset. A negative
+	// length reads to the end.
+	Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+	// Stat describes the object without reading it.
+	Stat(ctx context.Context, key string) (*BlobInfo, error)
+	// Delete removes the object. Deleting a missing object is not an error.
+	Delete(ctx context.Context, key string) error
+	// List describes every object whose key starts with prefix.
+	List(ctx context.Context, prefix string) ([]BlobInfo, error)
+	// SignedURL returns a URL from which the object can be fetched without a
+	// session until expiry has passed.
+	SignedURL(ctx context.Context, key string, expiry time.Duration) (string, error)
+}
+
+type BlobInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// blobContentType returns the media type an object is served with, from
+// its key's extension.
+func blobContentType(key string) string {
+	switch path.Ext(key) {
+	case ".m3u8":
+		return "application/vnd.apple.mpegurl"
+	case ".ts":
+		return "video/mp2t"
+	case ".webp":
+		return "image/webp"
+	}
+	if t := mime.TypeByExtension(path.Ext(key)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// LocalBlobStore keeps objects as files under Dir, each key naming a path
+// relative to it. Signed URLs point at the store itself, which serves them
+// as an http.Handler mounted at URLPrefix.
+type LocalBlobStore struct {
+	Dir       string
+	URLPrefix string // e.g. "/api/blobs"
+
+	secret []byte // signs URLs; they stop working when the process exits
+}
+
+var _ BlobStore = (*LocalBlobStore)(nil)
+
+// putTempPrefix marks files still being written by Put.
+const putTempPrefix = ".put-"
+
+func NewLocalBlobStore(dir, urlPrefix string) *LocalBlobStore {
+	return &LocalBlobStore{Dir: dir, URLPrefix: urlPrefix, secret: []byte(rand.Text())}
+}
+
+// path returns the file holding key, rejecting keys that would escape Dir.
+func (s *LocalBlobStore) path(key string) (string, error) {
+	if key == "" || !filepath.IsLocal(filepath.FromSlash(key)) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(s.Dir, filepath.FromSlash(key)), nil
+}
+
+func (s *LocalBlobStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	dest, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	// Written beside the destination and renamed into place, so readers
+	// never see a partial object.
+	var f *os.File
+	for range 2 {
+		if err = os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return fmt.Errorf("put blob: %w", err)
+		}
+		// Delete may remove the directory once it is empty; try again if
+		// that happened in between.
+		f, err = os.CreateTemp(filepath.Dir(dest), putTempPrefix+"*")
+		if !errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("put blob: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	n, err := io.Copy(f, r)
+	if err != nil {
+		return fmt.Errorf("put blob: %w", err)
+	}
+	if n != size {
+		return fmt.Errorf("put blob: read %d bytes, expected %d", n, size)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("put blob: %w", err)
+	}
+	if err := os.Rename(f.Name(), dest); err != nil {
+		return fmt.Errorf("put blob: %w", err)
+	}
+	return nil
+}
+
+func (s *LocalBlobStore) Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, fmt.Errorf("get blob: %w", err)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("get blob: %w", err)
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, length), f}, nil
+}
+
+func (s *LocalBlobStore) Stat(ctx context.Context, key string) (*BlobInfo, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, fmt.Errorf("stat blob: %w", err)
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("stat blob %q: %w", key, fs.ErrNotExist)
+	}
+	return &BlobInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// Delete removes the object's file, and then any directories left empty
+// between it and Dir.
+func (s *LocalBlobStore) Delete(ctx context.Context, key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("delete blob: %w", err)
+	}
+	for dir := path.Dir(key); dir != "."; dir = path.Dir(dir) {
+		if os.Remove(filepath.Join(s.Dir, filepath.FromSlash(dir))) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *LocalBlobStore) List(ctx context.Context, prefix string) ([]BlobInfo, error) {
+	// Only the directory the prefix ends in needs walking.
+	dir := prefix
+	if !strings.HasSuffix(dir, "/") {
+		dir = path.Dir(dir)
+	}
+	root := filepath.Join(s.Dir, filepath.FromSlash(dir))
+
+	var blobs []BlobInfo
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), putTempPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(s.Dir, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		blobs = append(blobs, BlobInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list blobs: %w", err)
+	}
+	return blobs, nil
+}
+
+func (s *LocalBlobStore) SignedURL(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	if _, err := s.path(key); err != nil {
+		return "", err
+	}
+	expires := strconv.FormatInt(time.Now().Add(expiry).Unix(), 10)
+	q := url.Values{"expires": {expires}, "signature": {s.sign(key, expires)}}
+	return s.URLPrefix + "/" + escapeKey(key) + "?" + q.Encode(), nil
+}
+
+func (s *LocalBlobStore) sign(key, expires string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(key + "\n" + expires))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// ServeHTTP serves objects at their signed URLs. Range and conditional
+// requests are supported.
+func (s *LocalBlobStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key, ok := strings.CutPrefix(r.URL.Path, s.URLPrefix+"/")
+	expires := r.URL.Query().Get("expires")
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if !ok || err != nil || time.Now().Unix() > unix ||
+		!hmac.Equal([]byte(r.URL.Query().Get("signature")), []byte(s.sign(key, expires))) {
+		http.Error(w, "invalid or expired signature", http.StatusForbidden)
+		return
+	}
+
+	p, err := s.path(key)
+	if err != nil {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", blobContentType(key))
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
+
+// escapeKey percent-encodes each segment of a key for use in a URL path.
+func escapeKey(key string) string {
+	segments := strings.Split(key, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,159 @@
+package storage_test
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+	"waffle-app/internal/storage"
+)
+
+func TestConnectionSettings(t *testing.T) {
+	db := newTestDB(t)
+
+	var mode string
+	if err := db.QueryRow(`PRAGMA journal_mode`).Scan(&mode); err != nil {
+		t.Fatalf("journal_mode: %v", err)
+	}
+	if mode != "wal" {
+		t.Errorf("expected WAL journal mode, got %q", mode)
+	}
+
+	// Every pooled connection enforces foreign keys, not just the first
+	conns := make([]*sql.Conn, 0, 3)
+	for range 3 {
+		conn, err := db.Conn(t.Context())
+		if err != nil {
+			t.Fatalf("Conn: %v", err)
+		}
+		conns = append(conns, conn)
+	}
+	for i, conn := range conns {
+		var enabled int
+		if err := conn.QueryRowContext(t.Context(), `PRAGMA foreign_keys`).Scan(&enabled); err != nil {
+			t.Fatalf("foreign_keys: %v", err)
+		}
+		if enabled != 1 {
+			t.Errorf("connection %d: expected foreign keys on, got %d", i, enabled)
+		}
+		conn.Close()
+	}
+}
+
+// TestConcurrentWrites hammers the database from many goroutines the way
+// transcoding workers and request handlers do, and expects no SQLITE_BUSY
+// errors.
+func TestConcurrentWrites(t *testing.T) {
+	db := newTestDB(t)
+	if err := db.CreateConversation("conv-1", "invite-abc", "Test Group", ""); err != nil {
+		t.Fatalf("CreateConversation: %v", err)
+	}
+
+	const writers, rounds = 16, 20
+	for w := range writers {
+		createUser(t, db, fmt.Sprintf("user-%d", w))
+	}
+	errs := make(chan error, writers*rounds*4)
+	var wg, writing sync.WaitGroup
+
+	// Request handlers: create videos and queue their jobs
+	for w := range writers {
+		writing.Go(func() {
+			for r := range rounds {
+				id := fmt.Sprintf("vid-%d-%d", w, r)
+				if err := db.CreateVideo(&storage.Video{ID: id, ConversationID: "conv-1", Uploader: "alice", Filename: id + ".mp4"}); err != nil {
+					errs <- fmt.Errorf("CreateVideo: %w", err)
+					continue
+				}
+				if _, err := db.EnqueueJob(id, id+".mov", id+".mp4", 3); err != nil {
+					errs <- fmt.Errorf("EnqueueJob: %w", err)
+				}
+				if err := db.AddMember("conv-1", fmt.Sprintf("user-%d", w)); err != nil {
+					errs <- fmt.Errorf("AddMember: %w", err)
+				}
+			}
+		})
+	}
+
+	writersDone := make(chan struct{})
+	go func() {
+		writing.Wait()
+		close(writersDone)
+	}()
+
+	// Transcoding workers: claim jobs and update their videos until the
+	// writers have finished and the queue is empty
+	var done sync.Map
+	for range 4 {
+		wg.Go(func() {
+			for {
+				// Checked before claiming, so that finding no job afterwards
+				// means every job has been claimed
+				finished := false
+				select {
+				case <-writersDone:
+					finished = true
+				default:
+				}
+				job, err := db.ClaimJob(time.Now())
+				if err != nil {
+					errs <- fmt.Errorf("ClaimJob: %w", err)
+					return
+				}
+				if job == nil {
+					if finished {
+						return
+					}
+					time.Sleep(time.Millisecond)
+					continue
+				}
+				if err := db.UpdateVideoStatus(job.VideoID, "ready"); err != nil {
+					errs <- fmt.Errorf("UpdateVideoStatus: %w", err)
+				}
+				variants := []storage.VideoVariant{{Name: "360p", Height: 360, Bandwidth: 896_000, Playlist: "360p/index.m3u8"}}
+				if err := db.SetVideoVariants(job.VideoID, job.VideoID+"/master.m3u8", variants); err != nil {
+					errs <- fmt.Errorf("SetVideoVariants: %w", err)
+				}
+				if err := db.CompleteJob(job.ID); err != nil {
+					errs <- fmt.Errorf("CompleteJob: %w", err)
+				}
+				done.Store(job.ID, true)
+			}
+		})
+	}
+
+	// Readers listing the conversation
+	for range 4 {
+		wg.Go(func() {
+			for range rounds {
+				if _, err := db.GetVideosByConversation("conv-1"); err != nil {
+					errs <- fmt.Errorf("GetVideosByConversation: %w", err)
+				}
+				if _, err := db.GetVariantsByConversation("conv-1"); err != nil {
+					errs <- fmt.Errorf("GetVariantsByConversation: %w", err)
+				}
+			}
+		})
+	}
+
+	wg.Wait()
+	<-writersDone
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	videos, err := db.GetVideosByConversation("conv-1")
+	if err != nil {
+		t.Fatalf("GetVideosByConversation: %v", err)
+	}
+	if len(videos) != writers*rounds {
+		t.Errorf("expected %d videos, got %d", writers*rounds, len(videos))
+	}
+	completed := 0
+	done.Range(func(any, any) bool { completed++; return true })
+	if completed != writers*rounds {
+		t.Errorf("expected %d completed jobs, got %d", writers*rounds, completed)
+	}
+}
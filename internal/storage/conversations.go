@@ -3,86 +3,322 @@ package storage
 import (
 	"database/sql"
 	"fmt"
+	"strings"
 	"time"
 )
 
+// Member roles, from most to least privileged. Owners may do anything;
+// admins manage members and videos; members watch and upload.
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
+// roleRanks orders the roles. Anything else, including "" for someone who
+// isn't a member, ranks below them all.
+var roleRanks = map[string]int{RoleMember: 1, RoleAdmin: 2, RoleOwner: 3}
+
+// RoleAtLeast reports whether role grants everything min does.
+func RoleAtLeast(role, min string) bool {
+	return roleRanks[role] > 0 && roleRanks[role] >= roleRanks[min]
+}
+
+// Member is a user's membership of a conversation.
+type Member struct {
+	Username string
+	Role     string
+	JoinedAt time.Time
+}
+
 type Conversation struct {
-	ID         string
-	InviteCode string
-	Name       string
-	CreatedAt  time.Time
+	ID        string
+	Name      string
+	Profile   string // transcoding profile name, empty for the server default
+	Retention Retention
+	CreatedAt time.Time
 }
 
-func (db *DB) CreateConversation(id, inviteCode, name string) error {
-	_, err := db.Exec(
-		`INSERT INTO conversations (id, invite_code, name) VALUES (?, ?, ?)`,
-		id, inviteCode, name,
-	)
+// Retention limits which videos a conversation keeps. The newest videos are
+// kept until one of the limits is reached. Zero fields are unlimited.
+type Retention struct {
+	Weeks  int   // keep videos uploaded in the last Weeks weeks
+	Videos int   // keep the newest Videos videos
+	Bytes  int64 // keep the newest videos using at most Bytes on disk
+}
+
+// Unlimited reports whether the policy keeps every video.
+func (r Retention) Unlimited() bool {
+	return r.Weeks == 0 && r.Videos == 0 && r.Bytes == 0
+}
+
+const conversationColumns = `id, name, profile, retention_weeks, retention_videos, retention_bytes, created_at`
+
+func scanConversation(row interface{ Scan(...any) error }) (*Conversation, error) {
+	c := &Conversation{}
+	err := row.Scan(&c.ID, &c.Name, &c.Profile,
+		&c.Retention.Weeks, &c.Retention.Videos, &c.Retention.Bytes, &c.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// CreateConversation creates a conversation with a first invite code,
+// which has no expiry or limit on its uses, and makes the existing user
+// creator its owner. An empty creator leaves the conversation without
+// members.
+func (db *DB) CreateConversation(id, inviteCode, name, creator string) error {
+	tx, err := db.Begin()
 	if err != nil {
+		return fmt.Errorf("begin create conversation: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`INSERT INTO conversations (id, name) VALUES (?, ?)`, id, name); err != nil {
 		return fmt.Errorf("create conversation: %w", err)
 	}
+	if _, err := tx.Exec(`INSERT INTO invites (code, conversation_id) VALUES (?, ?)`, inviteCode, id); err != nil {
+		return fmt.Errorf("create invite: %w", err)
+	}
+	if creator != "" {
+		_, err := tx.Exec(
+			`INSERT INTO members (conversation_id, user_id, role) VALUES (?, (SELECT id FROM users WHERE username = ?), ?)`,
+			id, creator, RoleOwner,
+		)
+		if err != nil {
+			return fmt.Errorf("add owner: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit create conversation: %w", err)
+	}
 	return nil
 }
 
-func (db *DB) GetConversationByInviteCode(inviteCode string) (*Conversation, error) {
+func (db *DB) GetConversation(id string) (*Conversation, error) {
 	row := db.QueryRow(
-		`SELECT id, invite_code, name, created_at FROM conversations WHERE invite_code = ?`,
-		inviteCode,
+		`SELECT `+conversationColumns+` FROM conversations WHERE id = ?`,
+		id,
 	)
-	c := &Conversation{}
-	err := row.Scan(&c.ID, &c.InviteCode, &c.Name, &c.CreatedAt)
+	c, err := scanConversation(row)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
-		return nil, fmt.Errorf("get conversation by invite code: %w", err)
+		return nil, fmt.Errorf("get conversation: %w", err)
 	}
 	return c, nil
 }
 
+// ConversationUpdate holds the settings to change on a conversation. Nil
+// fields are left as they are.
+type ConversationUpdate struct {
+	Name      *string
+	Profile   *string // empty selects the server default
+	Retention *Retention
+}
+
+// UpdateConversation changes a conversation's settings in a single
+// statement, so that either all of them change or none do.
+func (db *DB) UpdateConversation(id string, u ConversationUpdate) error {
+	var set []string
+	var args []any
+	if u.Name != nil {
+		set = append(set, "name = ?")
+		args = append(args, *u.Name)
+	}
+	if u.Profile != nil {
+		set = append(set, "profile = ?")
+		args = append(args, *u.Profile)
+	}
+	if u.Retention != nil {
+		set = append(set, "retention_weeks = ?", "retention_videos = ?", "retention_bytes = ?")
+		args = append(args, u.Retention.Weeks, u.Retention.Videos, u.Retention.Bytes)
+	}
+	if len(set) == 0 {
+		return nil
+	}
+	args = append(args, id)
+	_, err := db.Exec(`UPDATE conversations SET `+strings.Join(set, ", ")+` WHERE id = ?`, args...)
+	if err != nil {
+		return fmt.Errorf("update conversation: %w", err)
+	}
+	return nil
+}
+
+// DeleteConversation removes a conversation along with its members,
+// invites, videos, jobs and uploads. Files are not touched. Deleting a conversation that
+// doesn't exist is not an error.
+func (db *DB) DeleteConversation(id string) error {
+	if _, err := db.Exec(`DELETE FROM conversations WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("delete conversation: %w", err)
+	}
+	return nil
+}
+
+// SetConversationProfile sets the transcoding profile used for new uploads
+// to a conversation. An empty profile selects the server default.
+func (db *DB) SetConversationProfile(id, profile string) error {
+	_, err := db.Exec(`UPDATE conversations SET profile = ? WHERE id = ?`, profile, id)
+	if err != nil {
+		return fmt.Errorf("set conversation profile: %w", err)
+	}
+	return nil
+}
+
 func (db *DB) GetConversationsByUsername(username string) ([]Conversation, error) {
 	rows, err := db.Query(`
-		SELECT c.id, c.invite_code, c.name, c.created_at
-		FROM conversations c
-		JOIN members m ON c.id = m.conversation_id
-		WHERE m.username = ?
-		ORDER BY c.created_at DESC
+		SELECT `+conversationColumns+`
+		FROM conversations
+		WHERE id IN (
+			SELECT m.conversation_id FROM members m JOIN users u ON u.id = m.user_id
+			WHERE u.username = ?
+		)
+		ORDER BY created_at DESC
 	`, username)
 	if err != nil {
 		return nil, fmt.Errorf("get conversations by username: %w", err)
 	}
-	defer rows.Close()
+	return scanConversations(rows)
+}
+
+// GetConversationsWithRetention returns every conversation whose retention
+// policy limits the videos it keeps.
+func (db *DB) GetConversationsWithRetention() ([]Conversation, error) {
+	rows, err := db.Query(`
+		SELECT ` + conversationColumns + `
+		FROM conversations
+		WHERE retention_weeks > 0 OR retention_videos > 0 OR retention_bytes > 0
+		ORDER BY id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("get conversations with retention: %w", err)
+	}
+	return scanConversations(rows)
+}
 
+func scanConversations(rows *sql.Rows) ([]Conversation, error) {
+	defer rows.Close()
 	var conversations []Conversation
 	for rows.Next() {
-		c := Conversation{}
-		if err := rows.Scan(&c.ID, &c.InviteCode, &c.Name, &c.CreatedAt); err != nil {
+		c, err := scanConversation(rows)
+		if err != nil {
 			return nil, fmt.Errorf("scan conversation: %w", err)
 		}
-		conversations = append(conversations, c)
+		conversations = append(conversations, *c)
 	}
-	return conversations, nil
+	return conversations, rows.Err()
 }
 
+// SetConversationRetention replaces a conversation's retention policy.
+func (db *DB) SetConversationRetention(id string, r Retention) error {
+	_, err := db.Exec(
+		`UPDATE conversations SET retention_weeks = ?, retention_videos = ?, retention_bytes = ? WHERE id = ?`,
+		r.Weeks, r.Videos, r.Bytes, id,
+	)
+	if err != nil {
+		return fmt.Errorf("set conversation retention: %w", err)
+	}
+	return nil
+}
+
+// Members are keyed by user ID, but looked up by username, which is what
+// sessions carry.
+
 func (db *DB) IsMember(conversationID, username string) (bool, error) {
 	var count int
-	err := db.QueryRow(
-		`SELECT COUNT(*) FROM members WHERE conversation_id = ? AND username = ?`,
-		conversationID, username,
-	).Scan(&count)
+	err := db.QueryRow(`
+		SELECT COUNT(*) FROM members m JOIN users u ON u.id = m.user_id
+		WHERE m.conversation_id = ? AND u.username = ?
+	`, conversationID, username).Scan(&count)
 	if err != nil {
 		return false, fmt.Errorf("check membership: %w", err)
 	}
 	return count > 0, nil
 }
 
+// AddMember adds an existing user to a conversation. Adding a member again
+// does nothing.
 func (db *DB) AddMember(conversationID, username string) error {
-	_, err := db.Exec(
-		`INSERT OR IGNORE INTO members (conversation_id, username) VALUES (?, ?)`,
-		conversationID, username,
+	user, err := db.GetUserByUsername(username)
+	if err != nil {
+		return fmt.Errorf("add member: %w", err)
+	}
+	if user == nil {
+		return fmt.Errorf("add member: no user %q", username)
+	}
+	_, err = db.Exec(
+		`INSERT OR IGNORE INTO members (conversation_id, user_id) VALUES (?, ?)`,
+		conversationID, user.ID,
 	)
 	if err != nil {
 		return fmt.Errorf("add member: %w", err)
 	}
 	return nil
 }
+
+// GetMemberRole returns the user's role in a conversation, or "" if they are
+// not a member.
+func (db *DB) GetMemberRole(conversationID, username string) (string, error) {
+	var role string
+	err := db.QueryRow(`
+		SELECT m.role FROM members m JOIN users u ON u.id = m.user_id
+		WHERE m.conversation_id = ? AND u.username = ?
+	`, conversationID, username).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("get member role: %w", err)
+	}
+	return role, nil
+}
+
+// SetMemberRole changes the role of an existing member.
+func (db *DB) SetMemberRole(conversationID, username, role string) error {
+	_, err := db.Exec(`
+		UPDATE members SET role = ?
+		WHERE conversation_id = ? AND user_id = (SELECT id FROM users WHERE username = ?)
+	`, role, conversationID, username)
+	if err != nil {
+		return fmt.Errorf("set member role: %w", err)
+	}
+	return nil
+}
+
+// RemoveMember takes a user out of a conversation. Their videos stay.
+// Removing someone who isn't a member is not an error.
+func (db *DB) RemoveMember(conversationID, username string) error {
+	_, err := db.Exec(`
+		DELETE FROM members
+		WHERE conversation_id = ? AND user_id = (SELECT id FROM users WHERE username = ?)
+	`, conversationID, username)
+	if err != nil {
+		return fmt.Errorf("remove member: %w", err)
+	}
+	return nil
+}
+
+// GetMembers returns a conversation's members, most privileged first, then
+// in the order they joined.
+func (db *DB) GetMembers(conversationID string) ([]Member, error) {
+	rows, err := db.Query(`
+		SELECT u.username, m.role, m.joined_at FROM members m JOIN users u ON u.id = m.user_id
+		WHERE m.conversation_id = ?
+		ORDER BY CASE m.role WHEN 'owner' THEN 0 WHEN 'admin' THEN 1 ELSE 2 END, m.joined_at, u.username
+	`, conversationID)
+	if err != nil {
+		return nil, fmt.Errorf("get members: %w", err)
+	}
+	defer rows.Close()
+	var members []Member
+	for rows.Next() {
+		var m Member
+		if err := rows.Scan(&m.Username, &m.Role, &m.JoinedAt); err != nil {
+			return nil, fmt.Errorf("scan member: %w", err)
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
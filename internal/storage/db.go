@@ -4,6 +4,9 @@ import (
 	"database/sql"
 	"fmt"
 	"log/slog"
+	"net/url"
+	"strings"
+	"time"
 
 	_ "modernc.org/sqlite"
 )
@@ -12,58 +15,77 @@ type DB struct {
 	*sql.DB
 }
 
+// busyTimeout is how long a connection waits for a lock held by another
+// connection before failing with SQLITE_BUSY. Transcoding workers write
+// concurrently with request handlers, so this must be non-zero.
+const busyTimeout = 5 * time.Second
+
+// Connection pool limits. SQLite serializes writers regardless, so more
+// connections only add readers.
+const (
+	maxOpenConns    = 8
+	maxIdleConns    = 4
+	connMaxIdleTime = 5 * time.Minute
+)
+
+// New opens the database at path and applies any pending migrations.
 func New(path string) (*DB, error) {
-	slog.Info("opening database", "path", path)
-	db, err := sql.Open("sqlite", path)
+	db, err := Open(path)
 	if err != nil {
-		return nil, fmt.Errorf("open database: %w", err)
+		return nil, err
 	}
 
-	if err := db.Ping(); err != nil {
-		return nil, fmt.Errorf("ping database: %w", err)
-	}
-
-	if err := migrate(db); err != nil {
+	slog.Info("running database migrations")
+	n, err := db.MigrateUp(0)
+	if err != nil {
+		db.Close()
 		return nil, fmt.Errorf("migrate database: %w", err)
 	}
+	slog.Info("migrations complete", "applied", n, "version", LatestVersion())
 
 	slog.Info("database ready")
-	return &DB{db}, nil
+	return db, nil
 }
 
-func migrate(db *sql.DB) error {
-	slog.Info("running database migrations")
-
-	_, err := db.Exec(`
-		CREATE TABLE IF NOT EXISTS conversations (
-			id          TEXT PRIMARY KEY,
-			invite_code TEXT UNIQUE NOT NULL,
-			name        TEXT NOT NULL,
-			created_at  DATETIME DEFAULT CURRENT_TIMESTAMP
-		);
-
-		CREATE TABLE IF NOT EXISTS members (
-			conversation_id TEXT NOT NULL,
-			username        TEXT NOT NULL,
-			joined_at       DATETIME DEFAULT CURRENT_TIMESTAMP,
-			PRIMARY KEY (conversation_id, username),
-			FOREIGN KEY (conversation_id) REFERENCES conversations(id)
-		);
-
-		CREATE TABLE IF NOT EXISTS videos (
-			id              TEXT PRIMARY KEY,
-			conversation_id TEXT NOT NULL,
-			uploader        TEXT NOT NULL,
-			filename        TEXT NOT NULL,
-			status          TEXT NOT NULL DEFAULT 'pending',
-			uploaded_at     DATETIME DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY (conversation_id) REFERENCES conversations(id)
-		);
-	`)
+// Open opens the database at path without migrating it.
+func Open(path string) (*DB, error) {
+	slog.Info("opening database", "path", path)
+	db, err := sql.Open("sqlite", dsn(path))
 	if err != nil {
-		return fmt.Errorf("create tables: %w", err)
+		return nil, fmt.Errorf("open database: %w", err)
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("ping database: %w", err)
 	}
+	db.SetMaxOpenConns(maxOpenConns)
+	db.SetMaxIdleConns(maxIdleConns)
+	db.SetConnMaxIdleTime(connMaxIdleTime)
+	return &DB{db}, nil
+}
 
-	slog.Info("migrations complete")
-	return nil
+// dsn appends connection settings to the database path. The driver applies
+// them to every new connection in the pool:
+//
+//   - WAL lets readers proceed while a write is in progress.
+//   - foreign_keys enforces the schema's FOREIGN KEY constraints, which
+//     SQLite ignores by default.
+//   - synchronous NORMAL is durable across application crashes in WAL mode
+//     and avoids an fsync on every commit.
+//   - Immediate transactions take the write lock at BEGIN, so they wait out
+//     busy_timeout instead of failing with SQLITE_BUSY when a read turns
+//     into a write.
+func dsn(path string) string {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	params := url.Values{}
+	params.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", busyTimeout.Milliseconds()))
+	params.Add("_pragma", "foreign_keys(1)")
+	params.Add("_pragma", "journal_mode(WAL)")
+	params.Add("_pragma", "synchronous(NORMAL)")
+	params.Set("_txlock", "immediate")
+	return path + sep + params.Encode()
 }
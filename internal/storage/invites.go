@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrInviteUnusable is returned when redeeming an invite that was revoked,
+// has expired or has been used up.
+var ErrInviteUnusable = errors.New("invite revoked, expired or used up")
+
+// Invite is a code that lets people join a conversation.
+type Invite struct {
+	Code           string
+	ConversationID string
+	MaxUses        int       // zero for unlimited
+	Uses           int       // people who have joined with it
+	ExpiresAt      time.Time // zero if it never expires
+	RevokedAt      time.Time // zero unless revoked
+	CreatedAt      time.Time
+}
+
+// Usable reports whether the invite still lets people join as of now.
+func (i *Invite) Usable(now time.Time) bool {
+	return i.RevokedAt.IsZero() &&
+		(i.ExpiresAt.IsZero() || now.Before(i.ExpiresAt)) &&
+		(i.MaxUses == 0 || i.Uses < i.MaxUses)
+}
+
+const inviteColumns = `code, conversation_id, max_uses, uses, expires_at, revoked_at, created_at`
+
+func scanInvite(row interface{ Scan(...any) error }) (*Invite, error) {
+	i := &Invite{}
+	var expiresAt, revokedAt sql.NullTime
+	if err := row.Scan(&i.Code, &i.ConversationID, &i.MaxUses, &i.Uses, &expiresAt, &revokedAt, &i.CreatedAt); err != nil {
+		return nil, err
+	}
+	i.ExpiresAt = expiresAt.Time
+	i.RevokedAt = revokedAt.Time
+	return i, nil
+}
+
+// nullTime stores a zero time as NULL.
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t.UTC(), Valid: !t.IsZero()}
+}
+
+// CreateInvite stores an invite, created now unless CreatedAt is set.
+// CreatedAt is set to the time stored.
+func (db *DB) CreateInvite(i *Invite) error {
+	if i.CreatedAt.IsZero() {
+		i.CreatedAt = time.Now()
+	}
+	i.CreatedAt = i.CreatedAt.UTC()
+	_, err := db.Exec(
+		`INSERT INTO invites (code, conversation_id, max_uses, expires_at, created_at) VALUES (?, ?, ?, ?, ?)`,
+		i.Code, i.ConversationID, i.MaxUses, nullTime(i.ExpiresAt), i.CreatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("create invite: %w", err)
+	}
+	return nil
+}
+
+func (db *DB) GetInvite(code string) (*Invite, error) {
+	row := db.QueryRow(`SELECT `+inviteColumns+` FROM invites WHERE code = ?`, code)
+	i, err := scanInvite(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get invite: %w", err)
+	}
+	return i, nil
+}
+
+// GetInvitesByConversation returns every invite to a conversation, including
+// revoked and expired ones, newest first.
+func (db *DB) GetInvitesByConversation(conversationID string) ([]Invite, error) {
+	rows, err := db.Query(
+		`SELECT `+inviteColumns+` FROM invites WHERE conversation_id = ? ORDER BY created_at DESC, rowid DESC`,
+		conversationID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("get invites by conversation: %w", err)
+	}
+	defer rows.Close()
+	var invites []Invite
+	for rows.Next() {
+		i, err := scanInvite(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan invite: %w", err)
+		}
+		invites = append(invites, *i)
+	}
+	return invites, rows.Err()
+}
+
+// RevokeInvite stops a conversation's invite from being used, returning
+// false if the conversation has no such invite. Revoking an invite again
+// keeps the time it was first revoked.
+func (db *DB) RevokeInvite(conversationID, code string, now time.Time) (bool, error) {
+	res, err := db.Exec(
+		`UPDATE invites SET revoked_at = coalesce(revoked_at, ?) WHERE conversation_id = ? AND code = ?`,
+		now.UTC(), conversationID, code,
+	)
+	if err != nil {
+		return false, fmt.Errorf("revoke invite: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("revoke invite: %w", err)
+	}
+	return n > 0, nil
+}
+
+// RedeemInvite adds the user to the invite's conversation and counts the
+// use, returning the conversation's ID, or "" if there is no such invite.
+// It returns ErrInviteUnusable if the invite can no longer be used as of
+// now. Redeeming an invite to a conversation the user is already in
+// succeeds without counting a use.
+func (db *DB) RedeemInvite(code, username string, now time.Time) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", fmt.Errorf("begin redeem invite: %w", err)
+	}
+	defer tx.Rollback()
+
+	invite, err := scanInvite(tx.QueryRow(`SELECT `+inviteColumns+` FROM invites WHERE code = ?`, code))
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("get invite: %w", err)
+	}
+	var userID string
+	err = tx.QueryRow(`SELECT id FROM users WHERE username = ?`, username).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("redeem invite: no user %q", username)
+	}
+	if err != nil {
+		return "", fmt.Errorf("redeem invite: %w", err)
+	}
+
+	var members int
+	err = tx.QueryRow(
+		`SELECT COUNT(*) FROM members WHERE conversation_id = ? AND user_id = ?`,
+		invite.ConversationID, userID,
+	).Scan(&members)
+	if err != nil {
+		return "", fmt.Errorf("check membership: %w", err)
+	}
+	if members > 0 {
+		return invite.ConversationID, nil
+	}
+
+	// The conditions repeat Invite.Usable, so that the limit holds however
+	// the transaction is isolated.
+	res, err := tx.Exec(`
+		UPDATE invites SET uses = uses + 1
+		WHERE code = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?) AND (max_uses = 0 OR uses < max_uses)
+	`, code, now.UTC())
+	if err != nil {
+		return "", fmt.Errorf("count invite use: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return "", fmt.Errorf("count invite use: %w", err)
+	} else if n == 0 {
+		return "", ErrInviteUnusable
+	}
+	_, err = tx.Exec(`INSERT INTO members (conversation_id, user_id) VALUES (?, ?)`, invite.ConversationID, userID)
+	if err != nil {
+		return "", fmt.Errorf("add member: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return "", fmt.Errorf("commit redeem invite: %w", err)
+	}
+	return invite.ConversationID, nil
+}
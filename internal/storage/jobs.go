@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Job states.
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// Job is a persisted transcoding job for a video.
+type Job struct {
+	ID          int64
+	VideoID     string
+	InputKey    string // blob key of the original upload
+	OutputKey   string // blob key of the transcoded MP4
+	State       string
+	Attempts    int
+	MaxAttempts int
+	LastError   string
+	RunAt       time.Time
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+const jobColumns = `id, video_id, input_key, output_key, state, attempts, max_attempts, last_error, run_at, created_at, updated_at`
+
+func scanJob(row interface{ Scan(...any) error }) (*Job, error) {
+	j := &Job{}
+	err := row.Scan(&j.ID, &j.VideoID, &j.InputKey, &j.OutputKey, &j.State, &j.Attempts,
+		&j.MaxAttempts, &j.LastError, &j.RunAt, &j.CreatedAt, &j.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// EnqueueJob queues a transcoding job that is ready to run immediately.
+func (db *DB) EnqueueJob(videoID, inputKey, outputKey string, maxAttempts int) (int64, error) {
+	now := time.Now().UTC()
+	res, err := db.Exec(`
+		INSERT INTO jobs (video_id, input_key, output_key, state, max_attempts, run_at, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, videoID, inputKey, outputKey, JobQueued, maxAttempts, now, now, now)
+	if err != nil {
+		return 0, fmt.Errorf("enqueue job: %w", err)
+	}
+	return res.LastInsertId()
+}
+
+// ClaimJob atomically moves the oldest queued job whose run time has passed
+// into the running state and increments its attempt counter. It returns nil
+// if no job is due.
+func (db *DB) ClaimJob(now time.Time) (*Job, error) {
+	now = now.UTC()
+	row := db.QueryRow(`
+		UPDATE jobs
+		SET state = ?, attempts = attempts + 1, updated_at = ?
+		WHERE id = (
+			SELECT id FROM jobs
+			WHERE state = ? AND run_at <= ?
+			ORDER BY run_at, id
+			LIMIT 1
+		)
+		RETURNING `+jobColumns,
+		JobRunning, now, JobQueued, now,
+	)
+	j, err := scanJob(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("claim job: %w", err)
+	}
+	return j, nil
+}
+
+// CompleteJob marks a job as done.
+func (db *DB) CompleteJob(id int64) error {
+	_, err := db.Exec(
+		`UPDATE jobs SET state = ?, last_error = '', updated_at = ? WHERE id = ?`,
+		JobDone, time.Now().UTC(), id,
+	)
+	if err != nil {
+		return fmt.Errorf("complete job: %w", err)
+	}
+	return nil
+}
+
+// RetryJob records a failed attempt and requeues the job to run at runAt.
+func (db *DB) RetryJob(id int64, lastError string, runAt time.Time) error {
+	_, err := db.Exec(
+		`UPDATE jobs SET state = ?, last_error = ?, run_at = ?, updated_at = ? WHERE id = ?`,
+		JobQueued, lastError, runAt.UTC(), time.Now().UTC(), id,
+	)
+	if err != nil {
+		return fmt.Errorf("retry job: %w", err)
+	}
+	return nil
+}
+
+// FailJob records the final error of a job that will not be retried.
+func (db *DB) FailJob(id int64, lastError string) error {
+	_, err := db.Exec(
+		`UPDATE jobs SET state = ?, last_error = ?, updated_at = ? WHERE id = ?`,
+		JobFailed, lastError, time.Now().UTC(), id,
+	)
+	if err != nil {
+		return fmt.Errorf("fail job: %w", err)
+	}
+	return nil
+}
+
+// ReleaseJob requeues a running job that was interrupted before it could
+// finish, without counting the interrupted attempt, so it runs again as soon
+// as a worker is available.
+func (db *DB) ReleaseJob(id int64) error {
+	now := time.Now().UTC()
+	_, err := db.Exec(
+		`UPDATE jobs SET state = ?, attempts = MAX(attempts - 1, 0), run_at = ?, updated_at = ? WHERE id = ? AND state = ?`,
+		JobQueued, now, now, id, JobRunning,
+	)
+	if err != nil {
+		return fmt.Errorf("release job: %w", err)
+	}
+	return nil
+}
+
+// JobWorkerDied is the last error of a job whose worker died on its final
+// attempt.
+const JobWorkerDied = "worker died"
+
+// RecoverJobs handles jobs left in the running state by a worker that died,
+// e.g. because the server crashed or was restarted mid-transcode. The
+// attempt was counted when it was claimed, so jobs with attempts left are
+// requeued, and the rest fail along with their videos, so that an input
+// that kills the server isn't retried on every restart. It returns the
+// number of jobs requeued and failed. It must only be called while no
+// workers are running.
+func (db *DB) RecoverJobs() (requeued, failed int64, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, fmt.Errorf("begin recover jobs: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	_, err = tx.Exec(`
+		UPDATE videos SET status = 'error', error = ?
+		WHERE id IN (SELECT video_id FROM jobs WHERE state = ? AND attempts >= max_attempts)
+	`, JobWorkerDied, JobRunning)
+	if err != nil {
+		return 0, 0, fmt.Errorf("fail videos of recovered jobs: %w", err)
+	}
+	res, err := tx.Exec(
+		`UPDATE jobs SET state = ?, last_error = ?, updated_at = ? WHERE state = ? AND attempts >= max_attempts`,
+		JobFailed, JobWorkerDied, now, JobRunning,
+	)
+	if err != nil {
+		return 0, 0, fmt.Errorf("fail recovered jobs: %w", err)
+	}
+	if failed, err = res.RowsAffected(); err != nil {
+		return 0, 0, fmt.Errorf("fail recovered jobs: %w", err)
+	}
+	res, err = tx.Exec(
+		`UPDATE jobs SET state = ?, last_error = ?, run_at = ?, updated_at = ? WHERE state = ?`,
+		JobQueued, JobWorkerDied, now, now, JobRunning,
+	)
+	if err != nil {
+		return 0, 0, fmt.Errorf("requeue recovered jobs: %w", err)
+	}
+	if requeued, err = res.RowsAffected(); err != nil {
+		return 0, 0, fmt.Errorf("requeue recovered jobs: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, 0, fmt.Errorf("commit recover jobs: %w", err)
+	}
+	return requeued, failed, nil
+}
+
+// GetJobByVideoID returns the most recent job for a video.
+func (db *DB) GetJobByVideoID(videoID string) (*Job, error) {
+	row := db.QueryRow(
+		`SELECT `+jobColumns+` FROM jobs WHERE video_id = ? ORDER BY id DESC LIMIT 1`,
+		videoID,
+	)
+	j, err := scanJob(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get job by video id: %w", err)
+	}
+	return j, nil
+}
@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// LoginToken is an emailed sign-in link, stored by the hash of its token.
+type LoginToken struct {
+	UserID string
+	// Email, if set, is the address the link was sent to for confirmation,
+	// which following the link sets on the user.
+	Email     string
+	ExpiresAt time.Time
+}
+
+// CreateLoginToken stores a new token, and deletes any that have expired.
+func (db *DB) CreateLoginToken(tokenHash string, t *LoginToken) error {
+	_, err := db.Exec(`DELETE FROM login_tokens WHERE expires_at < ?`, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("delete expired login tokens: %w", err)
+	}
+	_, err = db.Exec(
+		`INSERT INTO login_tokens (token_hash, user_id, email, expires_at) VALUES (?, ?, ?, ?)`,
+		tokenHash, t.UserID, t.Email, t.ExpiresAt.UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("create login token: %w", err)
+	}
+	return nil
+}
+
+// ConsumeLoginToken deletes the token and returns it, or nil if there is no
+// such token or it expired before now. Each token can be consumed once.
+func (db *DB) ConsumeLoginToken(tokenHash string, now time.Time) (*LoginToken, error) {
+	row := db.QueryRow(
+		`DELETE FROM login_tokens WHERE token_hash = ? RETURNING user_id, email, expires_at`,
+		tokenHash,
+	)
+	t := &LoginToken{}
+	err := row.Scan(&t.UserID, &t.Email, &t.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("consume login token: %w", err)
+	}
+	if !now.Before(t.ExpiresAt) {
+		return nil, nil
+	}
+	return t, nil
+}
@@ -0,0 +1,788 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// migration is one numbered, reversible schema change. Each runs in its own
+// transaction together with its schema_migrations bookkeeping.
+//
+// Before migrations were versioned the schema was created with CREATE TABLE
+// IF NOT EXISTS, so databases from that time may already contain some of the
+// tables and columns later migrations add. Migrations therefore create
+// tables and indexes IF NOT EXISTS and add columns with addColumn, which
+// skips columns that are already present.
+type migration struct {
+	version int
+	name    string
+	up      migrateFunc
+	down    migrateFunc
+	// rebuildsTables runs the migration with foreign key enforcement
+	// off, as SQLite requires for dropping and recreating referenced
+	// tables. Foreign keys are checked before it commits.
+	rebuildsTables bool
+}
+
+type migrateFunc func(tx *sql.Tx) error
+
+// migrations must be appended to, never edited or reordered once released.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "baseline",
+		up: steps(
+			execSQL(`
+				CREATE TABLE IF NOT EXISTS conversations (
+					id          TEXT PRIMARY KEY,
+					invite_code TEXT UNIQUE NOT NULL,
+					name        TEXT NOT NULL,
+					created_at  DATETIME DEFAULT CURRENT_TIMESTAMP
+				);
+
+				CREATE TABLE IF NOT EXISTS members (
+					conversation_id TEXT NOT NULL,
+					username        TEXT NOT NULL,
+					joined_at       DATETIME DEFAULT CURRENT_TIMESTAMP,
+					PRIMARY KEY (conversation_id, username),
+					FOREIGN KEY (conversation_id) REFERENCES conversations(id)
+				);
+
+				CREATE TABLE IF NOT EXISTS videos (
+					id              TEXT PRIMARY KEY,
+					conversation_id TEXT NOT NULL,
+					uploader        TEXT NOT NULL,
+					filename        TEXT NOT NULL,
+					status          TEXT NOT NULL DEFAULT 'pending',
+					uploaded_at     DATETIME DEFAULT CURRENT_TIMESTAMP,
+					FOREIGN KEY (conversation_id) REFERENCES conversations(id)
+				);
+			`),
+			// Databases created from the original spec have no status column.
+			addColumn("videos", "status", "TEXT NOT NULL DEFAULT 'pending'"),
+		),
+		down: execSQL(`
+			DROP TABLE videos;
+			DROP TABLE members;
+			DROP TABLE conversations;
+		`),
+	},
+	{
+		version: 2,
+		name:    "sessions",
+		up: execSQL(`
+			CREATE TABLE IF NOT EXISTS sessions (
+				token_hash   TEXT PRIMARY KEY,
+				username     TEXT NOT NULL,
+				created_at   DATETIME NOT NULL,
+				last_seen_at DATETIME NOT NULL
+			);
+
+			CREATE INDEX IF NOT EXISTS sessions_username ON sessions (username);
+		`),
+		down: execSQL(`DROP TABLE sessions;`),
+	},
+	{
+		version: 3,
+		name:    "jobs",
+		up: execSQL(`
+			CREATE TABLE IF NOT EXISTS jobs (
+				id           INTEGER PRIMARY KEY AUTOINCREMENT,
+				video_id     TEXT NOT NULL,
+				input_path   TEXT NOT NULL,
+				output_path  TEXT NOT NULL,
+				state        TEXT NOT NULL DEFAULT 'queued',
+				attempts     INTEGER NOT NULL DEFAULT 0,
+				max_attempts INTEGER NOT NULL,
+				last_error   TEXT NOT NULL DEFAULT '',
+				run_at       DATETIME NOT NULL,
+				created_at   DATETIME NOT NULL,
+				updated_at   DATETIME NOT NULL,
+				FOREIGN KEY (video_id) REFERENCES videos(id)
+			);
+
+			CREATE INDEX IF NOT EXISTS jobs_state_run_at ON jobs (state, run_at);
+		`),
+		down: execSQL(`DROP TABLE jobs;`),
+	},
+	{
+		version: 4,
+		name:    "video_thumbnails",
+		up: steps(
+			addColumn("videos", "poster_filename", "TEXT NOT NULL DEFAULT ''"),
+			addColumn("videos", "preview_filename", "TEXT NOT NULL DEFAULT ''"),
+		),
+		down: dropColumns("videos", "poster_filename", "preview_filename"),
+	},
+	{
+		version: 5,
+		name:    "video_metadata",
+		up: steps(
+			addColumn("videos", "duration_ms", "INTEGER NOT NULL DEFAULT 0"),
+			addColumn("videos", "width", "INTEGER NOT NULL DEFAULT 0"),
+			addColumn("videos", "height", "INTEGER NOT NULL DEFAULT 0"),
+			addColumn("videos", "video_codec", "TEXT NOT NULL DEFAULT ''"),
+			addColumn("videos", "audio_codec", "TEXT NOT NULL DEFAULT ''"),
+			addColumn("videos", "bitrate", "INTEGER NOT NULL DEFAULT 0"),
+			addColumn("videos", "size_bytes", "INTEGER NOT NULL DEFAULT 0"),
+			addColumn("videos", "rotation", "INTEGER NOT NULL DEFAULT 0"),
+		),
+		down: dropColumns("videos", "duration_ms", "width", "height", "video_codec", "audio_codec", "bitrate", "size_bytes", "rotation"),
+	},
+	{
+		version: 6,
+		name:    "video_error",
+		up:      addColumn("videos", "error", "TEXT NOT NULL DEFAULT ''"),
+		down:    dropColumns("videos", "error"),
+	},
+	{
+		version: 7,
+		name:    "uploads",
+		up: execSQL(`
+			CREATE TABLE IF NOT EXISTS uploads (
+				id              TEXT PRIMARY KEY,
+				conversation_id TEXT NOT NULL,
+				uploader        TEXT NOT NULL,
+				filename        TEXT NOT NULL DEFAULT '',
+				upload_length   INTEGER NOT NULL,
+				upload_offset   INTEGER NOT NULL DEFAULT 0,
+				expires_at      DATETIME NOT NULL,
+				created_at      DATETIME NOT NULL,
+				FOREIGN KEY (conversation_id) REFERENCES conversations(id)
+			);
+		`),
+		down: execSQL(`DROP TABLE uploads;`),
+	},
+	{
+		version: 8,
+		name:    "video_checksum",
+		up:      addColumn("videos", "original_sha256", "TEXT NOT NULL DEFAULT ''"),
+		down:    dropColumns("videos", "original_sha256"),
+	},
+	{
+		version: 9,
+		name:    "hls",
+		up: steps(
+			addColumn("videos", "hls_playlist", "TEXT NOT NULL DEFAULT ''"),
+			execSQL(`
+				CREATE TABLE IF NOT EXISTS video_variants (
+					video_id  TEXT NOT NULL,
+					name      TEXT NOT NULL,
+					height    INTEGER NOT NULL,
+					bandwidth INTEGER NOT NULL,
+					playlist  TEXT NOT NULL,
+					PRIMARY KEY (video_id, name),
+					FOREIGN KEY (video_id) REFERENCES videos(id)
+				);
+			`),
+		),
+		down: steps(
+			execSQL(`DROP TABLE video_variants;`),
+			dropColumns("videos", "hls_playlist"),
+		),
+	},
+	{
+		version: 10,
+		name:    "transcoding_profiles",
+		up: steps(
+			addColumn("conversations", "profile", "TEXT NOT NULL DEFAULT ''"),
+			addColumn("videos", "profile", "TEXT NOT NULL DEFAULT ''"),
+		),
+		down: steps(
+			dropColumns("videos", "profile"),
+			dropColumns("conversations", "profile"),
+		),
+	},
+	{
+		version:        11,
+		name:           "cascade_deletes",
+		up:             rebuildForeignKeys("ON DELETE CASCADE"),
+		down:           rebuildForeignKeys(""),
+		rebuildsTables: true,
+	},
+	{
+		version: 12,
+		name:    "member_roles",
+		up: steps(
+			addColumn("members", "role", "TEXT NOT NULL DEFAULT 'member'"),
+			// Creators join their conversation first, so the earliest member
+			// of an existing conversation is taken to be its owner.
+			execSQL(`
+				UPDATE members SET role = 'owner'
+				WHERE rowid IN (
+					SELECT (
+						SELECT m.rowid FROM members m
+						WHERE m.conversation_id = c.id
+						ORDER BY m.joined_at, m.rowid
+						LIMIT 1
+					)
+					FROM conversations c
+				);
+			`),
+		),
+		down: dropColumns("members", "role"),
+	},
+	{
+		version: 13,
+		name:    "conversation_retention",
+		up: steps(
+			addColumn("conversations", "retention_weeks", "INTEGER NOT NULL DEFAULT 0"),
+			addColumn("conversations", "retention_videos", "INTEGER NOT NULL DEFAULT 0"),
+			addColumn("conversations", "retention_bytes", "INTEGER NOT NULL DEFAULT 0"),
+		),
+		down: dropColumns("conversations", "retention_weeks", "retention_videos", "retention_bytes"),
+	},
+	{
+		version: 14,
+		name:    "video_stored_bytes",
+		up: steps(
+			addColumn("videos", "stored_bytes", "INTEGER NOT NULL DEFAULT 0"),
+			// The transcoded MP4 accounts for nearly all of an existing
+			// video's files.
+			execSQL(`
+				UPDATE videos SET stored_bytes = size_bytes WHERE status = 'ready';
+				CREATE INDEX IF NOT EXISTS videos_uploader ON videos (uploader);
+			`),
+		),
+		down: steps(
+			execSQL(`DROP INDEX IF EXISTS videos_uploader`),
+			dropColumns("videos", "stored_bytes"),
+		),
+	},
+	{
+		version: 15,
+		name:    "blob_keys",
+		// Files were stored at <videos-dir>/<conversation id>/<name>, so the
+		// key is the path's last segment under the conversation.
+		up: execSQL(`
+			UPDATE videos SET
+				filename = CASE WHEN filename = '' THEN '' ELSE conversation_id || '/' || ` + basenameSQL("filename") + ` END,
+				poster_filename = CASE WHEN poster_filename = '' THEN '' ELSE conversation_id || '/' || ` + basenameSQL("poster_filename") + ` END,
+				preview_filename = CASE WHEN preview_filename = '' THEN '' ELSE conversation_id || '/' || ` + basenameSQL("preview_filename") + ` END,
+				hls_playlist = CASE WHEN hls_playlist = '' THEN '' ELSE conversation_id || '/' || id || '_hls/' || ` + basenameSQL("hls_playlist") + ` END;
+			UPDATE jobs SET
+				input_path = (SELECT conversation_id FROM videos WHERE videos.id = jobs.video_id) || '/' || ` + basenameSQL("input_path") + `,
+				output_path = (SELECT conversation_id FROM videos WHERE videos.id = jobs.video_id) || '/' || ` + basenameSQL("output_path") + `;
+		`),
+		// Paths are restored under "videos/", the default videos-dir.
+		// Migrations don't see the server's configuration, so an install
+		// with another videos-dir has to fix the prefix by hand after
+		// reverting this far; see the README.
+		down: execSQL(`
+			UPDATE videos SET
+				filename = CASE WHEN filename = '' THEN '' ELSE 'videos/' || filename END,
+				poster_filename = CASE WHEN poster_filename = '' THEN '' ELSE 'videos/' || poster_filename END,
+				preview_filename = CASE WHEN preview_filename = '' THEN '' ELSE 'videos/' || preview_filename END,
+				hls_playlist = CASE WHEN hls_playlist = '' THEN '' ELSE 'videos/' || hls_playlist END;
+			UPDATE jobs SET input_path = 'videos/' || input_path, output_path = 'videos/' || output_path;
+		`),
+	},
+	{
+		version: 16,
+		name:    "users",
+		// Everyone who has joined, uploaded or signed in so far becomes a
+		// user with no passphrase, which they can set to claim the account.
+		up: execSQL(`
+			CREATE TABLE users (
+				id              TEXT PRIMARY KEY,
+				username        TEXT NOT NULL UNIQUE,
+				passphrase_hash TEXT NOT NULL DEFAULT '',
+				created_at      DATETIME DEFAULT CURRENT_TIMESTAMP
+			);
+			INSERT INTO users (id, username)
+				SELECT lower(hex(randomblob(16))), username FROM (
+					SELECT username FROM members
+					UNION SELECT uploader FROM videos
+					UNION SELECT uploader FROM uploads
+					UNION SELECT username FROM sessions
+				);
+
+			CREATE TABLE new_members (
+				conversation_id TEXT NOT NULL,
+				user_id         TEXT NOT NULL,
+				role            TEXT NOT NULL DEFAULT 'member',
+				joined_at       DATETIME DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (conversation_id, user_id),
+				FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE,
+				FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+			);
+			INSERT INTO new_members (conversation_id, user_id, role, joined_at)
+				SELECT m.conversation_id, u.id, m.role, m.joined_at
+				FROM members m JOIN users u ON u.username = m.username;
+			DROP TABLE members;
+			ALTER TABLE new_members RENAME TO members;
+			CREATE INDEX members_user_id ON members (user_id);
+		`),
+		down: execSQL(`
+			CREATE TABLE new_members (
+				conversation_id TEXT NOT NULL,
+				username        TEXT NOT NULL,
+				role            TEXT NOT NULL DEFAULT 'member',
+				joined_at       DATETIME DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (conversation_id, username),
+				FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE
+			);
+			INSERT INTO new_members (conversation_id, username, role, joined_at)
+				SELECT m.conversation_id, u.username, m.role, m.joined_at
+				FROM members m JOIN users u ON u.id = m.user_id;
+			DROP TABLE members;
+			ALTER TABLE new_members RENAME TO members;
+			DROP TABLE users;
+		`),
+		rebuildsTables: true,
+	},
+	{
+		version: 17,
+		name:    "passkeys",
+		up: execSQL(`
+			CREATE TABLE passkeys (
+				id           BLOB PRIMARY KEY,
+				user_id      TEXT NOT NULL,
+				public_key   BLOB NOT NULL,
+				algorithm    INTEGER NOT NULL,
+				sign_count   INTEGER NOT NULL DEFAULT 0,
+				created_at   DATETIME DEFAULT CURRENT_TIMESTAMP,
+				last_used_at DATETIME,
+				FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+			);
+			CREATE INDEX passkeys_user_id ON passkeys (user_id);
+		`),
+		down: execSQL(`DROP TABLE passkeys;`),
+	},
+	{
+		version: 18,
+		name:    "email_login",
+		up: steps(
+			addColumn("users", "email", "TEXT"),
+			execSQL(`
+				CREATE UNIQUE INDEX users_email ON users (email);
+				CREATE TABLE login_tokens (
+					token_hash TEXT PRIMARY KEY,
+					user_id    TEXT NOT NULL,
+					email      TEXT NOT NULL DEFAULT '',
+					expires_at DATETIME NOT NULL,
+					created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+					FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+				);
+			`),
+		),
+		down: steps(
+			execSQL(`
+				DROP TABLE login_tokens;
+				DROP INDEX users_email;
+			`),
+			dropColumns("users", "email"),
+		),
+	},
+	{
+		version: 19,
+		name:    "invites",
+		// Each conversation's invite code becomes its first invite. The
+		// column is UNIQUE, so dropping it means rebuilding the table.
+		up: execSQL(`
+			CREATE TABLE invites (
+				code            TEXT PRIMARY KEY,
+				conversation_id TEXT NOT NULL,
+				max_uses        INTEGER NOT NULL DEFAULT 0,
+				uses            INTEGER NOT NULL DEFAULT 0,
+				expires_at      DATETIME,
+				revoked_at      DATETIME,
+				created_at      DATETIME DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE
+			);
+			CREATE INDEX invites_conversation_id ON invites (conversation_id);
+			INSERT INTO invites (code, conversation_id, created_at)
+				SELECT invite_code, id, created_at FROM conversations;
+
+			CREATE TABLE new_conversations (
+				id               TEXT PRIMARY KEY,
+				name             TEXT NOT NULL,
+				profile          TEXT NOT NULL DEFAULT '',
+				retention_weeks  INTEGER NOT NULL DEFAULT 0,
+				retention_videos INTEGER NOT NULL DEFAULT 0,
+				retention_bytes  INTEGER NOT NULL DEFAULT 0,
+				created_at       DATETIME DEFAULT CURRENT_TIMESTAMP
+			);
+			INSERT INTO new_conversations (id, name, profile, retention_weeks, retention_videos, retention_bytes, created_at)
+				SELECT id, name, profile, retention_weeks, retention_videos, retention_bytes, created_at
+				FROM conversations;
+			DROP TABLE conversations;
+			ALTER TABLE new_conversations RENAME TO conversations;
+		`),
+		// Conversations keep their oldest active invite, or get a new code
+		// if they have none.
+		down: execSQL(`
+			CREATE TABLE new_conversations (
+				id               TEXT PRIMARY KEY,
+				invite_code      TEXT UNIQUE NOT NULL,
+				name             TEXT NOT NULL,
+				created_at       DATETIME DEFAULT CURRENT_TIMESTAMP,
+				profile          TEXT NOT NULL DEFAULT '',
+				retention_weeks  INTEGER NOT NULL DEFAULT 0,
+				retention_videos INTEGER NOT NULL DEFAULT 0,
+				retention_bytes  INTEGER NOT NULL DEFAULT 0
+			);
+			INSERT INTO new_conversations (id, invite_code, name, created_at, profile, retention_weeks, retention_videos, retention_bytes)
+				SELECT c.id, coalesce(
+					(SELECT i.code FROM invites i WHERE i.conversation_id = c.id AND i.revoked_at IS NULL ORDER BY i.created_at LIMIT 1),
+					lower(hex(randomblob(6)))
+				), c.name, c.created_at, c.profile, c.retention_weeks, c.retention_videos, c.retention_bytes
+				FROM conversations c;
+			DROP TABLE conversations;
+			ALTER TABLE new_conversations RENAME TO conversations;
+			DROP TABLE invites;
+		`),
+		rebuildsTables: true,
+	},
+	{
+		version: 20,
+		name:    "job_blob_keys",
+		// The job columns have held blob keys since migration 15.
+		up: execSQL(`
+			ALTER TABLE jobs RENAME COLUMN input_path TO input_key;
+			ALTER TABLE jobs RENAME COLUMN output_path TO output_key;
+		`),
+		down: execSQL(`
+			ALTER TABLE jobs RENAME COLUMN input_key TO input_path;
+			ALTER TABLE jobs RENAME COLUMN output_key TO output_path;
+		`),
+	},
+}
+
+// basenameSQL returns an SQL expression for the last slash-separated
+// segment of column.
+func basenameSQL(column string) string {
+	return fmt.Sprintf(`replace(%[1]s, rtrim(%[1]s, replace(%[1]s, '/', '')), '')`, column)
+}
+
+// rebuildForeignKeys recreates every table holding a foreign key with the
+// given ON DELETE action, since SQLite cannot alter a constraint in place.
+// Rows referencing a missing parent are not copied.
+func rebuildForeignKeys(onDelete string) migrateFunc {
+	tables := []struct {
+		name, columns, schema, parent string
+	}{
+		{
+			name:    "members",
+			columns: "conversation_id, username, joined_at",
+			schema: `
+				conversation_id TEXT NOT NULL,
+				username        TEXT NOT NULL,
+				joined_at       DATETIME DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (conversation_id, username),
+				FOREIGN KEY (conversation_id) REFERENCES conversations(id) ` + onDelete,
+			parent: "conversation_id IN (SELECT id FROM conversations)",
+		},
+		{
+			name: "videos",
+			columns: "id, conversation_id, uploader, filename, status, error, poster_filename, preview_filename, hls_playlist, " +
+				"original_sha256, profile, duration_ms, width, height, video_codec, audio_codec, bitrate, size_bytes, rotation, uploaded_at",
+			schema: `
+				id               TEXT PRIMARY KEY,
+				conversation_id  TEXT NOT NULL,
+				uploader         TEXT NOT NULL,
+				filename         TEXT NOT NULL,
+				status           TEXT NOT NULL DEFAULT 'pending',
+				error            TEXT NOT NULL DEFAULT '',
+				poster_filename  TEXT NOT NULL DEFAULT '',
+				preview_filename TEXT NOT NULL DEFAULT '',
+				hls_playlist     TEXT NOT NULL DEFAULT '',
+				original_sha256  TEXT NOT NULL DEFAULT '',
+				profile          TEXT NOT NULL DEFAULT '',
+				duration_ms      INTEGER NOT NULL DEFAULT 0,
+				width            INTEGER NOT NULL DEFAULT 0,
+				height           INTEGER NOT NULL DEFAULT 0,
+				video_codec      TEXT NOT NULL DEFAULT '',
+				audio_codec      TEXT NOT NULL DEFAULT '',
+				bitrate          INTEGER NOT NULL DEFAULT 0,
+				size_bytes       INTEGER NOT NULL DEFAULT 0,
+				rotation         INTEGER NOT NULL DEFAULT 0,
+				uploaded_at      DATETIME DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (conversation_id) REFERENCES conversations(id) ` + onDelete,
+			parent: "conversation_id IN (SELECT id FROM conversations)",
+		},
+		{
+			name:    "jobs",
+			columns: "id, video_id, input_path, output_path, state, attempts, max_attempts, last_error, run_at, created_at, updated_at",
+			schema: `
+				id           INTEGER PRIMARY KEY AUTOINCREMENT,
+				video_id     TEXT NOT NULL,
+				input_path   TEXT NOT NULL,
+				output_path  TEXT NOT NULL,
+				state        TEXT NOT NULL DEFAULT 'queued',
+				attempts     INTEGER NOT NULL DEFAULT 0,
+				max_attempts INTEGER NOT NULL,
+				last_error   TEXT NOT NULL DEFAULT '',
+				run_at       DATETIME NOT NULL,
+				created_at   DATETIME NOT NULL,
+				updated_at   DATETIME NOT NULL,
+				FOREIGN KEY (video_id) REFERENCES videos(id) ` + onDelete,
+			parent: "video_id IN (SELECT id FROM videos)",
+		},
+		{
+			name:    "video_variants",
+			columns: "video_id, name, height, bandwidth, playlist",
+			schema: `
+				video_id  TEXT NOT NULL,
+				name      TEXT NOT NULL,
+				height    INTEGER NOT NULL,
+				bandwidth INTEGER NOT NULL,
+				playlist  TEXT NOT NULL,
+				PRIMARY KEY (video_id, name),
+				FOREIGN KEY (video_id) REFERENCES videos(id) ` + onDelete,
+			parent: "video_id IN (SELECT id FROM videos)",
+		},
+		{
+			name:    "uploads",
+			columns: "id, conversation_id, uploader, filename, upload_length, upload_offset, expires_at, created_at",
+			schema: `
+				id              TEXT PRIMARY KEY,
+				conversation_id TEXT NOT NULL,
+				uploader        TEXT NOT NULL,
+				filename        TEXT NOT NULL DEFAULT '',
+				upload_length   INTEGER NOT NULL,
+				upload_offset   INTEGER NOT NULL DEFAULT 0,
+				expires_at      DATETIME NOT NULL,
+				created_at      DATETIME NOT NULL,
+				FOREIGN KEY (conversation_id) REFERENCES conversations(id) ` + onDelete,
+			parent: "conversation_id IN (SELECT id FROM conversations)",
+		},
+	}
+
+	return func(tx *sql.Tx) error {
+		for _, t := range tables {
+			_, err := tx.Exec(fmt.Sprintf(`
+				CREATE TABLE new_%[1]s (%[2]s);
+				INSERT INTO new_%[1]s (%[3]s) SELECT %[3]s FROM %[1]s WHERE %[4]s;
+				DROP TABLE %[1]s;
+				ALTER TABLE new_%[1]s RENAME TO %[1]s;
+			`, t.name, t.schema, t.columns, t.parent))
+			if err != nil {
+				return fmt.Errorf("rebuild %s: %w", t.name, err)
+			}
+		}
+		// Dropped along with the jobs table. Child key indexes keep
+		// cascading deletes from scanning whole tables.
+		_, err := tx.Exec(`
+			CREATE INDEX IF NOT EXISTS jobs_state_run_at ON jobs (state, run_at);
+			CREATE INDEX IF NOT EXISTS jobs_video_id ON jobs (video_id);
+			CREATE INDEX IF NOT EXISTS videos_conversation_id ON videos (conversation_id);
+			CREATE INDEX IF NOT EXISTS uploads_conversation_id ON uploads (conversation_id);
+		`)
+		return err
+	}
+}
+
+func execSQL(query string) migrateFunc {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(query)
+		return err
+	}
+}
+
+// addColumn adds a column unless the table already has it.
+func addColumn(table, column, definition string) migrateFunc {
+	return func(tx *sql.Tx) error {
+		var n int
+		err := tx.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&n)
+		if err != nil {
+			return fmt.Errorf("inspect %s: %w", table, err)
+		}
+		if n > 0 {
+			return nil
+		}
+		_, err = tx.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition))
+		return err
+	}
+}
+
+func dropColumns(table string, columns ...string) migrateFunc {
+	return func(tx *sql.Tx) error {
+		for _, column := range columns {
+			if _, err := tx.Exec(fmt.Sprintf(`ALTER TABLE %s DROP COLUMN %s`, table, column)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func steps(fns ...migrateFunc) migrateFunc {
+	return func(tx *sql.Tx) error {
+		for _, fn := range fns {
+			if err := fn(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Migration is the state of one schema migration.
+type Migration struct {
+	Version   int
+	Name      string
+	AppliedAt time.Time // zero if pending
+}
+
+// LatestVersion is the schema version this build migrates to.
+func LatestVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// MigrationStatus lists every known migration in order and when it was
+// applied.
+func (db *DB) MigrationStatus() ([]Migration, error) {
+	applied, err := db.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	status := make([]Migration, 0, len(migrations))
+	for _, m := range migrations {
+		status = append(status, Migration{Version: m.version, Name: m.name, AppliedAt: applied[m.version]})
+	}
+	return status, nil
+}
+
+// MigrateUp applies up to n pending migrations in order, or all of them if
+// n <= 0, and returns how many were applied.
+func (db *DB) MigrateUp(n int) (int, error) {
+	applied, err := db.appliedMigrations()
+	if err != nil {
+		return 0, err
+	}
+	for version := range applied {
+		if version > LatestVersion() {
+			return 0, fmt.Errorf("database schema version %d is newer than this build supports (%d)", version, LatestVersion())
+		}
+	}
+
+	count := 0
+	for _, m := range migrations {
+		if n > 0 && count == n {
+			break
+		}
+		if _, ok := applied[m.version]; ok {
+			continue
+		}
+		if err := db.runMigration(m, m.up, true); err != nil {
+			return count, err
+		}
+		slog.Info("applied migration", "version", m.version, "name", m.name)
+		count++
+	}
+	return count, nil
+}
+
+// MigrateDown reverts up to n applied migrations, newest first, or all of
+// them if n <= 0, and returns how many were reverted.
+func (db *DB) MigrateDown(n int) (int, error) {
+	applied, err := db.appliedMigrations()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, m := range slices.Backward(migrations) {
+		if n > 0 && count == n {
+			break
+		}
+		if _, ok := applied[m.version]; !ok {
+			continue
+		}
+		if err := db.runMigration(m, m.down, false); err != nil {
+			return count, err
+		}
+		slog.Info("reverted migration", "version", m.version, "name", m.name)
+		count++
+	}
+	return count, nil
+}
+
+func (db *DB) runMigration(m migration, fn migrateFunc, up bool) error {
+	// foreign_keys is per connection and cannot change inside a
+	// transaction, so the migration gets a connection of its own.
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("get connection for migration %d: %w", m.version, err)
+	}
+	defer conn.Close()
+	if m.rebuildsTables {
+		if _, err := conn.ExecContext(ctx, `PRAGMA foreign_keys = OFF`); err != nil {
+			return fmt.Errorf("disable foreign keys: %w", err)
+		}
+		defer conn.ExecContext(ctx, `PRAGMA foreign_keys = ON`)
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin migration %d: %w", m.version, err)
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+	}
+	if m.rebuildsTables {
+		var table string
+		err := tx.QueryRow(`SELECT "table" FROM pragma_foreign_key_check`).Scan(&table)
+		if err == nil {
+			return fmt.Errorf("migration %d (%s): foreign key violation in %s", m.version, m.name, table)
+		}
+		if err != sql.ErrNoRows {
+			return fmt.Errorf("check foreign keys: %w", err)
+		}
+	}
+	if up {
+		_, err = tx.Exec(
+			`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`,
+			m.version, m.name, time.Now().UTC(),
+		)
+	} else {
+		_, err = tx.Exec(`DELETE FROM schema_migrations WHERE version = ?`, m.version)
+	}
+	if err != nil {
+		return fmt.Errorf("record migration %d: %w", m.version, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit migration %d: %w", m.version, err)
+	}
+	return nil
+}
+
+// appliedMigrations returns when each applied migration ran, creating the
+// schema_migrations table if needed.
+func (db *DB) appliedMigrations() (map[int]time.Time, error) {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    INTEGER PRIMARY KEY,
+			name       TEXT NOT NULL,
+			applied_at DATETIME NOT NULL
+		)
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	rows, err := db.Query(`SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("get applied migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("scan applied migration: %w", err)
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
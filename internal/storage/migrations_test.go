@@ -0,0 +1,189 @@
+package storage_test
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"waffle-app/internal/storage"
+)
+
+// baselineDB creates a database file with the pre-migrations schema and
+// data from testdata/baseline.sql.
+func baselineDB(t *testing.T) string {
+	t.Helper()
+	fixture, err := os.ReadFile(filepath.Join("testdata", "baseline.sql"))
+	if err != nil {
+		t.Fatalf("read fixture: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "waffle.db")
+	raw, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("open fixture db: %v", err)
+	}
+	defer raw.Close()
+	if _, err := raw.Exec(string(fixture)); err != nil {
+		t.Fatalf("load fixture: %v", err)
+	}
+	return path
+}
+
+func openDB(t *testing.T, path string) *storage.DB {
+	t.Helper()
+	db, err := storage.Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestMigrate_UpgradesBaselineDatabase(t *testing.T) {
+	path := baselineDB(t)
+
+	db, err := storage.New(path)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer db.Close()
+
+	status, err := db.MigrationStatus()
+	if err != nil {
+		t.Fatalf("MigrationStatus: %v", err)
+	}
+	if len(status) == 0 || status[len(status)-1].Version != storage.LatestVersion() {
+		t.Fatalf("expected status up to version %d, got %+v", storage.LatestVersion(), status)
+	}
+	for _, m := range status {
+		if m.AppliedAt.IsZero() {
+			t.Errorf("expected migration %d (%s) to be applied", m.Version, m.Name)
+		}
+	}
+
+	// Existing rows survive and gain the new columns' defaults
+	video, err := db.GetVideo("vid-1")
+	if err != nil {
+		t.Fatalf("GetVideo: %v", err)
+	}
+	if video == nil || video.Status != "ready" || video.Uploader != "alice" {
+		t.Fatalf("expected baseline video to survive, got %+v", video)
+	}
+	if video.PosterFilename != "" || video.Profile != "" || video.HLSPlaylist != "" {
+		t.Errorf("expected empty defaults for new columns, got %+v", video)
+	}
+	if video.Filename != "conv-1/vid-1.mp4" {
+		t.Errorf("expected path to become an object key, got %q", video.Filename)
+	}
+	if role, err := db.GetMemberRole("conv-1", "alice"); err != nil || role != storage.RoleOwner {
+		t.Errorf("expected earliest member to become owner, got %q, %v", role, err)
+	}
+	if invite, err := db.GetInvite("invite-abc"); err != nil || invite == nil || invite.ConversationID != "conv-1" || !invite.Usable(time.Now()) {
+		t.Errorf("expected invite code to become a usable invite, got %+v, %v", invite, err)
+	}
+	if user, err := db.GetUserByUsername("alice"); err != nil || user == nil || user.ID == "" || user.PassphraseHash != "" {
+		t.Errorf("expected member to become an unclaimed user, got %+v, %v", user, err)
+	}
+
+	// Tables added after the baseline are usable
+	if err := db.SetVideoThumbnails("vid-1", "vid-1.jpg", "vid-1.webp"); err != nil {
+		t.Errorf("SetVideoThumbnails: %v", err)
+	}
+	if err := db.SetConversationProfile("conv-1", "480p"); err != nil {
+		t.Errorf("SetConversationProfile: %v", err)
+	}
+	if _, err := db.EnqueueJob("vid-1", "/in.mov", "/out.mp4", 3); err != nil {
+		t.Errorf("EnqueueJob: %v", err)
+	}
+}
+
+func TestMigrate_ReopenIsNoop(t *testing.T) {
+	path := baselineDB(t)
+
+	db, err := storage.New(path)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	db.Close()
+
+	db = openDB(t, path)
+	n, err := db.MigrateUp(0)
+	if err != nil {
+		t.Fatalf("MigrateUp: %v", err)
+	}
+	if n != 0 {
+		t.Errorf("expected no pending migrations, applied %d", n)
+	}
+}
+
+func TestMigrate_StepwiseUpAndDown(t *testing.T) {
+	db := openDB(t, filepath.Join(t.TempDir(), "waffle.db"))
+
+	if n, err := db.MigrateUp(2); err != nil || n != 2 {
+		t.Fatalf("MigrateUp(2): applied %d, %v", n, err)
+	}
+	status, err := db.MigrationStatus()
+	if err != nil {
+		t.Fatalf("MigrationStatus: %v", err)
+	}
+	if status[1].AppliedAt.IsZero() || !status[2].AppliedAt.IsZero() {
+		t.Errorf("expected exactly the first two migrations applied, got %+v", status)
+	}
+
+	if n, err := db.MigrateUp(0); err != nil || n != storage.LatestVersion()-2 {
+		t.Fatalf("MigrateUp(0): applied %d, %v", n, err)
+	}
+
+	// Reverting down to the profiles migration removes its columns
+	profiles := 0
+	for _, m := range status {
+		if m.Name == "transcoding_profiles" {
+			profiles = m.Version
+		}
+	}
+	revert := storage.LatestVersion() - profiles + 1
+	if n, err := db.MigrateDown(revert); err != nil || n != revert {
+		t.Fatalf("MigrateDown(%d): reverted %d, %v", revert, n, err)
+	}
+	if _, err := db.Exec(`SELECT profile FROM conversations`); err == nil || !strings.Contains(err.Error(), "profile") {
+		t.Errorf("expected conversations.profile to be dropped, got %v", err)
+	}
+
+	// Reverting everything leaves only the bookkeeping table, and the schema
+	// can be rebuilt from scratch
+	if n, err := db.MigrateDown(0); err != nil || n != profiles-1 {
+		t.Fatalf("MigrateDown(0): reverted %d, %v", n, err)
+	}
+	var tables int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name NOT IN ('schema_migrations', 'sqlite_sequence')`).Scan(&tables); err != nil {
+		t.Fatalf("count tables: %v", err)
+	}
+	if tables != 0 {
+		t.Errorf("expected no tables after reverting everything, got %d", tables)
+	}
+	if n, err := db.MigrateUp(0); err != nil || n != storage.LatestVersion() {
+		t.Fatalf("MigrateUp after full revert: applied %d, %v", n, err)
+	}
+}
+
+func TestMigrate_RejectsNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "waffle.db")
+	db, err := storage.New(path)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	_, err = db.Exec(
+		`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, 'from the future', CURRENT_TIMESTAMP)`,
+		storage.LatestVersion()+1,
+	)
+	if err != nil {
+		t.Fatalf("insert migration: %v", err)
+	}
+	db.Close()
+
+	if _, err := storage.New(path); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("expected newer schema to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrPasskeyExists is returned by CreatePasskey when the credential is
+// already registered.
+var ErrPasskeyExists = errors.New("passkey already registered")
+
+// Passkey is a WebAuthn credential a user can sign in with.
+type Passkey struct {
+	ID     []byte // the credential ID chosen by the authenticator
+	UserID string
+	// PublicKey is the credential's public key in PKIX form, and Algorithm
+	// its COSE signature algorithm.
+	PublicKey []byte
+	Algorithm int
+	SignCount uint32
+	CreatedAt time.Time
+	// LastUsedAt is zero if the passkey has never been used to sign in.
+	LastUsedAt time.Time
+}
+
+const passkeyColumns = `id, user_id, public_key, algorithm, sign_count, created_at, last_used_at`
+
+func scanPasskey(row interface{ Scan(...any) error }) (*Passkey, error) {
+	p := &Passkey{}
+	var lastUsed sql.NullTime
+	if err := row.Scan(&p.ID, &p.UserID, &p.PublicKey, &p.Algorithm, &p.SignCount, &p.CreatedAt, &lastUsed); err != nil {
+		return nil, err
+	}
+	p.LastUsedAt = lastUsed.Time
+	return p, nil
+}
+
+func (db *DB) CreatePasskey(p *Passkey) error {
+	res, err := db.Exec(
+		`INSERT INTO passkeys (id, user_id, public_key, algorithm, sign_count) VALUES (?, ?, ?, ?, ?) ON CONFLICT (id) DO NOTHING`,
+		p.ID, p.UserID, p.PublicKey, p.Algorithm, p.SignCount,
+	)
+	if err != nil {
+		return fmt.Errorf("create passkey: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("create passkey: %w", err)
+	} else if n == 0 {
+		return ErrPasskeyExists
+	}
+	return nil
+}
+
+func (db *DB) GetPasskey(id []byte) (*Passkey, error) {
+	row := db.QueryRow(`SELECT `+passkeyColumns+` FROM passkeys WHERE id = ?`, id)
+	p, err := scanPasskey(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get passkey: %w", err)
+	}
+	return p, nil
+}
+
+func (db *DB) GetPasskeysByUser(userID string) ([]Passkey, error) {
+	rows, err := db.Query(`SELECT `+passkeyColumns+` FROM passkeys WHERE user_id = ? ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("get passkeys by user: %w", err)
+	}
+	defer rows.Close()
+
+	var passkeys []Passkey
+	for rows.Next() {
+		p, err := scanPasskey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan passkey: %w", err)
+		}
+		passkeys = append(passkeys, *p)
+	}
+	return passkeys, rows.Err()
+}
+
+// UsePasskey records a sign-in with the passkey and the signature counter
+// its authenticator reported.
+func (db *DB) UsePasskey(id []byte, signCount uint32) error {
+	_, err := db.Exec(
+		`UPDATE passkeys SET sign_count = ?, last_used_at = CURRENT_TIMESTAMP WHERE id = ?`,
+		signCount, id,
+	)
+	if err != nil {
+		return fmt.Errorf("use passkey: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,346 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3Algorithm   = "AWS4-HMAC-SHA256"
+	s3TimeFormat  = "20060102T150405Z"
+	s3DateFormat  = "20060102"
+	unsignedBody  = "UNSIGNED-PAYLOAD"
+	emptyBodyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// S3BlobStore keeps objects in a bucket of an S3-compatible service such
+// as AWS S3 or MinIO, authenticating with Signature Version 4.
+type S3BlobStore struct {
+	Endpoint  string // e.g. "https://s3.eu-west-1.amazonaws.com" or "http://localhost:9000"
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// PathStyle addresses the bucket as the first path segment
+	// (endpoint/bucket/key), as MinIO expects, rather than as a subdomain
+	// of the endpoint (bucket.endpoint/key).
+	PathStyle bool
+	Client    *http.Client
+}
+
+var _ BlobStore = (*S3BlobStore)(nil)
+
+// objectURL returns the URL of key, or of the bucket itself if key is
+// empty.
+func (s *S3BlobStore) objectURL(key string) (*url.URL, error) {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parse s3 endpoint: %w", err)
+	}
+	escaped := strings.TrimSuffix(u.EscapedPath(), "/")
+	if s.PathStyle {
+		escaped += "/" + s3Escape(s.Bucket, true)
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+	}
+	if key != "" || escaped == "" {
+		escaped += "/" + s3Escape(key, false)
+	}
+	if u.Path, err = url.PathUnescape(escaped); err != nil {
+		return nil, fmt.Errorf("parse s3 endpoint: %w", err)
+	}
+	u.RawPath = escaped
+	return u, nil
+}
+
+func (s *S3BlobStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	body := io.NopCloser(r)
+	if size == 0 {
+		body = http.NoBody
+	}
+	resp, err := s.do(ctx, http.MethodPut, key, nil, body, size, http.Header{
+		"Content-Type": {blobContentType(key)},
+	})
+	if err != nil {
+		return fmt.Errorf("put blob: %w", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3BlobStore) Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	switch {
+	case length == 0:
+		return io.NopCloser(strings.NewReader("")), nil
+	case length > 0:
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	case offset > 0:
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := s.do(ctx, http.MethodGet, key, nil, nil, 0, header)
+	if err != nil {
+		return nil, fmt.Errorf("get blob: %w", err)
+	}
+	return resp.Body, nil
+}
+
+func (s *S3BlobStore) Stat(ctx context.Context, key string) (*BlobInfo, error) {
+	resp, err := s.do(ctx, http.MethodHead, key, nil, nil, 0, nil)
+	if err != nil {
+		return nil, fmt.Errorf("stat blob: %w", err)
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &BlobInfo{Key: key, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (s *S3BlobStore) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, nil, 0, nil)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("delete blob: %w", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3BlobStore) List(ctx context.Context, prefix string) ([]BlobInfo, error) {
+	var blobs []BlobInfo
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, 0, nil)
+		if err != nil {
+			return nil, fmt.Errorf("list blobs: %w", err)
+		}
+		var result struct {
+			Contents []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("list blobs: decode response: %w", err)
+		}
+		for _, c := range result.Contents {
+			blobs = append(blobs, BlobInfo{Key: c.Key, Size: c.Size, ModTime: c.LastModified})
+		}
+		if !result.IsTruncated {
+			return blobs, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (s *S3BlobStore) SignedURL(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	return s.PresignGet(key, expiry, time.Now())
+}
+
+// PresignGet returns a URL, signed at now, from which anyone may GET the
+// object until expiry has passed.
+func (s *S3BlobStore) PresignGet(key string, expiry time.Duration, now time.Time) (string, error) {
+	u, err := s.objectURL(key)
+	if err != nil {
+		return "", err
+	}
+	now = now.UTC()
+	query := url.Values{
+		"X-Amz-Algorithm":     {s3Algorithm},
+		"X-Amz-Credential":    {s.AccessKey + "/" + s.scope(now)},
+		"X-Amz-Date":          {now.Format(s3TimeFormat)},
+		"X-Amz-Expires":       {strconv.Itoa(int(expiry.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	header := http.Header{"Host": {u.Host}}
+	signature := s.signature(http.MethodGet, u, query, header, unsignedBody, now)
+	u.RawQuery = canonicalQuery(query) + "&X-Amz-Signature=" + signature
+	return u.String(), nil
+}
+
+// do sends a signed request for key, or for the bucket if key is empty,
+// and returns the response if it succeeded. Failures are returned as an
+// *S3Error.
+func (s *S3BlobStore) do(ctx context.Context, method, key string, query url.Values, body io.ReadCloser, size int64, header http.Header) (*http.Response, error) {
+	u, err := s.objectURL(key)
+	if err != nil {
+		return nil, err
+	}
+	if query != nil {
+		u.RawQuery = canonicalQuery(query)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.URL.RawPath = u.RawPath
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	payloadHash := emptyBodyHash
+	if body != nil && body != http.NoBody {
+		req.ContentLength = size
+		payloadHash = unsignedBody
+	}
+
+	now := time.Now().UTC()
+	req.Header.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signed := http.Header{
+		"Host":                 {u.Host},
+		"X-Amz-Content-Sha256": {payloadHash},
+		"X-Amz-Date":           {req.Header.Get("X-Amz-Date")},
+	}
+	signature := s.signature(method, u, query, signed, payloadHash, now)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s.AccessKey, s.scope(now), signedHeaders(signed), signature))
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		return nil, newS3Error(resp, key)
+	}
+	return resp, nil
+}
+
+func (s *S3BlobStore) scope(t time.Time) string {
+	return t.Format(s3DateFormat) + "/" + s.Region + "/s3/aws4_request"
+}
+
+// signature computes the Signature Version 4 signature of a request.
+func (s *S3BlobStore) signature(method string, u *url.URL, query url.Values, header http.Header, payloadHash string, t time.Time) string {
+	var canonical strings.Builder
+	canonical.WriteString(method + "\n")
+	canonical.WriteString(u.EscapedPath() + "\n")
+	canonical.WriteString(canonicalQuery(query) + "\n")
+	for _, name := range sortedHeaderNames(header) {
+		canonical.WriteString(name + ":" + strings.TrimSpace(header.Get(name)) + "\n")
+	}
+	canonical.WriteString("\n" + signedHeaders(header) + "\n")
+	canonical.WriteString(payloadHash)
+
+	hash := sha256.Sum256([]byte(canonical.String()))
+	stringToSign := s3Algorithm + "\n" + t.Format(s3TimeFormat) + "\n" + s.scope(t) + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), t.Format(s3DateFormat))
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sortedHeaderNames(header http.Header) []string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, strings.ToLower(name))
+	}
+	slices.Sort(names)
+	return names
+}
+
+func signedHeaders(header http.Header) string {
+	return strings.Join(sortedHeaderNames(header), ";")
+}
+
+// canonicalQuery encodes query sorted by name, escaped as Signature
+// Version 4 requires.
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var pairs []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			pairs = append(pairs, s3Escape(name, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// s3Escape percent-encodes everything but unreserved characters and, if
+// escapeSlash is false, slashes.
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// S3Error is an error response from an S3-compatible service. Errors for
+// missing objects match fs.ErrNotExist.
+type S3Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	Key        string
+}
+
+func (e *S3Error) Error() string {
+	msg := fmt.Sprintf("s3: %d %s", e.StatusCode, e.Code)
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if e.Key != "" {
+		msg += " (" + e.Key + ")"
+	}
+	return msg
+}
+
+func (e *S3Error) Is(target error) bool {
+	return target == fs.ErrNotExist && (e.StatusCode == http.StatusNotFound || e.Code == "NoSuchKey")
+}
+
+func newS3Error(resp *http.Response, key string) *S3Error {
+	e := &S3Error{StatusCode: resp.StatusCode, Code: http.StatusText(resp.StatusCode), Key: key}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	var parsed struct {
+		Code    string
+		Message string
+	}
+	if xml.NewDecoder(bytes.NewReader(body)).Decode(&parsed) == nil && parsed.Code != "" {
+		e.Code, e.Message = parsed.Code, parsed.Message
+	}
+	return e
+}
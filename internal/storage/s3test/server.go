@@ -0,0 +1,259 @@
+// Package s3test provides an in-memory S3-compatible server for tests. It
+// implements the subset of the API that storage.S3BlobStore uses, with
+// path-style addressing, and checks Signature Version 4 signatures on
+// every request.
+package s3test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"waffle-app/internal/storage"
+)
+
+const (
+	Bucket    = "waffle"
+	Region    = "us-east-1"
+	AccessKey = "test-access-key"
+	SecretKey = "test-secret-key"
+)
+
+type object struct {
+	data        []byte
+	contentType string
+	modTime     time.Time
+}
+
+// Server is a running fake S3 service holding a single bucket.
+type Server struct {
+	URL string
+
+	mu      sync.Mutex
+	objects map[string]object
+}
+
+// NewServer starts a server that is shut down when the test ends.
+func NewServer(t testing.TB) *Server {
+	s := &Server{objects: make(map[string]object)}
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	s.URL = ts.URL
+	return s
+}
+
+// Store returns a blob store using the server's bucket.
+func (s *Server) Store() *storage.S3BlobStore {
+	return &storage.S3BlobStore{
+		Endpoint:  s.URL,
+		Region:    Region,
+		Bucket:    Bucket,
+		AccessKey: AccessKey,
+		SecretKey: SecretKey,
+		PathStyle: true,
+	}
+}
+
+// Keys returns the keys of every stored object, sorted.
+func (s *Server) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sortedKeys()
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if code, msg := verify(r); code != "" {
+		writeError(w, http.StatusForbidden, code, msg)
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != Bucket {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		s.list(w, r)
+	case key == "":
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "")
+	case r.Method == http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		if r.ContentLength != int64(len(data)) {
+			writeError(w, http.StatusBadRequest, "MissingContentLength", "")
+			return
+		}
+		s.mu.Lock()
+		s.objects[key] = object{data: data, contentType: r.Header.Get("Content-Type"), modTime: time.Now()}
+		s.mu.Unlock()
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		s.mu.Lock()
+		obj, ok := s.objects[key]
+		s.mu.Unlock()
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		w.Header().Set("Content-Type", obj.contentType)
+		http.ServeContent(w, r, "", obj.modTime, strings.NewReader(string(obj.data)))
+	case r.Method == http.MethodDelete:
+		s.mu.Lock()
+		delete(s.objects, key)
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "")
+	}
+}
+
+// list implements ListObjectsV2, returning at most two keys per page so
+// that pagination is exercised.
+func (s *Server) list(w http.ResponseWriter, r *http.Request) {
+	const pageSize = 2
+	prefix := r.URL.Query().Get("prefix")
+	after := r.URL.Query().Get("continuation-token")
+
+	type content struct {
+		Key          string
+		Size         int
+		LastModified string
+	}
+	var result struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []content
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}
+	s.mu.Lock()
+	for _, key := range s.sortedKeys() {
+		if !strings.HasPrefix(key, prefix) || key <= after {
+			continue
+		}
+		if len(result.Contents) == pageSize {
+			result.IsTruncated = true
+			result.NextContinuationToken = result.Contents[pageSize-1].Key
+			break
+		}
+		obj := s.objects[key]
+		result.Contents = append(result.Contents, content{key, len(obj.data), obj.modTime.UTC().Format(time.RFC3339Nano)})
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+func (s *Server) sortedKeys() []string {
+	keys := make([]string, 0, len(s.objects))
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, message)
+}
+
+// verify checks the request's signature, from either its Authorization
+// header or a presigned URL's query. It returns an S3 error code and
+// message if the request is not authentic.
+func verify(r *http.Request) (code, message string) {
+	query := r.URL.Query()
+	var credential, signedHeaders, signature, amzDate, payloadHash string
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		fields, ok := strings.CutPrefix(auth, "AWS4-HMAC-SHA256 ")
+		if !ok {
+			return "AccessDenied", "unsupported authorization"
+		}
+		for _, field := range strings.Split(fields, ", ") {
+			name, value, _ := strings.Cut(field, "=")
+			switch name {
+			case "Credential":
+				credential = value
+			case "SignedHeaders":
+				signedHeaders = value
+			case "Signature":
+				signature = value
+			}
+		}
+		amzDate = r.Header.Get("X-Amz-Date")
+		payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+	} else if query.Has("X-Amz-Signature") {
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		signature = query.Get("X-Amz-Signature")
+		amzDate = query.Get("X-Amz-Date")
+		payloadHash = "UNSIGNED-PAYLOAD"
+		query.Del("X-Amz-Signature")
+
+		signedAt, err := time.Parse("20060102T150405Z", amzDate)
+		expires, _ := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || time.Now().After(signedAt.Add(time.Duration(expires)*time.Second)) {
+			return "AccessDenied", "Request has expired"
+		}
+	} else {
+		return "AccessDenied", "anonymous access is not allowed"
+	}
+
+	accessKey, scope, _ := strings.Cut(credential, "/")
+	if accessKey != AccessKey {
+		return "InvalidAccessKeyId", "unknown access key"
+	}
+	date, _, _ := strings.Cut(scope, "/")
+
+	var canonical strings.Builder
+	canonical.WriteString(r.Method + "\n" + r.URL.EscapedPath() + "\n")
+	var pairs []string
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, escape(name)+"="+escape(value))
+		}
+	}
+	slices.Sort(pairs)
+	canonical.WriteString(strings.Join(pairs, "&") + "\n")
+	for _, name := range strings.Split(signedHeaders, ";") {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		canonical.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	canonical.WriteString("\n" + signedHeaders + "\n" + payloadHash)
+
+	hash := sha256.Sum256([]byte(canonical.String()))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+	key := []byte("AWS4" + SecretKey)
+	for _, part := range []string{date, Region, "s3", "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	if !hmac.Equal([]byte(hex.EncodeToString(key)), []byte(signature)) {
+		return "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided."
+	}
+	return "", ""
+}
+
+func escape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
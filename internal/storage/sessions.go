@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+type Session struct {
+	TokenHash  string
+	Username   string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+}
+
+func (db *DB) CreateSession(tokenHash, username string, createdAt time.Time) error {
+	_, err := db.Exec(
+		`INSERT INTO sessions (token_hash, username, created_at, last_seen_at) VALUES (?, ?, ?, ?)`,
+		tokenHash, username, createdAt.UTC(), createdAt.UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("create session: %w", err)
+	}
+	return nil
+}
+
+func (db *DB) GetSession(tokenHash string) (*Session, error) {
+	row := db.QueryRow(
+		`SELECT token_hash, username, created_at, last_seen_at FROM sessions WHERE token_hash = ?`,
+		tokenHash,
+	)
+	s := &Session{}
+	err := row.Scan(&s.TokenHash, &s.Username, &s.CreatedAt, &s.LastSeenAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get session: %w", err)
+	}
+	return s, nil
+}
+
+func (db *DB) TouchSession(tokenHash string, lastSeenAt time.Time) error {
+	_, err := db.Exec(
+		`UPDATE sessions SET last_seen_at = ? WHERE token_hash = ?`,
+		lastSeenAt.UTC(), tokenHash,
+	)
+	if err != nil {
+		return fmt.Errorf("touch session: %w", err)
+	}
+	return nil
+}
+
+func (db *DB) DeleteSession(tokenHash string) error {
+	_, err := db.Exec(`DELETE FROM sessions WHERE token_hash = ?`, tokenHash)
+	if err != nil {
+		return fmt.Errorf("delete session: %w", err)
+	}
+	return nil
+}
+
+func (db *DB) DeleteSessionsByUsername(username string) (int64, error) {
+	res, err := db.Exec(`DELETE FROM sessions WHERE username = ?`, username)
+	if err != nil {
+		return 0, fmt.Errorf("delete sessions by username: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// DeleteExpiredSessions removes sessions created before createdBefore or last
+// used before lastSeenBefore. Passing the zero time disables that check.
+func (db *DB) DeleteExpiredSessions(createdBefore, lastSeenBefore time.Time) (int64, error) {
+	res, err := db.Exec(
+		`DELETE FROM sessions WHERE created_at < ? OR last_seen_at < ?`,
+		createdBefore.UTC(), lastSeenBefore.UTC(),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired sessions: %w", err)
+	}
+	return res.RowsAffected()
+}
@@ -1,21 +1,17 @@
 package storage_test
 
 import (
-	"os"
+	"errors"
+	"path/filepath"
+	"slices"
 	"testing"
+	"time"
 	"waffle-app/internal/storage"
 )
 
 func newTestDB(t *testing.T) *storage.DB {
 	t.Helper()
-	f, err := os.CreateTemp("", "waffle_test_*.db")
-	if err != nil {
-		t.Fatalf("create temp file: %v", err)
-	}
-	f.Close()
-	t.Cleanup(func() { os.Remove(f.Name()) })
-
-	db, err := storage.New(f.Name())
+	db, err := storage.New(filepath.Join(t.TempDir(), "waffle.db"))
 	if err != nil {
 		t.Fatalf("open test db: %v", err)
 	}
@@ -23,59 +19,174 @@ func newTestDB(t *testing.T) *storage.DB {
 	return db
 }
 
+// createUser adds a user without a passphrase, as members must be users.
+func createUser(t *testing.T, db *storage.DB, username string) {
+	t.Helper()
+	if err := db.CreateUser(&storage.User{ID: "id-" + username, Username: username}); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+}
+
 func TestCreateAndGetConversation(t *testing.T) {
 	db := newTestDB(t)
 
-	err := db.CreateConversation("conv-1", "invite-abc", "Test Group")
+	err := db.CreateConversation("conv-1", "invite-abc", "Test Group", "")
 	if err != nil {
 		t.Fatalf("CreateConversation: %v", err)
 	}
 
-	conv, err := db.GetConversationByInviteCode("invite-abc")
+	conv, err := db.GetConversation("conv-1")
 	if err != nil {
-		t.Fatalf("GetConversationByInviteCode: %v", err)
+		t.Fatalf("GetConversation: %v", err)
 	}
 	if conv == nil {
 		t.Fatal("expected conversation, got nil")
 	}
-	if conv.ID != "conv-1" {
-		t.Errorf("expected id 'conv-1', got %q", conv.ID)
-	}
 	if conv.Name != "Test Group" {
 		t.Errorf("expected name 'Test Group', got %q", conv.Name)
 	}
+
+	invite, err := db.GetInvite("invite-abc")
+	if err != nil {
+		t.Fatalf("GetInvite: %v", err)
+	}
+	if invite == nil || invite.ConversationID != "conv-1" || !invite.Usable(time.Now()) {
+		t.Errorf("expected a usable first invite, got %+v", invite)
+	}
+}
+
+func TestCreateConversation_CreatorIsOwner(t *testing.T) {
+	db := newTestDB(t)
+	createUser(t, db, "alice")
+
+	if err := db.CreateConversation("conv-1", "invite-abc", "Test Group", "alice"); err != nil {
+		t.Fatalf("CreateConversation: %v", err)
+	}
+	if role, err := db.GetMemberRole("conv-1", "alice"); err != nil || role != storage.RoleOwner {
+		t.Errorf("expected the creator to be owner, got %q, %v", role, err)
+	}
+
+	// Nothing is created for a creator without an account
+	if err := db.CreateConversation("conv-2", "invite-def", "Other", "nobody"); err == nil {
+		t.Fatal("expected an unknown creator to be rejected")
+	}
+	if conv, _ := db.GetConversation("conv-2"); conv != nil {
+		t.Errorf("expected the conversation not to be created, got %+v", conv)
+	}
+	if invite, _ := db.GetInvite("invite-def"); invite != nil {
+		t.Errorf("expected the invite not to be created, got %+v", invite)
+	}
 }
 
-func TestGetConversationByInviteCode_NotFound(t *testing.T) {
+func TestGetInvite_NotFound(t *testing.T) {
 	db := newTestDB(t)
 
-	conv, err := db.GetConversationByInviteCode("nonexistent")
+	invite, err := db.GetInvite("nonexistent")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	if conv != nil {
-		t.Errorf("expected nil, got %+v", conv)
+	if invite != nil {
+		t.Errorf("expected nil, got %+v", invite)
 	}
 }
 
 func TestDuplicateInviteCode(t *testing.T) {
 	db := newTestDB(t)
 
-	if err := db.CreateConversation("conv-1", "same-code", "First"); err != nil {
+	if err := db.CreateConversation("conv-1", "same-code", "First", ""); err != nil {
 		t.Fatalf("first CreateConversation: %v", err)
 	}
-	err := db.CreateConversation("conv-2", "same-code", "Second")
+	err := db.CreateConversation("conv-2", "same-code", "Second", "")
 	if err == nil {
 		t.Fatal("expected error for duplicate invite code, got nil")
 	}
+	if conv, _ := db.GetConversation("conv-2"); conv != nil {
+		t.Errorf("expected the conversation not to be created, got %+v", conv)
+	}
+}
+
+func TestRedeemInvite(t *testing.T) {
+	db := newTestDB(t)
+	if err := db.CreateConversation("conv-1", "invite-abc", "Test Group", ""); err != nil {
+		t.Fatalf("CreateConversation: %v", err)
+	}
+	for _, username := range []string{"alice", "bob", "carol"} {
+		createUser(t, db, username)
+	}
+	now := time.Now()
+	if err := db.CreateInvite(&storage.Invite{Code: "once", ConversationID: "conv-1", MaxUses: 1, ExpiresAt: now.Add(time.Hour)}); err != nil {
+		t.Fatalf("CreateInvite: %v", err)
+	}
+
+	if id, err := db.RedeemInvite("once", "alice", now); err != nil || id != "conv-1" {
+		t.Fatalf("RedeemInvite: %q, %v", id, err)
+	}
+	if ok, _ := db.IsMember("conv-1", "alice"); !ok {
+		t.Error("expected alice to join")
+	}
+	// Already a member, so no use is counted
+	if id, err := db.RedeemInvite("once", "alice", now); err != nil || id != "conv-1" {
+		t.Errorf("redeem again: %q, %v", id, err)
+	}
+	if _, err := db.RedeemInvite("once", "bob", now); !errors.Is(err, storage.ErrInviteUnusable) {
+		t.Errorf("used up: expected ErrInviteUnusable, got %v", err)
+	}
+	if invite, _ := db.GetInvite("once"); invite.Uses != 1 || invite.Usable(now) {
+		t.Errorf("expected one use, got %+v", invite)
+	}
+
+	if _, err := db.RedeemInvite("invite-abc", "bob", now.Add(24*time.Hour)); err != nil {
+		t.Errorf("unlimited invite: %v", err)
+	}
+	if found, err := db.RevokeInvite("conv-1", "invite-abc", now); err != nil || !found {
+		t.Fatalf("RevokeInvite: %v, %v", found, err)
+	}
+	if _, err := db.RedeemInvite("invite-abc", "carol", now); !errors.Is(err, storage.ErrInviteUnusable) {
+		t.Errorf("revoked: expected ErrInviteUnusable, got %v", err)
+	}
+	if ok, _ := db.IsMember("conv-1", "carol"); ok {
+		t.Error("expected carol not to join")
+	}
+	if found, _ := db.RevokeInvite("conv-2", "once", now); found {
+		t.Error("expected another conversation's invite not to be found")
+	}
+
+	if id, err := db.RedeemInvite("nonexistent", "carol", now); err != nil || id != "" {
+		t.Errorf("unknown code: %q, %v", id, err)
+	}
+	invites, err := db.GetInvitesByConversation("conv-1")
+	if err != nil || len(invites) != 2 {
+		t.Fatalf("GetInvitesByConversation: %+v, %v", invites, err)
+	}
+}
+
+func TestInviteExpiry(t *testing.T) {
+	db := newTestDB(t)
+	if err := db.CreateConversation("conv-1", "invite-abc", "Test Group", ""); err != nil {
+		t.Fatalf("CreateConversation: %v", err)
+	}
+	createUser(t, db, "alice")
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := db.CreateInvite(&storage.Invite{Code: "soon", ConversationID: "conv-1", ExpiresAt: expiresAt}); err != nil {
+		t.Fatalf("CreateInvite: %v", err)
+	}
+
+	invite, err := db.GetInvite("soon")
+	if err != nil || !invite.ExpiresAt.Equal(expiresAt) || !invite.RevokedAt.IsZero() {
+		t.Fatalf("GetInvite: %+v, %v", invite, err)
+	}
+	if _, err := db.RedeemInvite("soon", "alice", expiresAt); !errors.Is(err, storage.ErrInviteUnusable) {
+		t.Errorf("expected ErrInviteUnusable at expiry, got %v", err)
+	}
 }
 
 func TestAddMemberAndGetConversations(t *testing.T) {
 	db := newTestDB(t)
 
-	if err := db.CreateConversation("conv-1", "invite-abc", "Test Group"); err != nil {
+	if err := db.CreateConversation("conv-1", "invite-abc", "Test Group", ""); err != nil {
 		t.Fatalf("CreateConversation: %v", err)
 	}
+	createUser(t, db, "alice")
 	if err := db.AddMember("conv-1", "alice"); err != nil {
 		t.Fatalf("AddMember: %v", err)
 	}
@@ -95,9 +206,10 @@ func TestAddMemberAndGetConversations(t *testing.T) {
 func TestAddMemberIdempotent(t *testing.T) {
 	db := newTestDB(t)
 
-	if err := db.CreateConversation("conv-1", "invite-abc", "Test Group"); err != nil {
+	if err := db.CreateConversation("conv-1", "invite-abc", "Test Group", ""); err != nil {
 		t.Fatalf("CreateConversation: %v", err)
 	}
+	createUser(t, db, "alice")
 	if err := db.AddMember("conv-1", "alice"); err != nil {
 		t.Fatalf("first AddMember: %v", err)
 	}
@@ -110,7 +222,7 @@ func TestAddMemberIdempotent(t *testing.T) {
 func TestIsMember(t *testing.T) {
 	db := newTestDB(t)
 
-	if err := db.CreateConversation("conv-1", "invite-abc", "Test Group"); err != nil {
+	if err := db.CreateConversation("conv-1", "invite-abc", "Test Group", ""); err != nil {
 		t.Fatalf("CreateConversation: %v", err)
 	}
 
@@ -122,6 +234,7 @@ func TestIsMember(t *testing.T) {
 		t.Fatal("alice should not be a member yet")
 	}
 
+	createUser(t, db, "alice")
 	if err := db.AddMember("conv-1", "alice"); err != nil {
 		t.Fatalf("AddMember: %v", err)
 	}
@@ -138,10 +251,10 @@ func TestIsMember(t *testing.T) {
 func TestCreateAndListVideos(t *testing.T) {
 	db := newTestDB(t)
 
-	if err := db.CreateConversation("conv-1", "invite-abc", "Test Group"); err != nil {
+	if err := db.CreateConversation("conv-1", "invite-abc", "Test Group", ""); err != nil {
 		t.Fatalf("CreateConversation: %v", err)
 	}
-	if err := db.CreateVideo("vid-1", "conv-1", "alice", "/videos/conv-1/vid-1.mp4"); err != nil {
+	if err := db.CreateVideo(&storage.Video{ID: "vid-1", ConversationID: "conv-1", Uploader: "alice", Filename: "/videos/conv-1/vid-1.mp4"}); err != nil {
 		t.Fatalf("CreateVideo: %v", err)
 	}
 
@@ -163,10 +276,10 @@ func TestCreateAndListVideos(t *testing.T) {
 func TestUpdateVideoStatus(t *testing.T) {
 	db := newTestDB(t)
 
-	if err := db.CreateConversation("conv-1", "invite-abc", "Test Group"); err != nil {
+	if err := db.CreateConversation("conv-1", "invite-abc", "Test Group", ""); err != nil {
 		t.Fatalf("CreateConversation: %v", err)
 	}
-	if err := db.CreateVideo("vid-1", "conv-1", "alice", "/videos/conv-1/vid-1.mp4"); err != nil {
+	if err := db.CreateVideo(&storage.Video{ID: "vid-1", ConversationID: "conv-1", Uploader: "alice", Filename: "/videos/conv-1/vid-1.mp4"}); err != nil {
 		t.Fatalf("CreateVideo: %v", err)
 	}
 
@@ -186,7 +299,7 @@ func TestUpdateVideoStatus(t *testing.T) {
 func TestGetVideosEmpty(t *testing.T) {
 	db := newTestDB(t)
 
-	if err := db.CreateConversation("conv-1", "invite-abc", "Test Group"); err != nil {
+	if err := db.CreateConversation("conv-1", "invite-abc", "Test Group", ""); err != nil {
 		t.Fatalf("CreateConversation: %v", err)
 	}
 
@@ -198,3 +311,794 @@ func TestGetVideosEmpty(t *testing.T) {
 		t.Errorf("expected 0 videos, got %d", len(videos))
 	}
 }
+
+func TestGetVideo(t *testing.T) {
+	db := newTestDB(t)
+
+	if err := db.CreateConversation("conv-1", "invite-abc", "Test Group", ""); err != nil {
+		t.Fatalf("CreateConversation: %v", err)
+	}
+	if err := db.CreateVideo(&storage.Video{ID: "vid-1", ConversationID: "conv-1", Uploader: "alice", Filename: "/videos/conv-1/vid-1.mp4"}); err != nil {
+		t.Fatalf("CreateVideo: %v", err)
+	}
+
+	video, err := db.GetVideo("vid-1")
+	if err != nil {
+		t.Fatalf("GetVideo: %v", err)
+	}
+	if video == nil {
+		t.Fatal("expected video, got nil")
+	}
+	if video.ConversationID != "conv-1" || video.Filename != "/videos/conv-1/vid-1.mp4" {
+		t.Errorf("unexpected video %+v", video)
+	}
+
+	missing, err := db.GetVideo("nonexistent")
+	if err != nil {
+		t.Fatalf("GetVideo: %v", err)
+	}
+	if missing != nil {
+		t.Errorf("expected nil, got %+v", missing)
+	}
+}
+
+func TestCreateAndGetSession(t *testing.T) {
+	db := newTestDB(t)
+
+	if err := db.CreateSession("hash-1", "alice", time.Now()); err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+
+	session, err := db.GetSession("hash-1")
+	if err != nil {
+		t.Fatalf("GetSession: %v", err)
+	}
+	if session == nil {
+		t.Fatal("expected session, got nil")
+	}
+	if session.Username != "alice" {
+		t.Errorf("expected username 'alice', got %q", session.Username)
+	}
+
+	missing, err := db.GetSession("nonexistent")
+	if err != nil {
+		t.Fatalf("GetSession: %v", err)
+	}
+	if missing != nil {
+		t.Errorf("expected nil, got %+v", missing)
+	}
+}
+
+func TestDeleteSessions(t *testing.T) {
+	db := newTestDB(t)
+
+	now := time.Now()
+	if err := db.CreateSession("old", "alice", now.Add(-2*time.Hour)); err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	if err := db.CreateSession("fresh", "alice", now); err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	if err := db.CreateSession("other", "bob", now); err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+
+	n, err := db.DeleteExpiredSessions(now.Add(-time.Hour), time.Time{})
+	if err != nil {
+		t.Fatalf("DeleteExpiredSessions: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 expired session deleted, got %d", n)
+	}
+
+	n, err = db.DeleteSessionsByUsername("alice")
+	if err != nil {
+		t.Fatalf("DeleteSessionsByUsername: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 session deleted for alice, got %d", n)
+	}
+
+	if s, _ := db.GetSession("other"); s == nil {
+		t.Error("expected bob's session to remain")
+	}
+}
+
+func createTestVideo(t *testing.T, db *storage.DB) {
+	t.Helper()
+	if err := db.CreateConversation("conv-1", "invite-abc", "Test Group", ""); err != nil {
+		t.Fatalf("CreateConversation: %v", err)
+	}
+	if err := db.CreateVideo(&storage.Video{ID: "vid-1", ConversationID: "conv-1", Uploader: "alice", Filename: "/videos/conv-1/vid-1.mp4"}); err != nil {
+		t.Fatalf("CreateVideo: %v", err)
+	}
+}
+
+func TestJobLifecycle(t *testing.T) {
+	db := newTestDB(t)
+	createTestVideo(t, db)
+
+	id, err := db.EnqueueJob("vid-1", "/in.mov", "/out.mp4", 3)
+	if err != nil {
+		t.Fatalf("EnqueueJob: %v", err)
+	}
+
+	job, err := db.ClaimJob(time.Now())
+	if err != nil {
+		t.Fatalf("ClaimJob: %v", err)
+	}
+	if job == nil || job.ID != id {
+		t.Fatalf("expected to claim job %d, got %+v", id, job)
+	}
+	if job.State != storage.JobRunning || job.Attempts != 1 {
+		t.Errorf("expected running job on attempt 1, got %q attempt %d", job.State, job.Attempts)
+	}
+
+	// A running job cannot be claimed twice
+	again, err := db.ClaimJob(time.Now())
+	if err != nil {
+		t.Fatalf("ClaimJob: %v", err)
+	}
+	if again != nil {
+		t.Fatalf("expected no claimable job, got %+v", again)
+	}
+
+	retryAt := time.Now().Add(time.Hour)
+	if err := db.RetryJob(id, "boom", retryAt); err != nil {
+		t.Fatalf("RetryJob: %v", err)
+	}
+	if job, _ := db.ClaimJob(time.Now()); job != nil {
+		t.Fatal("job should not be claimable before its retry time")
+	}
+
+	job, err = db.ClaimJob(retryAt.Add(time.Second))
+	if err != nil {
+		t.Fatalf("ClaimJob: %v", err)
+	}
+	if job == nil || job.Attempts != 2 || job.LastError != "boom" {
+		t.Fatalf("expected second attempt with last error, got %+v", job)
+	}
+
+	if err := db.FailJob(id, "boom again"); err != nil {
+		t.Fatalf("FailJob: %v", err)
+	}
+	job, err = db.GetJobByVideoID("vid-1")
+	if err != nil {
+		t.Fatalf("GetJobByVideoID: %v", err)
+	}
+	if job.State != storage.JobFailed || job.LastError != "boom again" {
+		t.Errorf("expected failed job, got %+v", job)
+	}
+}
+
+func TestRecoverJobs(t *testing.T) {
+	db := newTestDB(t)
+	createTestVideo(t, db)
+
+	if _, err := db.EnqueueJob("vid-1", "/in.mov", "/out.mp4", 2); err != nil {
+		t.Fatalf("EnqueueJob: %v", err)
+	}
+	if _, err := db.ClaimJob(time.Now()); err != nil {
+		t.Fatalf("ClaimJob: %v", err)
+	}
+
+	// Simulate a restart: the running job's worker is gone
+	requeued, failed, err := db.RecoverJobs()
+	if err != nil {
+		t.Fatalf("RecoverJobs: %v", err)
+	}
+	if requeued != 1 || failed != 0 {
+		t.Errorf("expected 1 requeued job, got %d requeued and %d failed", requeued, failed)
+	}
+
+	job, err := db.ClaimJob(time.Now())
+	if err != nil {
+		t.Fatalf("ClaimJob: %v", err)
+	}
+	if job == nil {
+		t.Fatal("expected recovered job to be claimable")
+	}
+	if job.Attempts != 2 || job.LastError != storage.JobWorkerDied {
+		t.Errorf("expected interrupted attempt to count, got attempt %d with error %q", job.Attempts, job.LastError)
+	}
+
+	// The worker dies again, on the last attempt
+	requeued, failed, err = db.RecoverJobs()
+	if err != nil {
+		t.Fatalf("RecoverJobs: %v", err)
+	}
+	if requeued != 0 || failed != 1 {
+		t.Errorf("expected 1 failed job, got %d requeued and %d failed", requeued, failed)
+	}
+	job, _ = db.GetJobByVideoID("vid-1")
+	if job.State != storage.JobFailed || job.LastError != storage.JobWorkerDied {
+		t.Errorf("expected the job to fail, got %q with error %q", job.State, job.LastError)
+	}
+	if video, _ := db.GetVideo("vid-1"); video.Status != "error" || video.Error != storage.JobWorkerDied {
+		t.Errorf("expected the video to fail, got %q with error %q", video.Status, video.Error)
+	}
+	if job, _ := db.ClaimJob(time.Now()); job != nil {
+		t.Errorf("expected no claimable job, got %+v", job)
+	}
+}
+
+func TestReleaseJob(t *testing.T) {
+	db := newTestDB(t)
+	createTestVideo(t, db)
+
+	if _, err := db.EnqueueJob("vid-1", "/in.mov", "/out.mp4", 3); err != nil {
+		t.Fatalf("EnqueueJob: %v", err)
+	}
+	job, err := db.ClaimJob(time.Now())
+	if err != nil {
+		t.Fatalf("ClaimJob: %v", err)
+	}
+
+	// Simulate a graceful shutdown aborting the running attempt
+	if err := db.ReleaseJob(job.ID); err != nil {
+		t.Fatalf("ReleaseJob: %v", err)
+	}
+
+	job, err = db.ClaimJob(time.Now())
+	if err != nil {
+		t.Fatalf("ClaimJob: %v", err)
+	}
+	if job == nil {
+		t.Fatal("expected released job to be claimable")
+	}
+	if job.Attempts != 1 {
+		t.Errorf("expected interrupted attempt not to count, got attempt %d", job.Attempts)
+	}
+
+	// Only running jobs are released
+	if err := db.CompleteJob(job.ID); err != nil {
+		t.Fatalf("CompleteJob: %v", err)
+	}
+	if err := db.ReleaseJob(job.ID); err != nil {
+		t.Fatalf("ReleaseJob: %v", err)
+	}
+	job, err = db.GetJobByVideoID("vid-1")
+	if err != nil {
+		t.Fatalf("GetJobByVideoID: %v", err)
+	}
+	if job.State != storage.JobDone {
+		t.Errorf("expected completed job to stay done, got %q", job.State)
+	}
+}
+
+func TestSetVideoMetadata(t *testing.T) {
+	db := newTestDB(t)
+	createTestVideo(t, db)
+
+	want := storage.VideoMetadata{
+		DurationMS: 12500,
+		Width:      1280,
+		Height:     720,
+		VideoCodec: "h264",
+		AudioCodec: "aac",
+		Bitrate:    2_000_000,
+		SizeBytes:  3_125_000,
+		Rotation:   90,
+	}
+	if err := db.SetVideoMetadata("vid-1", want); err != nil {
+		t.Fatalf("SetVideoMetadata: %v", err)
+	}
+
+	video, err := db.GetVideo("vid-1")
+	if err != nil {
+		t.Fatalf("GetVideo: %v", err)
+	}
+	if video.Metadata != want {
+		t.Errorf("got %+v, want %+v", video.Metadata, want)
+	}
+}
+
+func TestUploadLifecycle(t *testing.T) {
+	db := newTestDB(t)
+	if err := db.CreateConversation("conv-1", "invite-abc", "Test", ""); err != nil {
+		t.Fatalf("CreateConversation: %v", err)
+	}
+
+	now := time.Now()
+	for _, u := range []*storage.Upload{
+		{ID: "up-1", ConversationID: "conv-1", Uploader: "alice", Filename: "a.mp4", Length: 100, ExpiresAt: now.Add(time.Hour), CreatedAt: now},
+		{ID: "up-2", ConversationID: "conv-1", Uploader: "alice", Length: 50, ExpiresAt: now.Add(-time.Minute), CreatedAt: now},
+	} {
+		if err := db.CreateUpload(u); err != nil {
+			t.Fatalf("CreateUpload: %v", err)
+		}
+	}
+
+	if err := db.UpdateUploadOffset("up-1", 40, now.Add(2*time.Hour)); err != nil {
+		t.Fatalf("UpdateUploadOffset: %v", err)
+	}
+	u, err := db.GetUpload("up-1")
+	if err != nil {
+		t.Fatalf("GetUpload: %v", err)
+	}
+	if u.Offset != 40 || u.Length != 100 || u.Filename != "a.mp4" {
+		t.Errorf("unexpected upload %+v", u)
+	}
+	if !u.ExpiresAt.After(now.Add(time.Hour)) {
+		t.Errorf("expected expiry to be extended, got %v", u.ExpiresAt)
+	}
+
+	expired, err := db.GetExpiredUploads(now)
+	if err != nil {
+		t.Fatalf("GetExpiredUploads: %v", err)
+	}
+	if len(expired) != 1 || expired[0].ID != "up-2" {
+		t.Errorf("expected only up-2 to be expired, got %+v", expired)
+	}
+
+	if err := db.DeleteUpload("up-1"); err != nil {
+		t.Fatalf("DeleteUpload: %v", err)
+	}
+	if u, err := db.GetUpload("up-1"); err != nil || u != nil {
+		t.Errorf("expected upload to be deleted, got %+v (err %v)", u, err)
+	}
+}
+
+func TestSetVideoVariants(t *testing.T) {
+	db := newTestDB(t)
+	createTestVideo(t, db)
+
+	variants := []storage.VideoVariant{
+		{Name: "720p", Height: 720, Bandwidth: 3_128_000, Playlist: "720p/index.m3u8"},
+		{Name: "360p", Height: 360, Bandwidth: 896_000, Playlist: "360p/index.m3u8"},
+	}
+	if err := db.SetVideoVariants("vid-1", "/videos/conv-1/vid-1_hls/master.m3u8", variants); err != nil {
+		t.Fatalf("SetVideoVariants: %v", err)
+	}
+	// Repackaging replaces the previous variants.
+	if err := db.SetVideoVariants("vid-1", "/videos/conv-1/vid-1_hls/master.m3u8", variants); err != nil {
+		t.Fatalf("SetVideoVariants again: %v", err)
+	}
+
+	v, err := db.GetVideo("vid-1")
+	if err != nil {
+		t.Fatalf("GetVideo: %v", err)
+	}
+	if v.HLSPlaylist != "/videos/conv-1/vid-1_hls/master.m3u8" {
+		t.Errorf("unexpected HLS playlist %q", v.HLSPlaylist)
+	}
+
+	byVideo, err := db.GetVariantsByConversation("conv-1")
+	if err != nil {
+		t.Fatalf("GetVariantsByConversation: %v", err)
+	}
+	got := byVideo["vid-1"]
+	if len(got) != 2 || got[0].Name != "360p" || got[1].Name != "720p" {
+		t.Errorf("expected variants ordered by height, got %+v", got)
+	}
+}
+
+func TestSetConversationProfile(t *testing.T) {
+	db := newTestDB(t)
+	if err := db.CreateConversation("conv-1", "invite-abc", "Test", ""); err != nil {
+		t.Fatalf("CreateConversation: %v", err)
+	}
+
+	c, err := db.GetConversation("conv-1")
+	if err != nil {
+		t.Fatalf("GetConversation: %v", err)
+	}
+	if c.Profile != "" {
+		t.Errorf("expected no profile by default, got %q", c.Profile)
+	}
+
+	if err := db.SetConversationProfile("conv-1", "1080p"); err != nil {
+		t.Fatalf("SetConversationProfile: %v", err)
+	}
+	c, err = db.GetConversation("conv-1")
+	if err != nil {
+		t.Fatalf("GetConversation: %v", err)
+	}
+	if c.Profile != "1080p" {
+		t.Errorf("expected profile 1080p, got %q", c.Profile)
+	}
+
+	if c, err := db.GetConversation("missing"); err != nil || c != nil {
+		t.Errorf("expected nil for missing conversation, got %+v (err %v)", c, err)
+	}
+}
+
+func TestSetConversationRetention(t *testing.T) {
+	db := newTestDB(t)
+	for _, id := range []string{"conv-1", "conv-2"} {
+		if err := db.CreateConversation(id, "invite-"+id, "Test", ""); err != nil {
+			t.Fatalf("CreateConversation: %v", err)
+		}
+	}
+
+	limited, err := db.GetConversationsWithRetention()
+	if err != nil {
+		t.Fatalf("GetConversationsWithRetention: %v", err)
+	}
+	if len(limited) != 0 {
+		t.Errorf("expected no conversations with retention by default, got %+v", limited)
+	}
+
+	policy := storage.Retention{Weeks: 4, Videos: 10, Bytes: 1 << 30}
+	if err := db.SetConversationRetention("conv-2", policy); err != nil {
+		t.Fatalf("SetConversationRetention: %v", err)
+	}
+	limited, err = db.GetConversationsWithRetention()
+	if err != nil {
+		t.Fatalf("GetConversationsWithRetention: %v", err)
+	}
+	if len(limited) != 1 || limited[0].ID != "conv-2" || limited[0].Retention != policy {
+		t.Errorf("expected conv-2 with %+v, got %+v", policy, limited)
+	}
+
+	if err := db.SetConversationRetention("conv-2", storage.Retention{}); err != nil {
+		t.Fatalf("SetConversationRetention: %v", err)
+	}
+	c, err := db.GetConversation("conv-2")
+	if err != nil {
+		t.Fatalf("GetConversation: %v", err)
+	}
+	if !c.Retention.Unlimited() {
+		t.Errorf("expected retention to be cleared, got %+v", c.Retention)
+	}
+}
+
+func TestForeignKeysEnforced(t *testing.T) {
+	db := newTestDB(t)
+
+	err := db.CreateVideo(&storage.Video{ID: "vid-1", ConversationID: "no-such-conv", Uploader: "alice", Filename: "/videos/vid-1.mp4"})
+	if err == nil {
+		t.Error("expected video in a missing conversation to be rejected")
+	}
+	if _, err := db.EnqueueJob("no-such-video", "/in.mov", "/out.mp4", 3); err == nil {
+		t.Error("expected job for a missing video to be rejected")
+	}
+}
+
+func TestDeleteConversationCascades(t *testing.T) {
+	db := newTestDB(t)
+	createTestVideo(t, db)
+
+	createUser(t, db, "alice")
+	if err := db.AddMember("conv-1", "alice"); err != nil {
+		t.Fatalf("AddMember: %v", err)
+	}
+	if _, err := db.EnqueueJob("vid-1", "/in.mov", "/out.mp4", 3); err != nil {
+		t.Fatalf("EnqueueJob: %v", err)
+	}
+	variants := []storage.VideoVariant{{Name: "360p", Height: 360, Bandwidth: 896_000, Playlist: "360p/index.m3u8"}}
+	if err := db.SetVideoVariants("vid-1", "/videos/conv-1/vid-1_hls/master.m3u8", variants); err != nil {
+		t.Fatalf("SetVideoVariants: %v", err)
+	}
+	upload := &storage.Upload{ID: "up-1", ConversationID: "conv-1", Uploader: "alice", Length: 10, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := db.CreateUpload(upload); err != nil {
+		t.Fatalf("CreateUpload: %v", err)
+	}
+
+	if err := db.DeleteConversation("conv-1"); err != nil {
+		t.Fatalf("DeleteConversation: %v", err)
+	}
+
+	for _, table := range []string{"members", "videos", "jobs", "video_variants", "uploads"} {
+		var n int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(&n); err != nil {
+			t.Fatalf("count %s: %v", table, err)
+		}
+		if n != 0 {
+			t.Errorf("expected %s rows to be deleted with the conversation, got %d", table, n)
+		}
+	}
+}
+
+func TestMemberRoles(t *testing.T) {
+	db := newTestDB(t)
+	if err := db.CreateConversation("conv-1", "invite-abc", "Test Group", ""); err != nil {
+		t.Fatalf("CreateConversation: %v", err)
+	}
+	createUser(t, db, "alice")
+	if err := db.AddMember("conv-1", "alice"); err != nil {
+		t.Fatalf("AddMember: %v", err)
+	}
+
+	role, err := db.GetMemberRole("conv-1", "alice")
+	if err != nil {
+		t.Fatalf("GetMemberRole: %v", err)
+	}
+	if role != storage.RoleMember {
+		t.Errorf("expected new member to have role %q, got %q", storage.RoleMember, role)
+	}
+
+	if err := db.SetMemberRole("conv-1", "alice", storage.RoleOwner); err != nil {
+		t.Fatalf("SetMemberRole: %v", err)
+	}
+	if role, _ := db.GetMemberRole("conv-1", "alice"); role != storage.RoleOwner {
+		t.Errorf("expected role %q, got %q", storage.RoleOwner, role)
+	}
+	if role, _ := db.GetMemberRole("conv-1", "bob"); role != "" {
+		t.Errorf("expected no role for non-member, got %q", role)
+	}
+}
+
+func TestRoleAtLeast(t *testing.T) {
+	tests := []struct {
+		role, min string
+		want      bool
+	}{
+		{storage.RoleOwner, storage.RoleAdmin, true},
+		{storage.RoleAdmin, storage.RoleAdmin, true},
+		{storage.RoleMember, storage.RoleAdmin, false},
+		{storage.RoleMember, storage.RoleMember, true},
+		{"", storage.RoleMember, false},
+		{"superuser", storage.RoleMember, false},
+	}
+	for _, tt := range tests {
+		if got := storage.RoleAtLeast(tt.role, tt.min); got != tt.want {
+			t.Errorf("RoleAtLeast(%q, %q) = %v, want %v", tt.role, tt.min, got, tt.want)
+		}
+	}
+}
+
+func TestGetAndRemoveMembers(t *testing.T) {
+	db := newTestDB(t)
+	if err := db.CreateConversation("conv-1", "invite-abc", "Test Group", ""); err != nil {
+		t.Fatalf("CreateConversation: %v", err)
+	}
+	for _, username := range []string{"alice", "bob", "carol"} {
+		createUser(t, db, username)
+		if err := db.AddMember("conv-1", username); err != nil {
+			t.Fatalf("AddMember: %v", err)
+		}
+	}
+	if err := db.SetMemberRole("conv-1", "carol", storage.RoleOwner); err != nil {
+		t.Fatalf("SetMemberRole: %v", err)
+	}
+	if err := db.SetMemberRole("conv-1", "bob", storage.RoleAdmin); err != nil {
+		t.Fatalf("SetMemberRole: %v", err)
+	}
+
+	members, err := db.GetMembers("conv-1")
+	if err != nil {
+		t.Fatalf("GetMembers: %v", err)
+	}
+	var got []string
+	for _, m := range members {
+		got = append(got, m.Username+":"+m.Role)
+	}
+	if want := []string{"carol:owner", "bob:admin", "alice:member"}; !slices.Equal(got, want) {
+		t.Errorf("expected members %v, got %v", want, got)
+	}
+
+	if err := db.RemoveMember("conv-1", "bob"); err != nil {
+		t.Fatalf("RemoveMember: %v", err)
+	}
+	if ok, _ := db.IsMember("conv-1", "bob"); ok {
+		t.Error("expected bob to be removed")
+	}
+	if user, _ := db.GetUserByUsername("bob"); user == nil {
+		t.Error("expected bob's account to remain")
+	}
+	if err := db.RemoveMember("conv-1", "bob"); err != nil {
+		t.Errorf("removing a non-member: %v", err)
+	}
+}
+
+func TestUpdateConversation(t *testing.T) {
+	db := newTestDB(t)
+	if err := db.CreateConversation("conv-1", "invite-abc", "Test Group", ""); err != nil {
+		t.Fatalf("CreateConversation: %v", err)
+	}
+	name, profile := "Book Club", "480p"
+	update := storage.ConversationUpdate{Name: &name, Profile: &profile, Retention: &storage.Retention{Weeks: 4, Videos: 10}}
+	if err := db.UpdateConversation("conv-1", update); err != nil {
+		t.Fatalf("UpdateConversation: %v", err)
+	}
+	c, _ := db.GetConversation("conv-1")
+	if c.Name != name || c.Profile != profile || c.Retention != (storage.Retention{Weeks: 4, Videos: 10}) {
+		t.Errorf("expected every setting to change, got %+v", c)
+	}
+
+	// Unset fields are left alone
+	name = "Wednesday Waffle"
+	if err := db.UpdateConversation("conv-1", storage.ConversationUpdate{Name: &name}); err != nil {
+		t.Fatalf("UpdateConversation: %v", err)
+	}
+	c, _ = db.GetConversation("conv-1")
+	if c.Name != name || c.Profile != profile || c.Retention.Weeks != 4 {
+		t.Errorf("expected only the name to change, got %+v", c)
+	}
+	if err := db.UpdateConversation("conv-1", storage.ConversationUpdate{}); err != nil {
+		t.Errorf("empty update: %v", err)
+	}
+}
+
+func TestDeleteRejectedVideos(t *testing.T) {
+	db := newTestDB(t)
+	createTestVideo(t, db)
+	if err := db.CreateRejectedVideo("bad-1", "conv-1", "alice", "unsupported media type"); err != nil {
+		t.Fatalf("CreateRejectedVideo: %v", err)
+	}
+
+	if n, err := db.DeleteRejectedVideos(time.Now().Add(-time.Hour)); err != nil || n != 0 {
+		t.Errorf("expected a recent rejection to be kept, removed %d, %v", n, err)
+	}
+	if n, err := db.DeleteRejectedVideos(time.Now().Add(time.Hour)); err != nil || n != 1 {
+		t.Errorf("expected 1 rejection to be removed, got %d, %v", n, err)
+	}
+	if v, _ := db.GetVideo("bad-1"); v != nil {
+		t.Errorf("expected the rejection to be gone, got %+v", v)
+	}
+	if v, _ := db.GetVideo("vid-1"); v == nil {
+		t.Error("expected other videos to be kept")
+	}
+}
+
+func TestDeleteVideo(t *testing.T) {
+	db := newTestDB(t)
+	createTestVideo(t, db)
+	if _, err := db.EnqueueJob("vid-1", "/in.mov", "/out.mp4", 3); err != nil {
+		t.Fatalf("EnqueueJob: %v", err)
+	}
+
+	if err := db.DeleteVideo("vid-1"); err != nil {
+		t.Fatalf("DeleteVideo: %v", err)
+	}
+	if video, _ := db.GetVideo("vid-1"); video != nil {
+		t.Errorf("expected video to be deleted, got %+v", video)
+	}
+	if job, _ := db.ClaimJob(time.Now()); job != nil {
+		t.Errorf("expected job to be deleted with its video, got %+v", job)
+	}
+	if err := db.DeleteVideo("vid-1"); err != nil {
+		t.Errorf("expected deleting a missing video to succeed, got %v", err)
+	}
+}
+
+func TestStorageUsage(t *testing.T) {
+	db := newTestDB(t)
+	for _, id := range []string{"conv-1", "conv-2"} {
+		if err := db.CreateConversation(id, "invite-"+id, "Test", ""); err != nil {
+			t.Fatalf("CreateConversation: %v", err)
+		}
+	}
+	videos := []storage.Video{
+		{ID: "vid-1", ConversationID: "conv-1", Uploader: "alice", StoredBytes: 100},
+		{ID: "vid-2", ConversationID: "conv-1", Uploader: "bob", StoredBytes: 20},
+		{ID: "vid-3", ConversationID: "conv-2", Uploader: "alice", StoredBytes: 3},
+	}
+	for _, v := range videos {
+		if err := db.CreateVideo(&v); err != nil {
+			t.Fatalf("CreateVideo: %v", err)
+		}
+	}
+	if err := db.SetVideoStoredBytes("vid-1", 50); err != nil {
+		t.Fatalf("SetVideoStoredBytes: %v", err)
+	}
+
+	total, byUploader, err := db.GetConversationUsage("conv-1")
+	if err != nil {
+		t.Fatalf("GetConversationUsage: %v", err)
+	}
+	if total != 70 || byUploader["alice"] != 50 || byUploader["bob"] != 20 {
+		t.Errorf("expected 70 bytes (alice 50, bob 20), got %d %v", total, byUploader)
+	}
+	if used, err := db.GetUploaderUsage("alice"); err != nil || used != 53 {
+		t.Errorf("expected alice to use 53 bytes, got %d, %v", used, err)
+	}
+	if used, err := db.GetUploaderUsage("carol"); err != nil || used != 0 {
+		t.Errorf("expected carol to use nothing, got %d, %v", used, err)
+	}
+}
+
+func TestUsers(t *testing.T) {
+	db := newTestDB(t)
+	if err := db.CreateUser(&storage.User{ID: "user-1", Username: "alice", PassphraseHash: "hash"}); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	if err := db.CreateUser(&storage.User{ID: "user-2", Username: "alice"}); !errors.Is(err, storage.ErrUsernameTaken) {
+		t.Errorf("expected ErrUsernameTaken for a duplicate username, got %v", err)
+	}
+
+	user, err := db.GetUserByUsername("alice")
+	if err != nil || user == nil {
+		t.Fatalf("GetUserByUsername: %+v, %v", user, err)
+	}
+	if user.ID != "user-1" || user.PassphraseHash != "hash" || user.CreatedAt.IsZero() {
+		t.Errorf("unexpected user %+v", user)
+	}
+	if err := db.SetUserPassphrase("user-1", "new-hash"); err != nil {
+		t.Fatalf("SetUserPassphrase: %v", err)
+	}
+	if user, err := db.GetUser("user-1"); err != nil || user == nil || user.PassphraseHash != "new-hash" {
+		t.Errorf("expected passphrase to change, got %+v, %v", user, err)
+	}
+	if user, err := db.GetUser("user-2"); err != nil || user != nil {
+		t.Errorf("expected no user, got %+v, %v", user, err)
+	}
+
+	if err := db.CreateConversation("conv-1", "invite-abc", "Test Group", ""); err != nil {
+		t.Fatalf("CreateConversation: %v", err)
+	}
+	if err := db.AddMember("conv-1", "mallory"); err == nil {
+		t.Error("expected adding a missing user to fail")
+	}
+}
+
+func TestClaimUser(t *testing.T) {
+	db := newTestDB(t)
+	for _, username := range []string{"alice", "bob", "carol"} {
+		createUser(t, db, username)
+	}
+	if err := db.SetUserEmail("id-bob", "bob@example.com"); err != nil {
+		t.Fatalf("SetUserEmail: %v", err)
+	}
+	if err := db.CreatePasskey(&storage.Passkey{ID: []byte("key-1"), UserID: "id-carol", PublicKey: []byte("pk")}); err != nil {
+		t.Fatalf("CreatePasskey: %v", err)
+	}
+
+	user, err := db.ClaimUser("alice", "hash")
+	if err != nil || user == nil || user.ID != "id-alice" || user.PassphraseHash != "hash" {
+		t.Fatalf("ClaimUser: %+v, %v", user, err)
+	}
+	for _, username := range []string{"alice", "bob", "carol", "nobody"} {
+		if user, err := db.ClaimUser(username, "other-hash"); err != nil || user != nil {
+			t.Errorf("%s: expected no claim, got %+v, %v", username, user, err)
+		}
+	}
+	if user, _ := db.GetUser("id-alice"); user.PassphraseHash != "hash" {
+		t.Errorf("expected the first claim to stick, got %q", user.PassphraseHash)
+	}
+}
+
+func TestUserEmail(t *testing.T) {
+	db := newTestDB(t)
+	createUser(t, db, "alice")
+	createUser(t, db, "bob")
+
+	if err := db.SetUserEmail("id-alice", "alice@example.com"); err != nil {
+		t.Fatalf("SetUserEmail: %v", err)
+	}
+	if err := db.SetUserEmail("id-bob", "alice@example.com"); !errors.Is(err, storage.ErrEmailTaken) {
+		t.Errorf("expected ErrEmailTaken, got %v", err)
+	}
+	if err := db.SetUserEmail("id-alice", "alice@example.com"); err != nil {
+		t.Errorf("expected setting the same address again to succeed, got %v", err)
+	}
+	if user, err := db.GetUserByEmail("alice@example.com"); err != nil || user == nil || user.Username != "alice" {
+		t.Errorf("GetUserByEmail: %+v, %v", user, err)
+	}
+
+	// Clearing the address frees it, and leaves no empty address to collide
+	if err := db.SetUserEmail("id-alice", ""); err != nil {
+		t.Fatalf("SetUserEmail: %v", err)
+	}
+	if err := db.SetUserEmail("id-bob", ""); err != nil {
+		t.Errorf("expected two users without an address, got %v", err)
+	}
+	if err := db.SetUserEmail("id-bob", "alice@example.com"); err != nil {
+		t.Errorf("expected the cleared address to be free, got %v", err)
+	}
+}
+
+func TestLoginTokens(t *testing.T) {
+	db := newTestDB(t)
+	createUser(t, db, "alice")
+	now := time.Now()
+
+	if err := db.CreateLoginToken("hash-1", &storage.LoginToken{UserID: "id-alice", ExpiresAt: now.Add(time.Minute)}); err != nil {
+		t.Fatalf("CreateLoginToken: %v", err)
+	}
+	if err := db.CreateLoginToken("hash-2", &storage.LoginToken{UserID: "id-alice", Email: "alice@example.com", ExpiresAt: now.Add(-time.Second)}); err != nil {
+		t.Fatalf("CreateLoginToken: %v", err)
+	}
+
+	token, err := db.ConsumeLoginToken("hash-1", now)
+	if err != nil || token == nil || token.UserID != "id-alice" {
+		t.Fatalf("ConsumeLoginToken: %+v, %v", token, err)
+	}
+	if token, err := db.ConsumeLoginToken("hash-1", now); err != nil || token != nil {
+		t.Errorf("expected the token to be single-use, got %+v, %v", token, err)
+	}
+	if token, err := db.ConsumeLoginToken("hash-2", now); err != nil || token != nil {
+		t.Errorf("expected the expired token to be rejected, got %+v, %v", token, err)
+	}
+}
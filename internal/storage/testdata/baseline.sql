@@ -0,0 +1,30 @@
+-- A database created by the original release, before migrations were
+-- versioned.
+CREATE TABLE conversations (
+	id          TEXT PRIMARY KEY,
+	invite_code TEXT UNIQUE NOT NULL,
+	name        TEXT NOT NULL,
+	created_at  DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE members (
+	conversation_id TEXT NOT NULL,
+	username        TEXT NOT NULL,
+	joined_at       DATETIME DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (conversation_id, username),
+	FOREIGN KEY (conversation_id) REFERENCES conversations(id)
+);
+
+CREATE TABLE videos (
+	id              TEXT PRIMARY KEY,
+	conversation_id TEXT NOT NULL,
+	uploader        TEXT NOT NULL,
+	filename        TEXT NOT NULL,
+	status          TEXT NOT NULL DEFAULT 'pending',
+	uploaded_at     DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (conversation_id) REFERENCES conversations(id)
+);
+
+INSERT INTO conversations (id, invite_code, name) VALUES ('conv-1', 'invite-abc', 'Wednesday');
+INSERT INTO members (conversation_id, username) VALUES ('conv-1', 'alice');
+INSERT INTO videos (id, conversation_id, uploader, filename, status) VALUES ('vid-1', 'conv-1', 'alice', '/videos/conv-1/vid-1.mp4', 'ready');
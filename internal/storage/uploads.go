@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Upload is an in-progress resumable upload.
+type Upload struct {
+	ID             string
+	ConversationID string
+	Uploader       string // username; see User
+	Filename       string // as supplied by the client, informational only
+	Length         int64
+	Offset         int64
+	ExpiresAt      time.Time
+	CreatedAt      time.Time
+}
+
+const uploadColumns = `id, conversation_id, uploader, filename, upload_length, upload_offset, expires_at, created_at`
+
+func scanUpload(row interface{ Scan(...any) error }) (*Upload, error) {
+	u := &Upload{}
+	err := row.Scan(&u.ID, &u.ConversationID, &u.Uploader, &u.Filename, &u.Length, &u.Offset, &u.ExpiresAt, &u.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (db *DB) CreateUpload(u *Upload) error {
+	_, err := db.Exec(`
+		INSERT INTO uploads (id, conversation_id, uploader, filename, upload_length, upload_offset, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, u.ID, u.ConversationID, u.Uploader, u.Filename, u.Length, u.Offset, u.ExpiresAt.UTC(), u.CreatedAt.UTC())
+	if err != nil {
+		return fmt.Errorf("create upload: %w", err)
+	}
+	return nil
+}
+
+func (db *DB) GetUpload(id string) (*Upload, error) {
+	row := db.QueryRow(`SELECT `+uploadColumns+` FROM uploads WHERE id = ?`, id)
+	u, err := scanUpload(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get upload: %w", err)
+	}
+	return u, nil
+}
+
+// UpdateUploadOffset records how many bytes have been received and extends
+// the upload's expiry.
+func (db *DB) UpdateUploadOffset(id string, offset int64, expiresAt time.Time) error {
+	_, err := db.Exec(
+		`UPDATE uploads SET upload_offset = ?, expires_at = ? WHERE id = ?`,
+		offset, expiresAt.UTC(), id,
+	)
+	if err != nil {
+		return fmt.Errorf("update upload offset: %w", err)
+	}
+	return nil
+}
+
+func (db *DB) DeleteUpload(id string) error {
+	_, err := db.Exec(`DELETE FROM uploads WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("delete upload: %w", err)
+	}
+	return nil
+}
+
+// GetExpiredUploads returns uploads that expired before now.
+func (db *DB) GetExpiredUploads(now time.Time) ([]Upload, error) {
+	rows, err := db.Query(`SELECT `+uploadColumns+` FROM uploads WHERE expires_at < ?`, now.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("get expired uploads: %w", err)
+	}
+	return scanUploads(rows)
+}
+
+// GetUploadsByConversation returns the conversation's uploads in progress.
+func (db *DB) GetUploadsByConversation(conversationID string) ([]Upload, error) {
+	rows, err := db.Query(`SELECT `+uploadColumns+` FROM uploads WHERE conversation_id = ?`, conversationID)
+	if err != nil {
+		return nil, fmt.Errorf("get uploads by conversation: %w", err)
+	}
+	return scanUploads(rows)
+}
+
+func scanUploads(rows *sql.Rows) ([]Upload, error) {
+	defer rows.Close()
+
+	var uploads []Upload
+	for rows.Next() {
+		u, err := scanUpload(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan upload: %w", err)
+		}
+		uploads = append(uploads, *u)
+	}
+	return uploads, rows.Err()
+}
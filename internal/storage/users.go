@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrUsernameTaken is returned by CreateUser when another user already has
+// the username.
+var ErrUsernameTaken = errors.New("username taken")
+
+// ErrEmailTaken is returned by SetUserEmail when another user already has
+// the email address.
+var ErrEmailTaken = errors.New("email taken")
+
+// User is an account. Usernames are unique and never change, and users are
+// never deleted, so no username is ever reused. Members, passkeys and login
+// tokens refer to users by ID; videos, uploads and sessions, which predate
+// accounts, still refer to them by username, which is as stable.
+type User struct {
+	ID       string
+	Username string
+	// PassphraseHash is empty for accounts carried over from before users
+	// existed, until their owner claims them by setting a passphrase.
+	PassphraseHash string
+	// Email is the confirmed address sign-in links are sent to, or empty.
+	Email     string
+	CreatedAt time.Time
+}
+
+const userColumns = `id, username, passphrase_hash, coalesce(email, ''), created_at`
+
+func scanUser(row interface{ Scan(...any) error }) (*User, error) {
+	u := &User{}
+	if err := row.Scan(&u.ID, &u.Username, &u.PassphraseHash, &u.Email, &u.CreatedAt); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (db *DB) CreateUser(u *User) error {
+	res, err := db.Exec(
+		`INSERT INTO users (id, username, passphrase_hash) VALUES (?, ?, ?) ON CONFLICT (username) DO NOTHING`,
+		u.ID, u.Username, u.PassphraseHash,
+	)
+	if err != nil {
+		return fmt.Errorf("create user: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("create user: %w", err)
+	} else if n == 0 {
+		return ErrUsernameTaken
+	}
+	return nil
+}
+
+func (db *DB) GetUser(id string) (*User, error) {
+	row := db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id)
+	u, err := scanUser(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get user: %w", err)
+	}
+	return u, nil
+}
+
+func (db *DB) GetUserByUsername(username string) (*User, error) {
+	row := db.QueryRow(`SELECT `+userColumns+` FROM users WHERE username = ?`, username)
+	u, err := scanUser(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get user by username: %w", err)
+	}
+	return u, nil
+}
+
+func (db *DB) SetUserPassphrase(id, passphraseHash string) error {
+	_, err := db.Exec(`UPDATE users SET passphrase_hash = ? WHERE id = ?`, passphraseHash, id)
+	if err != nil {
+		return fmt.Errorf("set user passphrase: %w", err)
+	}
+	return nil
+}
+
+// ClaimUser sets the passphrase of an account carried over from before
+// users existed, returning it, or nil if there is no such account or its
+// owner has already claimed or secured it with an email address or a
+// passkey.
+func (db *DB) ClaimUser(username, passphraseHash string) (*User, error) {
+	row := db.QueryRow(`
+		UPDATE users SET passphrase_hash = ?
+		WHERE username = ? AND passphrase_hash = '' AND email IS NULL
+			AND NOT EXISTS (SELECT 1 FROM passkeys WHERE user_id = users.id)
+		RETURNING `+userColumns,
+		passphraseHash, username,
+	)
+	u, err := scanUser(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("claim user: %w", err)
+	}
+	return u, nil
+}
+
+func (db *DB) GetUserByEmail(email string) (*User, error) {
+	row := db.QueryRow(`SELECT `+userColumns+` FROM users WHERE email = ?`, email)
+	u, err := scanUser(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get user by email: %w", err)
+	}
+	return u, nil
+}
+
+// SetUserEmail sets the user's email address, or clears it if email is
+// empty.
+func (db *DB) SetUserEmail(id, email string) error {
+	var value any
+	if email != "" {
+		value = email
+	}
+	res, err := db.Exec(
+		`UPDATE users SET email = ? WHERE id = ? AND NOT EXISTS (SELECT 1 FROM users WHERE email = ? AND id != ?)`,
+		value, id, value, id,
+	)
+	if err != nil {
+		return fmt.Errorf("set user email: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("set user email: %w", err)
+	} else if n == 0 && email != "" {
+		return ErrEmailTaken
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package storage
+
+import "fmt"
+
+// VideoVariant is one rendition of a video's HLS ladder.
+type VideoVariant struct {
+	Name      string
+	Height    int
+	Bandwidth int64  // bits per second
+	Playlist  string // media playlist, relative to the master playlist
+}
+
+// SetVideoVariants records a video's master playlist and renditions,
+// replacing any recorded before.
+func (db *DB) SetVideoVariants(videoID, masterPlaylist string, variants []VideoVariant) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin set video variants: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM video_variants WHERE video_id = ?`, videoID); err != nil {
+		return fmt.Errorf("clear video variants: %w", err)
+	}
+	for _, v := range variants {
+		_, err := tx.Exec(
+			`INSERT INTO video_variants (video_id, name, height, bandwidth, playlist) VALUES (?, ?, ?, ?, ?)`,
+			videoID, v.Name, v.Height, v.Bandwidth, v.Playlist,
+		)
+		if err != nil {
+			return fmt.Errorf("insert video variant: %w", err)
+		}
+	}
+	if _, err := tx.Exec(`UPDATE videos SET hls_playlist = ? WHERE id = ?`, masterPlaylist, videoID); err != nil {
+		return fmt.Errorf("set hls playlist: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit set video variants: %w", err)
+	}
+	return nil
+}
+
+// GetVariantsByConversation returns the HLS renditions of every video in a
+// conversation, keyed by video id and ordered from lowest to highest.
+func (db *DB) GetVariantsByConversation(conversationID string) (map[string][]VideoVariant, error) {
+	rows, err := db.Query(`
+		SELECT vv.video_id, vv.name, vv.height, vv.bandwidth, vv.playlist
+		FROM video_variants vv
+		JOIN videos v ON v.id = vv.video_id
+		WHERE v.conversation_id = ?
+		ORDER BY vv.video_id, vv.height
+	`, conversationID)
+	if err != nil {
+		return nil, fmt.Errorf("get variants by conversation: %w", err)
+	}
+	defer rows.Close()
+
+	variants := make(map[string][]VideoVariant)
+	for rows.Next() {
+		var videoID string
+		var v VideoVariant
+		if err := rows.Scan(&videoID, &v.Name, &v.Height, &v.Bandwidth, &v.Playlist); err != nil {
+			return nil, fmt.Errorf("scan video variant: %w", err)
+		}
+		variants[videoID] = append(variants[videoID], v)
+	}
+	return variants, rows.Err()
+}
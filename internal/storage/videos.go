@@ -1,23 +1,62 @@
 package storage
 
 import (
+	"database/sql"
 	"fmt"
 	"time"
 )
 
 type Video struct {
-	ID             string
-	ConversationID string
-	Uploader       string
-	Filename       string
-	Status         string // "pending", "ready", "error"
-	UploadedAt     time.Time
+	ID              string
+	ConversationID  string
+	Uploader        string // username, which is as stable as a user ID; see User
+	Filename        string // blob key of the transcoded MP4, e.g. "<conversation id>/<id>.mp4"
+	Status          string // "pending", "ready", "error", "rejected"
+	Error           string // why the video was rejected or failed to transcode
+	PosterFilename  string // blob key, empty until generated
+	PreviewFilename string // blob key, empty until generated
+	HLSPlaylist     string // blob key of the master playlist, empty unless HLS was generated
+	OriginalSHA256  string // hex SHA-256 of the uploaded file, empty for rejected uploads
+	Profile         string // name of the transcoding profile, empty for rejected uploads
+	StoredBytes     int64  // disk space used by the video's files
+	Metadata        VideoMetadata
+	UploadedAt      time.Time
 }
 
-func (db *DB) CreateVideo(id, conversationID, uploader, filename string) error {
+// VideoMetadata describes the media of a transcoded video. All fields are
+// zero until the video has been probed.
+type VideoMetadata struct {
+	DurationMS int64
+	Width      int
+	Height     int
+	VideoCodec string
+	AudioCodec string
+	Bitrate    int64 // bits per second
+	SizeBytes  int64
+	Rotation   int // rotation of the original upload, in degrees clockwise
+}
+
+const videoColumns = `id, conversation_id, uploader, filename, status, error, poster_filename, preview_filename, hls_playlist, original_sha256, profile, stored_bytes,
+	duration_ms, width, height, video_codec, audio_codec, bitrate, size_bytes, rotation, uploaded_at`
+
+func scanVideo(row interface{ Scan(...any) error }) (*Video, error) {
+	v := &Video{}
+	m := &v.Metadata
+	err := row.Scan(&v.ID, &v.ConversationID, &v.Uploader, &v.Filename, &v.Status, &v.Error,
+		&v.PosterFilename, &v.PreviewFilename, &v.HLSPlaylist, &v.OriginalSHA256, &v.Profile, &v.StoredBytes,
+		&m.DurationMS, &m.Width, &m.Height, &m.VideoCodec, &m.AudioCodec, &m.Bitrate, &m.SizeBytes, &m.Rotation,
+		&v.UploadedAt)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// CreateVideo records a new upload as pending.
+func (db *DB) CreateVideo(v *Video) error {
 	_, err := db.Exec(
-		`INSERT INTO videos (id, conversation_id, uploader, filename, status) VALUES (?, ?, ?, ?, 'pending')`,
-		id, conversationID, uploader, filename,
+		`INSERT INTO videos (id, conversation_id, uploader, filename, status, original_sha256, profile, stored_bytes) VALUES (?, ?, ?, ?, 'pending', ?, ?, ?)`,
+		v.ID, v.ConversationID, v.Uploader, v.Filename, v.OriginalSHA256, v.Profile, v.StoredBytes,
 	)
 	if err != nil {
 		return fmt.Errorf("create video: %w", err)
@@ -25,6 +64,42 @@ func (db *DB) CreateVideo(id, conversationID, uploader, filename string) error {
 	return nil
 }
 
+// CreateRejectedVideo records an upload that failed validation. No file is
+// kept for it.
+func (db *DB) CreateRejectedVideo(id, conversationID, uploader, reason string) error {
+	_, err := db.Exec(
+		`INSERT INTO videos (id, conversation_id, uploader, filename, status, error) VALUES (?, ?, ?, '', 'rejected', ?)`,
+		id, conversationID, uploader, reason,
+	)
+	if err != nil {
+		return fmt.Errorf("create rejected video: %w", err)
+	}
+	return nil
+}
+
+// DeleteRejectedVideos removes the records of uploads rejected before the
+// given time, returning how many were removed.
+func (db *DB) DeleteRejectedVideos(before time.Time) (int64, error) {
+	res, err := db.Exec(`DELETE FROM videos WHERE status = 'rejected' AND uploaded_at < ?`, before.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("delete rejected videos: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// SetVideoFailure sets the status of a video that could not be processed
+// along with the reason.
+func (db *DB) SetVideoFailure(id, status, reason string) error {
+	_, err := db.Exec(
+		`UPDATE videos SET status = ?, error = ? WHERE id = ?`,
+		status, reason, id,
+	)
+	if err != nil {
+		return fmt.Errorf("set video failure: %w", err)
+	}
+	return nil
+}
+
 func (db *DB) UpdateVideoStatus(id, status string) error {
 	_, err := db.Exec(
 		`UPDATE videos SET status = ? WHERE id = ?`,
@@ -36,12 +111,94 @@ func (db *DB) UpdateVideoStatus(id, status string) error {
 	return nil
 }
 
+// DeleteVideo removes a video along with its transcoding job and HLS
+// variants. Deleting a video that doesn't exist is not an error.
+func (db *DB) DeleteVideo(id string) error {
+	if _, err := db.Exec(`DELETE FROM videos WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("delete video: %w", err)
+	}
+	return nil
+}
+
+// SetVideoThumbnails records the generated poster and preview files. An
+// empty filename means that asset could not be generated.
+func (db *DB) SetVideoThumbnails(id, posterFilename, previewFilename string) error {
+	_, err := db.Exec(
+		`UPDATE videos SET poster_filename = ?, preview_filename = ? WHERE id = ?`,
+		posterFilename, previewFilename, id,
+	)
+	if err != nil {
+		return fmt.Errorf("set video thumbnails: %w", err)
+	}
+	return nil
+}
+
+// SetVideoStoredBytes records the disk space used by a video's files.
+func (db *DB) SetVideoStoredBytes(id string, n int64) error {
+	if _, err := db.Exec(`UPDATE videos SET stored_bytes = ? WHERE id = ?`, n, id); err != nil {
+		return fmt.Errorf("set video stored bytes: %w", err)
+	}
+	return nil
+}
+
+// GetConversationUsage returns the bytes stored for a conversation's
+// videos, in total and by uploader.
+func (db *DB) GetConversationUsage(conversationID string) (int64, map[string]int64, error) {
+	rows, err := db.Query(`
+		SELECT uploader, SUM(stored_bytes)
+		FROM videos
+		WHERE conversation_id = ?
+		GROUP BY uploader
+	`, conversationID)
+	if err != nil {
+		return 0, nil, fmt.Errorf("get conversation usage: %w", err)
+	}
+	defer rows.Close()
+
+	var total int64
+	byUploader := make(map[string]int64)
+	for rows.Next() {
+		var uploader string
+		var n int64
+		if err := rows.Scan(&uploader, &n); err != nil {
+			return 0, nil, fmt.Errorf("scan conversation usage: %w", err)
+		}
+		byUploader[uploader] = n
+		total += n
+	}
+	return total, byUploader, rows.Err()
+}
+
+// GetUploaderUsage returns the bytes stored for a user's videos across
+// every conversation.
+func (db *DB) GetUploaderUsage(username string) (int64, error) {
+	var n int64
+	err := db.QueryRow(`SELECT COALESCE(SUM(stored_bytes), 0) FROM videos WHERE uploader = ?`, username).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("get uploader usage: %w", err)
+	}
+	return n, nil
+}
+
+func (db *DB) SetVideoMetadata(id string, m VideoMetadata) error {
+	_, err := db.Exec(`
+		UPDATE videos
+		SET duration_ms = ?, width = ?, height = ?, video_codec = ?, audio_codec = ?,
+			bitrate = ?, size_bytes = ?, rotation = ?
+		WHERE id = ?
+	`, m.DurationMS, m.Width, m.Height, m.VideoCodec, m.AudioCodec, m.Bitrate, m.SizeBytes, m.Rotation, id)
+	if err != nil {
+		return fmt.Errorf("set video metadata: %w", err)
+	}
+	return nil
+}
+
 func (db *DB) GetVideosByConversation(conversationID string) ([]Video, error) {
 	rows, err := db.Query(`
-		SELECT id, conversation_id, uploader, filename, status, uploaded_at
+		SELECT `+videoColumns+`
 		FROM videos
 		WHERE conversation_id = ?
-		ORDER BY uploaded_at DESC
+		ORDER BY uploaded_at DESC, rowid DESC
 	`, conversationID)
 	if err != nil {
 		return nil, fmt.Errorf("get videos by conversation: %w", err)
@@ -50,11 +207,27 @@ func (db *DB) GetVideosByConversation(conversationID string) ([]Video, error) {
 
 	var videos []Video
 	for rows.Next() {
-		v := Video{}
-		if err := rows.Scan(&v.ID, &v.ConversationID, &v.Uploader, &v.Filename, &v.Status, &v.UploadedAt); err != nil {
+		v, err := scanVideo(rows)
+		if err != nil {
 			return nil, fmt.Errorf("scan video: %w", err)
 		}
-		videos = append(videos, v)
+		videos = append(videos, *v)
 	}
 	return videos, nil
 }
+
+func (db *DB) GetVideo(id string) (*Video, error) {
+	row := db.QueryRow(`
+		SELECT `+videoColumns+`
+		FROM videos
+		WHERE id = ?
+	`, id)
+	v, err := scanVideo(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get video: %w", err)
+	}
+	return v, nil
+}
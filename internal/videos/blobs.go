@@ -0,0 +1,164 @@
+package videos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"waffle-app/internal/storage"
+)
+
+// scratchDirName is the directory under VideosDir where workers fetch
+// originals and write transcoder output before storing it.
+const scratchDirName = ".scratch"
+
+func (h *Handler) scratchDir() string {
+	return filepath.Join(h.VideosDir, scratchDirName)
+}
+
+// originalKey and outputKey name a video's objects in the blob store,
+// grouped by conversation.
+func originalKey(conversationID, videoID string, format container) string {
+	return conversationID + "/original_" + videoID + format.ext
+}
+
+func outputKey(conversationID, videoID string) string {
+	return conversationID + "/" + videoID + ".mp4"
+}
+
+// putFile stores the file at localPath under key.
+func (h *Handler) putFile(ctx context.Context, key, localPath string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return h.Blobs.Put(ctx, key, f, info.Size())
+}
+
+// putDir stores every file under dir with keys starting with prefix,
+// followed by the file's slash-separated path relative to dir.
+func (h *Handler) putDir(ctx context.Context, prefix, dir string) error {
+	return filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		return h.putFile(ctx, prefix+filepath.ToSlash(rel), p)
+	})
+}
+
+// fetchBlob copies the object stored under key to localPath.
+func (h *Handler) fetchBlob(ctx context.Context, key, localPath string) error {
+	body, err := h.Blobs.Get(ctx, key, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	f, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, body); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// deletePrefix removes every object whose key starts with prefix.
+func (h *Handler) deletePrefix(ctx context.Context, prefix string) error {
+	blobs, err := h.Blobs.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, b := range blobs {
+		errs = append(errs, h.Blobs.Delete(ctx, b.Key))
+	}
+	return errors.Join(errs...)
+}
+
+// videoBlobs lists every object stored for a video: its original if it
+// has not been transcoded yet, and otherwise the MP4, thumbnails and HLS
+// ladder, whose keys all start with the MP4's key minus its extension.
+// Video ids have a fixed length, so the prefix matches no other video.
+func (h *Handler) videoBlobs(ctx context.Context, video *storage.Video) ([]storage.BlobInfo, error) {
+	blobs, err := h.Blobs.List(ctx, video.ConversationID+"/original_"+video.ID+".")
+	if err != nil {
+		return nil, err
+	}
+	if video.Filename != "" {
+		outputs, err := h.Blobs.List(ctx, strings.TrimSuffix(video.Filename, ".mp4"))
+		if err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, outputs...)
+	}
+	return blobs, nil
+}
+
+// blobReader reads an object as an io.ReadSeeker, so that
+// http.ServeContent can serve Range requests from any BlobStore. Each read
+// after a seek opens a new ranged read at the current offset.
+type blobReader struct {
+	ctx    context.Context
+	store  storage.BlobStore
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (b *blobReader) Read(p []byte) (int, error) {
+	if b.offset >= b.size {
+		return 0, io.EOF
+	}
+	if b.body == nil {
+		body, err := b.store.Get(b.ctx, b.key, b.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+		b.body = body
+	}
+	n, err := b.body.Read(p)
+	b.offset += int64(n)
+	return n, err
+}
+
+func (b *blobReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += b.offset
+	case io.SeekEnd:
+		offset += b.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("seek %s: negative position", b.key)
+	}
+	if offset != b.offset {
+		b.Close()
+		b.offset = offset
+	}
+	return offset, nil
+}
+
+func (b *blobReader) Close() error {
+	if b.body == nil {
+		return nil
+	}
+	err := b.body.Close()
+	b.body = nil
+	return err
+}
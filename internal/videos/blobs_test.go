@@ -0,0 +1,107 @@
+package videos_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"waffle-app/internal/storage"
+	"waffle-app/internal/storage/s3test"
+	"waffle-app/internal/videos/videotest"
+)
+
+func TestLifecycle_S3BlobStore(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	setupMember(t, db)
+
+	s3 := s3test.NewServer(t)
+	h := newHLSHandler(db, sessions, dir, &videotest.HLSPackager{})
+	h.Blobs = s3.Store()
+
+	videoID := upload(t, h, sessions, "clip.mp4", videotest.MP4("raw footage"))
+	if keys := s3.Keys(); !slices.Equal(keys, []string{"conv-1/original_" + videoID + ".mp4"}) {
+		t.Errorf("expected only the original to be stored, got %v", keys)
+	}
+	startWorkers(t, h)
+	waitForJob(t, db, videoID, storage.JobDone)
+
+	video, err := db.GetVideo(videoID)
+	if err != nil || video == nil {
+		t.Fatalf("GetVideo: %+v, %v", video, err)
+	}
+	if video.Filename != "conv-1/"+videoID+".mp4" || video.PosterFilename != "conv-1/"+videoID+".jpg" {
+		t.Errorf("expected keys to be recorded, got %q and %q", video.Filename, video.PosterFilename)
+	}
+	if slices.Contains(s3.Keys(), "conv-1/original_"+videoID+".mp4") {
+		t.Error("expected the original to be deleted after transcoding")
+	}
+	if entries, _ := os.ReadDir(filepath.Join(dir, "conv-1")); len(entries) != 0 {
+		t.Errorf("expected nothing stored on disk, got %v", entries)
+	}
+
+	want := videotest.TranscodedPrefix + string(videotest.MP4("raw footage"))
+	rr := httptest.NewRecorder()
+	h.Stream(rr, streamRequest(t, sessions, videoID))
+	if rr.Code != http.StatusOK || rr.Body.String() != want {
+		t.Errorf("stream: got %d %q", rr.Code, rr.Body.String())
+	}
+	req := streamRequest(t, sessions, videoID)
+	req.Header.Set("Range", "bytes=2-5")
+	rr = httptest.NewRecorder()
+	h.Stream(rr, req)
+	if rr.Code != http.StatusPartialContent || rr.Body.String() != want[2:6] {
+		t.Errorf("range: got %d %q", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	h.HLSFile(rr, hlsRequest(t, sessions, videoID, "360p/segment_000.ts"))
+	if rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), videotest.Segment("360p")) {
+		t.Errorf("HLS segment: got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	h.Delete(rr, deleteRequest(t, sessions, "alice", videoID))
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("delete: expected 204, got %d", rr.Code)
+	}
+	if keys := s3.Keys(); len(keys) != 0 {
+		t.Errorf("expected every object to be deleted, got %v", keys)
+	}
+}
+
+func TestThumbnail_RedirectsToSignedURL(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	setupMember(t, db)
+
+	s3 := s3test.NewServer(t)
+	h := newPipelineHandler(db, sessions, dir, &videotest.Transcoder{})
+	h.Blobs = s3.Store()
+	h.SignedURLExpiry = time.Minute
+
+	videoID := upload(t, h, sessions, "clip.mp4", videotest.MP4("raw footage"))
+	startWorkers(t, h)
+	waitForJob(t, db, videoID, storage.JobDone)
+
+	rr := httptest.NewRecorder()
+	h.Thumbnail(rr, thumbnailRequest(t, sessions, videoID, ""))
+	location := rr.Header().Get("Location")
+	if rr.Code != http.StatusFound || !strings.HasPrefix(location, s3.URL+"/") {
+		t.Fatalf("expected a redirect to the blob store, got %d %q", rr.Code, location)
+	}
+
+	resp, err := http.Get(location)
+	if err != nil {
+		t.Fatalf("GET signed URL: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, videotest.Poster) {
+		t.Errorf("signed URL: got %d %q", resp.StatusCode, body)
+	}
+}
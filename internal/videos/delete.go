@@ -0,0 +1,144 @@
+package videos
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"waffle-app/internal/auth"
+	"waffle-app/internal/storage"
+)
+
+// errVideoDeleted is the cancellation cause of a transcode whose video was
+// deleted while it ran.
+var errVideoDeleted = errors.New("video deleted")
+
+// runningJob is a transcoding job in progress.
+type runningJob struct {
+	cancel context.CancelCauseFunc
+	done   chan struct{}
+}
+
+// DELETE /api/videos/{id}
+// Deletes a video and every file derived from it. Allowed for the uploader
+// and the conversation's owner and admins. A transcode in progress is
+// cancelled.
+func (h *Handler) Delete(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireSession(w, r)
+	if !ok {
+		return
+	}
+
+	video, ok := h.requireVideo(w, r.PathValue("id"), session)
+	if !ok {
+		return
+	}
+	if video.Uploader != session.Username {
+		if _, ok := auth.RequireRole(w, h.DB, session, video.ConversationID, storage.RoleAdmin); !ok {
+			return
+		}
+	}
+
+	if err := h.deleteVideo(video); err != nil {
+		slog.Error("failed to delete video", "error", err, "video_id", video.ID)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("video deleted", "video_id", video.ID, "username", session.Username, "uploader", video.Uploader)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteVideo removes a video's row and files, cancelling its transcode if
+// one is running.
+func (h *Handler) deleteVideo(video *storage.Video) error {
+	// Deleting the row first stops a worker from claiming the job, so once
+	// any running transcode has stopped nothing else writes the files.
+	if err := h.DB.DeleteVideo(video.ID); err != nil {
+		return err
+	}
+	h.cancelJob(video.ID)
+	h.removeVideoFiles(video)
+	return nil
+}
+
+// DeleteConversation deletes a conversation with its videos and uploads in
+// progress, cancelling their transcodes and removing their files.
+func (h *Handler) DeleteConversation(conversationID string) error {
+	videos, err := h.DB.GetVideosByConversation(conversationID)
+	if err != nil {
+		return err
+	}
+	uploads, err := h.DB.GetUploadsByConversation(conversationID)
+	if err != nil {
+		return err
+	}
+	// As in deleteVideo, deleting the rows first stops workers from claiming
+	// the jobs.
+	if err := h.DB.DeleteConversation(conversationID); err != nil {
+		return err
+	}
+	for i := range videos {
+		h.cancelJob(videos[i].ID)
+		h.removeVideoFiles(&videos[i])
+	}
+	for _, upload := range uploads {
+		if err := os.Remove(h.partialPath(upload.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("failed to remove partial upload", "error", err, "upload_id", upload.ID)
+		}
+	}
+	return nil
+}
+
+// removeVideoFiles deletes the transcoded video, its thumbnails and HLS
+// ladder, and the original upload if it is still stored.
+func (h *Handler) removeVideoFiles(video *storage.Video) {
+	ctx := context.Background()
+	blobs, err := h.videoBlobs(ctx, video)
+	if err != nil {
+		slog.Error("failed to list video files", "error", err, "video_id", video.ID)
+		return
+	}
+	for _, b := range blobs {
+		if err := h.Blobs.Delete(ctx, b.Key); err != nil {
+			slog.Error("failed to remove video file", "error", err, "video_id", video.ID, "key", b.Key)
+		}
+	}
+}
+
+// trackJob registers a running transcode so that cancelJob can stop it. The
+// returned function must be called when the job returns.
+func (h *Handler) trackJob(ctx context.Context, videoID string) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	job := &runningJob{cancel: cancel, done: make(chan struct{})}
+
+	h.jobsMu.Lock()
+	if h.running == nil {
+		h.running = make(map[string]*runningJob)
+	}
+	h.running[videoID] = job
+	h.jobsMu.Unlock()
+
+	return ctx, func() {
+		h.jobsMu.Lock()
+		delete(h.running, videoID)
+		h.jobsMu.Unlock()
+		cancel(nil)
+		close(job.done)
+	}
+}
+
+// cancelJob stops the video's transcode, if one is running, and waits for
+// it to return.
+func (h *Handler) cancelJob(videoID string) {
+	h.jobsMu.Lock()
+	job := h.running[videoID]
+	h.jobsMu.Unlock()
+	if job == nil {
+		return
+	}
+	slog.Info("cancelling transcoding job", "video_id", videoID)
+	job.cancel(errVideoDeleted)
+	<-job.done
+}
@@ -0,0 +1,213 @@
+package videos_test
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"waffle-app/internal/auth"
+	"waffle-app/internal/storage"
+	"waffle-app/internal/videos/videotest"
+)
+
+func deleteRequest(t *testing.T, sessions *auth.Store, username, videoID string) *http.Request {
+	t.Helper()
+	req := httptest.NewRequest("DELETE", "/api/videos/"+videoID, nil)
+	req.SetPathValue("id", videoID)
+	session, err := sessions.Create(username)
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	req.AddCookie(&http.Cookie{Name: "waffle_session", Value: session.Token})
+	return req
+}
+
+// conversationFiles lists every file under the conversation's directory.
+func conversationFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	var files []string
+	err := filepath.WalkDir(filepath.Join(dir, "conv-1"), func(path string, d os.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && path == filepath.Join(dir, "conv-1") {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if path != filepath.Join(dir, "conv-1") {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walk videos dir: %v", err)
+	}
+	return files
+}
+
+func TestDelete_ReadyVideoRemovesFiles(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	setupMember(t, db)
+
+	h := newHLSHandler(db, sessions, dir, &videotest.HLSPackager{})
+	videoID := upload(t, h, sessions, "clip.mp4", videotest.MP4("raw footage"))
+	startWorkers(t, h)
+	waitForJob(t, db, videoID, storage.JobDone)
+	if len(conversationFiles(t, dir)) == 0 {
+		t.Fatal("expected transcoded files on disk")
+	}
+
+	rr := httptest.NewRecorder()
+	h.Delete(rr, deleteRequest(t, sessions, "alice", videoID))
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	if files := conversationFiles(t, dir); len(files) != 0 {
+		t.Errorf("expected all files to be removed, found %v", files)
+	}
+	if video, _ := db.GetVideo(videoID); video != nil {
+		t.Errorf("expected video row to be deleted, got %+v", video)
+	}
+	if job, _ := db.GetJobByVideoID(videoID); job != nil {
+		t.Errorf("expected job to be deleted, got %+v", job)
+	}
+	if list := listVideos(t, h, sessions); len(list) != 0 {
+		t.Errorf("expected empty list, got %v", list)
+	}
+
+	rr = httptest.NewRecorder()
+	h.Delete(rr, deleteRequest(t, sessions, "alice", videoID))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("second delete: expected 404, got %d", rr.Code)
+	}
+}
+
+func TestDelete_PendingVideoIsNeverTranscoded(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	setupMember(t, db)
+
+	transcoder := &videotest.Transcoder{}
+	h := newPipelineHandler(db, sessions, dir, transcoder)
+	videoID := upload(t, h, sessions, "clip.mov", videotest.MP4("raw footage"))
+
+	rr := httptest.NewRecorder()
+	h.Delete(rr, deleteRequest(t, sessions, "alice", videoID))
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if files := conversationFiles(t, dir); len(files) != 0 {
+		t.Errorf("expected original to be removed, found %v", files)
+	}
+
+	stop := runWorkers(t, h)
+	stop()
+	if calls := transcoder.Calls(); len(calls) != 0 {
+		t.Errorf("expected deleted video not to be transcoded, got %d calls", len(calls))
+	}
+}
+
+func TestDelete_CancelsRunningTranscode(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	setupMember(t, db)
+
+	transcoder := &videotest.Transcoder{Block: make(chan struct{})}
+	h := newPipelineHandler(db, sessions, dir, transcoder)
+	videoID := upload(t, h, sessions, "clip.mp4", videotest.MP4("raw footage"))
+	startWorkers(t, h)
+	waitForJob(t, db, videoID, storage.JobRunning)
+
+	// Returns only once the transcode has stopped
+	rr := httptest.NewRecorder()
+	h.Delete(rr, deleteRequest(t, sessions, "alice", videoID))
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if files := conversationFiles(t, dir); len(files) != 0 {
+		t.Errorf("expected original to be removed, found %v", files)
+	}
+	if job, _ := db.GetJobByVideoID(videoID); job != nil {
+		t.Errorf("expected job not to be requeued, got %+v", job)
+	}
+
+	// The worker is free for the next upload
+	close(transcoder.Block)
+	next := upload(t, h, sessions, "next.mp4", videotest.MP4("more footage"))
+	waitForJob(t, db, next, storage.JobDone)
+}
+
+func TestDelete_Permissions(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	setupMember(t, db)
+	for _, username := range []string{"bob", "carol", "dave"} {
+		addMember(t, db, "conv-1", username)
+	}
+	if err := db.SetMemberRole("conv-1", "carol", storage.RoleOwner); err != nil {
+		t.Fatalf("SetMemberRole: %v", err)
+	}
+	if err := db.SetMemberRole("conv-1", "dave", storage.RoleAdmin); err != nil {
+		t.Fatalf("SetMemberRole: %v", err)
+	}
+	createVideoFile(t, db, dir, "vid-1", "ready", []byte("0123456789"))
+	createVideoFile(t, db, dir, "vid-2", "ready", []byte("0123456789"))
+	h := newTestHandler(db, sessions, dir)
+
+	tests := []struct {
+		username string
+		want     int
+	}{
+		{"mallory", http.StatusForbidden}, // not a member
+		{"bob", http.StatusForbidden},     // member, not the uploader
+		{"carol", http.StatusNoContent},   // conversation owner
+	}
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		h.Delete(rr, deleteRequest(t, sessions, tt.username, "vid-1"))
+		if rr.Code != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.username, tt.want, rr.Code)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "conv-1", "vid-1.mp4")); !os.IsNotExist(err) {
+		t.Errorf("expected video file to be removed, got %v", err)
+	}
+
+	// Admins may delete other people's videos too
+	rr := httptest.NewRecorder()
+	h.Delete(rr, deleteRequest(t, sessions, "dave", "vid-2"))
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("dave: expected 204, got %d", rr.Code)
+	}
+}
+
+func TestDeleteConversation_RemovesFiles(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	setupMember(t, db)
+
+	transcoder := &videotest.Transcoder{Block: make(chan struct{})}
+	h := newPipelineHandler(db, sessions, dir, transcoder)
+	running := upload(t, h, sessions, "clip.mp4", videotest.MP4("raw footage"))
+	startWorkers(t, h)
+	waitForJob(t, db, running, storage.JobRunning)
+	createVideoFile(t, db, dir, "vid-1", "ready", []byte("0123456789"))
+	partial := createTusUpload(t, h, sessions, 1000)
+
+	// Returns only once the transcode has stopped
+	if err := h.DeleteConversation("conv-1"); err != nil {
+		t.Fatalf("DeleteConversation: %v", err)
+	}
+	if files := conversationFiles(t, dir); len(files) != 0 {
+		t.Errorf("expected all files to be removed, found %v", files)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".uploads", partial)); !os.IsNotExist(err) {
+		t.Errorf("expected partial upload to be removed, got %v", err)
+	}
+	if c, _ := db.GetConversation("conv-1"); c != nil {
+		t.Errorf("expected conversation to be deleted, got %+v", c)
+	}
+	if job, _ := db.GetJobByVideoID(running); job != nil {
+		t.Errorf("expected job to be deleted, got %+v", job)
+	}
+	close(transcoder.Block)
+}
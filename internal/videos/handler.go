@@ -1,90 +1,176 @@
 package videos
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
+	"mime/multipart"
 	"net/http"
 	"os"
-	"os/exec"
-	"path/filepath"
-	"strings"
+	"path"
+	"sync"
 	"time"
 	"waffle-app/internal/auth"
 	"waffle-app/internal/storage"
 )
 
 const (
-	maxUploadSize = 500 << 20 // 500 MB
-	maxRetries    = 3
-	retryDelay    = 2 * time.Second
+	DefaultMaxUploadSize = 500 << 20 // 500 MB
+	maxFieldSize         = 1 << 10   // non-file form fields
 )
 
-var allowedExtensions = map[string]bool{
-	".mp4": true,
-	".mov": true,
-	".avi": true,
-	".mkv": true,
-}
+// BlobURLPrefix is where a local blob store serves signed URLs.
+const BlobURLPrefix = "/api/blobs"
 
 type Handler struct {
-	DB        *storage.DB
-	Sessions  *auth.Store
+	DB       *storage.DB
+	Sessions auth.SessionStore
+	// Blobs stores originals and every transcoded asset.
+	Blobs storage.BlobStore
+	// VideosDir holds resumable uploads in progress and transcoding
+	// scratch files.
 	VideosDir string
+	// SignedURLExpiry, if set, makes Stream and Thumbnail redirect to a
+	// signed URL valid this long, so the blob store serves the file
+	// directly. If zero, files are proxied through the server.
+	SignedURLExpiry time.Duration
+	// MaxUploadSize is the largest upload accepted, in bytes.
+	MaxUploadSize int64
+	// ConversationQuota and UserQuota cap the bytes stored for a
+	// conversation's videos and for each user's videos across every
+	// conversation. Zero means no limit.
+	ConversationQuota int64
+	UserQuota         int64
+
+	// Transcoder converts uploads into playable MP4s.
+	Transcoder Transcoder
+	// Thumbnailer generates the poster and animated preview of each video.
+	Thumbnailer Thumbnailer
+	// Prober extracts media metadata from uploaded and transcoded files.
+	Prober Prober
+	// HLS, if set, packages each transcoded video into the HLSLadder
+	// renditions for adaptive streaming. If nil, only the MP4 is served.
+	HLS       HLSPackager
+	HLSLadder []Rendition
+	// Profiles are the transcoding profiles conversations may choose from.
+	Profiles Profiles
+	// Retry controls how often failed transcoding jobs are retried.
+	Retry RetryPolicy
+	// PollInterval is how often idle workers check for due jobs.
+	PollInterval time.Duration
+	// DrainTimeout is how long running jobs may take to finish after the
+	// workers are stopped before they are aborted and requeued.
+	DrainTimeout time.Duration
+	// UploadExpiry is how long a resumable upload may go without receiving
+	// a chunk before it is discarded.
+	UploadExpiry time.Duration
+
+	wake chan struct{}
+
+	quotaMu sync.Mutex // serializes quota checks with recording the upload
+
+	uploadMu      sync.Mutex
+	activeUploads map[string]struct{} // resumable uploads with a request in flight
+
+	jobsMu  sync.Mutex
+	running map[string]*runningJob // transcodes in progress, by video id
 }
 
-func NewHandler(db *storage.DB, sessions *auth.Store, videosDir string) *Handler {
-	return &Handler{DB: db, Sessions: sessions, VideosDir: videosDir}
+// NewHandler creates a video handler that stores files on disk under
+// videosDir. If transcoder is nil, the system ffmpeg binary is used.
+func NewHandler(db *storage.DB, sessions auth.SessionStore, videosDir string, transcoder Transcoder) *Handler {
+	if transcoder == nil {
+		transcoder = &FFmpeg{}
+	}
+	return &Handler{
+		DB:            db,
+		Sessions:      sessions,
+		Blobs:         storage.NewLocalBlobStore(videosDir, BlobURLPrefix),
+		VideosDir:     videosDir,
+		MaxUploadSize: DefaultMaxUploadSize,
+		Transcoder:    transcoder,
+		Thumbnailer:   &FFmpeg{},
+		Prober:        &FFprobe{},
+		HLSLadder:     DefaultLadder,
+		Profiles:      DefaultProfiles,
+		Retry:         DefaultRetryPolicy,
+		PollInterval:  defaultPollInterval,
+		DrainTimeout:  DefaultDrainTimeout,
+		UploadExpiry:  DefaultUploadExpiry,
+		wake:          make(chan struct{}, 1),
+	}
 }
 
 // POST /api/upload
-// Multipart form: file, conversation_id
+// Multipart form: conversation_id, file
+// The file is streamed to disk as it arrives, so conversation_id must be
+// sent before it, and then stored in the blob store.
 func (h *Handler) Upload(w http.ResponseWriter, r *http.Request) {
 	session, ok := h.requireSession(w, r)
 	if !ok {
 		return
 	}
 
-	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
-	if err := r.ParseMultipartForm(32 << 20); err != nil {
-		slog.Warn("failed to parse multipart form", "error", err)
-		http.Error(w, "request too large or malformed", http.StatusBadRequest)
+	r.Body = http.MaxBytesReader(w, r.Body, h.MaxUploadSize)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "expected a multipart/form-data body", http.StatusBadRequest)
 		return
 	}
 
-	conversationID := r.FormValue("conversation_id")
-	if conversationID == "" {
-		http.Error(w, "'conversation_id' is required", http.StatusBadRequest)
-		return
-	}
+	var conversationID string
+	var file *multipart.Part
+	for file == nil {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			http.Error(w, "file is required", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			slog.Warn("failed to read multipart body", "error", err)
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				http.Error(w, "upload too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "request malformed", http.StatusBadRequest)
+			return
+		}
 
-	// Verify user is a member of the conversation
-	isMember, err := h.DB.IsMember(conversationID, session.Username)
-	if err != nil {
-		slog.Error("failed to check membership", "error", err)
-		http.Error(w, "internal error", http.StatusInternalServerError)
-		return
+		switch part.FormName() {
+		case "conversation_id":
+			value, err := io.ReadAll(io.LimitReader(part, maxFieldSize))
+			if err != nil {
+				http.Error(w, "request malformed", http.StatusBadRequest)
+				return
+			}
+			conversationID = string(value)
+		case "file":
+			file = part
+		}
 	}
-	if !isMember {
-		slog.Warn("upload attempted by non-member", "username", session.Username, "conversation_id", conversationID)
-		http.Error(w, "forbidden", http.StatusForbidden)
+	defer file.Close()
+
+	if conversationID == "" {
+		http.Error(w, "'conversation_id' is required before 'file'", http.StatusBadRequest)
 		return
 	}
 
-	file, header, err := r.FormFile("file")
-	if err != nil {
-		http.Error(w, "file is required", http.StatusBadRequest)
+	if _, ok := auth.RequireRole(w, h.DB, session, conversationID, storage.RoleMember); !ok {
 		return
 	}
-	defer file.Close()
 
-	ext := strings.ToLower(filepath.Ext(header.Filename))
-	if !allowedExtensions[ext] {
-		slog.Warn("unsupported file extension", "ext", ext, "username", session.Username)
-		http.Error(w, fmt.Sprintf("unsupported file type: %s", ext), http.StatusBadRequest)
+	// Refuse before streaming the file if the quota is already used up. The
+	// file's actual size is checked once it has been received.
+	if !h.requireQuota(w, conversationID, session.Username, 0) {
 		return
 	}
 
@@ -95,45 +181,66 @@ func (h *Handler) Upload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	convDir := filepath.Join(h.VideosDir, conversationID)
-	if err := os.MkdirAll(convDir, 0755); err != nil {
-		slog.Error("failed to create conversation directory", "error", err, "dir", convDir)
-		http.Error(w, "internal error", http.StatusInternalServerError)
+	// Identify the container by its magic bytes; the client-supplied
+	// filename is not trusted.
+	header := make([]byte, sniffLen)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		http.Error(w, "failed to read file", http.StatusBadRequest)
+		return
+	}
+	header = header[:n]
+	format, detected, ok := detectContainer(header)
+	if !ok {
+		h.reject(w, videoID, conversationID, session.Username, fmt.Sprintf("unsupported media type: detected %s", detected))
 		return
 	}
 
-	originalPath := filepath.Join(convDir, "original_"+videoID+ext)
-	outputPath := filepath.Join(convDir, videoID+".mp4")
-
-	// Save original file to disk
-	slog.Info("saving original upload", "path", originalPath, "username", session.Username)
-	if err := saveFile(file, originalPath); err != nil {
-		slog.Error("failed to save uploaded file", "error", err, "path", originalPath)
+	if err := os.MkdirAll(h.uploadsDir(), 0755); err != nil {
+		slog.Error("failed to create uploads directory", "error", err, "dir", h.uploadsDir())
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
 
-	// Record in DB as pending before transcoding
-	if err := h.DB.CreateVideo(videoID, conversationID, session.Username, outputPath); err != nil {
-		slog.Error("failed to create video record", "error", err)
+	originalPath := h.partialPath(videoID)
+
+	// Stream original file to disk
+	slog.Info("saving original upload", "path", originalPath, "username", session.Username, "type", format.mimeType)
+	checksum, err := saveFile(io.MultiReader(bytes.NewReader(header), file), originalPath)
+	if err != nil {
 		os.Remove(originalPath)
-		http.Error(w, "internal error", http.StatusInternalServerError)
+		var maxErr *http.MaxBytesError
+		var readErr *readError
+		switch {
+		case errors.As(err, &maxErr):
+			slog.Warn("upload exceeded size limit", "video_id", videoID, "username", session.Username)
+			http.Error(w, "upload too large", http.StatusRequestEntityTooLarge)
+		case errors.As(err, &readErr):
+			slog.Warn("upload interrupted", "error", err, "video_id", videoID, "username", session.Username)
+			http.Error(w, "failed to read file", http.StatusBadRequest)
+		default:
+			slog.Error("failed to save uploaded file", "error", err, "path", originalPath)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+		}
 		return
 	}
 
-	// Transcode asynchronously so the client gets a fast response
-	go h.transcode(videoID, originalPath, outputPath)
+	if !h.queueUpload(w, r, videoID, conversationID, session.Username, originalPath, checksum, format) {
+		return
+	}
 
-	slog.Info("upload accepted, transcoding started", "video_id", videoID, "username", session.Username)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusAccepted)
 	json.NewEncoder(w).Encode(map[string]string{
 		"video_id": videoID,
 		"status":   "pending",
+		"sha256":   checksum,
 	})
 }
 
 // GET /api/videos?conversation_id=...
+// Lists the conversation's videos, newest first. Rejected uploads are only
+// listed for their uploader, until RejectedVideoExpiry passes.
 func (h *Handler) List(w http.ResponseWriter, r *http.Request) {
 	session, ok := h.requireSession(w, r)
 	if !ok {
@@ -146,14 +253,7 @@ func (h *Handler) List(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	isMember, err := h.DB.IsMember(conversationID, session.Username)
-	if err != nil {
-		slog.Error("failed to check membership", "error", err)
-		http.Error(w, "internal error", http.StatusInternalServerError)
-		return
-	}
-	if !isMember {
-		http.Error(w, "forbidden", http.StatusForbidden)
+	if _, ok := auth.RequireRole(w, h.DB, session, conversationID, storage.RoleMember); !ok {
 		return
 	}
 
@@ -164,110 +264,363 @@ func (h *Handler) List(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	variants, err := h.DB.GetVariantsByConversation(conversationID)
+	if err != nil {
+		slog.Error("failed to list video variants", "error", err, "conversation_id", conversationID)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
 	slog.Debug("listed videos", "conversation_id", conversationID, "count", len(videos))
 
+	type variant struct {
+		Name        string `json:"name"`
+		Height      int    `json:"height"`
+		Bandwidth   int64  `json:"bandwidth"`
+		PlaylistURL string `json:"playlist_url"`
+	}
+
 	type response struct {
-		ID         string `json:"id"`
-		Uploader   string `json:"uploader"`
-		Status     string `json:"status"`
-		UploadedAt string `json:"uploaded_at"`
+		ID           string    `json:"id"`
+		Uploader     string    `json:"uploader"`
+		Status       string    `json:"status"`
+		Error        string    `json:"error,omitempty"`
+		UploadedAt   string    `json:"uploaded_at"`
+		StreamURL    string    `json:"stream_url,omitempty"`
+		ThumbnailURL string    `json:"thumbnail_url,omitempty"`
+		PreviewURL   string    `json:"preview_url,omitempty"`
+		Duration     float64   `json:"duration,omitempty"` // seconds
+		Width        int       `json:"width,omitempty"`
+		Height       int       `json:"height,omitempty"`
+		VideoCodec   string    `json:"video_codec,omitempty"`
+		AudioCodec   string    `json:"audio_codec,omitempty"`
+		Bitrate      int64     `json:"bitrate,omitempty"`
+		SizeBytes    int64     `json:"size_bytes,omitempty"`
+		Rotation     int       `json:"rotation,omitempty"`
+		SHA256       string    `json:"sha256,omitempty"`
+		Profile      string    `json:"profile,omitempty"`
+		HLSURL       string    `json:"hls_url,omitempty"`
+		Variants     []variant `json:"variants,omitempty"`
 	}
 	result := make([]response, 0, len(videos))
 	for _, v := range videos {
-		result = append(result, response{
+		if v.Status == "rejected" && v.Uploader != session.Username {
+			continue
+		}
+		m := v.Metadata
+		resp := response{
 			ID:         v.ID,
 			Uploader:   v.Uploader,
 			Status:     v.Status,
+			Error:      v.Error,
 			UploadedAt: v.UploadedAt.Format(time.RFC3339),
-		})
+			Duration:   float64(m.DurationMS) / 1000,
+			Width:      m.Width,
+			Height:     m.Height,
+			VideoCodec: m.VideoCodec,
+			AudioCodec: m.AudioCodec,
+			Bitrate:    m.Bitrate,
+			SizeBytes:  m.SizeBytes,
+			Rotation:   m.Rotation,
+			SHA256:     v.OriginalSHA256,
+			Profile:    v.Profile,
+		}
+		if v.Status == "ready" {
+			resp.StreamURL = "/api/videos/" + v.ID + "/stream"
+			if v.HLSPlaylist != "" {
+				resp.HLSURL = "/api/videos/" + v.ID + "/hls/" + hlsMasterPlaylist
+				for _, vv := range variants[v.ID] {
+					resp.Variants = append(resp.Variants, variant{
+						Name:        vv.Name,
+						Height:      vv.Height,
+						Bandwidth:   vv.Bandwidth,
+						PlaylistURL: "/api/videos/" + v.ID + "/hls/" + vv.Playlist,
+					})
+				}
+			}
+		}
+		if v.PosterFilename != "" {
+			resp.ThumbnailURL = "/api/videos/" + v.ID + "/thumbnail"
+		}
+		if v.PreviewFilename != "" {
+			resp.PreviewURL = "/api/videos/" + v.ID + "/thumbnail?kind=preview"
+		}
+		result = append(result, resp)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(result)
 }
 
-func (h *Handler) transcode(videoID, inputPath, outputPath string) {
-	slog.Info("starting transcoding", "video_id", videoID, "input", inputPath, "output", outputPath)
-
-	var lastErr error
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		slog.Info("transcoding attempt", "video_id", videoID, "attempt", attempt, "max", maxRetries)
-
-		cmd := exec.Command("ffmpeg",
-			"-i", inputPath,
-			"-vf", "scale=-2:720",
-			"-c:v", "libx264",
-			"-c:a", "aac",
-			"-y", // overwrite output if exists
-			outputPath,
-		)
-
-		output, err := cmd.CombinedOutput()
-		if err == nil {
-			slog.Info("transcoding succeeded", "video_id", videoID, "attempt", attempt)
-
-			// Delete original only on success
-			slog.Info("deleting original file", "path", inputPath)
-			if err := os.Remove(inputPath); err != nil {
-				slog.Error("failed to delete original file", "error", err, "path", inputPath)
-			} else {
-				slog.Info("original file deleted", "path", inputPath)
-			}
+// GET /api/videos/{id}/stream
+// Serves the transcoded MP4 with support for Range and conditional requests.
+func (h *Handler) Stream(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireSession(w, r)
+	if !ok {
+		return
+	}
 
-			if err := h.DB.UpdateVideoStatus(videoID, "ready"); err != nil {
-				slog.Error("failed to update video status to ready", "error", err, "video_id", videoID)
-			}
+	video, ok := h.requireVideo(w, r.PathValue("id"), session)
+	if !ok {
+		return
+	}
+
+	switch video.Status {
+	case "ready":
+	case "pending":
+		http.Error(w, "video is still processing", http.StatusConflict)
+		return
+	default:
+		http.Error(w, "video is not available", http.StatusConflict)
+		return
+	}
+
+	slog.Debug("streaming video", "video_id", video.ID, "username", session.Username, "range", r.Header.Get("Range"))
+	h.serveAsset(w, r, video.ID, video.Filename, "video/mp4")
+}
+
+// GET /api/videos/{id}/thumbnail?kind=poster|preview
+// Serves the JPEG poster (default) or animated WebP preview of a video.
+func (h *Handler) Thumbnail(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireSession(w, r)
+	if !ok {
+		return
+	}
+
+	video, ok := h.requireVideo(w, r.PathValue("id"), session)
+	if !ok {
+		return
+	}
+
+	var key, contentType string
+	switch kind := r.URL.Query().Get("kind"); kind {
+	case "", "poster":
+		key, contentType = video.PosterFilename, "image/jpeg"
+	case "preview":
+		key, contentType = video.PreviewFilename, "image/webp"
+	default:
+		http.Error(w, fmt.Sprintf("unknown thumbnail kind: %s", kind), http.StatusBadRequest)
+		return
+	}
+	if key == "" {
+		http.Error(w, "thumbnail not available", http.StatusNotFound)
+		return
+	}
+
+	h.serveAsset(w, r, video.ID, key, contentType)
+}
+
+// serveFile writes a video asset from the blob store to the response.
+// ServeContent handles Range, If-Range, If-None-Match and
+// If-Modified-Since once ETag and Content-Type are set.
+func (h *Handler) serveFile(w http.ResponseWriter, r *http.Request, videoID, key, contentType string) {
+	info, err := h.Blobs.Stat(r.Context(), key)
+	if err != nil {
+		slog.Error("failed to stat video file", "error", err, "video_id", videoID, "key", key)
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "file not found", http.StatusNotFound)
 			return
 		}
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	content := &blobReader{ctx: r.Context(), store: h.Blobs, key: key, size: info.Size}
+	defer content.Close()
 
-		lastErr = err
-		slog.Warn("transcoding attempt failed",
-			"video_id", videoID,
-			"attempt", attempt,
-			"error", err,
-			"ffmpeg_output", string(output),
-		)
-
-		if attempt < maxRetries {
-			slog.Info("waiting before retry", "delay", retryDelay, "video_id", videoID)
-			time.Sleep(retryDelay)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", etag(info))
+	w.Header().Set("Cache-Control", "private, no-cache")
+	http.ServeContent(w, r, "", info.ModTime, content)
+}
+
+// serveAsset redirects to a signed URL for a video asset if
+// SignedURLExpiry is set, and otherwise serves it like serveFile.
+func (h *Handler) serveAsset(w http.ResponseWriter, r *http.Request, videoID, key, contentType string) {
+	if h.SignedURLExpiry <= 0 {
+		h.serveFile(w, r, videoID, key, contentType)
+		return
+	}
+	url, err := h.Blobs.SignedURL(r.Context(), key, h.SignedURLExpiry)
+	if err != nil {
+		slog.Error("failed to sign video file URL", "error", err, "video_id", videoID, "key", key)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "private, no-store")
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// queueUpload validates a fully received original, stores it in the blob
+// store and queues it for transcoding. The local file at uploadPath is
+// always removed. If the upload is not accepted, an error response is
+// written and false is returned.
+func (h *Handler) queueUpload(w http.ResponseWriter, r *http.Request, videoID, conversationID, uploader, uploadPath, checksum string, format container) bool {
+	defer os.Remove(uploadPath)
+
+	// Probe before queueing, so that files with valid magic bytes but
+	// unreadable contents are rejected now rather than after every
+	// transcoding attempt has failed.
+	if reason := h.probeUpload(r.Context(), videoID, uploadPath, format); reason != "" {
+		h.reject(w, videoID, conversationID, uploader, reason)
+		return false
+	}
+
+	profile, err := h.conversationProfile(conversationID)
+	if err != nil {
+		slog.Error("failed to resolve transcoding profile", "error", err, "conversation_id", conversationID)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return false
+	}
+
+	info, err := os.Stat(uploadPath)
+	if err != nil {
+		slog.Error("failed to stat original file", "error", err, "path", uploadPath)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return false
+	}
+
+	// Record in DB as pending before transcoding. The quota check and the
+	// insert are serialized so that concurrent uploads can't both fit.
+	video := &storage.Video{
+		ID:             videoID,
+		ConversationID: conversationID,
+		Uploader:       uploader,
+		Filename:       outputKey(conversationID, videoID),
+		OriginalSHA256: checksum,
+		Profile:        profile.Name,
+		StoredBytes:    info.Size(),
+	}
+	h.quotaMu.Lock()
+	if !h.requireQuota(w, conversationID, uploader, info.Size()) {
+		h.quotaMu.Unlock()
+		return false
+	}
+	err = h.DB.CreateVideo(video)
+	h.quotaMu.Unlock()
+	if err != nil {
+		slog.Error("failed to create video record", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return false
+	}
+
+	inputKey := originalKey(conversationID, videoID, format)
+	if err := h.putFile(r.Context(), inputKey, uploadPath); err != nil {
+		slog.Error("failed to store original file", "error", err, "video_id", videoID, "key", inputKey)
+		if err := h.DB.DeleteVideo(videoID); err != nil {
+			slog.Error("failed to delete video record", "error", err, "video_id", videoID)
+		}
+		h.Blobs.Delete(context.WithoutCancel(r.Context()), inputKey)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return false
+	}
+
+	// Transcode asynchronously so the client gets a fast response. The job
+	// is persisted so it survives a restart.
+	if _, err := h.DB.EnqueueJob(videoID, inputKey, video.Filename, h.Retry.MaxAttempts); err != nil {
+		slog.Error("failed to enqueue transcoding job", "error", err, "video_id", videoID)
+		if err := h.DB.UpdateVideoStatus(videoID, "error"); err != nil {
+			slog.Error("failed to update video status to error", "error", err, "video_id", videoID)
 		}
+		h.Blobs.Delete(context.WithoutCancel(r.Context()), inputKey)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return false
 	}
+	h.notifyWorkers()
+
+	slog.Info("upload accepted, transcoding queued", "video_id", videoID, "username", uploader, "profile", profile.Name)
+	return true
+}
 
-	slog.Error("transcoding failed after all retries, original file retained",
-		"video_id", videoID,
-		"input", inputPath,
-		"error", lastErr,
-	)
-	if err := h.DB.UpdateVideoStatus(videoID, "error"); err != nil {
-		slog.Error("failed to update video status to error", "error", err, "video_id", videoID)
+// probeUpload checks that a saved upload contains a readable video stream.
+// It returns the reason for rejecting the upload, or "" if it is valid.
+func (h *Handler) probeUpload(ctx context.Context, videoID, path string, format container) string {
+	info, err := h.Prober.Probe(ctx, path)
+	if err != nil {
+		slog.Warn("failed to probe upload", "error", err, "video_id", videoID)
+		return fmt.Sprintf("unsupported media type: %s file could not be read as video", format.mimeType)
+	}
+	if info.VideoCodec == "" {
+		return fmt.Sprintf("unsupported media type: %s file contains no video stream", format.mimeType)
 	}
+	return ""
+}
+
+// reject records an invalid upload with its reason, so that it is not
+// retried, and responds with 415 Unsupported Media Type.
+func (h *Handler) reject(w http.ResponseWriter, videoID, conversationID, uploader, reason string) {
+	slog.Warn("upload rejected", "video_id", videoID, "username", uploader, "reason", reason)
+	if err := h.DB.CreateRejectedVideo(videoID, conversationID, uploader, reason); err != nil {
+		slog.Error("failed to record rejected upload", "error", err, "video_id", videoID)
+	}
+	http.Error(w, reason, http.StatusUnsupportedMediaType)
 }
 
 func (h *Handler) requireSession(w http.ResponseWriter, r *http.Request) (*auth.Session, bool) {
-	token, ok := auth.FromRequest(r)
-	if !ok {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	return auth.RequireSession(w, r, h.Sessions)
+}
+
+// requireVideo looks up the video and verifies the user is a member of its
+// conversation, writing the appropriate error response if not.
+func (h *Handler) requireVideo(w http.ResponseWriter, videoID string, session *auth.Session) (*storage.Video, bool) {
+	video, err := h.DB.GetVideo(videoID)
+	if err != nil {
+		slog.Error("failed to get video", "error", err, "video_id", videoID)
+		http.Error(w, "internal error", http.StatusInternalServerError)
 		return nil, false
 	}
-	session, ok := h.Sessions.Get(token)
-	if !ok {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	if video == nil {
+		http.Error(w, "video not found", http.StatusNotFound)
 		return nil, false
 	}
-	return session, true
+
+	if _, ok := auth.RequireRole(w, h.DB, session, video.ConversationID, storage.RoleMember); !ok {
+		return nil, false
+	}
+	return video, true
+}
+
+// etag identifies a version of an object by name, size and modification
+// time. Object names embed the video id, so tags are unique across videos.
+func etag(info *storage.BlobInfo) string {
+	return fmt.Sprintf(`"%s-%x-%x"`, path.Base(info.Key), info.Size, info.ModTime.UnixNano())
 }
 
-func saveFile(src io.Reader, destPath string) error {
+// saveFile writes src to destPath and returns the hex SHA-256 of its
+// contents. Failures to read src are returned as a *readError.
+func saveFile(src io.Reader, destPath string) (string, error) {
 	f, err := os.Create(destPath)
 	if err != nil {
-		return fmt.Errorf("create file: %w", err)
+		return "", fmt.Errorf("create file: %w", err)
 	}
 	defer f.Close()
-	if _, err := io.Copy(f, src); err != nil {
-		return fmt.Errorf("write file: %w", err)
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, hash), sourceReader{src}); err != nil {
+		return "", fmt.Errorf("write file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return "", fmt.Errorf("close file: %w", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// readError reports that the upload itself could not be read, e.g. because
+// the client disconnected, as opposed to a failure to write it to disk.
+type readError struct{ err error }
+
+func (e *readError) Error() string { return "read upload: " + e.err.Error() }
+func (e *readError) Unwrap() error { return e.err }
+
+// sourceReader wraps read failures in a *readError.
+type sourceReader struct{ r io.Reader }
+
+func (s sourceReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = &readError{err}
 	}
-	return nil
+	return n, err
 }
 
 func generateID() (string, error) {
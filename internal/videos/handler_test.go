@@ -2,40 +2,49 @@ package videos_test
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"io"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 	"waffle-app/internal/auth"
 	"waffle-app/internal/storage"
 	"waffle-app/internal/videos"
+	"waffle-app/internal/videos/videotest"
 )
 
 func setupTest(t *testing.T) (*storage.DB, *auth.Store, string) {
 	t.Helper()
 
-	f, err := os.CreateTemp("", "waffle_test_*.db")
-	if err != nil {
-		t.Fatalf("create temp db: %v", err)
-	}
-	f.Close()
-	t.Cleanup(func() { os.Remove(f.Name()) })
-
-	db, err := storage.New(f.Name())
+	db, err := storage.New(filepath.Join(t.TempDir(), "waffle.db"))
 	if err != nil {
 		t.Fatalf("open db: %v", err)
 	}
 	t.Cleanup(func() { db.Close() })
 
 	dir := t.TempDir()
-	sessions := auth.NewStore()
+	sessions := auth.NewStore(auth.DefaultTimeouts)
 
 	return db, sessions, dir
 }
 
+// newTestHandler returns a handler whose media tools are all fakes.
+func newTestHandler(db *storage.DB, sessions *auth.Store, dir string) *videos.Handler {
+	h := videos.NewHandler(db, sessions, dir, &videotest.Transcoder{})
+	h.Thumbnailer = &videotest.Thumbnailer{}
+	h.Prober = &videotest.Prober{}
+	return h
+}
+
 func authenticatedRequest(t *testing.T, sessions *auth.Store, method, target string, body *bytes.Buffer, contentType string) *http.Request {
 	t.Helper()
 	var req *http.Request
@@ -52,23 +61,21 @@ func authenticatedRequest(t *testing.T, sessions *auth.Store, method, target str
 		req.Header.Set("Content-Type", contentType)
 	}
 
-	token, err := sessions.Create("alice")
+	session, err := sessions.Create("alice")
 	if err != nil {
 		t.Fatalf("create session: %v", err)
 	}
-	req.AddCookie(&http.Cookie{Name: "waffle_session", Value: token})
+	req.AddCookie(&http.Cookie{Name: "waffle_session", Value: session.Token})
 	return req
 }
 
 func TestUpload_UnsupportedFileType(t *testing.T) {
 	db, sessions, dir := setupTest(t)
 
-	if err := db.CreateConversation("conv-1", "invite-abc", "Test"); err != nil {
+	if err := db.CreateConversation("conv-1", "invite-abc", "Test", ""); err != nil {
 		t.Fatalf("CreateConversation: %v", err)
 	}
-	if err := db.AddMember("conv-1", "alice"); err != nil {
-		t.Fatalf("AddMember: %v", err)
-	}
+	addMember(t, db, "conv-1", "alice")
 
 	body := &bytes.Buffer{}
 	writer := multipart.NewWriter(body)
@@ -80,18 +87,130 @@ func TestUpload_UnsupportedFileType(t *testing.T) {
 	req := authenticatedRequest(t, sessions, "POST", "/api/upload", body, writer.FormDataContentType())
 	rr := httptest.NewRecorder()
 
-	h := videos.NewHandler(db, sessions, dir)
+	h := newTestHandler(db, sessions, dir)
 	h.Upload(rr, req)
 
-	if rr.Code != http.StatusBadRequest {
-		t.Errorf("expected 400, got %d", rr.Code)
+	if rr.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected 415, got %d", rr.Code)
+	}
+}
+
+func TestUpload_RenamedFileRejectedBySniffing(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	setupMember(t, db)
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("conversation_id", "conv-1")
+	part, _ := writer.CreateFormFile("file", "holiday.mp4")
+	part.Write([]byte("this is a text file with a video extension"))
+	writer.Close()
+
+	req := authenticatedRequest(t, sessions, "POST", "/api/upload", body, writer.FormDataContentType())
+	rr := httptest.NewRecorder()
+
+	h := newTestHandler(db, sessions, dir)
+	h.Upload(rr, req)
+
+	if rr.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected 415, got %d", rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), "detected text/plain") {
+		t.Errorf("expected detected type in response, got %q", rr.Body.String())
+	}
+
+	list := listVideos(t, h, sessions)
+	if len(list) != 1 || list[0]["status"] != "rejected" {
+		t.Fatalf("expected rejected upload to be recorded, got %v", list)
+	}
+	if !strings.Contains(list[0]["error"].(string), "text/plain") {
+		t.Errorf("expected rejection reason, got %v", list[0]["error"])
+	}
+	if entries, _ := os.ReadDir(filepath.Join(dir, "conv-1")); len(entries) != 0 {
+		t.Errorf("expected no file to be kept, found %d", len(entries))
+	}
+}
+
+func TestList_RejectedOnlyForUploader(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	setupMember(t, db)
+	addMember(t, db, "conv-1", "bob")
+	createVideoFile(t, db, dir, "vid-1", "ready", []byte("video"))
+	for id, uploader := range map[string]string{"bad-1": "alice", "bad-2": "bob", "bad-3": "bob"} {
+		if err := db.CreateRejectedVideo(id, "conv-1", uploader, "unsupported media type"); err != nil {
+			t.Fatalf("CreateRejectedVideo: %v", err)
+		}
+	}
+
+	h := newTestHandler(db, sessions, dir)
+	list := listVideos(t, h, sessions)
+	if len(list) != 2 {
+		t.Fatalf("expected alice's video and rejected upload, got %v", list)
+	}
+	for _, v := range list {
+		if v["uploader"] != "alice" {
+			t.Errorf("expected bob's rejected uploads to be hidden, got %v", v)
+		}
+	}
+}
+
+func TestUpload_RejectedByProbe(t *testing.T) {
+	tests := []struct {
+		name   string
+		prober *videotest.Prober
+		reason string
+	}{
+		{"unreadable", &videotest.Prober{Err: errors.New("moov atom not found")}, "could not be read as video"},
+		{"audio only", &videotest.Prober{Info: &videos.MediaInfo{AudioCodec: "aac"}}, "contains no video stream"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, sessions, dir := setupTest(t)
+			setupMember(t, db)
+
+			body := &bytes.Buffer{}
+			writer := multipart.NewWriter(body)
+			writer.WriteField("conversation_id", "conv-1")
+			part, _ := writer.CreateFormFile("file", "clip.mp4")
+			part.Write(videotest.MP4("truncated"))
+			writer.Close()
+
+			req := authenticatedRequest(t, sessions, "POST", "/api/upload", body, writer.FormDataContentType())
+			rr := httptest.NewRecorder()
+
+			h := newTestHandler(db, sessions, dir)
+			h.Prober = tt.prober
+			h.Upload(rr, req)
+
+			if rr.Code != http.StatusUnsupportedMediaType {
+				t.Fatalf("expected 415, got %d", rr.Code)
+			}
+			if !strings.Contains(rr.Body.String(), "video/mp4 file "+tt.reason) {
+				t.Errorf("unexpected response %q", rr.Body.String())
+			}
+
+			list := listVideos(t, h, sessions)
+			if len(list) != 1 || list[0]["status"] != "rejected" {
+				t.Fatalf("expected rejected upload to be recorded, got %v", list)
+			}
+			job, err := db.GetJobByVideoID(list[0]["id"].(string))
+			if err != nil {
+				t.Fatalf("GetJobByVideoID: %v", err)
+			}
+			if job != nil {
+				t.Errorf("expected no transcoding job to be queued, got %+v", job)
+			}
+			if entries, _ := os.ReadDir(filepath.Join(dir, "conv-1")); len(entries) != 0 {
+				t.Errorf("expected original to be removed, found %d files", len(entries))
+			}
+		})
 	}
 }
 
 func TestUpload_NonMemberForbidden(t *testing.T) {
 	db, sessions, dir := setupTest(t)
 
-	if err := db.CreateConversation("conv-1", "invite-abc", "Test"); err != nil {
+	if err := db.CreateConversation("conv-1", "invite-abc", "Test", ""); err != nil {
 		t.Fatalf("CreateConversation: %v", err)
 	}
 	// Alice is NOT added as a member
@@ -106,7 +225,7 @@ func TestUpload_NonMemberForbidden(t *testing.T) {
 	req := authenticatedRequest(t, sessions, "POST", "/api/upload", body, writer.FormDataContentType())
 	rr := httptest.NewRecorder()
 
-	h := videos.NewHandler(db, sessions, dir)
+	h := newTestHandler(db, sessions, dir)
 	h.Upload(rr, req)
 
 	if rr.Code != http.StatusForbidden {
@@ -126,7 +245,7 @@ func TestUpload_MissingConversationID(t *testing.T) {
 	req := authenticatedRequest(t, sessions, "POST", "/api/upload", body, writer.FormDataContentType())
 	rr := httptest.NewRecorder()
 
-	h := videos.NewHandler(db, sessions, dir)
+	h := newTestHandler(db, sessions, dir)
 	h.Upload(rr, req)
 
 	if rr.Code != http.StatusBadRequest {
@@ -140,7 +259,7 @@ func TestUpload_Unauthenticated(t *testing.T) {
 	req, _ := http.NewRequest("POST", "/api/upload", nil)
 	rr := httptest.NewRecorder()
 
-	h := videos.NewHandler(db, sessions, dir)
+	h := newTestHandler(db, sessions, dir)
 	h.Upload(rr, req)
 
 	if rr.Code != http.StatusUnauthorized {
@@ -151,24 +270,22 @@ func TestUpload_Unauthenticated(t *testing.T) {
 func TestUpload_AcceptedAndOriginalSaved(t *testing.T) {
 	db, sessions, dir := setupTest(t)
 
-	if err := db.CreateConversation("conv-1", "invite-abc", "Test"); err != nil {
+	if err := db.CreateConversation("conv-1", "invite-abc", "Test", ""); err != nil {
 		t.Fatalf("CreateConversation: %v", err)
 	}
-	if err := db.AddMember("conv-1", "alice"); err != nil {
-		t.Fatalf("AddMember: %v", err)
-	}
+	addMember(t, db, "conv-1", "alice")
 
 	body := &bytes.Buffer{}
 	writer := multipart.NewWriter(body)
 	writer.WriteField("conversation_id", "conv-1")
 	part, _ := writer.CreateFormFile("file", "test.mp4")
-	part.Write([]byte("fake video content"))
+	part.Write(videotest.MP4("fake video content"))
 	writer.Close()
 
 	req := authenticatedRequest(t, sessions, "POST", "/api/upload", body, writer.FormDataContentType())
 	rr := httptest.NewRecorder()
 
-	h := videos.NewHandler(db, sessions, dir)
+	h := newTestHandler(db, sessions, dir)
 	h.Upload(rr, req)
 
 	if rr.Code != http.StatusAccepted {
@@ -201,6 +318,540 @@ func TestUpload_AcceptedAndOriginalSaved(t *testing.T) {
 	if !found {
 		t.Error("expected original file to be saved in conversation directory")
 	}
+
+	job, err := db.GetJobByVideoID(resp["video_id"])
+	if err != nil {
+		t.Fatalf("GetJobByVideoID: %v", err)
+	}
+	if job == nil || job.State != storage.JobQueued {
+		t.Errorf("expected a queued transcoding job, got %+v", job)
+	}
+}
+
+func TestUpload_RecordsChecksum(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	setupMember(t, db)
+	h := newTestHandler(db, sessions, dir)
+
+	content := videotest.MP4("fake video content")
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("conversation_id", "conv-1")
+	part, _ := writer.CreateFormFile("file", "test.mp4")
+	part.Write(content)
+	writer.Close()
+
+	req := authenticatedRequest(t, sessions, "POST", "/api/upload", body, writer.FormDataContentType())
+	rr := httptest.NewRecorder()
+	h.Upload(rr, req)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var resp map[string]string
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	sum := sha256.Sum256(content)
+	want := hex.EncodeToString(sum[:])
+	if resp["sha256"] != want {
+		t.Errorf("expected sha256 %s, got %s", want, resp["sha256"])
+	}
+
+	video, err := db.GetVideo(resp["video_id"])
+	if err != nil {
+		t.Fatalf("GetVideo: %v", err)
+	}
+	if video.OriginalSHA256 != want {
+		t.Errorf("expected stored sha256 %s, got %s", want, video.OriginalSHA256)
+	}
+}
+
+func TestUpload_FileBeforeConversationID(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	setupMember(t, db)
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("file", "test.mp4")
+	part.Write(videotest.MP4("fake video content"))
+	writer.WriteField("conversation_id", "conv-1")
+	writer.Close()
+
+	req := authenticatedRequest(t, sessions, "POST", "/api/upload", body, writer.FormDataContentType())
+	rr := httptest.NewRecorder()
+	newTestHandler(db, sessions, dir).Upload(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rr.Code)
+	}
+}
+
+func TestUpload_TooLarge(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	setupMember(t, db)
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("conversation_id", "conv-1")
+	part, _ := writer.CreateFormFile("file", "test.mp4")
+	part.Write(videotest.MP4(strings.Repeat("frame", 1000)))
+	writer.Close()
+
+	req := authenticatedRequest(t, sessions, "POST", "/api/upload", body, writer.FormDataContentType())
+	rr := httptest.NewRecorder()
+	h := newTestHandler(db, sessions, dir)
+	h.MaxUploadSize = 2048
+	h.Upload(rr, req)
+
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d", rr.Code)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(dir, "conv-1")); len(entries) != 0 {
+		t.Errorf("expected partial file to be removed, found %d", len(entries))
+	}
+	if list := listVideos(t, h, sessions); len(list) != 0 {
+		t.Errorf("expected no video to be recorded, got %v", list)
+	}
+}
+
+func TestUpload_ClientDisconnectCleansUp(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	setupMember(t, db)
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("conversation_id", "conv-1")
+	part, _ := writer.CreateFormFile("file", "test.mp4")
+	part.Write(videotest.MP4(strings.Repeat("frame", 1000)))
+	writer.Close()
+
+	// Cut the connection part way through the file.
+	req := authenticatedRequest(t, sessions, "POST", "/api/upload", nil, writer.FormDataContentType())
+	req.Body = io.NopCloser(&failingReader{
+		data: body.Bytes()[:body.Len()/2],
+		err:  errors.New("connection reset by peer"),
+	})
+	rr := httptest.NewRecorder()
+	h := newTestHandler(db, sessions, dir)
+	h.Upload(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rr.Code)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(dir, "conv-1")); len(entries) != 0 {
+		t.Errorf("expected partial file to be removed, found %d", len(entries))
+	}
+	if list := listVideos(t, h, sessions); len(list) != 0 {
+		t.Errorf("expected no video to be recorded, got %v", list)
+	}
+}
+
+func setupMember(t *testing.T, db *storage.DB) {
+	t.Helper()
+	if err := db.CreateConversation("conv-1", "invite-abc", "Test", ""); err != nil {
+		t.Fatalf("CreateConversation: %v", err)
+	}
+	addMember(t, db, "conv-1", "alice")
+}
+
+// addMember adds username to the conversation, creating their account if
+// it doesn't exist yet.
+func addMember(t *testing.T, db *storage.DB, conversationID, username string) {
+	t.Helper()
+	err := db.CreateUser(&storage.User{ID: "id-" + username, Username: username})
+	if err != nil && !errors.Is(err, storage.ErrUsernameTaken) {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	if err := db.AddMember(conversationID, username); err != nil {
+		t.Fatalf("AddMember: %v", err)
+	}
+}
+
+// upload posts content to the handler and returns the new video's id.
+func upload(t *testing.T, h *videos.Handler, sessions *auth.Store, filename string, content []byte) string {
+	t.Helper()
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("conversation_id", "conv-1")
+	part, _ := writer.CreateFormFile("file", filename)
+	part.Write(content)
+	writer.Close()
+
+	req := authenticatedRequest(t, sessions, "POST", "/api/upload", body, writer.FormDataContentType())
+	rr := httptest.NewRecorder()
+	h.Upload(rr, req)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp map[string]string
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	return resp["video_id"]
+}
+
+// newPipelineHandler returns a handler whose jobs retry quickly, for tests
+// that run the transcoding workers.
+func newPipelineHandler(db *storage.DB, sessions *auth.Store, dir string, transcoder videos.Transcoder) *videos.Handler {
+	h := newTestHandler(db, sessions, dir)
+	h.Transcoder = transcoder
+	h.Retry = videos.RetryPolicy{MaxAttempts: 2, Backoff: time.Millisecond}
+	h.PollInterval = 5 * time.Millisecond
+	return h
+}
+
+// startWorkers runs the handler's transcoding workers for the rest of the test.
+func startWorkers(t *testing.T, h *videos.Handler) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := h.RunWorkers(ctx, 2); err != nil {
+			t.Errorf("RunWorkers: %v", err)
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func TestLifecycle_UploadToReady(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	setupMember(t, db)
+
+	transcoder := &videotest.Transcoder{}
+	h := newPipelineHandler(db, sessions, dir, transcoder)
+
+	videoID := upload(t, h, sessions, "clip.mov", videotest.MP4("raw footage"))
+	startWorkers(t, h)
+	waitForJob(t, db, videoID, storage.JobDone)
+
+	video, err := db.GetVideo(videoID)
+	if err != nil {
+		t.Fatalf("GetVideo: %v", err)
+	}
+	if video.Status != "ready" {
+		t.Errorf("expected status 'ready', got %q", video.Status)
+	}
+
+	calls := transcoder.Calls()
+	if len(calls) != 1 {
+		t.Fatalf("expected 1 transcode call, got %d", len(calls))
+	}
+	if calls[0].Profile != videos.DefaultProfile {
+		t.Errorf("expected default profile, got %+v", calls[0].Profile)
+	}
+	if _, err := os.Stat(calls[0].InputPath); !os.IsNotExist(err) {
+		t.Error("expected original file to be deleted after successful transcoding")
+	}
+
+	rr := httptest.NewRecorder()
+	h.Stream(rr, streamRequest(t, sessions, videoID))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	if want := videotest.TranscodedPrefix + string(videotest.MP4("raw footage")); rr.Body.String() != want {
+		t.Errorf("expected streamed body %q, got %q", want, rr.Body.String())
+	}
+
+	list := listVideos(t, h, sessions)
+	if len(list) != 1 {
+		t.Fatalf("expected 1 video, got %d", len(list))
+	}
+	if list[0]["thumbnail_url"] != "/api/videos/"+videoID+"/thumbnail" {
+		t.Errorf("unexpected thumbnail_url %v", list[0]["thumbnail_url"])
+	}
+	if list[0]["preview_url"] != "/api/videos/"+videoID+"/thumbnail?kind=preview" {
+		t.Errorf("unexpected preview_url %v", list[0]["preview_url"])
+	}
+
+	for kind, want := range map[string][]byte{"poster": videotest.Poster, "preview": videotest.Preview} {
+		rr := httptest.NewRecorder()
+		h.Thumbnail(rr, thumbnailRequest(t, sessions, videoID, kind))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", kind, rr.Code)
+		}
+		if !bytes.Equal(rr.Body.Bytes(), want) {
+			t.Errorf("%s: unexpected body %q", kind, rr.Body.String())
+		}
+	}
+}
+
+func TestLifecycle_RecordsMetadata(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	setupMember(t, db)
+
+	h := newPipelineHandler(db, sessions, dir, &videotest.Transcoder{})
+	prober := &videotest.Prober{Info: &videos.MediaInfo{
+		Duration:   3500 * time.Millisecond,
+		Width:      720,
+		Height:     1280,
+		VideoCodec: "h264",
+		AudioCodec: "aac",
+		Bitrate:    1_500_000,
+		Rotation:   90,
+	}}
+	h.Prober = prober
+
+	videoID := upload(t, h, sessions, "clip.mov", videotest.MP4("raw footage"))
+	startWorkers(t, h)
+	waitForJob(t, db, videoID, storage.JobDone)
+
+	// The original is probed once when validating the upload and again by
+	// the job, followed by the transcoded output.
+	paths := prober.Paths()
+	if len(paths) != 3 || !strings.HasSuffix(paths[2], videoID+".mp4") {
+		t.Fatalf("expected original and transcoded file to be probed, got %v", paths)
+	}
+
+	list := listVideos(t, h, sessions)
+	v := list[0]
+	if v["duration"] != 3.5 {
+		t.Errorf("expected duration 3.5, got %v", v["duration"])
+	}
+	if v["width"] != 720.0 || v["height"] != 1280.0 {
+		t.Errorf("expected 720x1280, got %vx%v", v["width"], v["height"])
+	}
+	if v["video_codec"] != "h264" || v["audio_codec"] != "aac" {
+		t.Errorf("unexpected codecs %v/%v", v["video_codec"], v["audio_codec"])
+	}
+	if v["bitrate"] != 1_500_000.0 {
+		t.Errorf("expected bitrate 1500000, got %v", v["bitrate"])
+	}
+	if want := float64(len(videotest.TranscodedPrefix + string(videotest.MP4("raw footage")))); v["size_bytes"] != want {
+		t.Errorf("expected size_bytes %v, got %v", want, v["size_bytes"])
+	}
+	if v["rotation"] != 90.0 {
+		t.Errorf("expected rotation 90, got %v", v["rotation"])
+	}
+}
+
+func TestLifecycle_ThumbnailFailureIsNotFatal(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	setupMember(t, db)
+
+	h := newPipelineHandler(db, sessions, dir, &videotest.Transcoder{})
+	h.Thumbnailer = &videotest.Thumbnailer{PreviewErr: errors.New("no libwebp")}
+
+	videoID := upload(t, h, sessions, "clip.mp4", videotest.MP4("raw footage"))
+	startWorkers(t, h)
+	waitForJob(t, db, videoID, storage.JobDone)
+
+	video, _ := db.GetVideo(videoID)
+	if video.Status != "ready" {
+		t.Errorf("expected status 'ready', got %q", video.Status)
+	}
+	if video.PosterFilename == "" {
+		t.Error("expected poster to be recorded")
+	}
+	if video.PreviewFilename != "" {
+		t.Errorf("expected no preview, got %q", video.PreviewFilename)
+	}
+
+	rr := httptest.NewRecorder()
+	h.Thumbnail(rr, thumbnailRequest(t, sessions, videoID, "preview"))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for missing preview, got %d", rr.Code)
+	}
+}
+
+func TestThumbnail_NonMemberForbidden(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+
+	if err := db.CreateConversation("conv-1", "invite-abc", "Test", ""); err != nil {
+		t.Fatalf("CreateConversation: %v", err)
+	}
+	createVideoFile(t, db, dir, "vid-1", "ready", []byte("0123456789"))
+
+	rr := httptest.NewRecorder()
+	h := newTestHandler(db, sessions, dir)
+	h.Thumbnail(rr, thumbnailRequest(t, sessions, "vid-1", ""))
+
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", rr.Code)
+	}
+}
+
+func thumbnailRequest(t *testing.T, sessions *auth.Store, videoID, kind string) *http.Request {
+	t.Helper()
+	target := "/api/videos/" + videoID + "/thumbnail"
+	if kind != "" {
+		target += "?kind=" + kind
+	}
+	req := authenticatedRequest(t, sessions, "GET", target, nil, "")
+	req.SetPathValue("id", videoID)
+	return req
+}
+
+func listVideos(t *testing.T, h *videos.Handler, sessions *auth.Store) []map[string]any {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	h.List(rr, authenticatedRequest(t, sessions, "GET", "/api/videos?conversation_id=conv-1", nil, ""))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	var list []map[string]any
+	if err := json.NewDecoder(rr.Body).Decode(&list); err != nil {
+		t.Fatalf("decode list: %v", err)
+	}
+	return list
+}
+
+func TestLifecycle_RetryThenReady(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	setupMember(t, db)
+
+	transcoder := &videotest.Transcoder{FailTimes: 1}
+	h := newPipelineHandler(db, sessions, dir, transcoder)
+
+	videoID := upload(t, h, sessions, "clip.mp4", videotest.MP4("raw footage"))
+	startWorkers(t, h)
+	job := waitForJob(t, db, videoID, storage.JobDone)
+	if job.Attempts != 2 {
+		t.Errorf("expected success on attempt 2, got %d", job.Attempts)
+	}
+
+	video, _ := db.GetVideo(videoID)
+	if video.Status != "ready" {
+		t.Errorf("expected status 'ready', got %q", video.Status)
+	}
+}
+
+func TestLifecycle_UploadToError(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	setupMember(t, db)
+
+	transcoder := &videotest.Transcoder{Err: errors.New("corrupt input")}
+	h := newPipelineHandler(db, sessions, dir, transcoder)
+
+	videoID := upload(t, h, sessions, "clip.mp4", videotest.MP4("raw footage"))
+	startWorkers(t, h)
+	job := waitForJob(t, db, videoID, storage.JobFailed)
+	if job.Attempts != 2 {
+		t.Errorf("expected 2 attempts, got %d", job.Attempts)
+	}
+	if job.LastError != "corrupt input" {
+		t.Errorf("expected last error to be recorded, got %q", job.LastError)
+	}
+
+	video, err := db.GetVideo(videoID)
+	if err != nil {
+		t.Fatalf("GetVideo: %v", err)
+	}
+	if video.Status != "error" {
+		t.Errorf("expected status 'error', got %q", video.Status)
+	}
+	if _, err := os.Stat(filepath.Join(dir, job.InputKey)); err != nil {
+		t.Errorf("expected original file to be retained after failure: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	h.Stream(rr, streamRequest(t, sessions, videoID))
+	if rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 for errored video, got %d", rr.Code)
+	}
+}
+
+// runWorkers starts the transcoding workers and returns a function that
+// stops them and waits for RunWorkers to return.
+func runWorkers(t *testing.T, h *videos.Handler) (stop func()) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := h.RunWorkers(ctx, 1); err != nil {
+			t.Errorf("RunWorkers: %v", err)
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func TestShutdown_DrainsRunningJob(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	setupMember(t, db)
+
+	transcoder := &videotest.Transcoder{Block: make(chan struct{})}
+	h := newPipelineHandler(db, sessions, dir, transcoder)
+
+	videoID := upload(t, h, sessions, "clip.mp4", videotest.MP4("raw footage"))
+	stop := runWorkers(t, h)
+	waitForJob(t, db, videoID, storage.JobRunning)
+
+	// ffmpeg finishes shortly after shutdown begins
+	time.AfterFunc(50*time.Millisecond, func() { close(transcoder.Block) })
+	stop()
+
+	job, err := db.GetJobByVideoID(videoID)
+	if err != nil {
+		t.Fatalf("GetJobByVideoID: %v", err)
+	}
+	if job.State != storage.JobDone {
+		t.Errorf("expected running job to finish, got state %q", job.State)
+	}
+	video, _ := db.GetVideo(videoID)
+	if video.Status != "ready" {
+		t.Errorf("expected status 'ready', got %q", video.Status)
+	}
+}
+
+func TestShutdown_RequeuesJobAfterDrainTimeout(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	setupMember(t, db)
+
+	transcoder := &videotest.Transcoder{Block: make(chan struct{})}
+	h := newPipelineHandler(db, sessions, dir, transcoder)
+	h.DrainTimeout = 10 * time.Millisecond
+
+	videoID := upload(t, h, sessions, "clip.mp4", videotest.MP4("raw footage"))
+	stop := runWorkers(t, h)
+	waitForJob(t, db, videoID, storage.JobRunning)
+	stop()
+
+	job, err := db.GetJobByVideoID(videoID)
+	if err != nil {
+		t.Fatalf("GetJobByVideoID: %v", err)
+	}
+	if job.State != storage.JobQueued || job.Attempts != 0 {
+		t.Errorf("expected aborted job to be requeued without using an attempt, got %+v", job)
+	}
+	video, _ := db.GetVideo(videoID)
+	if video.Status != "pending" {
+		t.Errorf("expected status 'pending', got %q", video.Status)
+	}
+
+	// The next start resumes the job from scratch
+	close(transcoder.Block)
+	startWorkers(t, h)
+	job = waitForJob(t, db, videoID, storage.JobDone)
+	if job.Attempts != 1 {
+		t.Errorf("expected success on attempt 1, got %d", job.Attempts)
+	}
+}
+
+func waitForJob(t *testing.T, db *storage.DB, videoID, state string) *storage.Job {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		job, err := db.GetJobByVideoID(videoID)
+		if err != nil {
+			t.Fatalf("GetJobByVideoID: %v", err)
+		}
+		if job != nil && job.State == state {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for job of video %s to reach state %q", videoID, state)
+	return nil
 }
 
 func TestList_Unauthenticated(t *testing.T) {
@@ -209,7 +860,7 @@ func TestList_Unauthenticated(t *testing.T) {
 	req, _ := http.NewRequest("GET", "/api/videos?conversation_id=conv-1", nil)
 	rr := httptest.NewRecorder()
 
-	h := videos.NewHandler(db, sessions, dir)
+	h := newTestHandler(db, sessions, dir)
 	h.List(rr, req)
 
 	if rr.Code != http.StatusUnauthorized {
@@ -220,7 +871,7 @@ func TestList_Unauthenticated(t *testing.T) {
 func TestList_NonMemberForbidden(t *testing.T) {
 	db, sessions, dir := setupTest(t)
 
-	if err := db.CreateConversation("conv-1", "invite-abc", "Test"); err != nil {
+	if err := db.CreateConversation("conv-1", "invite-abc", "Test", ""); err != nil {
 		t.Fatalf("CreateConversation: %v", err)
 	}
 	// alice is NOT a member
@@ -228,10 +879,162 @@ func TestList_NonMemberForbidden(t *testing.T) {
 	req := authenticatedRequest(t, sessions, "GET", "/api/videos?conversation_id=conv-1", nil, "")
 	rr := httptest.NewRecorder()
 
-	h := videos.NewHandler(db, sessions, dir)
+	h := newTestHandler(db, sessions, dir)
 	h.List(rr, req)
 
 	if rr.Code != http.StatusForbidden {
 		t.Errorf("expected 403, got %d", rr.Code)
 	}
 }
+
+func createVideoFile(t *testing.T, db *storage.DB, dir, videoID, status string, content []byte) {
+	t.Helper()
+	key := "conv-1/" + videoID + ".mp4"
+	if err := os.MkdirAll(filepath.Join(dir, "conv-1"), 0755); err != nil {
+		t.Fatalf("create conversation dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, key), content, 0644); err != nil {
+		t.Fatalf("write video file: %v", err)
+	}
+	if err := db.CreateVideo(&storage.Video{ID: videoID, ConversationID: "conv-1", Uploader: "alice", Filename: key}); err != nil {
+		t.Fatalf("CreateVideo: %v", err)
+	}
+	if err := db.UpdateVideoStatus(videoID, status); err != nil {
+		t.Fatalf("UpdateVideoStatus: %v", err)
+	}
+}
+
+func streamRequest(t *testing.T, sessions *auth.Store, videoID string) *http.Request {
+	t.Helper()
+	req := authenticatedRequest(t, sessions, "GET", "/api/videos/"+videoID+"/stream", nil, "")
+	req.SetPathValue("id", videoID)
+	return req
+}
+
+func TestStream_FullAndRange(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+
+	if err := db.CreateConversation("conv-1", "invite-abc", "Test", ""); err != nil {
+		t.Fatalf("CreateConversation: %v", err)
+	}
+	addMember(t, db, "conv-1", "alice")
+	createVideoFile(t, db, dir, "vid-1", "ready", []byte("0123456789"))
+
+	h := newTestHandler(db, sessions, dir)
+
+	rr := httptest.NewRecorder()
+	h.Stream(rr, streamRequest(t, sessions, "vid-1"))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr.Body.String() != "0123456789" {
+		t.Errorf("unexpected body %q", rr.Body.String())
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "video/mp4" {
+		t.Errorf("expected Content-Type video/mp4, got %q", ct)
+	}
+	if rr.Header().Get("Accept-Ranges") != "bytes" {
+		t.Errorf("expected Accept-Ranges: bytes, got %q", rr.Header().Get("Accept-Ranges"))
+	}
+
+	req := streamRequest(t, sessions, "vid-1")
+	req.Header.Set("Range", "bytes=2-5")
+	rr = httptest.NewRecorder()
+	h.Stream(rr, req)
+	if rr.Code != http.StatusPartialContent {
+		t.Fatalf("expected 206, got %d", rr.Code)
+	}
+	if rr.Body.String() != "2345" {
+		t.Errorf("expected range body '2345', got %q", rr.Body.String())
+	}
+	if cr := rr.Header().Get("Content-Range"); cr != "bytes 2-5/10" {
+		t.Errorf("expected Content-Range 'bytes 2-5/10', got %q", cr)
+	}
+}
+
+func TestStream_ConditionalRequests(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+
+	if err := db.CreateConversation("conv-1", "invite-abc", "Test", ""); err != nil {
+		t.Fatalf("CreateConversation: %v", err)
+	}
+	addMember(t, db, "conv-1", "alice")
+	createVideoFile(t, db, dir, "vid-1", "ready", []byte("0123456789"))
+
+	h := newTestHandler(db, sessions, dir)
+
+	rr := httptest.NewRecorder()
+	h.Stream(rr, streamRequest(t, sessions, "vid-1"))
+	etag := rr.Header().Get("ETag")
+	lastModified := rr.Header().Get("Last-Modified")
+	if etag == "" || lastModified == "" {
+		t.Fatalf("expected ETag and Last-Modified, got %q and %q", etag, lastModified)
+	}
+
+	req := streamRequest(t, sessions, "vid-1")
+	req.Header.Set("If-None-Match", etag)
+	rr = httptest.NewRecorder()
+	h.Stream(rr, req)
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match: expected 304, got %d", rr.Code)
+	}
+
+	req = streamRequest(t, sessions, "vid-1")
+	req.Header.Set("If-Modified-Since", lastModified)
+	rr = httptest.NewRecorder()
+	h.Stream(rr, req)
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("If-Modified-Since: expected 304, got %d", rr.Code)
+	}
+}
+
+func TestStream_NotReady(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+
+	if err := db.CreateConversation("conv-1", "invite-abc", "Test", ""); err != nil {
+		t.Fatalf("CreateConversation: %v", err)
+	}
+	addMember(t, db, "conv-1", "alice")
+	createVideoFile(t, db, dir, "vid-pending", "pending", []byte("partial"))
+	createVideoFile(t, db, dir, "vid-error", "error", []byte("broken"))
+
+	h := newTestHandler(db, sessions, dir)
+
+	for _, id := range []string{"vid-pending", "vid-error"} {
+		rr := httptest.NewRecorder()
+		h.Stream(rr, streamRequest(t, sessions, id))
+		if rr.Code != http.StatusConflict {
+			t.Errorf("%s: expected 409, got %d", id, rr.Code)
+		}
+	}
+}
+
+func TestStream_NonMemberForbidden(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+
+	if err := db.CreateConversation("conv-1", "invite-abc", "Test", ""); err != nil {
+		t.Fatalf("CreateConversation: %v", err)
+	}
+	// alice is NOT a member
+	createVideoFile(t, db, dir, "vid-1", "ready", []byte("0123456789"))
+
+	rr := httptest.NewRecorder()
+	h := newTestHandler(db, sessions, dir)
+	h.Stream(rr, streamRequest(t, sessions, "vid-1"))
+
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", rr.Code)
+	}
+}
+
+func TestStream_NotFound(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+
+	rr := httptest.NewRecorder()
+	h := newTestHandler(db, sessions, dir)
+	h.Stream(rr, streamRequest(t, sessions, "missing"))
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,209 @@
+package videos
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"waffle-app/internal/storage"
+)
+
+const (
+	hlsMasterPlaylist = "master.m3u8"
+	hlsSegmentSeconds = "4"
+)
+
+// Rendition is one rung of an HLS bitrate ladder.
+type Rendition struct {
+	Name         string // also the rendition's directory, e.g. "360p"
+	Height       int
+	VideoBitrate int64 // bits per second
+	AudioBitrate int64 // bits per second
+}
+
+// Bandwidth is the peak bit rate advertised for the rendition.
+func (r Rendition) Bandwidth() int64 {
+	return r.VideoBitrate + r.AudioBitrate
+}
+
+var DefaultLadder = []Rendition{
+	{Name: "360p", Height: 360, VideoBitrate: 800_000, AudioBitrate: 96_000},
+	{Name: "540p", Height: 540, VideoBitrate: 1_800_000, AudioBitrate: 128_000},
+	{Name: "720p", Height: 720, VideoBitrate: 3_000_000, AudioBitrate: 128_000},
+}
+
+// HLSPackager segments a transcoded video into an adaptive bitrate ladder.
+type HLSPackager interface {
+	// PackageHLS writes one media playlist and its segments per rendition
+	// to outputDir/<name>/index.m3u8, and a master playlist referencing
+	// them to outputDir/master.m3u8.
+	PackageHLS(ctx context.Context, videoPath, outputDir string, ladder []Rendition, hasAudio bool) error
+}
+
+var _ HLSPackager = (*FFmpeg)(nil)
+
+func (f *FFmpeg) PackageHLS(ctx context.Context, videoPath, outputDir string, ladder []Rendition, hasAudio bool) error {
+	var filter strings.Builder
+	fmt.Fprintf(&filter, "[0:v]split=%d", len(ladder))
+	for i := range ladder {
+		fmt.Fprintf(&filter, "[v%d]", i)
+	}
+	for i, r := range ladder {
+		fmt.Fprintf(&filter, ";[v%d]scale=-2:%d[v%dout]", i, r.Height, i)
+	}
+
+	args := []string{"-i", videoPath, "-filter_complex", filter.String()}
+	var streams []string
+	for i, r := range ladder {
+		n := strconv.Itoa(i)
+		args = append(args,
+			"-map", "[v"+n+"out]",
+			"-c:v:"+n, "libx264",
+			"-b:v:"+n, strconv.FormatInt(r.VideoBitrate, 10),
+			"-maxrate:v:"+n, strconv.FormatInt(r.VideoBitrate, 10),
+			"-bufsize:v:"+n, strconv.FormatInt(2*r.VideoBitrate, 10),
+		)
+		stream := "v:" + n
+		if hasAudio {
+			args = append(args,
+				"-map", "a:0",
+				"-c:a:"+n, "aac",
+				"-b:a:"+n, strconv.FormatInt(r.AudioBitrate, 10),
+			)
+			stream += ",a:" + n
+		}
+		streams = append(streams, stream+",name:"+r.Name)
+	}
+	args = append(args,
+		"-preset", "veryfast",
+		"-g", "48",
+		"-sc_threshold", "0",
+		"-f", "hls",
+		"-hls_time", hlsSegmentSeconds,
+		"-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(outputDir, "%v", "segment_%03d.ts"),
+		"-master_pl_name", hlsMasterPlaylist,
+		"-var_stream_map", strings.Join(streams, " "),
+		"-y",
+		filepath.Join(outputDir, "%v", "index.m3u8"),
+	)
+	return f.run(ctx, args...)
+}
+
+// GET /api/videos/{id}/hls/{path...}
+// Serves the master playlist, media playlists and segments of a video's HLS
+// ladder. Playlists reference each other by relative URI, so players fetch
+// everything through this route with the same session cookie.
+func (h *Handler) HLSFile(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireSession(w, r)
+	if !ok {
+		return
+	}
+
+	video, ok := h.requireVideo(w, r.PathValue("id"), session)
+	if !ok {
+		return
+	}
+	if video.Status != "ready" || video.HLSPlaylist == "" {
+		http.Error(w, "HLS not available", http.StatusNotFound)
+		return
+	}
+
+	name := r.PathValue("path")
+	if !filepath.IsLocal(filepath.FromSlash(name)) {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	var contentType string
+	switch path.Ext(name) {
+	case ".m3u8":
+		contentType = "application/vnd.apple.mpegurl"
+	case ".ts":
+		contentType = "video/mp2t"
+	default:
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+
+	h.serveFile(w, r, video.ID, path.Join(path.Dir(video.HLSPlaylist), name), contentType)
+}
+
+// hlsDir derives the directory holding a video's HLS output from the
+// transcoded video's path or key, so it is stored next to the MP4.
+func hlsDir(videoPath string) string {
+	return strings.TrimSuffix(videoPath, ".mp4") + "_hls"
+}
+
+// ladderFor returns the renditions of ladder that don't upscale a video of
+// the given height. The lowest rendition is always kept.
+func ladderFor(ladder []Rendition, height int) []Rendition {
+	var renditions []Rendition
+	for _, r := range ladder {
+		if height == 0 || r.Height <= height {
+			renditions = append(renditions, r)
+		}
+	}
+	if len(renditions) == 0 && len(ladder) > 0 {
+		renditions = ladder[:1]
+	}
+	return renditions
+}
+
+// generateHLS packages a transcoded video at videoPath for adaptive
+// streaming if HLS is enabled, and stores the ladder next to videoKey.
+// Like thumbnails, failures are not fatal: the video remains playable as a
+// single MP4.
+func (h *Handler) generateHLS(ctx context.Context, videoID, videoPath, videoKey string, info *MediaInfo) {
+	if h.HLS == nil {
+		return
+	}
+
+	height, hasAudio := 0, true
+	if info != nil {
+		height, hasAudio = info.Height, info.AudioCodec != ""
+	}
+	ladder := ladderFor(h.HLSLadder, height)
+	if len(ladder) == 0 {
+		return
+	}
+
+	dir := hlsDir(videoPath)
+	if err := os.RemoveAll(dir); err != nil {
+		slog.Warn("failed to clear HLS directory", "error", err, "video_id", videoID)
+		return
+	}
+	if err := h.HLS.PackageHLS(ctx, videoPath, dir, ladder, hasAudio); err != nil {
+		slog.Warn("failed to package HLS", "error", err, "video_id", videoID)
+		return
+	}
+
+	// Objects left by an earlier attempt are replaced wholesale.
+	prefix := hlsDir(videoKey) + "/"
+	if err := h.deletePrefix(ctx, prefix); err != nil {
+		slog.Warn("failed to clear stored HLS files", "error", err, "video_id", videoID)
+		return
+	}
+	if err := h.putDir(ctx, prefix, dir); err != nil {
+		slog.Warn("failed to store HLS files", "error", err, "video_id", videoID)
+		h.deletePrefix(context.WithoutCancel(ctx), prefix)
+		return
+	}
+
+	variants := make([]storage.VideoVariant, 0, len(ladder))
+	for _, r := range ladder {
+		variants = append(variants, storage.VideoVariant{
+			Name:      r.Name,
+			Height:    r.Height,
+			Bandwidth: r.Bandwidth(),
+			Playlist:  r.Name + "/index.m3u8",
+		})
+	}
+	if err := h.DB.SetVideoVariants(videoID, prefix+hlsMasterPlaylist, variants); err != nil {
+		slog.Error("failed to record HLS variants", "error", err, "video_id", videoID)
+	}
+}
@@ -0,0 +1,157 @@
+package videos_test
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"waffle-app/internal/auth"
+	"waffle-app/internal/storage"
+	"waffle-app/internal/videos"
+	"waffle-app/internal/videos/videotest"
+)
+
+func hlsRequest(t *testing.T, sessions *auth.Store, videoID, path string) *http.Request {
+	t.Helper()
+	req := authenticatedRequest(t, sessions, "GET", "/api/videos/"+videoID+"/hls/"+path, nil, "")
+	req.SetPathValue("id", videoID)
+	req.SetPathValue("path", path)
+	return req
+}
+
+// newHLSHandler returns a pipeline handler with HLS packaging enabled.
+func newHLSHandler(db *storage.DB, sessions *auth.Store, dir string, packager *videotest.HLSPackager) *videos.Handler {
+	h := newPipelineHandler(db, sessions, dir, &videotest.Transcoder{})
+	h.HLS = packager
+	return h
+}
+
+func TestHLS_LadderGeneratedAndServed(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	setupMember(t, db)
+
+	h := newHLSHandler(db, sessions, dir, &videotest.HLSPackager{})
+	videoID := upload(t, h, sessions, "clip.mp4", videotest.MP4("raw footage"))
+	startWorkers(t, h)
+	waitForJob(t, db, videoID, storage.JobDone)
+
+	list := listVideos(t, h, sessions)
+	if len(list) != 1 {
+		t.Fatalf("expected 1 video, got %d", len(list))
+	}
+	if want := "/api/videos/" + videoID + "/hls/master.m3u8"; list[0]["hls_url"] != want {
+		t.Errorf("expected hls_url %s, got %v", want, list[0]["hls_url"])
+	}
+	variants, _ := list[0]["variants"].([]any)
+	if len(variants) != len(videos.DefaultLadder) {
+		t.Fatalf("expected %d variants, got %v", len(videos.DefaultLadder), list[0]["variants"])
+	}
+	first := variants[0].(map[string]any)
+	if first["name"] != "360p" || first["height"] != float64(360) || first["bandwidth"] != float64(896_000) {
+		t.Errorf("unexpected lowest variant %v", first)
+	}
+	if want := "/api/videos/" + videoID + "/hls/360p/index.m3u8"; first["playlist_url"] != want {
+		t.Errorf("expected playlist_url %s, got %v", want, first["playlist_url"])
+	}
+
+	rr := httptest.NewRecorder()
+	h.HLSFile(rr, hlsRequest(t, sessions, videoID, "master.m3u8"))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("master: expected 200, got %d", rr.Code)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/vnd.apple.mpegurl" {
+		t.Errorf("master: unexpected Content-Type %q", ct)
+	}
+
+	rr = httptest.NewRecorder()
+	h.HLSFile(rr, hlsRequest(t, sessions, videoID, "540p/segment_000.ts"))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("segment: expected 200, got %d", rr.Code)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "video/mp2t" {
+		t.Errorf("segment: unexpected Content-Type %q", ct)
+	}
+	if !bytes.Equal(rr.Body.Bytes(), videotest.Segment("540p")) {
+		t.Errorf("segment: unexpected body %q", rr.Body.String())
+	}
+
+	for _, path := range []string{"../" + videoID + ".mp4", "360p/../../" + videoID + ".mp4", videoID + ".jpg"} {
+		rr := httptest.NewRecorder()
+		h.HLSFile(rr, hlsRequest(t, sessions, videoID, path))
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d", path, rr.Code)
+		}
+	}
+}
+
+func TestHLS_SkipsRenditionsAboveSource(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	setupMember(t, db)
+
+	packager := &videotest.HLSPackager{}
+	h := newHLSHandler(db, sessions, dir, packager)
+	info := videotest.DefaultMediaInfo
+	info.Width, info.Height = 960, 540
+	h.Prober = &videotest.Prober{Info: &info}
+
+	videoID := upload(t, h, sessions, "clip.mp4", videotest.MP4("raw footage"))
+	startWorkers(t, h)
+	waitForJob(t, db, videoID, storage.JobDone)
+
+	ladders := packager.Ladders()
+	if len(ladders) != 1 {
+		t.Fatalf("expected 1 packaging call, got %d", len(ladders))
+	}
+	var names []string
+	for _, r := range ladders[0] {
+		names = append(names, r.Name)
+	}
+	if len(names) != 2 || names[0] != "360p" || names[1] != "540p" {
+		t.Errorf("expected 360p and 540p renditions, got %v", names)
+	}
+}
+
+func TestHLS_FailureIsNotFatal(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	setupMember(t, db)
+
+	h := newHLSHandler(db, sessions, dir, &videotest.HLSPackager{Err: errors.New("ffmpeg exploded")})
+	videoID := upload(t, h, sessions, "clip.mp4", videotest.MP4("raw footage"))
+	startWorkers(t, h)
+	waitForJob(t, db, videoID, storage.JobDone)
+
+	list := listVideos(t, h, sessions)
+	if list[0]["status"] != "ready" {
+		t.Errorf("expected video to be ready, got %v", list[0]["status"])
+	}
+	if _, ok := list[0]["hls_url"]; ok {
+		t.Errorf("expected no hls_url, got %v", list[0]["hls_url"])
+	}
+	if _, ok := list[0]["variants"]; ok {
+		t.Errorf("expected no variants, got %v", list[0]["variants"])
+	}
+
+	rr := httptest.NewRecorder()
+	h.HLSFile(rr, hlsRequest(t, sessions, videoID, "master.m3u8"))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rr.Code)
+	}
+}
+
+func TestHLS_NonMemberForbidden(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+
+	if err := db.CreateConversation("conv-1", "invite-abc", "Test", ""); err != nil {
+		t.Fatalf("CreateConversation: %v", err)
+	}
+	createVideoFile(t, db, dir, "vid-1", "ready", []byte("0123456789"))
+
+	rr := httptest.NewRecorder()
+	h := newTestHandler(db, sessions, dir)
+	h.HLSFile(rr, hlsRequest(t, sessions, "vid-1", "master.m3u8"))
+
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,153 @@
+package videos
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"strconv"
+	"time"
+	"waffle-app/internal/storage"
+)
+
+// MediaInfo describes a media file as reported by ffprobe.
+type MediaInfo struct {
+	Duration   time.Duration
+	Width      int
+	Height     int
+	VideoCodec string
+	AudioCodec string
+	Bitrate    int64 // bits per second
+	Size       int64 // bytes
+	Rotation   int   // display rotation in degrees clockwise, 0-359
+}
+
+// Prober inspects media files.
+type Prober interface {
+	Probe(ctx context.Context, path string) (*MediaInfo, error)
+}
+
+// FFprobe probes media using the system ffprobe binary.
+type FFprobe struct {
+	// Path is the ffprobe binary to run. Defaults to "ffprobe" on PATH.
+	Path string
+}
+
+var _ Prober = (*FFprobe)(nil)
+
+func (f *FFprobe) Probe(ctx context.Context, path string) (*MediaInfo, error) {
+	binary := f.Path
+	if binary == "" {
+		binary = "ffprobe"
+	}
+	cmd := exec.CommandContext(ctx, binary,
+		"-v", "error",
+		"-print_format", "json",
+		"-show_format",
+		"-show_streams",
+		path,
+	)
+	output, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("ffprobe: %w: %s", err, tail(exitErr.Stderr, maxErrorOutput))
+		}
+		return nil, fmt.Errorf("ffprobe: %w", err)
+	}
+	return parseProbeOutput(output)
+}
+
+// recordMetadata probes the transcoded video and stores its metadata. The
+// rotation comes from the original upload, since ffmpeg applies it while
+// transcoding and the output is always upright. original may be nil if the
+// upload could not be probed. It returns the transcoded video's media info,
+// or nil if it could not be probed.
+func (h *Handler) recordMetadata(ctx context.Context, videoID, outputPath string, original *MediaInfo) *MediaInfo {
+	info, err := h.Prober.Probe(ctx, outputPath)
+	if err != nil {
+		slog.Warn("failed to probe transcoded file", "error", err, "video_id", videoID)
+		return nil
+	}
+
+	m := storage.VideoMetadata{
+		DurationMS: info.Duration.Milliseconds(),
+		Width:      info.Width,
+		Height:     info.Height,
+		VideoCodec: info.VideoCodec,
+		AudioCodec: info.AudioCodec,
+		Bitrate:    info.Bitrate,
+		SizeBytes:  info.Size,
+	}
+	if original != nil {
+		m.Rotation = original.Rotation
+	}
+	if err := h.DB.SetVideoMetadata(videoID, m); err != nil {
+		slog.Error("failed to record video metadata", "error", err, "video_id", videoID)
+	}
+	return info
+}
+
+type probeOutput struct {
+	Format struct {
+		Duration string `json:"duration"`
+		Size     string `json:"size"`
+		BitRate  string `json:"bit_rate"`
+	} `json:"format"`
+	Streams []struct {
+		CodecType string `json:"codec_type"`
+		CodecName string `json:"codec_name"`
+		Width     int    `json:"width"`
+		Height    int    `json:"height"`
+		Tags      struct {
+			Rotate string `json:"rotate"`
+		} `json:"tags"`
+		SideDataList []struct {
+			Rotation *float64 `json:"rotation"`
+		} `json:"side_data_list"`
+	} `json:"streams"`
+}
+
+func parseProbeOutput(data []byte) (*MediaInfo, error) {
+	var out probeOutput
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, fmt.Errorf("parse ffprobe output: %w", err)
+	}
+
+	info := &MediaInfo{}
+	if seconds, err := strconv.ParseFloat(out.Format.Duration, 64); err == nil {
+		info.Duration = time.Duration(seconds * float64(time.Second))
+	}
+	info.Size, _ = strconv.ParseInt(out.Format.Size, 10, 64)
+	info.Bitrate, _ = strconv.ParseInt(out.Format.BitRate, 10, 64)
+
+	for _, s := range out.Streams {
+		switch s.CodecType {
+		case "video":
+			if info.VideoCodec != "" {
+				continue // only the first video stream is described
+			}
+			info.VideoCodec = s.CodecName
+			info.Width, info.Height = s.Width, s.Height
+			// Older muxers use a rotate tag; newer ones report a display
+			// matrix in side data, rotated counter-clockwise.
+			if deg, err := strconv.Atoi(s.Tags.Rotate); err == nil {
+				info.Rotation = normalizeRotation(deg)
+			}
+			for _, sd := range s.SideDataList {
+				if sd.Rotation != nil {
+					info.Rotation = normalizeRotation(-int(*sd.Rotation))
+				}
+			}
+		case "audio":
+			if info.AudioCodec == "" {
+				info.AudioCodec = s.CodecName
+			}
+		}
+	}
+	return info, nil
+}
+
+func normalizeRotation(deg int) int {
+	return ((deg % 360) + 360) % 360
+}
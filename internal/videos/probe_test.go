@@ -0,0 +1,58 @@
+package videos
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseProbeOutput(t *testing.T) {
+	output := []byte(`{
+		"streams": [
+			{
+				"codec_type": "video",
+				"codec_name": "hevc",
+				"width": 1920,
+				"height": 1080,
+				"side_data_list": [{"side_data_type": "Display Matrix", "rotation": -90}]
+			},
+			{"codec_type": "audio", "codec_name": "aac"}
+		],
+		"format": {"duration": "12.500000", "size": "31457280", "bit_rate": "20132659"}
+	}`)
+
+	info, err := parseProbeOutput(output)
+	if err != nil {
+		t.Fatalf("parseProbeOutput: %v", err)
+	}
+	want := MediaInfo{
+		Duration:   12500 * time.Millisecond,
+		Width:      1920,
+		Height:     1080,
+		VideoCodec: "hevc",
+		AudioCodec: "aac",
+		Bitrate:    20132659,
+		Size:       31457280,
+		Rotation:   90,
+	}
+	if *info != want {
+		t.Errorf("got %+v, want %+v", *info, want)
+	}
+}
+
+func TestParseProbeOutput_RotateTag(t *testing.T) {
+	output := []byte(`{
+		"streams": [{"codec_type": "video", "codec_name": "h264", "width": 1280, "height": 720, "tags": {"rotate": "270"}}],
+		"format": {"duration": "1.0"}
+	}`)
+
+	info, err := parseProbeOutput(output)
+	if err != nil {
+		t.Fatalf("parseProbeOutput: %v", err)
+	}
+	if info.Rotation != 270 {
+		t.Errorf("expected rotation 270, got %d", info.Rotation)
+	}
+	if info.AudioCodec != "" {
+		t.Errorf("expected no audio codec, got %q", info.AudioCodec)
+	}
+}
@@ -0,0 +1,175 @@
+package videos
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"time"
+)
+
+// Profiles is a set of named transcoding profiles, one of which is the
+// server's default.
+type Profiles struct {
+	Default string
+	ByName  map[string]Profile
+}
+
+var DefaultProfiles = Profiles{
+	Default: DefaultProfile.Name,
+	ByName: map[string]Profile{
+		"480p": {
+			Name:         "480p",
+			Height:       480,
+			VideoCodec:   "libx264",
+			CRF:          26,
+			AudioCodec:   "aac",
+			AudioBitrate: 96_000,
+		},
+		DefaultProfile.Name: DefaultProfile,
+		"1080p": {
+			Name:         "1080p",
+			Height:       1080,
+			VideoCodec:   "libx264",
+			CRF:          21,
+			AudioCodec:   "aac",
+			AudioBitrate: 160_000,
+		},
+	},
+}
+
+// Resolve returns the named profile, or the default profile if name is
+// empty. ok is false if there is no profile with that name.
+func (p Profiles) Resolve(name string) (profile Profile, ok bool) {
+	if name == "" {
+		name = p.Default
+	}
+	profile, ok = p.ByName[name]
+	return profile, ok
+}
+
+// Names returns the profile names in sorted order.
+func (p Profiles) Names() []string {
+	names := make([]string, 0, len(p.ByName))
+	for name := range p.ByName {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Validate checks that every profile can be passed to ffmpeg and that the
+// default exists.
+func (p Profiles) Validate() error {
+	if len(p.ByName) == 0 {
+		return errors.New("no transcoding profiles defined")
+	}
+	if _, ok := p.ByName[p.Default]; !ok {
+		return fmt.Errorf("default profile %q is not defined", p.Default)
+	}
+	for name, profile := range p.ByName {
+		switch {
+		case profile.Height <= 0 || profile.Height%2 != 0:
+			return fmt.Errorf("profile %q: height must be a positive even number", name)
+		case profile.VideoCodec == "":
+			return fmt.Errorf("profile %q: video_codec is required", name)
+		case profile.AudioCodec == "":
+			return fmt.Errorf("profile %q: audio_codec is required", name)
+		case profile.CRF < 0 || profile.CRF > 51:
+			return fmt.Errorf("profile %q: crf must be between 0 and 51", name)
+		case profile.VideoBitrate < 0 || profile.AudioBitrate < 0 || profile.AudioChannels < 0:
+			return fmt.Errorf("profile %q: bitrates and channels must not be negative", name)
+		case profile.MaxDuration < 0:
+			return fmt.Errorf("profile %q: max_duration must not be negative", name)
+		}
+	}
+	return nil
+}
+
+// profileFile is the JSON form of Profiles.
+type profileFile struct {
+	Default  string `json:"default"`
+	Profiles map[string]struct {
+		Height        int    `json:"height"`
+		VideoCodec    string `json:"video_codec"`
+		CRF           int    `json:"crf"`
+		VideoBitrate  int64  `json:"video_bitrate"`
+		AudioCodec    string `json:"audio_codec"`
+		AudioBitrate  int64  `json:"audio_bitrate"`
+		AudioChannels int    `json:"audio_channels"`
+		MaxDuration   string `json:"max_duration"` // e.g. "5m"
+	} `json:"profiles"`
+}
+
+// LoadProfiles reads and validates transcoding profiles from a JSON file.
+func LoadProfiles(path string) (Profiles, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Profiles{}, fmt.Errorf("read profiles: %w", err)
+	}
+	return ParseProfiles(data)
+}
+
+// ParseProfiles decodes and validates transcoding profiles in the JSON
+// format read by LoadProfiles.
+func ParseProfiles(data []byte) (Profiles, error) {
+	var file profileFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return Profiles{}, fmt.Errorf("parse profiles: %w", err)
+	}
+
+	profiles := Profiles{Default: file.Default, ByName: make(map[string]Profile, len(file.Profiles))}
+	for name, p := range file.Profiles {
+		var maxDuration time.Duration
+		if p.MaxDuration != "" {
+			d, err := time.ParseDuration(p.MaxDuration)
+			if err != nil {
+				return Profiles{}, fmt.Errorf("profile %q: invalid max_duration: %w", name, err)
+			}
+			maxDuration = d
+		}
+		profiles.ByName[name] = Profile{
+			Name:          name,
+			Height:        p.Height,
+			VideoCodec:    p.VideoCodec,
+			CRF:           p.CRF,
+			VideoBitrate:  p.VideoBitrate,
+			AudioCodec:    p.AudioCodec,
+			AudioBitrate:  p.AudioBitrate,
+			AudioChannels: p.AudioChannels,
+			MaxDuration:   maxDuration,
+		}
+	}
+	if err := profiles.Validate(); err != nil {
+		return Profiles{}, err
+	}
+	return profiles, nil
+}
+
+// conversationProfile returns the profile new uploads to a conversation are
+// transcoded with: the conversation's own choice if it is still defined,
+// otherwise the server default.
+func (h *Handler) conversationProfile(conversationID string) (Profile, error) {
+	conversation, err := h.DB.GetConversation(conversationID)
+	if err != nil {
+		return Profile{}, err
+	}
+	var name string
+	if conversation != nil {
+		name = conversation.Profile
+	}
+	return h.profile(name), nil
+}
+
+// profile resolves a profile by name, falling back to the server default if
+// it is no longer configured.
+func (h *Handler) profile(name string) Profile {
+	profile, ok := h.Profiles.Resolve(name)
+	if !ok {
+		slog.Warn("unknown transcoding profile, using default", "profile", name, "default", h.Profiles.Default)
+		profile, _ = h.Profiles.Resolve("")
+	}
+	return profile
+}
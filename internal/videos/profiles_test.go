@@ -0,0 +1,126 @@
+package videos_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"waffle-app/internal/storage"
+	"waffle-app/internal/videos"
+	"waffle-app/internal/videos/videotest"
+)
+
+func TestParseProfiles(t *testing.T) {
+	profiles, err := videos.ParseProfiles([]byte(`{
+		"default": "small",
+		"profiles": {
+			"small": {"height": 360, "video_codec": "libx264", "crf": 28, "audio_codec": "aac", "audio_bitrate": 64000, "audio_channels": 1, "max_duration": "2m"},
+			"hevc": {"height": 1080, "video_codec": "libx265", "video_bitrate": 4000000, "audio_codec": "aac"}
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("ParseProfiles: %v", err)
+	}
+
+	small, ok := profiles.Resolve("")
+	if !ok {
+		t.Fatal("expected default profile to resolve")
+	}
+	want := videos.Profile{
+		Name:          "small",
+		Height:        360,
+		VideoCodec:    "libx264",
+		CRF:           28,
+		AudioCodec:    "aac",
+		AudioBitrate:  64000,
+		AudioChannels: 1,
+		MaxDuration:   2 * time.Minute,
+	}
+	if small != want {
+		t.Errorf("expected %+v, got %+v", want, small)
+	}
+	if names := profiles.Names(); len(names) != 2 || names[0] != "hevc" || names[1] != "small" {
+		t.Errorf("unexpected names %v", names)
+	}
+	if _, ok := profiles.Resolve("missing"); ok {
+		t.Error("expected unknown profile not to resolve")
+	}
+}
+
+func TestParseProfiles_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want string
+	}{
+		{"missing default", `{"default": "x", "profiles": {"y": {"height": 720, "video_codec": "libx264", "audio_codec": "aac"}}}`, "default profile"},
+		{"odd height", `{"default": "x", "profiles": {"x": {"height": 721, "video_codec": "libx264", "audio_codec": "aac"}}}`, "height"},
+		{"missing codec", `{"default": "x", "profiles": {"x": {"height": 720, "audio_codec": "aac"}}}`, "video_codec"},
+		{"crf out of range", `{"default": "x", "profiles": {"x": {"height": 720, "video_codec": "libx264", "audio_codec": "aac", "crf": 60}}}`, "crf"},
+		{"bad duration", `{"default": "x", "profiles": {"x": {"height": 720, "video_codec": "libx264", "audio_codec": "aac", "max_duration": "soon"}}}`, "max_duration"},
+		{"no profiles", `{"default": "x"}`, "no transcoding profiles"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := videos.ParseProfiles([]byte(tt.json))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestLifecycle_ConversationProfile(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	setupMember(t, db)
+	if err := db.SetConversationProfile("conv-1", "1080p"); err != nil {
+		t.Fatalf("SetConversationProfile: %v", err)
+	}
+
+	transcoder := &videotest.Transcoder{}
+	h := newPipelineHandler(db, sessions, dir, transcoder)
+
+	videoID := upload(t, h, sessions, "clip.mp4", videotest.MP4("raw footage"))
+
+	// Changing the conversation's profile doesn't affect queued uploads.
+	if err := db.SetConversationProfile("conv-1", "480p"); err != nil {
+		t.Fatalf("SetConversationProfile: %v", err)
+	}
+
+	startWorkers(t, h)
+	waitForJob(t, db, videoID, storage.JobDone)
+
+	calls := transcoder.Calls()
+	if len(calls) != 1 {
+		t.Fatalf("expected 1 transcode call, got %d", len(calls))
+	}
+	if calls[0].Profile != videos.DefaultProfiles.ByName["1080p"] {
+		t.Errorf("expected 1080p profile, got %+v", calls[0].Profile)
+	}
+
+	list := listVideos(t, h, sessions)
+	if list[0]["profile"] != "1080p" {
+		t.Errorf("expected recorded profile 1080p, got %v", list[0]["profile"])
+	}
+}
+
+func TestLifecycle_UnknownProfileFallsBackToDefault(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	setupMember(t, db)
+	if err := db.SetConversationProfile("conv-1", "removed-from-config"); err != nil {
+		t.Fatalf("SetConversationProfile: %v", err)
+	}
+
+	transcoder := &videotest.Transcoder{}
+	h := newPipelineHandler(db, sessions, dir, transcoder)
+
+	videoID := upload(t, h, sessions, "clip.mp4", videotest.MP4("raw footage"))
+	startWorkers(t, h)
+	waitForJob(t, db, videoID, storage.JobDone)
+
+	if calls := transcoder.Calls(); len(calls) != 1 || calls[0].Profile != videos.DefaultProfile {
+		t.Errorf("expected default profile, got %+v", calls)
+	}
+	if list := listVideos(t, h, sessions); list[0]["profile"] != videos.DefaultProfile.Name {
+		t.Errorf("expected recorded profile %s, got %v", videos.DefaultProfile.Name, list[0]["profile"])
+	}
+}
@@ -0,0 +1,263 @@
+package videos
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+	"waffle-app/internal/storage"
+)
+
+const defaultPollInterval = time.Second
+
+// DefaultDrainTimeout is how long running transcoding jobs may take to
+// finish once the workers are asked to stop.
+const DefaultDrainTimeout = 30 * time.Second
+
+// RetryPolicy controls how failed transcoding jobs are retried. The delay
+// before attempt n+1 is Backoff * 2^(n-1).
+type RetryPolicy struct {
+	MaxAttempts int
+	Backoff     time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 3, Backoff: 2 * time.Second}
+
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	return p.Backoff << (attempt - 1)
+}
+
+// RunWorkers processes queued transcoding jobs with n concurrent workers
+// until ctx is cancelled. Jobs left running by a previous process are
+// requeued, or failed if that was their last attempt, before any worker
+// starts.
+//
+// Once ctx is cancelled no new jobs are claimed, and running jobs get
+// DrainTimeout to finish. Jobs still running after that are aborted and
+// requeued without counting the attempt. RunWorkers returns when every
+// worker has stopped.
+func (h *Handler) RunWorkers(ctx context.Context, n int) error {
+	requeued, failed, err := h.DB.RecoverJobs()
+	if err != nil {
+		return err
+	}
+	if requeued > 0 {
+		slog.Warn("requeued interrupted transcoding jobs", "count", requeued)
+	}
+	if failed > 0 {
+		slog.Error("failed interrupted transcoding jobs on their last attempt", "count", failed)
+	}
+
+	// Jobs run under their own context so that they outlive ctx by up to
+	// DrainTimeout.
+	jobCtx, abort := context.WithCancel(context.WithoutCancel(ctx))
+	defer abort()
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stopped:
+			return
+		}
+		timer := time.NewTimer(h.DrainTimeout)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			slog.Warn("transcoding jobs did not finish in time, aborting", "timeout", h.DrainTimeout)
+			abort()
+		case <-stopped:
+		}
+	}()
+
+	slog.Info("starting transcoding workers", "count", n)
+	var claimMu sync.Mutex
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Go(func() { h.worker(ctx, jobCtx, i, &claimMu) })
+	}
+	wg.Wait()
+	close(stopped)
+	slog.Info("transcoding workers stopped")
+	return nil
+}
+
+func (h *Handler) worker(ctx, jobCtx context.Context, id int, claimMu *sync.Mutex) {
+	ticker := time.NewTicker(h.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		// Claims are serialized so that workers don't contend for the
+		// SQLite write lock.
+		claimMu.Lock()
+		job, err := h.DB.ClaimJob(time.Now())
+		claimMu.Unlock()
+		if err != nil {
+			slog.Error("failed to claim transcoding job", "error", err, "worker", id)
+		}
+		if job != nil {
+			h.runJob(jobCtx, job)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-h.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// notifyWorkers wakes an idle worker without blocking.
+func (h *Handler) notifyWorkers() {
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (h *Handler) runJob(ctx context.Context, job *storage.Job) {
+	slog.Info("transcoding attempt",
+		"video_id", job.VideoID,
+		"job_id", job.ID,
+		"attempt", job.Attempts,
+		"max", job.MaxAttempts,
+	)
+
+	// Registered before the video is looked up, so that a concurrent
+	// delete either finds the job to cancel or the video already gone.
+	ctx, done := h.trackJob(ctx, job.VideoID)
+	defer done()
+
+	profile := h.profile("")
+	video, err := h.DB.GetVideo(job.VideoID)
+	if err != nil {
+		slog.Error("failed to get video, using default profile", "error", err, "video_id", job.VideoID)
+	} else if video == nil {
+		slog.Info("video deleted, dropping transcoding job", "video_id", job.VideoID, "job_id", job.ID)
+		return
+	} else {
+		profile = h.profile(video.Profile)
+	}
+
+	err = h.processJob(ctx, job, profile)
+	if err == nil {
+		// Delete original only on success
+		slog.Info("deleting original file", "key", job.InputKey)
+		if err := h.Blobs.Delete(ctx, job.InputKey); err != nil {
+			slog.Error("failed to delete original file", "error", err, "key", job.InputKey)
+		} else {
+			slog.Info("original file deleted", "key", job.InputKey)
+		}
+
+		if video != nil {
+			if err := h.DB.SetVideoStoredBytes(job.VideoID, h.diskUsage(video)); err != nil {
+				slog.Error("failed to record video disk usage", "error", err, "video_id", job.VideoID)
+			}
+		}
+
+		if err := h.DB.UpdateVideoStatus(job.VideoID, "ready"); err != nil {
+			slog.Error("failed to update video status to ready", "error", err, "video_id", job.VideoID)
+		}
+		if err := h.DB.CompleteJob(job.ID); err != nil {
+			slog.Error("failed to complete transcoding job", "error", err, "job_id", job.ID)
+		}
+		return
+	}
+
+	if context.Cause(ctx) == errVideoDeleted {
+		slog.Info("transcoding cancelled, video deleted", "video_id", job.VideoID)
+		return
+	}
+	if ctx.Err() != nil {
+		slog.Warn("transcoding interrupted by shutdown, requeueing",
+			"video_id", job.VideoID,
+			"attempt", job.Attempts,
+		)
+		if err := h.DB.ReleaseJob(job.ID); err != nil {
+			slog.Error("failed to requeue interrupted transcoding job", "error", err, "job_id", job.ID)
+		}
+		return
+	}
+
+	if job.Attempts < job.MaxAttempts {
+		delay := h.Retry.delay(job.Attempts)
+		slog.Warn("transcoding attempt failed, retrying",
+			"video_id", job.VideoID,
+			"attempt", job.Attempts,
+			"delay", delay,
+			"error", err,
+		)
+		if err := h.DB.RetryJob(job.ID, err.Error(), time.Now().Add(delay)); err != nil {
+			slog.Error("failed to requeue transcoding job", "error", err, "job_id", job.ID)
+		}
+		return
+	}
+
+	slog.Error("transcoding failed after all retries, original file retained",
+		"video_id", job.VideoID,
+		"input", job.InputKey,
+		"error", err,
+	)
+	if err := h.DB.FailJob(job.ID, err.Error()); err != nil {
+		slog.Error("failed to mark transcoding job failed", "error", err, "job_id", job.ID)
+	}
+	if err := h.DB.SetVideoFailure(job.VideoID, "error", err.Error()); err != nil {
+		slog.Error("failed to update video status to error", "error", err, "video_id", job.VideoID)
+	}
+}
+
+// processJob fetches a job's original into a scratch directory, transcodes
+// it there and stores the MP4, its thumbnails and its HLS ladder. Only
+// failing to produce the MP4 is an error; the other assets are optional.
+func (h *Handler) processJob(ctx context.Context, job *storage.Job, profile Profile) error {
+	if err := os.MkdirAll(h.scratchDir(), 0755); err != nil {
+		return fmt.Errorf("create scratch directory: %w", err)
+	}
+	work, err := os.MkdirTemp(h.scratchDir(), job.VideoID+"-")
+	if err != nil {
+		return fmt.Errorf("create scratch directory: %w", err)
+	}
+	defer os.RemoveAll(work)
+
+	inputPath := filepath.Join(work, path.Base(job.InputKey))
+	if err := h.fetchBlob(ctx, job.InputKey, inputPath); err != nil {
+		return fmt.Errorf("fetch original: %w", err)
+	}
+
+	original, err := h.Prober.Probe(ctx, inputPath)
+	if err != nil {
+		slog.Warn("failed to probe original file", "error", err, "video_id", job.VideoID)
+	}
+
+	outputPath := filepath.Join(work, path.Base(job.OutputKey))
+	result, err := h.Transcoder.Transcode(ctx, inputPath, outputPath, profile)
+	if err != nil {
+		return err
+	}
+	slog.Info("transcoding succeeded",
+		"video_id", job.VideoID,
+		"attempt", job.Attempts,
+		"size", result.Size,
+		"elapsed", result.Elapsed,
+	)
+	if err := h.putFile(ctx, job.OutputKey, outputPath); err != nil {
+		return fmt.Errorf("store transcoded video: %w", err)
+	}
+
+	info := h.recordMetadata(ctx, job.VideoID, outputPath, original)
+	poster, preview := h.generateThumbnails(ctx, job.VideoID, outputPath, job.OutputKey)
+	if err := h.DB.SetVideoThumbnails(job.VideoID, poster, preview); err != nil {
+		slog.Error("failed to record video thumbnails", "error", err, "video_id", job.VideoID)
+	}
+	h.generateHLS(ctx, job.VideoID, outputPath, job.OutputKey, info)
+	return nil
+}
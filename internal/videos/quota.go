@@ -0,0 +1,74 @@
+package videos
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// requireQuota checks that storing size more bytes for an upload to the
+// conversation keeps both it and the uploader within their quotas. If not,
+// it responds with 413 Request Entity Too Large and returns false.
+func (h *Handler) requireQuota(w http.ResponseWriter, conversationID, uploader string, size int64) bool {
+	reason, err := h.quotaExceeded(conversationID, uploader, size)
+	if err != nil {
+		slog.Error("failed to check storage quota", "error", err, "conversation_id", conversationID, "username", uploader)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return false
+	}
+	if reason != "" {
+		slog.Warn("upload refused, storage quota exceeded", "conversation_id", conversationID, "username", uploader, "size", size, "reason", reason)
+		http.Error(w, reason, http.StatusRequestEntityTooLarge)
+		return false
+	}
+	return true
+}
+
+// quotaExceeded returns why storing size more bytes would exceed the
+// conversation's or the uploader's quota, or "" if it fits. A quota that is
+// already used up is exceeded whatever the size.
+func (h *Handler) quotaExceeded(conversationID, uploader string, size int64) (string, error) {
+	if h.ConversationQuota > 0 {
+		used, _, err := h.DB.GetConversationUsage(conversationID)
+		if err != nil {
+			return "", err
+		}
+		if used >= h.ConversationQuota || used+size > h.ConversationQuota {
+			return quotaMessage("conversation", used, h.ConversationQuota, size), nil
+		}
+	}
+	if h.UserQuota > 0 {
+		used, err := h.DB.GetUploaderUsage(uploader)
+		if err != nil {
+			return "", err
+		}
+		if used >= h.UserQuota || used+size > h.UserQuota {
+			return quotaMessage("your", used, h.UserQuota, size), nil
+		}
+	}
+	return "", nil
+}
+
+func quotaMessage(whose string, used, quota, size int64) string {
+	msg := fmt.Sprintf("%s storage quota exceeded: %s of %s used", whose, formatBytes(used), formatBytes(quota))
+	if size > 0 {
+		msg += fmt.Sprintf(", upload is %s", formatBytes(size))
+	}
+	return msg
+}
+
+// formatBytes renders n in the largest binary unit it fills, e.g. "1.5 GB".
+func formatBytes(n int64) string {
+	const unit = 1 << 10
+	if n < unit {
+		return fmt.Sprintf("%d bytes", n)
+	}
+	value, suffix := float64(n)/unit, "KB"
+	for _, s := range []string{"MB", "GB", "TB"} {
+		if value < unit {
+			break
+		}
+		value, suffix = value/unit, s
+	}
+	return fmt.Sprintf("%.1f %s", value, suffix)
+}
@@ -0,0 +1,141 @@
+package videos_test
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"waffle-app/internal/storage"
+	"waffle-app/internal/videos/videotest"
+)
+
+// fillQuota records an existing video of n bytes uploaded by alice.
+func fillQuota(t *testing.T, db *storage.DB, n int64) {
+	t.Helper()
+	err := db.CreateVideo(&storage.Video{ID: "existing", ConversationID: "conv-1", Uploader: "alice", Filename: "existing.mp4", StoredBytes: n})
+	if err != nil {
+		t.Fatalf("CreateVideo: %v", err)
+	}
+}
+
+func TestUpload_QuotaExceeded(t *testing.T) {
+	content := videotest.MP4(strings.Repeat("frame", 100))
+	size := int64(len(content))
+
+	tests := []struct {
+		name              string
+		conversationQuota int64
+		userQuota         int64
+		used              int64
+		want              string
+	}{
+		{"conversation", 1000 + size - 1, 0, 1000, "conversation storage quota exceeded"},
+		{"user", 0, 1000 + size - 1, 1000, "your storage quota exceeded"},
+		{"already full", 1000, 0, 1000, "conversation storage quota exceeded: 1000 bytes of 1000 bytes used"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, sessions, dir := setupTest(t)
+			setupMember(t, db)
+			fillQuota(t, db, tt.used)
+
+			h := newTestHandler(db, sessions, dir)
+			h.ConversationQuota = tt.conversationQuota
+			h.UserQuota = tt.userQuota
+
+			body := &bytes.Buffer{}
+			writer := multipart.NewWriter(body)
+			writer.WriteField("conversation_id", "conv-1")
+			part, _ := writer.CreateFormFile("file", "clip.mp4")
+			part.Write(content)
+			writer.Close()
+			req := authenticatedRequest(t, sessions, "POST", "/api/upload", body, writer.FormDataContentType())
+			rr := httptest.NewRecorder()
+			h.Upload(rr, req)
+
+			if rr.Code != http.StatusRequestEntityTooLarge {
+				t.Fatalf("expected 413, got %d: %s", rr.Code, rr.Body.String())
+			}
+			if !strings.Contains(rr.Body.String(), tt.want) {
+				t.Errorf("expected message containing %q, got %q", tt.want, rr.Body.String())
+			}
+			if entries, _ := os.ReadDir(filepath.Join(dir, "conv-1")); len(entries) != 0 {
+				t.Errorf("expected original to be removed, found %d files", len(entries))
+			}
+			if list := listVideos(t, h, sessions); len(list) != 1 {
+				t.Errorf("expected only the existing video, got %v", list)
+			}
+		})
+	}
+}
+
+func TestUpload_WithinQuota(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	setupMember(t, db)
+	fillQuota(t, db, 1000)
+
+	content := videotest.MP4(strings.Repeat("frame", 100))
+	h := newTestHandler(db, sessions, dir)
+	h.ConversationQuota = 1000 + int64(len(content))
+	h.UserQuota = 1000 + int64(len(content))
+	videoID := upload(t, h, sessions, "clip.mp4", content)
+
+	video, err := db.GetVideo(videoID)
+	if err != nil || video == nil {
+		t.Fatalf("GetVideo: %+v, %v", video, err)
+	}
+	if video.StoredBytes != int64(len(content)) {
+		t.Errorf("expected %d stored bytes for the original, got %d", len(content), video.StoredBytes)
+	}
+}
+
+func TestCreateUpload_QuotaExceeded(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	setupMember(t, db)
+	fillQuota(t, db, 1000)
+
+	h := newTestHandler(db, sessions, dir)
+	h.UserQuota = 2000
+	createTusUpload(t, h, sessions, 1000)
+
+	req := tusRequest(t, sessions, "POST", "/api/uploads", nil)
+	req.Header.Set("Upload-Length", strconv.Itoa(1001))
+	req.Header.Set("Upload-Metadata", "conversation_id Y29udi0x")
+	rr := httptest.NewRecorder()
+	h.CreateUpload(rr, req)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if !strings.Contains(rr.Body.String(), "upload is 1001 bytes") {
+		t.Errorf("expected the upload size in the message, got %q", rr.Body.String())
+	}
+}
+
+func TestLifecycle_RecordsStoredBytes(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	setupMember(t, db)
+
+	h := newPipelineHandler(db, sessions, dir, &videotest.Transcoder{})
+	videoID := upload(t, h, sessions, "clip.mp4", videotest.MP4(strings.Repeat("frame", 100)))
+	startWorkers(t, h)
+	waitForJob(t, db, videoID, storage.JobDone)
+
+	video, err := db.GetVideo(videoID)
+	if err != nil || video == nil {
+		t.Fatalf("GetVideo: %+v, %v", video, err)
+	}
+	var want int64
+	for _, path := range []string{video.Filename, video.PosterFilename, video.PreviewFilename} {
+		if info, err := os.Stat(filepath.Join(dir, path)); err == nil {
+			want += info.Size()
+		}
+	}
+	if video.StoredBytes != want {
+		t.Errorf("expected %d stored bytes for the transcoded files, got %d", want, video.StoredBytes)
+	}
+}
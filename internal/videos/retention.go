@@ -0,0 +1,151 @@
+package videos
+
+import (
+	"context"
+	"log/slog"
+	"time"
+	"waffle-app/internal/storage"
+)
+
+// Reasons a retention policy expires a video.
+const (
+	ExpiredAge   = "age"
+	ExpiredCount = "count"
+	ExpiredQuota = "quota"
+)
+
+// Expiry is a video removed, or that would be removed, by its
+// conversation's retention policy.
+type Expiry struct {
+	VideoID        string
+	ConversationID string
+	Uploader       string
+	UploadedAt     time.Time
+	Bytes          int64  // disk space used by the video's files
+	Reason         string // ExpiredAge, ExpiredCount or ExpiredQuota
+}
+
+// RejectedVideoExpiry is how long the record of a rejected upload is kept,
+// so that its uploader can see why it was rejected.
+const RejectedVideoExpiry = 24 * time.Hour
+
+// RunRetentionJanitor applies every conversation's retention policy each
+// interval until ctx is cancelled. It also removes the records of uploads
+// rejected more than RejectedVideoExpiry ago.
+func (h *Handler) RunRetentionJanitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if n, err := h.DB.DeleteRejectedVideos(time.Now().Add(-RejectedVideoExpiry)); err != nil {
+				slog.Error("failed to remove rejected uploads", "error", err)
+			} else if n > 0 {
+				slog.Info("removed rejected uploads", "count", n)
+			}
+			expired, err := h.ApplyRetention(time.Now(), false)
+			if err != nil {
+				slog.Error("failed to apply retention policies", "error", err)
+				continue
+			}
+			if len(expired) > 0 {
+				slog.Info("expired videos past retention", "count", len(expired))
+			}
+		}
+	}
+}
+
+// ApplyRetention deletes the videos that fall outside their conversation's
+// retention policy as of now and returns them. If dryRun is set nothing is
+// deleted, and the videos that would be are returned.
+func (h *Handler) ApplyRetention(now time.Time, dryRun bool) ([]Expiry, error) {
+	conversations, err := h.DB.GetConversationsWithRetention()
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []Expiry
+	for _, c := range conversations {
+		videos, err := h.DB.GetVideosByConversation(c.ID)
+		if err != nil {
+			return expired, err
+		}
+		byID := make(map[string]*storage.Video, len(videos))
+		for i := range videos {
+			byID[videos[i].ID] = &videos[i]
+		}
+		for _, e := range expiredVideos(c.Retention, videos, h.diskUsage, now) {
+			if !dryRun {
+				if err := h.deleteVideo(byID[e.VideoID]); err != nil {
+					slog.Error("failed to delete expired video", "error", err, "video_id", e.VideoID)
+					continue
+				}
+				slog.Info("video expired", "video_id", e.VideoID, "conversation_id", e.ConversationID, "reason", e.Reason, "bytes", e.Bytes)
+			}
+			expired = append(expired, e)
+		}
+	}
+	return expired, nil
+}
+
+// expiredVideos applies a retention policy to a conversation's videos,
+// ordered newest first. Videos are kept until the first one outside a
+// limit; it and every older video expire. Rejected uploads don't count
+// towards the limits, and expire by RejectedVideoExpiry instead.
+func expiredVideos(policy storage.Retention, videos []storage.Video, usage func(*storage.Video) int64, now time.Time) []Expiry {
+	if policy.Unlimited() {
+		return nil
+	}
+	cutoff := now.AddDate(0, 0, -7*policy.Weeks)
+
+	var expired []Expiry
+	var total int64
+	kept := 0
+	reason := ""
+	for i := range videos {
+		v := &videos[i]
+		if v.Status == "rejected" {
+			continue
+		}
+		size := usage(v)
+		if reason == "" {
+			switch {
+			case policy.Weeks > 0 && v.UploadedAt.Before(cutoff):
+				reason = ExpiredAge
+			case policy.Videos > 0 && kept >= policy.Videos:
+				reason = ExpiredCount
+			case policy.Bytes > 0 && total+size > policy.Bytes:
+				reason = ExpiredQuota
+			}
+		}
+		if reason == "" {
+			total += size
+			kept++
+			continue
+		}
+		expired = append(expired, Expiry{
+			VideoID:        v.ID,
+			ConversationID: v.ConversationID,
+			Uploader:       v.Uploader,
+			UploadedAt:     v.UploadedAt,
+			Bytes:          size,
+			Reason:         reason,
+		})
+	}
+	return expired
+}
+
+// diskUsage returns the bytes used by every file of a video.
+func (h *Handler) diskUsage(video *storage.Video) int64 {
+	blobs, err := h.videoBlobs(context.Background(), video)
+	if err != nil {
+		slog.Warn("failed to list video files", "error", err, "video_id", video.ID)
+	}
+	var total int64
+	for _, b := range blobs {
+		total += b.Size
+	}
+	return total
+}
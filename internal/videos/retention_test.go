@@ -0,0 +1,144 @@
+package videos_test
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+	"waffle-app/internal/storage"
+	"waffle-app/internal/videos"
+)
+
+// setupRetention creates four 10-byte videos uploaded 1, 8, 15 and 22 days
+// before now, newest first.
+func setupRetention(t *testing.T, db *storage.DB, dir string, now time.Time) []string {
+	t.Helper()
+	setupMember(t, db)
+	ids := []string{"vid-1", "vid-2", "vid-3", "vid-4"}
+	for i, id := range ids {
+		createVideoFile(t, db, dir, id, "ready", []byte("0123456789"))
+		uploadedAt := now.AddDate(0, 0, -1-7*i).UTC().Format(time.DateTime)
+		if _, err := db.Exec(`UPDATE videos SET uploaded_at = ? WHERE id = ?`, uploadedAt, id); err != nil {
+			t.Fatalf("set uploaded_at: %v", err)
+		}
+	}
+	return ids
+}
+
+func TestApplyRetention(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  storage.Retention
+		expired []string
+		reason  string
+	}{
+		{"unlimited", storage.Retention{}, nil, ""},
+		{"age", storage.Retention{Weeks: 2}, []string{"vid-3", "vid-4"}, videos.ExpiredAge},
+		{"count", storage.Retention{Videos: 1}, []string{"vid-2", "vid-3", "vid-4"}, videos.ExpiredCount},
+		{"quota", storage.Retention{Bytes: 25}, []string{"vid-3", "vid-4"}, videos.ExpiredQuota},
+		{"first limit wins", storage.Retention{Weeks: 3, Videos: 2}, []string{"vid-3", "vid-4"}, videos.ExpiredCount},
+		{"within limits", storage.Retention{Weeks: 4, Videos: 4, Bytes: 40}, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, sessions, dir := setupTest(t)
+			now := time.Now()
+			ids := setupRetention(t, db, dir, now)
+			if err := db.SetConversationRetention("conv-1", tt.policy); err != nil {
+				t.Fatalf("SetConversationRetention: %v", err)
+			}
+
+			h := newTestHandler(db, sessions, dir)
+			expired, err := h.ApplyRetention(now, false)
+			if err != nil {
+				t.Fatalf("ApplyRetention: %v", err)
+			}
+
+			var got []string
+			for _, e := range expired {
+				got = append(got, e.VideoID)
+				if e.Reason != tt.reason {
+					t.Errorf("%s: expected reason %q, got %q", e.VideoID, tt.reason, e.Reason)
+				}
+				if e.Bytes != 10 {
+					t.Errorf("%s: expected 10 bytes, got %d", e.VideoID, e.Bytes)
+				}
+			}
+			if !slices.Equal(got, tt.expired) {
+				t.Fatalf("expected %v to expire, got %v", tt.expired, got)
+			}
+
+			for _, id := range ids {
+				video, err := db.GetVideo(id)
+				if err != nil {
+					t.Fatalf("GetVideo: %v", err)
+				}
+				_, statErr := os.Stat(filepath.Join(dir, "conv-1", id+".mp4"))
+				if slices.Contains(tt.expired, id) {
+					if video != nil || !os.IsNotExist(statErr) {
+						t.Errorf("%s: expected row and file to be deleted", id)
+					}
+				} else if video == nil || statErr != nil {
+					t.Errorf("%s: expected row and file to be kept, got %+v, %v", id, video, statErr)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyRetention_IgnoresRejectedUploads(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	now := time.Now()
+	setupRetention(t, db, dir, now)
+	if err := db.CreateRejectedVideo("bad-1", "conv-1", "alice", "unsupported media type"); err != nil {
+		t.Fatalf("CreateRejectedVideo: %v", err)
+	}
+	if err := db.SetConversationRetention("conv-1", storage.Retention{Videos: 2}); err != nil {
+		t.Fatalf("SetConversationRetention: %v", err)
+	}
+
+	// The rejected upload is newest, but doesn't push vid-2 out
+	h := newTestHandler(db, sessions, dir)
+	expired, err := h.ApplyRetention(now, false)
+	if err != nil {
+		t.Fatalf("ApplyRetention: %v", err)
+	}
+	var got []string
+	for _, e := range expired {
+		got = append(got, e.VideoID)
+	}
+	if want := []string{"vid-3", "vid-4"}; !slices.Equal(got, want) {
+		t.Errorf("expected %v to expire, got %v", want, got)
+	}
+}
+
+func TestApplyRetention_DryRunDeletesNothing(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	now := time.Now()
+	ids := setupRetention(t, db, dir, now)
+	if err := db.SetConversationRetention("conv-1", storage.Retention{Videos: 1}); err != nil {
+		t.Fatalf("SetConversationRetention: %v", err)
+	}
+
+	h := newTestHandler(db, sessions, dir)
+	expired, err := h.ApplyRetention(now, true)
+	if err != nil {
+		t.Fatalf("ApplyRetention: %v", err)
+	}
+	if len(expired) != 3 {
+		t.Fatalf("expected 3 videos in the report, got %+v", expired)
+	}
+	if e := expired[0]; e.ConversationID != "conv-1" || e.Uploader != "alice" || e.UploadedAt.IsZero() {
+		t.Errorf("expected report to describe the video, got %+v", e)
+	}
+
+	for _, id := range ids {
+		if video, _ := db.GetVideo(id); video == nil {
+			t.Errorf("%s: expected row to be kept", id)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "conv-1", id+".mp4")); err != nil {
+			t.Errorf("%s: expected file to be kept: %v", id, err)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package videos
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// sniffLen is how many leading bytes of an upload are inspected to detect
+// its container. It matches what http.DetectContentType considers.
+const sniffLen = 512
+
+// container is a video container format accepted for upload.
+type container struct {
+	ext      string
+	mimeType string
+}
+
+var (
+	containerMP4       = container{ext: ".mp4", mimeType: "video/mp4"}
+	containerQuickTime = container{ext: ".mov", mimeType: "video/quicktime"}
+	containerAVI       = container{ext: ".avi", mimeType: "video/x-msvideo"}
+	containerMatroska  = container{ext: ".mkv", mimeType: "video/x-matroska"}
+	containerWebM      = container{ext: ".webm", mimeType: "video/webm"}
+)
+
+// quickTimeAtoms are top-level atom types that may start a QuickTime file
+// that has no ftyp atom.
+var quickTimeAtoms = [][]byte{
+	[]byte("moov"), []byte("mdat"), []byte("wide"), []byte("free"), []byte("skip"), []byte("pnot"),
+}
+
+// mp4Brands are ftyp major brands of MP4 video. Other ISO base media files,
+// such as HEIF and AVIF images, share the ftyp box.
+var mp4Brands = []string{"isom", "iso2", "iso3", "iso4", "iso5", "iso6", "mp41", "mp42", "avc1", "dash", "M4V "}
+
+// imageBrands maps the ftyp major brands of still image formats to their
+// MIME types.
+var imageBrands = map[string]string{
+	"heic": "image/heic", "heix": "image/heic", "heim": "image/heic", "heis": "image/heic",
+	"mif1": "image/heif", "msf1": "image/heif", "heif": "image/heif",
+	"avif": "image/avif", "avis": "image/avif",
+}
+
+// detectBrand identifies an ISO base media file by its ftyp major brand.
+func detectBrand(brand string) (container, string, bool) {
+	switch {
+	case brand == "qt  ":
+		return containerQuickTime, containerQuickTime.mimeType, true
+	case slices.Contains(mp4Brands, brand), strings.HasPrefix(brand, "3gp"):
+		return containerMP4, containerMP4.mimeType, true
+	}
+	if mimeType, ok := imageBrands[brand]; ok {
+		return container{}, mimeType, false
+	}
+	return container{}, fmt.Sprintf("ISO media with brand %q", brand), false
+}
+
+// detectContainer identifies the video container from the leading bytes of
+// a file by its magic numbers. If the container is not supported, it
+// returns false and the MIME type the content appears to be instead.
+func detectContainer(header []byte) (container, string, bool) {
+	if len(header) >= 12 {
+		boxType := header[4:8]
+		if bytes.Equal(boxType, []byte("ftyp")) {
+			return detectBrand(string(header[8:12]))
+		}
+		for _, atom := range quickTimeAtoms {
+			if bytes.Equal(boxType, atom) {
+				return containerQuickTime, containerQuickTime.mimeType, true
+			}
+		}
+		if bytes.Equal(header[0:4], []byte("RIFF")) && bytes.Equal(header[8:12], []byte("AVI ")) {
+			return containerAVI, containerAVI.mimeType, true
+		}
+	}
+	if bytes.HasPrefix(header, []byte{0x1A, 0x45, 0xDF, 0xA3}) {
+		// The EBML header's DocType distinguishes WebM from Matroska.
+		if bytes.Contains(header, []byte("webm")) {
+			return containerWebM, containerWebM.mimeType, true
+		}
+		return containerMatroska, containerMatroska.mimeType, true
+	}
+	return container{}, http.DetectContentType(header), false
+}
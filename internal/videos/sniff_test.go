@@ -0,0 +1,58 @@
+package videos
+
+import "testing"
+
+func TestDetectContainer(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		want   string
+		ok     bool
+	}{
+		{"mp4", []byte("\x00\x00\x00\x20ftypisom\x00\x00\x02\x00isomiso2"), ".mp4", true},
+		{"mp4 mp42", []byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom"), ".mp4", true},
+		{"3gp", []byte("\x00\x00\x00\x14ftyp3gp5\x00\x00\x02\x003gp5"), ".mp4", true},
+		{"mov ftyp", []byte("\x00\x00\x00\x14ftypqt  \x00\x00\x00\x00"), ".mov", true},
+		{"mov moov", []byte("\x00\x00\x01\x00moov\x00\x00\x00\x6cmvhd"), ".mov", true},
+		{"avi", []byte("RIFF\x24\x00\x00\x00AVI LIST"), ".avi", true},
+		{"mkv", []byte("\x1a\x45\xdf\xa3\x9f\x42\x86\x81\x01\x42\x82\x88matroska"), ".mkv", true},
+		{"webm", []byte("\x1a\x45\xdf\xa3\x9f\x42\x86\x81\x01\x42\x82\x84webm"), ".webm", true},
+		{"heic", []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic"), "", false},
+		{"avif", []byte("\x00\x00\x00\x1cftypavif\x00\x00\x00\x00avifmif1miaf"), "", false},
+		{"m4a", []byte("\x00\x00\x00\x1cftypM4A \x00\x00\x00\x00M4A isom"), "", false},
+		{"text", []byte("just some text pretending to be a video"), "", false},
+		{"png", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), "", false},
+		{"wav", []byte("RIFF\x24\x00\x00\x00WAVEfmt "), "", false},
+		{"short", []byte("ftyp"), "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, detected, ok := detectContainer(tt.header)
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v (detected %q)", ok, tt.ok, detected)
+			}
+			if c.ext != tt.want {
+				t.Errorf("ext = %q, want %q", c.ext, tt.want)
+			}
+			if detected == "" {
+				t.Error("expected a detected type")
+			}
+		})
+	}
+}
+
+func TestDetectContainer_ReportsBrand(t *testing.T) {
+	tests := []struct {
+		header []byte
+		want   string
+	}{
+		{[]byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic"), "image/heic"},
+		{[]byte("\x00\x00\x00\x1cftypavif\x00\x00\x00\x00avifmif1miaf"), "image/avif"},
+		{[]byte("\x00\x00\x00\x1cftypM4A \x00\x00\x00\x00M4A isom"), `ISO media with brand "M4A "`},
+	}
+	for _, tt := range tests {
+		if _, detected, _ := detectContainer(tt.header); detected != tt.want {
+			t.Errorf("%q: detected %q, want %q", tt.header[8:12], detected, tt.want)
+		}
+	}
+}
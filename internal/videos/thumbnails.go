@@ -0,0 +1,91 @@
+package videos
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"strings"
+)
+
+const (
+	posterWidth     = 480
+	previewWidth    = 320
+	previewDuration = "3" // seconds
+	previewFPS      = 10
+)
+
+// Thumbnailer generates still and animated previews of a transcoded video.
+type Thumbnailer interface {
+	// Poster writes a representative JPEG frame of the video to outputPath.
+	Poster(ctx context.Context, videoPath, outputPath string) error
+	// Preview writes a short looping animated WebP of the video to outputPath.
+	Preview(ctx context.Context, videoPath, outputPath string) error
+}
+
+var _ Thumbnailer = (*FFmpeg)(nil)
+
+func (f *FFmpeg) Poster(ctx context.Context, videoPath, outputPath string) error {
+	return f.run(ctx,
+		"-i", videoPath,
+		"-vf", fmt.Sprintf("thumbnail,scale=%d:-2", posterWidth),
+		"-frames:v", "1",
+		"-q:v", "3",
+		"-y",
+		outputPath,
+	)
+}
+
+func (f *FFmpeg) Preview(ctx context.Context, videoPath, outputPath string) error {
+	return f.run(ctx,
+		"-t", previewDuration,
+		"-i", videoPath,
+		"-vf", fmt.Sprintf("fps=%d,scale=%d:-2", previewFPS, previewWidth),
+		"-an",
+		"-c:v", "libwebp",
+		"-loop", "0",
+		"-quality", "60",
+		"-y",
+		outputPath,
+	)
+}
+
+func (f *FFmpeg) run(ctx context.Context, args ...string) error {
+	output, err := exec.CommandContext(ctx, f.binary(), args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ffmpeg: %w: %s", err, tail(output, maxErrorOutput))
+	}
+	return nil
+}
+
+// posterPath and previewPath derive the thumbnail locations from the
+// transcoded video's path or key, so they are stored next to the MP4.
+func posterPath(videoPath string) string {
+	return strings.TrimSuffix(videoPath, ".mp4") + ".jpg"
+}
+
+func previewPath(videoPath string) string {
+	return strings.TrimSuffix(videoPath, ".mp4") + ".webp"
+}
+
+// generateThumbnails creates the poster and preview for a transcoded video
+// at videoPath and stores them next to videoKey. Failures are not fatal to
+// the video: the returned key is empty for any asset that could not be
+// generated or stored.
+func (h *Handler) generateThumbnails(ctx context.Context, videoID, videoPath, videoKey string) (poster, preview string) {
+	if err := h.Thumbnailer.Poster(ctx, videoPath, posterPath(videoPath)); err != nil {
+		slog.Warn("failed to generate poster", "error", err, "video_id", videoID)
+	} else if err := h.putFile(ctx, posterPath(videoKey), posterPath(videoPath)); err != nil {
+		slog.Warn("failed to store poster", "error", err, "video_id", videoID)
+	} else {
+		poster = posterPath(videoKey)
+	}
+	if err := h.Thumbnailer.Preview(ctx, videoPath, previewPath(videoPath)); err != nil {
+		slog.Warn("failed to generate preview", "error", err, "video_id", videoID)
+	} else if err := h.putFile(ctx, previewPath(videoKey), previewPath(videoPath)); err != nil {
+		slog.Warn("failed to store preview", "error", err, "video_id", videoID)
+	} else {
+		preview = previewPath(videoKey)
+	}
+	return poster, preview
+}
@@ -0,0 +1,108 @@
+package videos
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// maxErrorOutput caps how much ffmpeg output is kept in a job's last error.
+const maxErrorOutput = 2048
+
+// Profile describes the encoding settings for a transcode.
+type Profile struct {
+	Name          string
+	Height        int
+	VideoCodec    string
+	CRF           int   // constant quality; 0 leaves it to the codec
+	VideoBitrate  int64 // bits per second; 0 leaves it to the codec
+	AudioCodec    string
+	AudioBitrate  int64         // bits per second; 0 leaves it to the codec
+	AudioChannels int           // 0 keeps the source's channels
+	MaxDuration   time.Duration // output is cut at this length; 0 means no limit
+}
+
+var DefaultProfile = Profile{
+	Name:         "720p",
+	Height:       720,
+	VideoCodec:   "libx264",
+	CRF:          23,
+	AudioCodec:   "aac",
+	AudioBitrate: 128_000,
+}
+
+// Result describes a successful transcode.
+type Result struct {
+	Size    int64 // output file size in bytes
+	Elapsed time.Duration
+}
+
+// Transcoder converts the video at inputPath into a playable MP4 at
+// outputPath using the given profile.
+type Transcoder interface {
+	Transcode(ctx context.Context, inputPath, outputPath string, profile Profile) (*Result, error)
+}
+
+// FFmpeg transcodes using the system ffmpeg binary.
+type FFmpeg struct {
+	// Path is the ffmpeg binary to run. Defaults to "ffmpeg" on PATH.
+	Path string
+}
+
+var _ Transcoder = (*FFmpeg)(nil)
+
+func (f *FFmpeg) Transcode(ctx context.Context, inputPath, outputPath string, profile Profile) (*Result, error) {
+	start := time.Now()
+	args := []string{"-i", inputPath}
+	if profile.MaxDuration > 0 {
+		args = append(args, "-t", strconv.FormatFloat(profile.MaxDuration.Seconds(), 'f', -1, 64))
+	}
+	args = append(args,
+		"-vf", "scale=-2:"+strconv.Itoa(profile.Height),
+		"-c:v", profile.VideoCodec,
+	)
+	if profile.CRF > 0 {
+		args = append(args, "-crf", strconv.Itoa(profile.CRF))
+	}
+	if profile.VideoBitrate > 0 {
+		args = append(args, "-b:v", strconv.FormatInt(profile.VideoBitrate, 10))
+	}
+	args = append(args, "-c:a", profile.AudioCodec)
+	if profile.AudioBitrate > 0 {
+		args = append(args, "-b:a", strconv.FormatInt(profile.AudioBitrate, 10))
+	}
+	if profile.AudioChannels > 0 {
+		args = append(args, "-ac", strconv.Itoa(profile.AudioChannels))
+	}
+	args = append(args,
+		"-y", // overwrite output if exists
+		outputPath,
+	)
+
+	if err := f.run(ctx, args...); err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(outputPath)
+	if err != nil {
+		return nil, fmt.Errorf("stat transcoded file: %w", err)
+	}
+	return &Result{Size: info.Size(), Elapsed: time.Since(start)}, nil
+}
+
+func (f *FFmpeg) binary() string {
+	if f.Path != "" {
+		return f.Path
+	}
+	return "ffmpeg"
+}
+
+// tail returns at most the last n bytes of b.
+func tail(b []byte, n int) []byte {
+	if len(b) > n {
+		return b[len(b)-n:]
+	}
+	return b
+}
@@ -0,0 +1,514 @@
+package videos
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"waffle-app/internal/auth"
+	"waffle-app/internal/storage"
+)
+
+// Resumable uploads implement the core tus 1.0.0 protocol
+// (https://tus.io/protocols/resumable-upload) with the creation, expiration
+// and termination extensions. Partial files are kept in a hidden directory
+// under VideosDir until the last byte arrives, at which point the file is
+// handed to the same validation and transcoding pipeline as Upload.
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration,termination"
+
+	// DefaultUploadExpiry is how long an upload may sit idle before it is
+	// discarded. Every PATCH extends it.
+	DefaultUploadExpiry = 24 * time.Hour
+
+	uploadsDirName = ".uploads"
+)
+
+// OPTIONS /api/uploads
+func (h *Handler) UploadOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(h.MaxUploadSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /api/uploads
+// Headers: Upload-Length, Upload-Metadata (conversation_id, filename)
+func (h *Handler) CreateUpload(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireSession(w, r)
+	if !ok {
+		return
+	}
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		http.Error(w, "a positive Upload-Length is required", http.StatusBadRequest)
+		return
+	}
+	if length > h.MaxUploadSize {
+		http.Error(w, "upload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, "malformed Upload-Metadata", http.StatusBadRequest)
+		return
+	}
+	conversationID := metadata["conversation_id"]
+	if conversationID == "" {
+		http.Error(w, "'conversation_id' metadata is required", http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := auth.RequireRole(w, h.DB, session, conversationID, storage.RoleMember); !ok {
+		return
+	}
+	if !h.requireQuota(w, conversationID, session.Username, length) {
+		return
+	}
+
+	// The upload id becomes the video id once the upload completes.
+	uploadID, err := generateID()
+	if err != nil {
+		slog.Error("failed to generate upload id", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := os.MkdirAll(h.uploadsDir(), 0755); err != nil {
+		slog.Error("failed to create uploads directory", "error", err, "dir", h.uploadsDir())
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	partialPath := h.partialPath(uploadID)
+	f, err := os.Create(partialPath)
+	if err != nil {
+		slog.Error("failed to create partial upload", "error", err, "path", partialPath)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	f.Close()
+
+	now := time.Now()
+	upload := &storage.Upload{
+		ID:             uploadID,
+		ConversationID: conversationID,
+		Uploader:       session.Username,
+		Filename:       metadata["filename"],
+		Length:         length,
+		ExpiresAt:      now.Add(h.UploadExpiry),
+		CreatedAt:      now,
+	}
+	if err := h.DB.CreateUpload(upload); err != nil {
+		slog.Error("failed to create upload record", "error", err)
+		os.Remove(partialPath)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("resumable upload created", "upload_id", uploadID, "username", session.Username, "length", length)
+
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Location", "/api/uploads/"+uploadID)
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// HEAD /api/uploads/{id}
+// Reports how many bytes have been received, so a client can resume.
+func (h *Handler) UploadStatus(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireSession(w, r)
+	if !ok {
+		return
+	}
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	upload, ok := h.requireUpload(w, r.PathValue("id"), session)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// PATCH /api/uploads/{id}
+// Headers: Upload-Offset, Content-Type: application/offset+octet-stream
+// Appends the request body at Upload-Offset. The request that delivers the
+// final byte queues the video for transcoding.
+func (h *Handler) UploadChunk(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireSession(w, r)
+	if !ok {
+		return
+	}
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "a valid Upload-Offset is required", http.StatusBadRequest)
+		return
+	}
+
+	uploadID := r.PathValue("id")
+	if !h.lockUpload(uploadID) {
+		http.Error(w, "upload is already in progress", http.StatusLocked)
+		return
+	}
+	defer h.unlockUpload(uploadID)
+
+	upload, ok := h.requireUpload(w, uploadID, session)
+	if !ok {
+		return
+	}
+	if offset != upload.Offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		http.Error(w, "Upload-Offset does not match the upload", http.StatusConflict)
+		return
+	}
+
+	partialPath := h.partialPath(uploadID)
+	written, err := appendChunk(partialPath, upload.Offset, http.MaxBytesReader(w, r.Body, upload.Length-upload.Offset))
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		// Nothing is recorded, so the next PATCH truncates the excess.
+		http.Error(w, "chunk exceeds Upload-Length", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// Whatever reached the disk is kept even if the client disconnected
+	// mid-chunk, so that it can resume from there.
+	newOffset := upload.Offset + written
+	expiresAt := time.Now().Add(h.UploadExpiry)
+	if written > 0 {
+		if err := h.DB.UpdateUploadOffset(uploadID, newOffset, expiresAt); err != nil {
+			slog.Error("failed to record upload offset", "error", err, "upload_id", uploadID)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err != nil {
+		slog.Warn("resumable upload chunk interrupted", "error", err, "upload_id", uploadID, "offset", newOffset)
+		http.Error(w, "failed to read chunk", http.StatusBadRequest)
+		return
+	}
+
+	slog.Debug("received upload chunk", "upload_id", uploadID, "offset", newOffset, "length", upload.Length)
+
+	// Identify the container as soon as the header has arrived, so that an
+	// unsupported file is turned away before the rest is sent.
+	if upload.Offset < sniffLen && (newOffset >= sniffLen || newOffset == upload.Length) {
+		_, detected, ok, err := sniffFile(partialPath)
+		if err != nil {
+			slog.Error("failed to read partial upload", "error", err, "upload_id", uploadID)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			h.discardUpload(upload)
+			h.reject(w, uploadID, upload.ConversationID, upload.Uploader, fmt.Sprintf("unsupported media type: detected %s", detected))
+			return
+		}
+	}
+
+	if newOffset == upload.Length && !h.completeUpload(w, r, upload) {
+		return
+	}
+
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+	if newOffset < upload.Length {
+		w.Header().Set("Upload-Expires", expiresAt.UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DELETE /api/uploads/{id}
+// Abandons an upload and discards the bytes received so far.
+func (h *Handler) TerminateUpload(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.requireSession(w, r)
+	if !ok {
+		return
+	}
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	uploadID := r.PathValue("id")
+	if !h.lockUpload(uploadID) {
+		http.Error(w, "upload is already in progress", http.StatusLocked)
+		return
+	}
+	defer h.unlockUpload(uploadID)
+
+	upload, ok := h.requireUpload(w, uploadID, session)
+	if !ok {
+		return
+	}
+	h.discardUpload(upload)
+
+	slog.Info("resumable upload terminated", "upload_id", uploadID, "username", session.Username)
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RunUploadJanitor discards expired uploads every interval until ctx is
+// cancelled.
+func (h *Handler) RunUploadJanitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := h.ExpireUploads(time.Now())
+			if err != nil {
+				slog.Error("failed to expire abandoned uploads", "error", err)
+				continue
+			}
+			if n > 0 {
+				slog.Info("expired abandoned uploads", "count", n)
+			}
+		}
+	}
+}
+
+// ExpireUploads discards uploads whose expiry is before now and returns how
+// many were removed.
+func (h *Handler) ExpireUploads(now time.Time) (int, error) {
+	uploads, err := h.DB.GetExpiredUploads(now)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, u := range uploads {
+		// Skip uploads that are receiving a chunk; they will be picked up
+		// by a later sweep if they are still expired.
+		if !h.lockUpload(u.ID) {
+			continue
+		}
+		h.discardUpload(&u)
+		h.unlockUpload(u.ID)
+		n++
+	}
+	return n, nil
+}
+
+// completeUpload moves a fully received upload next to the conversation's
+// other videos and queues it for transcoding. It writes an error response
+// and returns false if the upload is not accepted.
+func (h *Handler) completeUpload(w http.ResponseWriter, r *http.Request, upload *storage.Upload) bool {
+	partialPath := h.partialPath(upload.ID)
+	format, detected, ok, err := sniffFile(partialPath)
+	if err != nil {
+		slog.Error("failed to read completed upload", "error", err, "upload_id", upload.ID)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return false
+	}
+	if !ok {
+		h.discardUpload(upload)
+		h.reject(w, upload.ID, upload.ConversationID, upload.Uploader, fmt.Sprintf("unsupported media type: detected %s", detected))
+		return false
+	}
+
+	checksum, err := hashFile(partialPath)
+	if err != nil {
+		slog.Error("failed to hash completed upload", "error", err, "upload_id", upload.ID)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return false
+	}
+
+	if err := h.DB.DeleteUpload(upload.ID); err != nil {
+		slog.Error("failed to delete upload record", "error", err, "upload_id", upload.ID)
+	}
+
+	slog.Info("resumable upload complete", "upload_id", upload.ID, "type", format.mimeType)
+	return h.queueUpload(w, r, upload.ID, upload.ConversationID, upload.Uploader, partialPath, checksum, format)
+}
+
+// requireUpload looks up an upload owned by the session's user, writing the
+// appropriate error response if it is missing, expired or not theirs.
+func (h *Handler) requireUpload(w http.ResponseWriter, uploadID string, session *auth.Session) (*storage.Upload, bool) {
+	upload, err := h.DB.GetUpload(uploadID)
+	if err != nil {
+		slog.Error("failed to get upload", "error", err, "upload_id", uploadID)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return nil, false
+	}
+	if upload == nil {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return nil, false
+	}
+	if upload.Uploader != session.Username {
+		slog.Warn("upload access attempted by another user", "username", session.Username, "upload_id", uploadID)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return nil, false
+	}
+
+	if _, ok := auth.RequireRole(w, h.DB, session, upload.ConversationID, storage.RoleMember); !ok {
+		return nil, false
+	}
+
+	if time.Now().After(upload.ExpiresAt) {
+		h.discardUpload(upload)
+		http.Error(w, "upload expired", http.StatusGone)
+		return nil, false
+	}
+	return upload, true
+}
+
+// discardUpload removes an unfinished upload's partial file and record.
+func (h *Handler) discardUpload(upload *storage.Upload) {
+	if err := os.Remove(h.partialPath(upload.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Error("failed to remove partial upload", "error", err, "upload_id", upload.ID)
+	}
+	if err := h.DB.DeleteUpload(upload.ID); err != nil {
+		slog.Error("failed to delete upload record", "error", err, "upload_id", upload.ID)
+	}
+}
+
+// lockUpload marks an upload as busy, returning false if another request
+// already holds it.
+func (h *Handler) lockUpload(id string) bool {
+	h.uploadMu.Lock()
+	defer h.uploadMu.Unlock()
+	if h.activeUploads == nil {
+		h.activeUploads = make(map[string]struct{})
+	}
+	if _, busy := h.activeUploads[id]; busy {
+		return false
+	}
+	h.activeUploads[id] = struct{}{}
+	return true
+}
+
+func (h *Handler) unlockUpload(id string) {
+	h.uploadMu.Lock()
+	defer h.uploadMu.Unlock()
+	delete(h.activeUploads, id)
+}
+
+func (h *Handler) uploadsDir() string {
+	return filepath.Join(h.VideosDir, uploadsDirName)
+}
+
+func (h *Handler) partialPath(uploadID string) string {
+	return filepath.Join(h.uploadsDir(), uploadID)
+}
+
+// appendChunk writes src to path starting at offset, first discarding any
+// bytes past offset left by an earlier interrupted request. It returns the
+// number of bytes written.
+func appendChunk(path string, offset int64, src io.Reader) (int64, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return 0, fmt.Errorf("open partial upload: %w", err)
+	}
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return 0, fmt.Errorf("truncate partial upload: %w", err)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return 0, fmt.Errorf("seek partial upload: %w", err)
+	}
+	n, copyErr := io.Copy(f, src)
+	if err := f.Close(); err != nil {
+		return 0, fmt.Errorf("close partial upload: %w", err)
+	}
+	return n, copyErr
+}
+
+// sniffFile identifies the container of the file at path by its magic bytes.
+func sniffFile(path string) (format container, detected string, ok bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return container{}, "", false, err
+	}
+	defer f.Close()
+
+	header := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return container{}, "", false, err
+	}
+	format, detected, ok = detectContainer(header[:n])
+	return format, detected, ok, nil
+}
+
+// hashFile returns the hex SHA-256 of the file at path. Chunks may arrive
+// over many requests, so the assembled file is hashed once it is complete.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// checkTusVersion rejects requests for a protocol version other than the
+// one implemented here.
+func checkTusVersion(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "unsupported Tus-Resumable version", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// parseUploadMetadata decodes an Upload-Metadata header: comma-separated
+// pairs of a key and a base64-encoded value, where the value may be omitted.
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for pair := range strings.SplitSeq(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("empty metadata key")
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("decode metadata %q: %w", key, err)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
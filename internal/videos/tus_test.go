@@ -0,0 +1,374 @@
+package videos_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"waffle-app/internal/auth"
+	"waffle-app/internal/storage"
+	"waffle-app/internal/videos"
+	"waffle-app/internal/videos/videotest"
+)
+
+// tusRequest builds an authenticated tus request for alice.
+func tusRequest(t *testing.T, sessions *auth.Store, method, target string, body io.Reader) *http.Request {
+	t.Helper()
+	req := authenticatedRequest(t, sessions, method, target, nil, "")
+	if body != nil {
+		req.Body = io.NopCloser(body)
+	}
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	return req
+}
+
+// createTusUpload starts a resumable upload of length bytes into conv-1 and
+// returns its id.
+func createTusUpload(t *testing.T, h *videos.Handler, sessions *auth.Store, length int) string {
+	t.Helper()
+	req := tusRequest(t, sessions, "POST", "/api/uploads", nil)
+	req.Header.Set("Upload-Length", strconv.Itoa(length))
+	req.Header.Set("Upload-Metadata", "conversation_id "+base64.StdEncoding.EncodeToString([]byte("conv-1"))+
+		",filename "+base64.StdEncoding.EncodeToString([]byte("clip.mp4")))
+	rr := httptest.NewRecorder()
+	h.CreateUpload(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	location := rr.Header().Get("Location")
+	if !strings.HasPrefix(location, "/api/uploads/") {
+		t.Fatalf("unexpected Location %q", location)
+	}
+	if rr.Header().Get("Upload-Expires") == "" {
+		t.Error("expected Upload-Expires header")
+	}
+	return strings.TrimPrefix(location, "/api/uploads/")
+}
+
+func patchChunk(t *testing.T, h *videos.Handler, sessions *auth.Store, uploadID string, offset int, chunk io.Reader) *httptest.ResponseRecorder {
+	t.Helper()
+	req := tusRequest(t, sessions, "PATCH", "/api/uploads/"+uploadID, chunk)
+	req.SetPathValue("id", uploadID)
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", strconv.Itoa(offset))
+	rr := httptest.NewRecorder()
+	h.UploadChunk(rr, req)
+	return rr
+}
+
+func headUpload(t *testing.T, h *videos.Handler, sessions *auth.Store, uploadID string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := tusRequest(t, sessions, "HEAD", "/api/uploads/"+uploadID, nil)
+	req.SetPathValue("id", uploadID)
+	rr := httptest.NewRecorder()
+	h.UploadStatus(rr, req)
+	return rr
+}
+
+// failingReader returns err once its data is exhausted, like a connection
+// that drops mid-request.
+type failingReader struct {
+	data []byte
+	err  error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if len(f.data) == 0 {
+		return 0, f.err
+	}
+	n := copy(p, f.data)
+	f.data = f.data[n:]
+	return n, nil
+}
+
+func TestTus_ChunkedUploadToReady(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	setupMember(t, db)
+
+	transcoder := &videotest.Transcoder{}
+	h := newPipelineHandler(db, sessions, dir, transcoder)
+
+	content := videotest.MP4(strings.Repeat("frame", 400))
+	uploadID := createTusUpload(t, h, sessions, len(content))
+
+	split := 1000
+	rr := patchChunk(t, h, sessions, uploadID, 0, bytes.NewReader(content[:split]))
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("first chunk: expected 204, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if got := rr.Header().Get("Upload-Offset"); got != strconv.Itoa(split) {
+		t.Errorf("expected Upload-Offset %d, got %s", split, got)
+	}
+
+	rr = headUpload(t, h, sessions, uploadID)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("HEAD: expected 200, got %d", rr.Code)
+	}
+	if got := rr.Header().Get("Upload-Offset"); got != strconv.Itoa(split) {
+		t.Errorf("HEAD: expected Upload-Offset %d, got %s", split, got)
+	}
+	if got := rr.Header().Get("Upload-Length"); got != strconv.Itoa(len(content)) {
+		t.Errorf("HEAD: expected Upload-Length %d, got %s", len(content), got)
+	}
+
+	// No video exists until the last byte arrives.
+	if list := listVideos(t, h, sessions); len(list) != 0 {
+		t.Fatalf("expected no videos before completion, got %v", list)
+	}
+
+	rr = patchChunk(t, h, sessions, uploadID, split, bytes.NewReader(content[split:]))
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("last chunk: expected 204, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	startWorkers(t, h)
+	waitForJob(t, db, uploadID, storage.JobDone)
+
+	video, err := db.GetVideo(uploadID)
+	if err != nil {
+		t.Fatalf("GetVideo: %v", err)
+	}
+	if video.Status != "ready" || video.Uploader != "alice" || video.ConversationID != "conv-1" {
+		t.Errorf("unexpected video %+v", video)
+	}
+	calls := transcoder.Calls()
+	if len(calls) != 1 || filepath.Base(calls[0].InputPath) != "original_"+uploadID+".mp4" {
+		t.Fatalf("expected assembled original to be transcoded, got %+v", calls)
+	}
+
+	rr = httptest.NewRecorder()
+	h.Stream(rr, streamRequest(t, sessions, uploadID))
+	if want := videotest.TranscodedPrefix + string(content); rr.Body.String() != want {
+		t.Error("expected streamed video to match the assembled upload")
+	}
+
+	if upload, _ := db.GetUpload(uploadID); upload != nil {
+		t.Error("expected upload record to be removed after completion")
+	}
+	if entries, _ := os.ReadDir(filepath.Join(dir, ".uploads")); len(entries) != 0 {
+		t.Errorf("expected no partial files, found %d", len(entries))
+	}
+}
+
+func TestTus_ResumeAfterInterruptedChunk(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	setupMember(t, db)
+	h := newTestHandler(db, sessions, dir)
+
+	content := videotest.MP4(strings.Repeat("frame", 400))
+	uploadID := createTusUpload(t, h, sessions, len(content))
+
+	rr := patchChunk(t, h, sessions, uploadID, 0, &failingReader{
+		data: content[:700],
+		err:  errors.New("connection reset"),
+	})
+	if rr.Code == http.StatusNoContent {
+		t.Fatal("expected interrupted chunk to fail")
+	}
+
+	rr = headUpload(t, h, sessions, uploadID)
+	if got := rr.Header().Get("Upload-Offset"); got != "700" {
+		t.Fatalf("expected received bytes to be kept, got Upload-Offset %s", got)
+	}
+
+	rr = patchChunk(t, h, sessions, uploadID, 700, bytes.NewReader(content[700:]))
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("resume: expected 204, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	job, err := db.GetJobByVideoID(uploadID)
+	if err != nil || job == nil {
+		t.Fatalf("expected transcoding job, got %v (err %v)", job, err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, job.InputKey))
+	if err != nil {
+		t.Fatalf("read original: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Error("expected resumed upload to match the original content")
+	}
+}
+
+func TestTus_OffsetMismatch(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	setupMember(t, db)
+	h := newTestHandler(db, sessions, dir)
+
+	content := videotest.MP4(strings.Repeat("frame", 400))
+	uploadID := createTusUpload(t, h, sessions, len(content))
+
+	rr := patchChunk(t, h, sessions, uploadID, 100, bytes.NewReader(content[100:200]))
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d", rr.Code)
+	}
+	if got := rr.Header().Get("Upload-Offset"); got != "0" {
+		t.Errorf("expected current Upload-Offset 0, got %s", got)
+	}
+}
+
+func TestTus_ChunkExceedingLength(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	setupMember(t, db)
+	h := newTestHandler(db, sessions, dir)
+
+	content := videotest.MP4("short")
+	uploadID := createTusUpload(t, h, sessions, len(content))
+
+	rr := patchChunk(t, h, sessions, uploadID, 0, bytes.NewReader(append(content, "extra"...)))
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d", rr.Code)
+	}
+	if got := headUpload(t, h, sessions, uploadID).Header().Get("Upload-Offset"); got != "0" {
+		t.Errorf("expected oversized chunk not to be recorded, got Upload-Offset %s", got)
+	}
+}
+
+func TestTus_UnsupportedFileRejectedEarly(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	setupMember(t, db)
+	h := newTestHandler(db, sessions, dir)
+
+	content := []byte(strings.Repeat("this is not a video. ", 100))
+	uploadID := createTusUpload(t, h, sessions, len(content))
+
+	rr := patchChunk(t, h, sessions, uploadID, 0, bytes.NewReader(content[:600]))
+	if rr.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected 415 once the header arrived, got %d", rr.Code)
+	}
+
+	if rr := headUpload(t, h, sessions, uploadID); rr.Code != http.StatusNotFound {
+		t.Errorf("expected rejected upload to be discarded, got %d", rr.Code)
+	}
+	list := listVideos(t, h, sessions)
+	if len(list) != 1 || list[0]["status"] != "rejected" {
+		t.Fatalf("expected rejected upload to be recorded, got %v", list)
+	}
+}
+
+func TestTus_CreateValidation(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	setupMember(t, db)
+	if err := db.CreateConversation("conv-2", "invite-xyz", "Other", ""); err != nil {
+		t.Fatalf("CreateConversation: %v", err)
+	}
+	h := newTestHandler(db, sessions, dir)
+
+	encode := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	tests := []struct {
+		name     string
+		version  string
+		length   string
+		metadata string
+		want     int
+	}{
+		{"missing version", "", "100", "conversation_id " + encode("conv-1"), http.StatusPreconditionFailed},
+		{"missing length", "1.0.0", "", "conversation_id " + encode("conv-1"), http.StatusBadRequest},
+		{"too large", "1.0.0", strconv.Itoa(1 << 30), "conversation_id " + encode("conv-1"), http.StatusRequestEntityTooLarge},
+		{"missing conversation", "1.0.0", "100", "filename " + encode("a.mp4"), http.StatusBadRequest},
+		{"malformed metadata", "1.0.0", "100", "conversation_id !!!", http.StatusBadRequest},
+		{"non-member", "1.0.0", "100", "conversation_id " + encode("conv-2"), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := authenticatedRequest(t, sessions, "POST", "/api/uploads", nil, "")
+			req.Header.Set("Tus-Resumable", tt.version)
+			req.Header.Set("Upload-Length", tt.length)
+			req.Header.Set("Upload-Metadata", tt.metadata)
+			rr := httptest.NewRecorder()
+			h.CreateUpload(rr, req)
+			if rr.Code != tt.want {
+				t.Errorf("expected %d, got %d: %s", tt.want, rr.Code, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestTus_OtherUserForbidden(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	setupMember(t, db)
+	addMember(t, db, "conv-1", "bob")
+	h := newTestHandler(db, sessions, dir)
+
+	uploadID := createTusUpload(t, h, sessions, 100)
+
+	session, err := sessions.Create("bob")
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	req, _ := http.NewRequest("HEAD", "/api/uploads/"+uploadID, nil)
+	req.SetPathValue("id", uploadID)
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	req.AddCookie(&http.Cookie{Name: "waffle_session", Value: session.Token})
+	rr := httptest.NewRecorder()
+	h.UploadStatus(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", rr.Code)
+	}
+}
+
+func TestTus_Terminate(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	setupMember(t, db)
+	h := newTestHandler(db, sessions, dir)
+
+	content := videotest.MP4(strings.Repeat("frame", 400))
+	uploadID := createTusUpload(t, h, sessions, len(content))
+	patchChunk(t, h, sessions, uploadID, 0, bytes.NewReader(content[:600]))
+
+	req := tusRequest(t, sessions, "DELETE", "/api/uploads/"+uploadID, nil)
+	req.SetPathValue("id", uploadID)
+	rr := httptest.NewRecorder()
+	h.TerminateUpload(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rr.Code)
+	}
+
+	if rr := headUpload(t, h, sessions, uploadID); rr.Code != http.StatusNotFound {
+		t.Errorf("expected terminated upload to be gone, got %d", rr.Code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".uploads", uploadID)); !os.IsNotExist(err) {
+		t.Error("expected partial file to be removed")
+	}
+}
+
+func TestTus_Expiry(t *testing.T) {
+	db, sessions, dir := setupTest(t)
+	setupMember(t, db)
+	h := newTestHandler(db, sessions, dir)
+
+	abandoned := []string{
+		createTusUpload(t, h, sessions, 100),
+		createTusUpload(t, h, sessions, 100),
+	}
+
+	n, err := h.ExpireUploads(time.Now().Add(h.UploadExpiry + time.Minute))
+	if err != nil {
+		t.Fatalf("ExpireUploads: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 expired uploads, got %d", n)
+	}
+	for _, id := range abandoned {
+		if _, err := os.Stat(filepath.Join(dir, ".uploads", id)); !os.IsNotExist(err) {
+			t.Errorf("expected partial file of %s to be removed", id)
+		}
+	}
+
+	// An upload that expired before the janitor ran is gone on next access.
+	h.UploadExpiry = -time.Minute
+	expired := createTusUpload(t, h, sessions, 100)
+	if rr := headUpload(t, h, sessions, expired); rr.Code != http.StatusGone {
+		t.Errorf("expected 410 for expired upload, got %d", rr.Code)
+	}
+	if rr := headUpload(t, h, sessions, expired); rr.Code != http.StatusNotFound {
+		t.Errorf("expected expired upload to be discarded, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,64 @@
+package videotest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"waffle-app/internal/videos"
+)
+
+// Segment returns the contents HLSPackager writes as the single segment of
+// the named rendition.
+func Segment(name string) []byte {
+	return []byte("fake-ts:" + name)
+}
+
+// HLSPackager is a fake videos.HLSPackager. It writes a master playlist and
+// one playlist and segment per rendition, and records the ladder it was
+// asked for.
+type HLSPackager struct {
+	// Err, if set, is returned instead of writing.
+	Err error
+
+	mu      sync.Mutex
+	ladders [][]videos.Rendition
+}
+
+var _ videos.HLSPackager = (*HLSPackager)(nil)
+
+func (p *HLSPackager) PackageHLS(ctx context.Context, videoPath, outputDir string, ladder []videos.Rendition, hasAudio bool) error {
+	p.mu.Lock()
+	p.ladders = append(p.ladders, ladder)
+	p.mu.Unlock()
+
+	if p.Err != nil {
+		return p.Err
+	}
+
+	master := []string{"#EXTM3U"}
+	for _, r := range ladder {
+		dir := filepath.Join(outputDir, r.Name)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		playlist := "#EXTM3U\n#EXTINF:4.0,\nsegment_000.ts\n#EXT-X-ENDLIST\n"
+		if err := os.WriteFile(filepath.Join(dir, "index.m3u8"), []byte(playlist), 0644); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, "segment_000.ts"), Segment(r.Name), 0644); err != nil {
+			return err
+		}
+		master = append(master, fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d", r.Bandwidth()), r.Name+"/index.m3u8")
+	}
+	return os.WriteFile(filepath.Join(outputDir, "master.m3u8"), []byte(strings.Join(master, "\n")+"\n"), 0644)
+}
+
+// Ladders returns the ladder of each PackageHLS call so far.
+func (p *HLSPackager) Ladders() [][]videos.Rendition {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([][]videos.Rendition(nil), p.ladders...)
+}
@@ -0,0 +1,61 @@
+package videotest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+	"waffle-app/internal/videos"
+)
+
+// DefaultMediaInfo is what Prober reports when Info is nil.
+var DefaultMediaInfo = videos.MediaInfo{
+	Duration:   12 * time.Second,
+	Width:      1280,
+	Height:     720,
+	VideoCodec: "h264",
+	AudioCodec: "aac",
+	Bitrate:    2_000_000,
+}
+
+// Prober is a fake videos.Prober. It reports Info (or DefaultMediaInfo)
+// for every file, with Size taken from the file on disk.
+type Prober struct {
+	Info *videos.MediaInfo
+	// Err, if set, is returned from every call.
+	Err error
+
+	mu    sync.Mutex
+	paths []string
+}
+
+var _ videos.Prober = (*Prober)(nil)
+
+func (p *Prober) Probe(ctx context.Context, path string) (*videos.MediaInfo, error) {
+	p.mu.Lock()
+	p.paths = append(p.paths, path)
+	p.mu.Unlock()
+
+	if p.Err != nil {
+		return nil, p.Err
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("probe: %w", err)
+	}
+
+	info := DefaultMediaInfo
+	if p.Info != nil {
+		info = *p.Info
+	}
+	info.Size = stat.Size()
+	return &info, nil
+}
+
+// Paths returns the files probed so far.
+func (p *Prober) Paths() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.paths...)
+}
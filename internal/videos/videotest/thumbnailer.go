@@ -0,0 +1,36 @@
+package videotest
+
+import (
+	"context"
+	"os"
+	"waffle-app/internal/videos"
+)
+
+// Poster and Preview are the fixed contents written by Thumbnailer.
+var (
+	Poster  = []byte("\xff\xd8\xff\xe0fake-jpeg")
+	Preview = []byte("RIFF\x00\x00\x00\x00WEBPfake-preview")
+)
+
+// Thumbnailer is a fake videos.Thumbnailer that writes fixed contents.
+type Thumbnailer struct {
+	// PosterErr and PreviewErr, if set, are returned instead of writing.
+	PosterErr  error
+	PreviewErr error
+}
+
+var _ videos.Thumbnailer = (*Thumbnailer)(nil)
+
+func (t *Thumbnailer) Poster(ctx context.Context, videoPath, outputPath string) error {
+	if t.PosterErr != nil {
+		return t.PosterErr
+	}
+	return os.WriteFile(outputPath, Poster, 0644)
+}
+
+func (t *Thumbnailer) Preview(ctx context.Context, videoPath, outputPath string) error {
+	if t.PreviewErr != nil {
+		return t.PreviewErr
+	}
+	return os.WriteFile(outputPath, Preview, 0644)
+}
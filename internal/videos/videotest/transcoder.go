@@ -0,0 +1,83 @@
+// Package videotest provides deterministic fakes for testing the video
+// pipeline without ffmpeg installed.
+package videotest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"waffle-app/internal/videos"
+)
+
+// TranscodedPrefix is prepended to the input's bytes to form the fake
+// transcoder's output.
+const TranscodedPrefix = "transcoded:"
+
+// Call records a single Transcode invocation.
+type Call struct {
+	InputPath  string
+	OutputPath string
+	Profile    videos.Profile
+}
+
+// Transcoder is a fake videos.Transcoder. On success it writes
+// TranscodedPrefix followed by the input file's contents to the output path.
+type Transcoder struct {
+	// Err, if set, is returned from every call.
+	Err error
+	// FailTimes makes the first FailTimes calls fail before succeeding.
+	FailTimes int
+	// Block, if set, makes each call wait until Block is closed or ctx is
+	// cancelled, simulating a long-running ffmpeg.
+	Block chan struct{}
+
+	mu    sync.Mutex
+	calls []Call
+}
+
+var _ videos.Transcoder = (*Transcoder)(nil)
+
+func (t *Transcoder) Transcode(ctx context.Context, inputPath, outputPath string, profile videos.Profile) (*videos.Result, error) {
+	t.mu.Lock()
+	t.calls = append(t.calls, Call{InputPath: inputPath, OutputPath: outputPath, Profile: profile})
+	n := len(t.calls)
+	t.mu.Unlock()
+
+	if t.Err != nil {
+		return nil, t.Err
+	}
+	if n <= t.FailTimes {
+		return nil, fmt.Errorf("fake transcode failure %d of %d", n, t.FailTimes)
+	}
+	if t.Block != nil {
+		select {
+		case <-t.Block:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	input, err := os.ReadFile(inputPath)
+	if err != nil {
+		return nil, fmt.Errorf("read input: %w", err)
+	}
+	output := append([]byte(TranscodedPrefix), input...)
+	if err := os.WriteFile(outputPath, output, 0644); err != nil {
+		return nil, fmt.Errorf("write output: %w", err)
+	}
+	return &videos.Result{Size: int64(len(output))}, nil
+}
+
+// Calls returns the invocations made so far.
+func (t *Transcoder) Calls() []Call {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Call(nil), t.calls...)
+}
+
+// MP4 returns content prefixed with a minimal ISO base media ftyp box, so
+// that it passes container sniffing as an MP4 upload.
+func MP4(content string) []byte {
+	return append([]byte("\x00\x00\x00\x18ftypisom\x00\x00\x02\x00isommp41"), content...)
+}
@@ -1,8 +1,129 @@
 let currentUser = null;
 
+function showApp(username) {
+    currentUser = username;
+    document.getElementById('auth-section').classList.add('hidden');
+    document.getElementById('app-section').classList.remove('hidden');
+    loadConversations();
+}
+
+async function login() {
+    await signIn('/api/auth/login', 'Invalid username or passphrase');
+}
+
+async function register() {
+    await signIn('/api/auth/register', 'Failed to create account');
+}
+
+async function signIn(url, failure) {
+    const username = document.getElementById('username').value;
+    const passphrase = document.getElementById('passphrase').value;
+    
+    try {
+        const response = await fetch(url, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({ username: username, passphrase: passphrase })
+        });
+        
+        if (response.ok) {
+            const data = await response.json();
+            showApp(data.username);
+        } else {
+            alert(`${failure}: ${(await response.text()).trim()}`);
+        }
+    } catch (error) {
+        console.error('Error:', error);
+        alert('Error signing in');
+    }
+}
+
+async function loginWithPasskey() {
+    try {
+        const begin = await fetch('/api/auth/passkeys/login/begin', { method: 'POST' });
+        const options = PublicKeyCredential.parseRequestOptionsFromJSON(await begin.json());
+        const credential = await navigator.credentials.get({ publicKey: options });
+        
+        const response = await fetch('/api/auth/passkeys/login/finish', {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify(credential)
+        });
+        
+        if (response.ok) {
+            const data = await response.json();
+            showApp(data.username);
+        } else {
+            alert('Passkey sign-in failed');
+        }
+    } catch (error) {
+        console.error('Error:', error);
+        alert('Error signing in with a passkey');
+    }
+}
+
+async function addPasskey() {
+    try {
+        const begin = await fetch('/api/auth/passkeys/register/begin', { method: 'POST' });
+        const options = PublicKeyCredential.parseCreationOptionsFromJSON(await begin.json());
+        const credential = await navigator.credentials.create({ publicKey: options });
+        
+        const response = await fetch('/api/auth/passkeys/register/finish', {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify(credential)
+        });
+        
+        if (response.ok) {
+            alert('Passkey added');
+        } else {
+            alert('Failed to add passkey');
+        }
+    } catch (error) {
+        console.error('Error:', error);
+        alert('Error adding passkey');
+    }
+}
+
+async function requestMagicLink() {
+    await sendEmail('POST', '/api/auth/magic', 'login-email', 'If that address belongs to an account, a sign-in link is on its way');
+}
+
+async function setEmail() {
+    await sendEmail('PUT', '/api/auth/email', 'account-email', 'Check your inbox for a link to confirm the address');
+}
+
+async function sendEmail(method, url, inputId, success) {
+    const email = document.getElementById(inputId).value;
+    
+    try {
+        const response = await fetch(url, {
+            method: method,
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({ email: email })
+        });
+        
+        if (response.ok) {
+            alert(success);
+        } else {
+            alert(`Failed to send email: ${(await response.text()).trim()}`);
+        }
+    } catch (error) {
+        console.error('Error:', error);
+        alert('Error sending email');
+    }
+}
+
 async function joinConversation() {
     const inviteCode = document.getElementById('invite-code').value;
-    const username = document.getElementById('username').value;
     
     try {
         const response = await fetch('/api/conversations/join', {
@@ -10,13 +131,10 @@ async function joinConversation() {
             headers: {
                 'Content-Type': 'application/json'
             },
-            body: JSON.stringify({ invite_code: inviteCode, username: username })
+            body: JSON.stringify({ invite_code: inviteCode })
         });
         
         if (response.ok) {
-            currentUser = username;
-            document.getElementById('auth-section').classList.add('hidden');
-            document.getElementById('app-section').classList.remove('hidden');
             loadConversations();
         } else {
             alert('Failed to join conversation');
@@ -72,6 +190,179 @@ async function loadConversations() {
     }
 }
 
+async function createInvite() {
+    const conversationId = document.getElementById('manage-conversation-id').value;
+    const maxUses = document.getElementById('invite-max-uses').value;
+    const expiresAt = document.getElementById('invite-expires-at').value;
+    const body = {};
+    if (maxUses) {
+        body.max_uses = parseInt(maxUses, 10);
+    }
+    if (expiresAt) {
+        body.expires_at = new Date(expiresAt).toISOString();
+    }
+    
+    try {
+        const response = await fetch(`/api/conversations/${encodeURIComponent(conversationId)}/invites`, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify(body)
+        });
+        
+        if (response.ok) {
+            const invite = await response.json();
+            alert(`Invite code: ${invite.code}`);
+            loadInvites();
+        } else {
+            alert(`Failed to create invite: ${(await response.text()).trim()}`);
+        }
+    } catch (error) {
+        console.error('Error:', error);
+        alert('Error creating invite');
+    }
+}
+
+async function loadInvites() {
+    const conversationId = document.getElementById('manage-conversation-id').value;
+    const invitesList = document.getElementById('invites-list');
+    invitesList.innerHTML = '';
+    
+    try {
+        const response = await fetch(`/api/conversations/${encodeURIComponent(conversationId)}/invites`);
+        
+        if (!response.ok) {
+            alert(`Failed to load invites: ${(await response.text()).trim()}`);
+            return;
+        }
+        const invites = await response.json();
+        invites.forEach(invite => {
+            const div = document.createElement('div');
+            const uses = invite.max_uses ? `${invite.uses}/${invite.max_uses} uses` : `${invite.uses} uses`;
+            const expires = invite.expires_at ? `, expires ${new Date(invite.expires_at).toLocaleString()}` : '';
+            const state = invite.revoked_at ? 'revoked' : (invite.active ? 'active' : 'expired');
+            div.textContent = `${invite.code}: ${uses}${expires} (${state}) `;
+            if (!invite.revoked_at) {
+                const revoke = document.createElement('button');
+                revoke.textContent = 'Revoke';
+                revoke.onclick = () => revokeInvite(conversationId, invite.code);
+                div.appendChild(revoke);
+            }
+            invitesList.appendChild(div);
+        });
+    } catch (error) {
+        console.error('Error loading invites:', error);
+    }
+}
+
+async function revokeInvite(conversationId, code) {
+    try {
+        const response = await fetch(`/api/conversations/${encodeURIComponent(conversationId)}/invites/${encodeURIComponent(code)}`, {
+            method: 'DELETE'
+        });
+        
+        if (response.ok) {
+            loadInvites();
+        } else {
+            alert(`Failed to revoke invite: ${(await response.text()).trim()}`);
+        }
+    } catch (error) {
+        console.error('Error:', error);
+        alert('Error revoking invite');
+    }
+}
+
+async function loadMembers() {
+    const conversationId = document.getElementById('manage-conversation-id').value;
+    const membersList = document.getElementById('members-list');
+    membersList.innerHTML = '';
+    
+    try {
+        const response = await fetch(`/api/conversations/${encodeURIComponent(conversationId)}/members`);
+        
+        if (!response.ok) {
+            alert(`Failed to load members: ${(await response.text()).trim()}`);
+            return;
+        }
+        const members = await response.json();
+        const me = members.find(member => member.username === currentUser);
+        const myRole = me ? me.role : 'member';
+        members.forEach(member => {
+            const div = document.createElement('div');
+            div.textContent = `${member.username} (${member.role}) `;
+            // The server checks these too; only offer what it would allow
+            if (myRole === 'owner' && member.role !== 'owner') {
+                const role = document.createElement('button');
+                const promote = member.role === 'member';
+                role.textContent = promote ? 'Make Admin' : 'Make Member';
+                role.onclick = () => setMemberRole(conversationId, member.username, promote ? 'admin' : 'member');
+                div.appendChild(role);
+            }
+            const isMe = member.username === currentUser;
+            const canRemove = isMe ? member.role !== 'owner'
+                : myRole === 'owner' || (myRole === 'admin' && member.role === 'member');
+            if (canRemove) {
+                const remove = document.createElement('button');
+                remove.textContent = isMe ? 'Leave' : 'Remove';
+                remove.onclick = () => removeMember(conversationId, member.username);
+                div.appendChild(remove);
+            }
+            membersList.appendChild(div);
+        });
+    } catch (error) {
+        console.error('Error loading members:', error);
+    }
+}
+
+async function setMemberRole(conversationId, username, role) {
+    try {
+        const response = await fetch(`/api/conversations/${encodeURIComponent(conversationId)}/members/${encodeURIComponent(username)}/role`, {
+            method: 'PUT',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({ role: role })
+        });
+        
+        if (response.ok) {
+            loadMembers();
+        } else {
+            alert(`Failed to change role: ${(await response.text()).trim()}`);
+        }
+    } catch (error) {
+        console.error('Error:', error);
+        alert('Error changing role');
+    }
+}
+
+async function removeMember(conversationId, username) {
+    const leaving = username === currentUser;
+    if (!confirm(leaving ? 'Leave this conversation?' : `Remove ${username} from this conversation?`)) {
+        return;
+    }
+    
+    try {
+        const response = await fetch(`/api/conversations/${encodeURIComponent(conversationId)}/members/${encodeURIComponent(username)}`, {
+            method: 'DELETE'
+        });
+        
+        if (response.ok) {
+            if (leaving) {
+                document.getElementById('members-list').innerHTML = '';
+                loadConversations();
+            } else {
+                loadMembers();
+            }
+        } else {
+            alert(`Failed to remove member: ${(await response.text()).trim()}`);
+        }
+    } catch (error) {
+        console.error('Error:', error);
+        alert('Error removing member');
+    }
+}
+
 async function uploadVideo() {
     const fileInput = document.getElementById('video-file');
     const conversationId = document.getElementById('conversation-id').value;
@@ -82,8 +373,9 @@ async function uploadVideo() {
     }
     
     const formData = new FormData();
-    formData.append('file', fileInput.files[0]);
+    // conversation_id must precede the file, which the server streams to disk
     formData.append('conversation_id', conversationId);
+    formData.append('file', fileInput.files[0]);
     
     try {
         const response = await fetch('/api/upload', {
@@ -119,11 +411,46 @@ async function loadVideos(conversationId) {
                     <p>Uploaded by: ${video.uploader}</p>
                     <p>Status: ${video.status}</p>
                     <p>Date: ${new Date(video.uploaded_at).toLocaleString()}</p>
+                    ${video.duration ? `<p>Length: ${Math.round(video.duration)}s</p>` : ''}
                 `;
+                if (video.stream_url) {
+                    const player = document.createElement('video');
+                    // Prefer adaptive HLS where the browser plays it natively
+                    const hls = video.hls_url && player.canPlayType('application/vnd.apple.mpegurl');
+                    player.src = hls ? video.hls_url : video.stream_url;
+                    player.controls = true;
+                    player.preload = 'metadata';
+                    player.width = 480;
+                    if (video.width && video.height) {
+                        // Reserve layout space before metadata loads
+                        player.height = Math.round(480 * video.height / video.width);
+                    }
+                    if (video.thumbnail_url) {
+                        player.poster = video.thumbnail_url;
+                    }
+                    if (video.preview_url) {
+                        // Show the animated preview while hovering a paused video
+                        player.addEventListener('mouseenter', () => {
+                            if (player.paused) player.poster = video.preview_url;
+                        });
+                        player.addEventListener('mouseleave', () => {
+                            player.poster = video.thumbnail_url || '';
+                        });
+                    }
+                    div.appendChild(player);
+                }
                 videosList.appendChild(div);
             });
         }
     } catch (error) {
         console.error('Error loading videos:', error);
     }
-}
\ No newline at end of file
+}
+
+// Skip the sign-in form if the session cookie is still valid
+fetch('/api/auth/me').then(async response => {
+    if (response.ok) {
+        const data = await response.json();
+        showApp(data.username);
+    }
+});